@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessLog logs each request handled by h to out in the Apache combined log format, so that the
+// logs can be processed by the same tools as those of other web servers. The user is whoever the
+// request is attributed to with the config c (see identity), if that's known from more than its
+// address. The user the request is logged in as is looked up before h handles it, so that logging
+// in or out doesn't change who it's logged as, and passed on to h (see userContext).
+func accessLog(out io.Writer, c *config, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r = r.WithContext(configContext(r.Context(), c))
+		if u := c.auth.User(r); u != nil {
+			r = r.WithContext(userContext(r.Context(), u))
+		}
+		user := "-"
+		if id := knownIdentity(r); id != "" {
+			user = strings.ReplaceAll(id, " ", "_")
+		}
+		lw := &loggingWriter{ResponseWriter: w}
+		h.ServeHTTP(lw, r)
+
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		if lw.status == 0 {
+			lw.status = 200
+		}
+		size := "-"
+		if lw.size > 0 {
+			size = fmt.Sprint(lw.size)
+		}
+		fmt.Fprintf(out, "%s - %s [%s] %q %d %s %q %q\n", host, user, start.Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method+" "+r.URL.RequestURI()+" "+r.Proto, lw.status, size, orDash(r.Referer()), orDash(r.UserAgent()))
+	})
+}
+
+// orDash returns s, or "-" if it's empty, as missing fields are logged.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// loggingWriter records the status and size of a response for accessLog.
+type loggingWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *loggingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+// Flush flushes the response if the underlying writer supports it, for streamed responses (see
+// serveEvents).
+func (w *loggingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// RotatingFile is a file which is rotated once it grows past a maximum size, keeping a number of
+// the previous files (eg. access.log.1, access.log.2, ...). Access to f and size must be guarded by
+// lock.
+type RotatingFile struct {
+	name    string
+	maxSize int64
+	backups int
+
+	lock sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// OpenRotatingFile opens (or creates) the file name to be appended to, rotating it once it's
+// larger than maxSize bytes (never if it's 0) and keeping backups previous files.
+func OpenRotatingFile(name string, maxSize int64, backups int) (*RotatingFile, error) {
+	f := &RotatingFile{name: name, maxSize: maxSize, backups: backups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens the file, replacing (and closing) any previously open one, and must be called with
+// lock held (or before f is shared).
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if f.f != nil {
+		f.f.Close()
+	}
+	f.f, f.size = file, info.Size()
+	return nil
+}
+
+// Write appends p to the file, rotating it first if p would take it past the maximum size. If the
+// file can't be rotated p is appended to it anyway, and rotating it is tried again next time.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			log.Printf("rotating %s: %v\n", f.name, err)
+		}
+	}
+	n, err := f.f.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the file to name.1 (and any previous ones along, dropping the oldest) and opens a
+// new one. The file is only closed once the new one is open, so that if anything fails it's still
+// written to (wherever it has been moved to). It must be called with lock held.
+func (f *RotatingFile) rotate() error {
+	if f.backups <= 0 {
+		if err := os.Remove(f.name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return f.open()
+	}
+	for i := f.backups - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", f.name, i), fmt.Sprintf("%s.%d", f.name, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(f.name, f.name+".1"); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+// Close closes the file.
+func (f *RotatingFile) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.f.Close()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogUser(t *testing.T) {
+	users, err := OpenUsers(filepath.Join(t.TempDir(), "users"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Add("alice", "secret", false); err != nil {
+		t.Fatal(err)
+	}
+	alice, _ := users.Get("alice")
+	auth := NewAuth("", users, nil, nil)
+	w := httptest.NewRecorder()
+	if err := auth.start(w, httptest.NewRequest("POST", "/login", nil), &loginSession{User: "alice", Hash: alice.Hash, Expires: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	cookie := w.Result().Cookies()[0]
+
+	var out bytes.Buffer
+	var seen string
+	cfg := defaultConfig()
+	cfg.auth = auth
+	h := accessLog(&out, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = identity(r)
+	}))
+
+	tests := []struct {
+		header, cookie bool
+		want           string
+	}{
+		{false, false, " - - "},
+		{false, true, " - alice "},
+		{true, true, " - bob_smith "},
+	}
+	for _, tt := range tests {
+		cfg.identityHeader = ""
+		r := httptest.NewRequest("GET", "/docs", nil)
+		if tt.header {
+			cfg.identityHeader = "X-Forwarded-Email"
+			r.Header.Set(cfg.identityHeader, "bob smith")
+		}
+		if tt.cookie {
+			r.AddCookie(cookie)
+		}
+		out.Reset()
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if !strings.Contains(out.String(), tt.want) {
+			t.Errorf("logged %q, want user %q", out.String(), tt.want)
+		}
+		if tt.cookie && !tt.header && seen != "alice" {
+			t.Errorf("handler saw %q, want alice", seen)
+		}
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "access.log")
+	f, err := OpenRotatingFile(name, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for file, want := range map[string]string{name: "four\n", name + ".1": "three\n", name + ".2": "one\ntwo\n"} {
+		if b, err := os.ReadFile(file); err != nil || string(b) != want {
+			t.Errorf("%s = %q, %v, want %q", file, b, err, want)
+		}
+	}
+}
+
+func TestRotatingFileFailure(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "access.log")
+	// A directory in the way of the backup stops the file from being moved there.
+	if err := os.MkdirAll(filepath.Join(name+".1", "x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := OpenRotatingFile(name, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, line := range []string{"one\n", "two\n", "three\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Write(%q): %v", line, err)
+		}
+	}
+	if b, err := os.ReadFile(name); err != nil || string(b) != "one\ntwo\nthree\n" {
+		t.Errorf("%s = %q, %v, want every line", name, b, err)
+	}
+
+	// Once the backup can be moved, rotating works again.
+	if err := os.RemoveAll(name + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("four\n")); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(name); err != nil || string(b) != "four\n" {
+		t.Errorf("%s = %q, %v, want %q", name, b, err, "four\n")
+	}
+}
@@ -0,0 +1,975 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiPath is the prefix of the paths served by the JSON API.
+const apiPath = "/api/v1/links"
+
+// importPath is the path of the API endpoint for importing many links at once.
+const importPath = "/api/v1/import"
+
+// exportPath is the path of the API endpoint for exporting every link.
+const exportPath = "/api/v1/export"
+
+// searchPath is the path of the API endpoint for searching links.
+const searchPath = "/api/v1/search"
+
+// resolvePath is the path of the API endpoint for resolving many names at once.
+const resolvePath = "/api/v1/resolve"
+
+// maxResolve is the most names which can be resolved in a single request.
+const maxResolve = 1000
+
+// suggestPath is the path of the endpoint for OpenSearch suggestions.
+const suggestPath = "/suggest"
+
+// suggestions is the number of suggestions returned by suggest.
+const suggestions = 10
+
+// openSearchPath is the path of the OpenSearch description document.
+const openSearchPath = "/opensearchdescription.xml"
+
+// openAPIPath is the path the OpenAPI document describing the API is served at.
+const openAPIPath = "/api/v1/openapi.json"
+
+// apiPage is the default number of links in each page of the list of links.
+const apiPage = 100
+
+// apiLink is the JSON representation of a mapping in the API.
+type apiLink struct {
+	Name string `json:"name"`
+	Entry
+}
+
+// serveAPI serves the JSON API for managing links:
+//
+//	GET    /api/v1/links         lists a page of links, most recently Set first
+//	POST   /api/v1/links         creates the link in the body, which must not already exist (or
+//	                             which is given a short name, if the body doesn't have one)
+//	GET    /api/v1/links/{name}  returns the link for name
+//	PUT    /api/v1/links/{name}  creates or updates the link for name from the body
+//	DELETE /api/v1/links/{name}  deletes the link for name
+//	POST   /api/v1/import        creates or updates the links in the body (see apiImport)
+//	GET    /api/v1/export        returns every link along with its metadata (see apiExport)
+//	GET    /api/v1/search?q=...  returns the links best matching q (see apiSearch)
+//	POST   /api/v1/resolve       returns the links the names in the body redirect to (see apiResolve)
+//	GET    /api/v1/broken        returns the links which are broken (see apiBroken)
+//	GET    /api/v1/stale?days=N  returns the links which haven't been used in N days (see apiStale)
+//	GET    /api/v1/stats/export  returns how often every link has been followed (see apiStatsExport)
+//	GET    /api/v1/metrics       returns latency histograms in the Prometheus format (see serveMetrics)
+//	GET    /api/v1/vars          returns runtime and store statistics for debugging (see publishVars)
+//
+// Requests must be authenticated either in the same way as the HTML interface or with an API token
+// (see apiAuth), which can only make GET requests (or resolve names) if it's read-only. Rather than
+// using XSRF tokens, requests with a body must be sent as JSON (or CSV), which forms on other sites
+// can't do (and browsers won't send DELETE requests from other sites without the CORS headers we
+// never send). The list of links is also served at "/" to clients which prefer JSON.
+func serveAPI(auth *Auth, store Store, tokens *Tokens, hits *Hits, stats *Stats, fuzzy bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, write := apiAuth(auth, tokens, r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			apiError(w, 401, errors.New("not logged in"))
+			return
+		}
+		if !write && r.Method != "GET" && r.URL.Path != resolvePath {
+			apiError(w, 403, errors.New("token is read-only"))
+			return
+		}
+
+		if r.URL.Path == importPath {
+			if r.Method != "POST" {
+				apiError(w, 405)
+				return
+			}
+			apiImport(store).ServeHTTP(w, r)
+			return
+		}
+		if r.URL.Path == exportPath {
+			if r.Method != "GET" {
+				apiError(w, 405)
+				return
+			}
+			apiExport(store).ServeHTTP(w, r)
+			return
+		}
+		if r.URL.Path == searchPath {
+			if r.Method != "GET" {
+				apiError(w, 405)
+				return
+			}
+			apiSearch(store, fuzzy).ServeHTTP(w, r)
+			return
+		}
+		if r.URL.Path == staleAPIPath {
+			if r.Method != "GET" {
+				apiError(w, 405)
+				return
+			}
+			apiStale(store, hits).ServeHTTP(w, r)
+			return
+		}
+		if r.URL.Path == varsPath {
+			if r.Method != "GET" {
+				apiError(w, 405)
+				return
+			}
+			serveVars().ServeHTTP(w, r)
+			return
+		}
+		if r.URL.Path == metricsPath {
+			if r.Method != "GET" {
+				apiError(w, 405)
+				return
+			}
+			serveMetrics().ServeHTTP(w, r)
+			return
+		}
+		if r.URL.Path == statsExportPath {
+			if r.Method != "GET" {
+				apiError(w, 405)
+				return
+			}
+			apiStatsExport(store, hits, stats).ServeHTTP(w, r)
+			return
+		}
+		if r.URL.Path == brokenPath {
+			if r.Method != "GET" {
+				apiError(w, 405)
+				return
+			}
+			apiBroken().ServeHTTP(w, r)
+			return
+		}
+		if r.URL.Path == resolvePath {
+			if r.Method != "POST" {
+				apiError(w, 405)
+				return
+			}
+			apiResolve(store).ServeHTTP(w, r)
+			return
+		}
+
+		name := normalizeName(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, apiPath), "/"))
+		switch {
+		case name == "" && r.Method == "GET":
+			apiList(store).ServeHTTP(w, r)
+		case name == "" && r.Method == "POST":
+			apiPut(store, "", true).ServeHTTP(w, r)
+		case name == "":
+			apiError(w, 405)
+		case !isValidName(name):
+			apiError(w, 400, errors.New("invalid name"))
+		case r.Method == "GET":
+			apiGet(store, name).ServeHTTP(w, r)
+		case r.Method == "PUT":
+			apiPut(store, name, false).ServeHTTP(w, r)
+		case r.Method == "DELETE":
+			apiDelete(store, name).ServeHTTP(w, r)
+		default:
+			apiError(w, 405)
+		}
+	})
+}
+
+// apiList responds with a page of the links in the store, selected by the page and limit query
+// parameters (see paginate) and optionally filtered by the tag query parameter, and the URL of the
+// next page if there is one. The page may be requested conditionally (see conditionalPage).
+func apiList(store Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, limit, err := paginate(r, apiPage)
+		if err != nil {
+			apiError(w, 400, err)
+			return
+		}
+		data, more, ok, err := conditionalPage(w, r, store, nil, page, limit)
+		if err != nil {
+			apiError(w, 500, err)
+			return
+		}
+		if !ok {
+			return
+		}
+
+		links := make([]apiLink, len(data))
+		for i, nl := range data {
+			links[i] = apiLink(nl)
+		}
+		next := ""
+		if more {
+			next = fmt.Sprintf("%s?page=%d&limit=%d", apiPath, page+1, limit)
+			if tag := r.URL.Query().Get("tag"); tag != "" {
+				next += "&tag=" + url.QueryEscape(tag)
+			}
+		}
+		writeJSON(w, 200, struct {
+			Links []apiLink `json:"links"`
+			Next  string    `json:"next,omitempty"`
+		}{links, next})
+	})
+}
+
+// apiGet responds with the link for name.
+func apiGet(store Store, name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e, err := store.Get(r.Context(), name)
+		if err == ErrNotFound {
+			apiError(w, 404, err)
+			return
+		}
+		if err != nil {
+			apiError(w, 500, err)
+			return
+		}
+		w.Header().Set("ETag", e.ETag())
+		writeJSON(w, 200, apiLink{Name: name, Entry: *e})
+	})
+}
+
+// apiPut Sets the link in the body of the request for name, or for the name in the body if name
+// is empty. If create is true the name must not already exist, otherwise if it does the If-Match
+// header must contain its ETag (see checkMatch). Instead of a link the body can have several
+// weighted destinations to choose between (see Entry.Choose). Links created without any name are
+// given a short one (see shortName), as with a general purpose URL shortener. Only those allowed
+// to change an existing link may do so (see checkOwner), and an owner in the body transfers it.
+func apiPut(store Store, name string, create bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); t != "application/json" {
+			apiError(w, 415, errors.New("body must be application/json"))
+			return
+		}
+		var body struct {
+			Name         string            `json:"name"`
+			Link         string            `json:"link"`
+			Expires      *time.Time        `json:"expires"`
+			Tags         []string          `json:"tags"`
+			Description  string            `json:"description"`
+			Owner        string            `json:"owner"`
+			Params       map[string]string `json:"params"`
+			Regions      map[string]string `json:"regions"`
+			Languages    map[string]string `json:"languages"`
+			Mobile       string            `json:"mobile"`
+			Destinations []Destination     `json:"destinations"`
+			Bundle       bool              `json:"bundle"`
+			Untracked    bool              `json:"untracked"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&body); err != nil {
+			apiError(w, 400, err)
+			return
+		}
+		body.Name = normalizeName(body.Name)
+		if name == "" {
+			name = body.Name
+		}
+		shorten := create && name == ""
+		if !shorten && (name == "" || !isValidName(name) || (body.Name != "" && body.Name != name)) {
+			apiError(w, 400, errors.New("invalid name"))
+			return
+		}
+		dests := body.Destinations
+		if len(dests) == 0 {
+			dests = []Destination{{Link: body.Link, Weight: 1}}
+		}
+		link, dests, err := normalizeDestinations(r.Context(), store, r.Host, dests)
+		if err != nil {
+			apiError(w, 400, err)
+			return
+		}
+		tags, err := normalizeTags(body.Tags)
+		if err != nil {
+			apiError(w, 400, err)
+			return
+		}
+		description, err := normalizeDescription(body.Description)
+		if err != nil {
+			apiError(w, 400, err)
+			return
+		}
+		params, err := normalizeParams(body.Params)
+		if err != nil {
+			apiError(w, 400, err)
+			return
+		}
+		regions, err := normalizeRegions(r.Context(), store, r.Host, body.Regions)
+		if err != nil {
+			apiError(w, 400, err)
+			return
+		}
+		langs, err := normalizeLanguages(r.Context(), store, r.Host, body.Languages)
+		if err != nil {
+			apiError(w, 400, err)
+			return
+		}
+		mobile, err := normalizeMobile(r.Context(), store, r.Host, body.Mobile)
+		if err != nil {
+			apiError(w, 400, err)
+			return
+		}
+
+		updates.Lock()
+		defer updates.Unlock()
+
+		if shorten {
+			short, existing, err := shortName(r.Context(), store, link)
+			if err != nil {
+				apiError(w, 500, err)
+				return
+			}
+			if existing != nil && len(dests) == 0 && body.Expires == nil && len(tags) == 0 && description == "" && params == nil && regions == nil && langs == nil && mobile == "" && !body.Bundle && !body.Untracked {
+				w.Header().Set("ETag", existing.ETag())
+				writeJSON(w, 200, apiLink{Name: short, Entry: *existing})
+				return
+			}
+			name = short
+		}
+		// The per-region and per-language links (and the mobile link) are checked along with the
+		// destinations.
+		all := append(append(linkDestinations(regions), linkDestinations(langs)...), dests...)
+		if mobile != "" {
+			all = append(all, Destination{Link: mobile})
+		}
+		if err := checkLoop(r.Context(), store, r.Host, name, link, all); err != nil {
+			apiError(w, 400, err)
+			return
+		}
+		if err := checkPublic(r.Context(), r.Host, link, all); err != nil {
+			apiError(w, 400, err)
+			return
+		}
+
+		existing, err := store.Get(r.Context(), name)
+		if err != nil && err != ErrNotFound {
+			apiError(w, 500, err)
+			return
+		}
+		if create && err == nil {
+			apiError(w, 409, errors.New("already exists"))
+			return
+		}
+		if !create {
+			if code, err := checkMatch(r.Header.Get("If-Match"), existing); code != 0 {
+				apiError(w, code, err)
+				return
+			}
+			if err := checkOwner(r, existing); err != nil {
+				apiError(w, 403, err)
+				return
+			}
+		}
+
+		now := time.Now()
+		e := &Entry{Link: link, Created: now, Updated: now, CreatedBy: identity(r), Expires: body.Expires, Tags: tags, Description: description, Params: params, Regions: regions, Languages: langs, Mobile: mobile, Destinations: dests, Bundle: body.Bundle, Untracked: body.Untracked}
+		code := 201
+		if err == nil {
+			e.Created, e.CreatedBy, e.Owner = existing.Created, existing.CreatedBy, existing.Owner
+			code = 200
+		}
+		if body.Owner != "" {
+			e.Owner = body.Owner
+		}
+
+		err = store.Set(r.Context(), name, e)
+		if errors.Is(err, ErrQuotaExceeded) {
+			apiError(w, 507, err)
+			return
+		}
+		if err != nil {
+			apiError(w, 500, err)
+			return
+		}
+		if code == 201 {
+			w.Header().Set("Location", apiPath+"/"+name)
+		}
+		w.Header().Set("ETag", e.ETag())
+		writeJSON(w, code, apiLink{Name: name, Entry: *e})
+	})
+}
+
+// shortNameLength is the shortest length of the names generated by shortName.
+const shortNameLength = 6
+
+// base62 are the digits of the names generated by shortName.
+const base62 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// shortName generates a name for link from the base62 digits of its hash, so that shortening the
+// same link again gives the same name, using as many digits (at least shortNameLength) as it takes
+// to not collide with a name which maps to another link. If the name already maps to link its
+// entry is returned as well.
+func shortName(ctx context.Context, store Store, link string) (string, *Entry, error) {
+	h := sha256.Sum256([]byte(link))
+	n, base, mod := new(big.Int).SetBytes(h[:]), big.NewInt(int64(len(base62))), new(big.Int)
+	var digits []byte
+	for n.Sign() > 0 {
+		n.DivMod(n, base, mod)
+		digits = append(digits, base62[mod.Int64()])
+	}
+
+	for l := shortNameLength; l <= len(digits); l++ {
+		name := string(digits[:l])
+		if !isValidName(name) {
+			continue
+		}
+		e, err := store.Get(ctx, name)
+		if err == ErrNotFound {
+			return name, nil, nil
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		if e.Link == link && len(e.Destinations) == 0 {
+			return name, e, nil
+		}
+	}
+	return "", nil, errors.New("no short name available")
+}
+
+// apiDelete deletes the link for name, provided it's the version in the If-Match header if one
+// is given (see checkMatch).
+func apiDelete(store Store, name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		updates.Lock()
+		defer updates.Unlock()
+
+		e, err := store.Get(r.Context(), name)
+		if err == ErrNotFound {
+			apiError(w, 404, err)
+			return
+		}
+		if err != nil {
+			apiError(w, 500, err)
+			return
+		}
+		if match := r.Header.Get("If-Match"); match != "" {
+			if code, err := checkMatch(match, e); code != 0 {
+				apiError(w, code, err)
+				return
+			}
+		}
+		if err := checkOwner(r, e); err != nil {
+			apiError(w, 403, err)
+			return
+		}
+
+		if err := store.Set(r.Context(), name, nil); err != nil {
+			apiError(w, 500, err)
+			return
+		}
+		w.WriteHeader(204)
+	})
+}
+
+// importResult is the outcome of importing a single row.
+type importResult struct {
+	Row    int    `json:"row"`
+	Name   string `json:"name"`
+	Link   string `json:"link"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// apiImport Sets each of the name/link pairs in the body of the request, which is either CSV
+// (text/csv) with a name and link in the first two columns of each row, optionally preceded by a
+// header (so exports can be imported again), or JSON in the same {"links": [...]} form as the list
+// of links. Rows are validated individually and the response includes the result of each, with any
+// invalid rows skipped. If the atomic query parameter is true then nothing is imported unless
+// every row is valid. Valid rows are Set in a single batch, so are imported all-or-nothing if the
+// store is a Batcher.
+func apiImport(store Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic, _ := strconv.ParseBool(r.URL.Query().Get("atomic"))
+		body := http.MaxBytesReader(w, r.Body, 1<<20)
+
+		var rows []importResult
+		t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch t {
+		case "text/csv":
+			cr := csv.NewReader(body)
+			cr.TrimLeadingSpace = true
+			for n := 1; ; n++ {
+				rec, err := cr.Read()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					apiError(w, 400, err)
+					return
+				}
+				if len(rec) < 2 {
+					apiError(w, 400, fmt.Errorf("row %d: expected name and link", n))
+					return
+				}
+				if n == 1 && rec[0] == "name" && rec[1] == "link" {
+					continue
+				}
+				rows = append(rows, importResult{Row: n, Name: rec[0], Link: rec[1]})
+			}
+		case "application/json":
+			var in struct {
+				Links []struct {
+					Name string `json:"name"`
+					Link string `json:"link"`
+				} `json:"links"`
+			}
+			if err := json.NewDecoder(body).Decode(&in); err != nil {
+				apiError(w, 400, err)
+				return
+			}
+			for i, l := range in.Links {
+				rows = append(rows, importResult{Row: i + 1, Name: l.Name, Link: l.Link})
+			}
+		default:
+			apiError(w, 415, errors.New("body must be text/csv or application/json"))
+			return
+		}
+
+		now := time.Now()
+		entries := make(map[string]*Entry, len(rows))
+		failed := 0
+		for i := range rows {
+			row := &rows[i]
+			e, err := importRow(r, store, row, entries, now)
+			if err != nil {
+				row.Status, row.Error = "invalid", err.Error()
+				failed++
+				continue
+			}
+			entries[row.Name] = e
+		}
+
+		code := 200
+		if failed > 0 && atomic {
+			code = 422
+			entries = nil
+		}
+		if len(entries) > 0 {
+			err := setAll(r.Context(), store, entries)
+			if errors.Is(err, ErrQuotaExceeded) {
+				apiError(w, 507, err)
+				return
+			}
+			if err != nil {
+				apiError(w, 500, err)
+				return
+			}
+		}
+		for i := range rows {
+			switch {
+			case rows[i].Status != "":
+			case entries[rows[i].Name] == nil:
+				rows[i].Status = "skipped"
+			default:
+				rows[i].Status = "imported"
+			}
+		}
+
+		writeJSON(w, code, struct {
+			Imported int            `json:"imported"`
+			Failed   int            `json:"failed"`
+			Results  []importResult `json:"results"`
+		}{len(entries), failed, rows})
+	})
+}
+
+// importRow validates row, normalizing its link, and returns the entry it should be imported as.
+// entries holds the entries of the rows before it, which mustn't have the same name.
+func importRow(r *http.Request, store Store, row *importResult, entries map[string]*Entry, now time.Time) (*Entry, error) {
+	row.Name = normalizeName(row.Name)
+	if row.Name == "" || !isValidName(row.Name) {
+		return nil, errors.New("invalid name")
+	}
+	if _, ok := entries[row.Name]; ok {
+		return nil, errors.New("duplicate name")
+	}
+	link, dests, err := parseDestinations(r.Context(), store, r.Host, row.Link)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkLoop(r.Context(), store, r.Host, row.Name, link, dests); err != nil {
+		return nil, err
+	}
+	if err := checkPublic(r.Context(), r.Host, link, dests); err != nil {
+		return nil, err
+	}
+	row.Link = link
+
+	e := &Entry{Link: link, Created: now, Updated: now, CreatedBy: identity(r), Destinations: dests}
+	existing, err := store.Get(r.Context(), row.Name)
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	if err == nil {
+		if err := checkOwner(r, existing); err != nil {
+			return nil, err
+		}
+		e.Created, e.CreatedBy, e.Owner = existing.Created, existing.CreatedBy, existing.Owner
+	}
+	return e, nil
+}
+
+// apiExport responds with every link in the store along with its metadata, for taking backups. The
+// format query parameter selects either CSV (with a name,link,created,updated,created_by header)
+// or JSON in the same form as the list of links, which is the default. The links are streamed as
+// they're read from the store, so an error part way through can only be reported by truncating
+// the response.
+func apiExport(store Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var write func(name string, e *Entry) error
+		var done func() error
+		switch format := r.URL.Query().Get("format"); format {
+		case "csv":
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", `attachment; filename="golinks.csv"`)
+			cw := csv.NewWriter(w)
+			_ = cw.Write([]string{"name", "link", "created", "updated", "created_by"})
+			write = func(name string, e *Entry) error {
+				return cw.Write([]string{name, e.Link, exportTime(e.Created), exportTime(e.Updated), e.CreatedBy})
+			}
+			done = func() error {
+				cw.Flush()
+				return cw.Error()
+			}
+		case "json", "":
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Disposition", `attachment; filename="golinks.json"`)
+			_, _ = io.WriteString(w, `{"links":[`)
+			first := true
+			write = func(name string, e *Entry) error {
+				b, err := json.Marshal(apiLink{Name: name, Entry: *e})
+				if err != nil {
+					return err
+				}
+				if !first {
+					b = append([]byte{','}, b...)
+				}
+				first = false
+				_, err = w.Write(b)
+				return err
+			}
+			done = func() error {
+				_, err := io.WriteString(w, "]}\n")
+				return err
+			}
+		default:
+			apiError(w, 400, fmt.Errorf("unknown format %q", format))
+			return
+		}
+
+		err := store.Iterate(r.Context(), write)
+		if err == nil {
+			err = done()
+		}
+		if err != nil {
+			log.Printf("exporting links failed: %v\n", err)
+		}
+	})
+}
+
+// exportTime formats t for CSV exports, leaving times which weren't recorded empty.
+func exportTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// searchResult is a link matching a search, along with how well it matched.
+type searchResult struct {
+	apiLink
+	Score int `json:"score"`
+}
+
+// apiSearch responds with the links whose names or links contain the q query parameter, ignoring
+// case (and, if fuzzy, the characters fuzzy name semantics ignore). Results are ranked by score,
+// with names which match exactly scoring highest, followed by names which start with q, names
+// which contain it and finally links which contain it, and then by how recently they were Set. At
+// most limit results are returned, which defaults to 20.
+func apiSearch(store Store, fuzzy bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query().Get("q")
+		if q == "" {
+			apiError(w, 400, errors.New("missing q"))
+			return
+		}
+		limit := 20
+		if l := r.URL.Query().Get("limit"); l != "" {
+			n, err := strconv.Atoi(l)
+			if err != nil || n < 1 {
+				apiError(w, 400, errors.New("invalid limit"))
+				return
+			}
+			limit = n
+		}
+
+		results, err := search(r.Context(), store, q, fuzzy, limit)
+		if err != nil {
+			apiError(w, 500, err)
+			return
+		}
+		writeJSON(w, 200, struct {
+			Results []searchResult `json:"results"`
+		}{results})
+	})
+}
+
+// search returns up to limit of the links in store matching q, ranked as described by apiSearch.
+func search(ctx context.Context, store Store, q string, fuzzy bool, limit int) ([]searchResult, error) {
+	results := []searchResult{}
+	err := store.Iterate(ctx, func(name string, e *Entry) error {
+		if score := searchScore(q, name, e.Link, fuzzy); score > 0 {
+			results = append(results, searchResult{apiLink{Name: name, Entry: *e}, score})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// searchScore returns how well name and link match the query q, or 0 if they don't.
+func searchScore(q, name, link string, fuzzy bool) int {
+	normalize := strings.ToLower
+	if fuzzy {
+		normalize = fuzz
+	}
+	nq, n := normalize(q), normalize(name)
+	switch {
+	case n == nq:
+		return 100
+	case strings.HasPrefix(n, nq):
+		return 50
+	case strings.Contains(n, nq):
+		return 25
+	case strings.Contains(strings.ToLower(link), strings.ToLower(q)):
+		return 10
+	}
+	return 0
+}
+
+// apiResolve responds with the links which each of the names in the JSON body ({"names": [...]})
+// redirect to, as with following go/name (see resolve), so that clients can expand many names in
+// one request:
+//
+//	{"links": {"name": "link", ...}, "unknown": ["name", ...]}
+//
+// Names which don't redirect anywhere (including invalid and expired ones, and those whose aliases
+// loop) are listed in unknown.
+// At most maxResolve names can be resolved at once.
+func apiResolve(store Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); t != "application/json" {
+			apiError(w, 415, errors.New("body must be application/json"))
+			return
+		}
+		var in struct {
+			Names []string `json:"names"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&in); err != nil {
+			apiError(w, 400, err)
+			return
+		}
+		if len(in.Names) > maxResolve {
+			apiError(w, 400, fmt.Errorf("at most %d names can be resolved at once", maxResolve))
+			return
+		}
+
+		out := struct {
+			Links   map[string]string `json:"links"`
+			Unknown []string          `json:"unknown"`
+		}{map[string]string{}, []string{}}
+		seen := make(map[string]bool, len(in.Names))
+		for _, name := range in.Names {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			if !isValidName(name) {
+				out.Unknown = append(out.Unknown, name)
+				continue
+			}
+			_, _, link, err := resolve(visitorContext(r), store, r.Host, normalizeName(name))
+			if err == ErrNotFound || errors.Is(err, errExpired) || errors.Is(err, errAliasLoop) {
+				out.Unknown = append(out.Unknown, name)
+				continue
+			}
+			if err != nil {
+				apiError(w, 500, err)
+				return
+			}
+			out.Links[name] = link
+		}
+		writeJSON(w, 200, out)
+	})
+}
+
+// suggest responds with the names starting with the q query parameter (ignoring case and any "go/"
+// prefix) in the OpenSearch suggestions format, so that browsers can complete names as they're
+// typed into the address bar:
+//
+//	["q", ["name", ...], ["link", ...], ["https://host/name", ...]]
+//
+// A name matching q exactly is suggested first, followed by the other names in the order they were
+// most recently Set. If fuzzy, names are matched ignoring the characters fuzzy name semantics do.
+func suggest(auth *Auth, store Store, tokens *Tokens, fuzzy bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, _ := apiAuth(auth, tokens, r); !ok {
+			apiError(w, 401, errors.New("not logged in"))
+			return
+		}
+		if r.Method != "GET" {
+			apiError(w, 405)
+			return
+		}
+
+		normalize := strings.ToLower
+		if fuzzy {
+			normalize = fuzz
+		}
+		q := r.URL.Query().Get("q")
+		prefix := normalize(strings.TrimPrefix(q, "go/"))
+
+		var exact *NameLink
+		var matches []NameLink
+		err := store.Iterate(r.Context(), func(name string, e *Entry) error {
+			switch n := normalize(name); {
+			case n == prefix && exact == nil:
+				exact = &NameLink{Name: name, Entry: *e}
+			case strings.HasPrefix(n, prefix) && len(matches) < suggestions:
+				matches = append(matches, NameLink{Name: name, Entry: *e})
+			}
+			if exact != nil && len(matches) >= suggestions-1 {
+				return errStop
+			}
+			return nil
+		})
+		if err != nil && err != errStop {
+			apiError(w, 500, err)
+			return
+		}
+		if exact != nil {
+			matches = append([]NameLink{*exact}, matches...)
+		}
+		if len(matches) > suggestions {
+			matches = matches[:suggestions]
+		}
+
+		names, links, urls := []string{}, []string{}, []string{}
+		for _, m := range matches {
+			names = append(names, m.Name)
+			links = append(links, m.Link)
+			urls = append(urls, fmt.Sprintf("https://%s/%s", r.Host, m.Name))
+		}
+		w.Header().Set("Content-Type", "application/x-suggestions+json")
+		if err := json.NewEncoder(w).Encode([]interface{}{q, names, links, urls}); err != nil {
+			log.Printf("writing response failed: %v\n", err)
+		}
+	})
+}
+
+// openSearchURL is a URL template in an OpenSearch description document.
+type openSearchURL struct {
+	Type     string `xml:"type,attr"`
+	Method   string `xml:"method,attr,omitempty"`
+	Template string `xml:"template,attr"`
+}
+
+// openSearch responds with an OpenSearch description document for the host the request was made
+// to, which browsers use to add "go" as a search engine (or keyword) which resolves the search
+// terms as a name, with suggestions from suggest.
+func openSearch() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		base := fmt.Sprintf("https://%s/", r.Host)
+		doc := struct {
+			XMLName     xml.Name `xml:"http://a9.com/-/spec/opensearch/1.1/ OpenSearchDescription"`
+			ShortName   string
+			Description string
+			Encoding    string `xml:"InputEncoding"`
+			Image       struct {
+				Width  int    `xml:"width,attr"`
+				Height int    `xml:"height,attr"`
+				Type   string `xml:"type,attr"`
+				URL    string `xml:",chardata"`
+			}
+			URLs []openSearchURL `xml:"Url"`
+		}{
+			ShortName:   "go",
+			Description: fmt.Sprintf("go links on %s", r.Host),
+			Encoding:    "UTF-8",
+			URLs: []openSearchURL{
+				{Type: "text/html", Method: "get", Template: base + "{searchTerms}"},
+				{Type: "application/x-suggestions+json", Method: "get", Template: base + suggestPath[1:] + "?q={searchTerms}"},
+			},
+		}
+		doc.Image.Width, doc.Image.Height = 16, 16
+		doc.Image.Type, doc.Image.URL = "image/x-icon", base+"favicon.ico"
+
+		w.Header().Set("Content-Type", "application/opensearchdescription+xml")
+		_, _ = io.WriteString(w, xml.Header)
+		if err := xml.NewEncoder(w).Encode(doc); err != nil {
+			log.Printf("writing response failed: %v\n", err)
+		}
+	})
+}
+
+// prefersJSON returns whether the Accept header of r prefers application/json to text/html.
+func prefersJSON(r *http.Request) bool {
+	q := map[string]float64{}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		t, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		q[t] = 1
+		if v, ok := params["q"]; ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q[t] = f
+			}
+		}
+	}
+	return q["application/json"] > q["text/html"]
+}
+
+// writeJSON responds with code and v encoded as JSON.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("writing response failed: %v\n", err)
+	}
+}
+
+// apiError is the equivalent of httpError for the API, responding with the error as JSON.
+func apiError(w http.ResponseWriter, code int, err ...error) {
+	msg := http.StatusText(code)
+	if len(err) > 0 {
+		msg = err[0].Error()
+	}
+	writeJSON(w, code, struct {
+		Error string `json:"error"`
+	}{msg})
+}
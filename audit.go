@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditPath is the path of the page showing the audit log.
+const auditPath = "/audit"
+
+// auditPage is the default number of records shown on each page of the audit log.
+const auditPage = 100
+
+// actorKey is the context key of who is making a change (see actorContext).
+type actorKey struct{}
+
+// actorContext returns ctx along with who is responsible for changes made with it, as recorded in
+// the audit log.
+func actorContext(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// actorOf returns who is responsible for changes made with ctx (see actorContext), or "unknown".
+func actorOf(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok && actor != "" {
+		return actor
+	}
+	return "unknown"
+}
+
+// AuditRecord records a link being created, updated or deleted, who by and what it was before and
+// after the change.
+type AuditRecord struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Name     string    `json:"name"`
+	Actor    string    `json:"actor"`
+	Previous *Entry    `json:"previous"`
+	Entry    *Entry    `json:"entry"`
+}
+
+// Audit wraps a StoreCloser to append a record of every link created, updated or deleted through
+// it to a file, one JSON AuditRecord per line, which is synced before Set returns. As with
+// Webhooks, the lock is held during Set so that the previous entry each record reports is
+// consistent with the change, and so that records are written in the order the changes happened.
+type Audit struct {
+	StoreCloser
+	filename string
+
+	lock sync.Mutex
+	f    *os.File
+}
+
+// OpenAudit returns Audit for store which appends to the file filename, creating it if necessary.
+func OpenAudit(store StoreCloser, filename string) (*Audit, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Audit{StoreCloser: store, filename: filename, f: f}, nil
+}
+
+func (a *Audit) Set(ctx context.Context, name string, e *Entry) error {
+	return a.SetAll(ctx, map[string]*Entry{name: e})
+}
+
+func (a *Audit) SetAll(ctx context.Context, entries map[string]*Entry) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	evs, err := setEvents(ctx, a.StoreCloser, entries)
+	if err != nil || len(evs) == 0 {
+		return err
+	}
+	var b []byte
+	actor := actorOf(ctx)
+	for _, ev := range evs {
+		line, err := json.Marshal(AuditRecord{ev.Time, ev.Event, ev.Name, actor, ev.Previous, ev.Entry})
+		if err != nil {
+			return err
+		}
+		b = append(append(b, line...), '\n')
+	}
+	// The changes have been made by now, so failing to record them is reported rather than hidden.
+	if _, err := a.f.Write(b); err != nil {
+		return fmt.Errorf("recording change in audit log: %w", err)
+	}
+	if err := a.f.Sync(); err != nil {
+		return fmt.Errorf("recording change in audit log: %w", err)
+	}
+	return nil
+}
+
+// Records returns page of the records in the audit log (of only the changes to name, if it isn't
+// empty) when split into pages of limit records, most recent first, along with whether there are
+// any later pages.
+func (a *Audit) Records(name string, page, limit int) ([]AuditRecord, bool, error) {
+	f, err := os.Open(a.filename)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	// Only the most recent page*limit+1 records need to be kept while reading forwards.
+	keep := page*limit + 1
+	var recent []AuditRecord
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<24)
+	for n := 1; s.Scan(); n++ {
+		var rec AuditRecord
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			return nil, false, fmt.Errorf("reading audit log line %d: %w", n, err)
+		}
+		if name != "" && rec.Name != name {
+			continue
+		}
+		recent = append(recent, rec)
+		if len(recent) > 2*keep {
+			recent = append([]AuditRecord(nil), recent[len(recent)-keep:]...)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, false, err
+	}
+
+	var data []AuditRecord
+	for i := len(recent) - 1 - (page-1)*limit; i >= 0 && len(data) < limit; i-- {
+		data = append(data, recent[i])
+	}
+	return data, len(recent) > page*limit, nil
+}
+
+// Unwrap returns the wrapped store.
+func (a *Audit) Unwrap() Store {
+	return a.StoreCloser
+}
+
+// Close closes the audit log and then the wrapped store.
+func (a *Audit) Close() error {
+	a.lock.Lock()
+	err := a.f.Close()
+	a.lock.Unlock()
+	if serr := a.StoreCloser.Close(); serr != nil {
+		return serr
+	}
+	return err
+}
+
+// getAudit renders a page of the audit log, selected by the page and limit query parameters (see
+// paginate) and optionally only of the changes to the name query parameter.
+func getAudit(auth *Auth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !auth.IsAuth(r) {
+			http.Redirect(w, r, "/login", 302)
+			return
+		}
+		if r.Method != "GET" {
+			httpError(w, 405)
+			return
+		}
+		auditLog := configOf(r.Context()).auditLog
+		if auditLog == nil {
+			httpError(w, 404, errors.New("the audit log isn't enabled"))
+			return
+		}
+		page, limit, err := paginate(r, auditPage)
+		if err != nil {
+			httpError(w, 400, err)
+			return
+		}
+		name := normalizeName(r.URL.Query().Get("name"))
+		data, more, err := auditLog.Records(name, page, limit)
+		if err != nil {
+			httpError(w, 500, err)
+			return
+		}
+
+		prev, next := page-1, 0
+		if more {
+			next = page + 1
+		}
+		render(w, "audit.html", struct {
+			Title string
+			Name  string
+			Data  []AuditRecord
+			Prev  int
+			Next  int
+			Limit int
+		}{
+			fmt.Sprintf("audit - %s", r.Host), name, data, prev, next, limit,
+		})
+	})
+}
+
+// requestActor returns who is responsible for changes made by r (see identity), along with the
+// API token it's authorized by, if any.
+func requestActor(r *http.Request, tokens *Tokens) string {
+	actor := identity(r)
+	if h := r.Header.Get("Authorization"); tokens != nil && strings.HasPrefix(h, "Bearer ") {
+		if tok, ok := tokens.Check(strings.TrimPrefix(h, "Bearer ")); ok {
+			actor += fmt.Sprintf(" (token %s)", tok.ID)
+		}
+	}
+	return actor
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/xsrftoken"
+)
+
+// sessionCookie is the name of the cookie holding the ID of a logged in session.
+const sessionCookie = "Authorization"
+
+// sessionLength is how long a session lasts after logging in.
+const sessionLength = 30 * 24 * time.Hour
+
+// errBadLogin is returned when logging in with a username or password which doesn't match.
+var errBadLogin = errors.New("incorrect username or password")
+
+// Auth authenticates requests, either with per-user passwords if there are users (see Users) or
+// otherwise with the single shared password whose hash it was created with, and with an OpenID
+// Connect provider if there is one (see OIDC). Logged in sessions are kept in Sessions.
+type Auth struct {
+	hash     []byte
+	users    *Users
+	oidc     *OIDC
+	sessions *Sessions
+	limiter  *RateLimiter
+}
+
+// NewAuth returns Auth checking logins against users, or against hash (see hashPassword) if users
+// is nil, which also logs in with oidc if it isn't nil and keeps the sessions logged in in sessions
+// (or only in memory if it's nil).
+func NewAuth(hash string, users *Users, oidc *OIDC, sessions *Sessions) *Auth {
+	if sessions == nil {
+		sessions, _ = OpenSessions("")
+	}
+	return &Auth{
+		hash:     []byte(hash),
+		users:    users,
+		oidc:     oidc,
+		sessions: sessions,
+		limiter:  NewRateLimiter(1),
+	}
+}
+
+// hashPassword returns the bcrypt hash of the SHA-512 of password, which is hashed first so that
+// short passwords are still of a decent length. Hashes are compatible with those created by the
+// a1 package which were used for the shared password.
+func hashPassword(password string) (string, error) {
+	sha := sha512.Sum512([]byte(password))
+	b, err := bcrypt.GenerateFromPassword(sha[:], bcrypt.DefaultCost)
+	return string(b), err
+}
+
+// checkPassword returns an error unless password matches hash (see hashPassword).
+func checkPassword(hash, password string) error {
+	sha := sha512.Sum512([]byte(password))
+	return bcrypt.CompareHashAndPassword([]byte(hash), sha[:])
+}
+
+// randomHex returns n random bytes encoded as hex.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Accounts returns whether logging in is with per-user accounts rather than a shared password.
+func (a *Auth) Accounts() bool {
+	return a.users != nil
+}
+
+// Passwords returns whether logging in with a password is possible, which it isn't if the
+// OpenID Connect provider is the only way of logging in.
+func (a *Auth) Passwords() bool {
+	return a.users != nil || len(a.hash) > 0
+}
+
+// LoginPage renders the login page, with a form which POSTs to path and a link to log in with the
+// OpenID Connect provider (if there is one) by requesting the page with the sso query parameter.
+// Without passwords requests are redirected to the provider straight away.
+func (a *Auth) LoginPage(title, path string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.oidc != nil && (!a.Passwords() || r.URL.Query().Get("sso") != "") {
+			a.oidc.Start(w, r)
+			return
+		}
+		render(w, "login.html", struct {
+			Title     string
+			LoginPath string
+			Token     string
+			Accounts  bool
+			SSO       bool
+		}{
+			title, path, a.XSRF(r, path), a.Accounts(), a.oidc != nil,
+		})
+	})
+}
+
+// Login logs in requests POSTed from the login page with a matching username and password (or only
+// password, with the shared password), redirecting them to redirectPath. Attempts are limited to
+// one a second from each client address so that passwords can't be guessed quickly, and the XSRF
+// token is scoped to loginPath.
+func (a *Auth) Login(loginPath, redirectPath string) http.Handler {
+	return a.CheckXSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		if !a.limiter.Allow(host) {
+			w.Header().Set("Retry-After", "1")
+			httpError(w, 429)
+			return
+		}
+
+		s := &loginSession{Expires: time.Now().Add(sessionLength)}
+		if a.users != nil {
+			u, err := a.users.Check(strings.TrimSpace(r.PostFormValue("username")), r.PostFormValue("password"))
+			if err != nil {
+				httpError(w, 401, err)
+				return
+			}
+			s.User, s.Hash = u.Name, u.Hash
+		} else if err := checkPassword(string(a.hash), r.PostFormValue("password")); err != nil {
+			httpError(w, 401, errBadLogin)
+			return
+		}
+		if err := a.start(w, r, s); err != nil {
+			httpError(w, 500, err)
+			return
+		}
+		http.Redirect(w, r, redirectPath, 302)
+	}), loginPath)
+}
+
+// Callback completes logging in with the OpenID Connect provider (see OIDC.Callback), redirecting
+// to redirectPath once logged in.
+func (a *Auth) Callback(redirectPath string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.oidc == nil {
+			httpError(w, 404)
+			return
+		}
+		email, err := a.oidc.Callback(w, r)
+		if err == errOIDCDomain {
+			httpError(w, 403, err)
+			return
+		}
+		if err != nil {
+			httpError(w, 401, err)
+			return
+		}
+		if err := a.start(w, r, &loginSession{User: email, SSO: true, Expires: time.Now().Add(sessionLength)}); err != nil {
+			httpError(w, 500, err)
+			return
+		}
+		http.Redirect(w, r, redirectPath, 302)
+	})
+}
+
+// start starts the session s for the request r, setting the cookie identifying it in w. The cookie
+// is only sent over HTTPS if r was made with it (see requestScheme).
+func (a *Auth) start(w http.ResponseWriter, r *http.Request, s *loginSession) error {
+	id, err := a.sessions.Start(s)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		HttpOnly: true,
+		Secure:   requestScheme(r) == "https",
+		SameSite: http.SameSiteLaxMode,
+		Path:     "/",
+		Expires:  s.Expires,
+	})
+	return nil
+}
+
+// Logout ends the request's session, if it has one, and redirects to redirectPath.
+func (a *Auth) Logout(redirectPath string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{
+			Name:     sessionCookie,
+			Value:    "",
+			HttpOnly: true,
+			Secure:   requestScheme(r) == "https",
+			Path:     "/",
+			Expires:  time.Unix(0, 0),
+		})
+		if c, err := r.Cookie(sessionCookie); err == nil {
+			if err := a.sessions.End(c.Value); err != nil {
+				httpError(w, 500, err)
+				return
+			}
+		}
+		http.Redirect(w, r, redirectPath, 302)
+	})
+}
+
+// XSRF returns a token for the request r's session (optionally scoped to path) which CheckXSRF
+// requires in forms POSTed by the same session, to thwart cross-site request forgery.
+func (a *Auth) XSRF(r *http.Request, path ...string) string {
+	p := ""
+	if len(path) > 0 {
+		p = path[0]
+	}
+	return xsrftoken.Generate(a.sessions.xsrfKey, xsrfUser(r), p)
+}
+
+// xsrfUser returns who XSRF tokens are for in the request r, which is its session (by a hash of
+// its ID, so that the ID isn't used for anything else) or nobody if it isn't logged in.
+func xsrfUser(r *http.Request) string {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return ""
+	}
+	return sessionKey(c.Value)
+}
+
+// CheckXSRF wraps handler to reject requests without a token from XSRF (for their session, and
+// scoped to the same path if any) in the token form value.
+func (a *Auth) CheckXSRF(handler http.Handler, path ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := ""
+		if len(path) > 0 {
+			p = path[0]
+		}
+		if !xsrftoken.Valid(r.PostFormValue("token"), a.sessions.xsrfKey, xsrfUser(r), p) {
+			httpError(w, 401, errors.New("invalid XSRF"))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// EnsureAuth wraps handler to reject requests which aren't logged in.
+func (a *Auth) EnsureAuth(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.IsAuth(r) {
+			httpError(w, 401)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// IsAuth returns whether the request r is logged in.
+func (a *Auth) IsAuth(r *http.Request) bool {
+	_, ok := a.session(r)
+	return ok
+}
+
+// User returns the user the request r is logged in as (who is only named by their email address if
+// they logged in with the OpenID Connect provider), or nil if it isn't logged in or is logged in
+// with the shared password.
+func (a *Auth) User(r *http.Request) *User {
+	u, _ := a.session(r)
+	return u
+}
+
+// session returns the user of the request r's session (which is nil with the shared password),
+// and whether it has an unexpired session at all. Sessions of users who have since been removed
+// or had their password changed are no longer valid.
+func (a *Auth) session(r *http.Request) (*User, bool) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, false
+	}
+	s, ok := a.sessions.Get(c.Value)
+	if !ok {
+		return nil, false
+	}
+	if s.SSO {
+		return &User{Name: s.User}, true
+	}
+	if a.users == nil {
+		return nil, s.User == ""
+	}
+	u, ok := a.users.Get(s.User)
+	if !ok || u.Hash != s.Hash {
+		return nil, false
+	}
+	return u, true
+}
+
+// userKey is the context key of the user a request is logged in as (see userContext).
+type userKey struct{}
+
+// userContext returns ctx along with the user u a request is logged in as.
+func userContext(ctx context.Context, u *User) context.Context {
+	return context.WithValue(ctx, userKey{}, u)
+}
+
+// userOf returns the user a request with ctx is logged in as (see userContext), or nil.
+func userOf(ctx context.Context) *User {
+	u, _ := ctx.Value(userKey{}).(*User)
+	return u
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHashPassword(t *testing.T) {
+	hash, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkPassword(hash, "correct horse"); err != nil {
+		t.Errorf("checkPassword with the password: %v", err)
+	}
+	if err := checkPassword(hash, "correct horse "); err == nil {
+		t.Error("checkPassword succeeded with another password")
+	}
+	if other, _ := hashPassword("correct horse"); other == hash {
+		t.Error("hashPassword isn't salted")
+	}
+	// Passwords longer than bcrypt's limit of 72 bytes still count in full.
+	long := strings.Repeat("a", 100)
+	if hash, err = hashPassword(long); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkPassword(hash, long[:99]+"b"); err == nil {
+		t.Error("checkPassword ignored the end of a long password")
+	}
+}
+
+// newTestAuth returns Auth with a user alice whose password is secret, with sessions persisted to a
+// file in dir.
+func newTestAuth(t *testing.T, dir string) *Auth {
+	t.Helper()
+	users, err := OpenUsers(filepath.Join(dir, "users"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := users.Get("alice"); !ok {
+		if err := users.Add("alice", "secret", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sessions, err := OpenSessions(filepath.Join(dir, "sessions"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewAuth("", users, nil, sessions)
+}
+
+// loginAddrs numbers the addresses logins come from, so that they aren't rate limited.
+var loginAddrs int
+
+// login POSTs the login form with username and password to auth, returning the response.
+func login(auth *Auth, username, password string) *http.Response {
+	get := httptest.NewRequest("GET", "/login", nil)
+	form := url.Values{"username": {username}, "password": {password}, "token": {auth.XSRF(get, "/login")}}
+	r := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	loginAddrs++
+	r.RemoteAddr = fmt.Sprintf("192.0.2.%d:1234", loginAddrs%256)
+	w := httptest.NewRecorder()
+	auth.Login("/login", "/").ServeHTTP(w, r)
+	return w.Result()
+}
+
+// withCookies returns a request for target with the cookies set by resp.
+func withCookies(method, target string, resp *http.Response) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	for _, c := range resp.Cookies() {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func TestLogin(t *testing.T) {
+	auth := newTestAuth(t, t.TempDir())
+	tests := []struct {
+		username, password string
+		code               int
+	}{
+		{"alice", "secret", 302},
+		{" alice ", "secret", 302},
+		{"alice", "wrong", 401},
+		{"bob", "secret", 401},
+		{"", "", 401},
+	}
+	for _, tt := range tests {
+		resp := login(auth, tt.username, tt.password)
+		if resp.StatusCode != tt.code {
+			t.Errorf("login as %q with %q = %d, want %d", tt.username, tt.password, resp.StatusCode, tt.code)
+			continue
+		}
+		u := auth.User(withCookies("GET", "/", resp))
+		if loggedIn := u != nil && u.Name == "alice"; loggedIn != (tt.code == 302) {
+			t.Errorf("login as %q with %q logged in as %v", tt.username, tt.password, u)
+		}
+	}
+}
+
+func TestLoginRejectsXSRF(t *testing.T) {
+	auth := newTestAuth(t, t.TempDir())
+	for _, token := range []string{"", "forged", auth.XSRF(httptest.NewRequest("GET", "/", nil), "/settings")} {
+		form := url.Values{"username": {"alice"}, "password": {"secret"}, "token": {token}}
+		r := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		auth.Login("/login", "/").ServeHTTP(w, r)
+		if w.Code != 401 || len(w.Result().Cookies()) > 0 {
+			t.Errorf("login with token %q = %d, want 401 without a session", token, w.Code)
+		}
+	}
+}
+
+func TestXSRFIsPerSession(t *testing.T) {
+	auth := newTestAuth(t, t.TempDir())
+	alice, other := login(auth, "alice", "secret"), login(auth, "alice", "secret")
+	token := auth.XSRF(withCookies("GET", "/", alice))
+
+	handler := auth.CheckXSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := []struct {
+		session *http.Response
+		code    int
+	}{
+		{alice, 200},
+		{other, 401},
+		{nil, 401},
+	}
+	for i, tt := range tests {
+		r := httptest.NewRequest("POST", "/settings", strings.NewReader(url.Values{"token": {token}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tt.session != nil {
+			for _, c := range tt.session.Cookies() {
+				r.AddCookie(c)
+			}
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.code {
+			t.Errorf("%d: POST with alice's token = %d, want %d", i, w.Code, tt.code)
+		}
+	}
+}
+
+func TestLogout(t *testing.T) {
+	auth := newTestAuth(t, t.TempDir())
+	resp := login(auth, "alice", "secret")
+	if !auth.IsAuth(withCookies("GET", "/", resp)) {
+		t.Fatal("not logged in")
+	}
+	w := httptest.NewRecorder()
+	auth.Logout("/").ServeHTTP(w, withCookies("GET", "/logout", resp))
+	if w.Code != 302 {
+		t.Fatalf("logout = %d, want 302", w.Code)
+	}
+	// The session has ended, even if the cookie is still sent.
+	if auth.IsAuth(withCookies("GET", "/", resp)) {
+		t.Error("still logged in after logging out")
+	}
+}
+
+func TestSessionsPersist(t *testing.T) {
+	dir := t.TempDir()
+	resp := login(newTestAuth(t, dir), "alice", "secret")
+	r := withCookies("GET", "/", resp)
+
+	auth := newTestAuth(t, dir)
+	if u := auth.User(r); u == nil || u.Name != "alice" {
+		t.Fatalf("logged in as %v after a restart, want alice", u)
+	}
+	// Changing the password ends the session.
+	if err := auth.users.SetPassword("alice", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if auth.IsAuth(r) {
+		t.Error("still logged in after the password changed")
+	}
+}
+
+func TestSessionCookieSecure(t *testing.T) {
+	auth := newTestAuth(t, t.TempDir())
+	for _, tt := range []struct {
+		proto  string
+		secure bool
+	}{{"", false}, {"https", true}} {
+		r := httptest.NewRequest("POST", "/login", nil)
+		if tt.proto != "" {
+			r.Header.Set("X-Forwarded-Proto", tt.proto)
+		}
+		w := httptest.NewRecorder()
+		if err := auth.start(w, r, &loginSession{User: "alice"}); err != nil {
+			t.Fatal(err)
+		}
+		if c := w.Result().Cookies()[0]; c.Secure != tt.secure || !c.HttpOnly {
+			t.Errorf("cookie with X-Forwarded-Proto %q is Secure %v, HttpOnly %v", tt.proto, c.Secure, c.HttpOnly)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	linksBucket = []byte("links")
+	fuzzyBucket = []byte("fuzzy")
+	orderBucket = []byte("order")
+	seqsBucket  = []byte("seqs")
+)
+
+func init() {
+	RegisterStore("bolt", func(dsn string, fuzzy, compact bool) (StoreCloser, error) {
+		path, _, err := openPath(dsn)
+		if err != nil {
+			return nil, err
+		}
+		s, err := OpenBolt(path, fuzzy)
+		if err != nil {
+			return nil, err
+		}
+		return Adapt(s), nil
+	})
+}
+
+// BoltStore provides an implementation of the Store interface backed by a
+// bbolt database. Mappings from name to encoded Entry live in the links bucket, while
+// the order bucket maps a monotonically increasing sequence number to the
+// name that was Set at that point (with seqs providing the reverse mapping so
+// stale order entries can be removed). Iterate walks the order bucket
+// backwards to provide the same last Set ordering as FileStore. If
+// initialized with fuzzy, entries are additionally stored under their fuzzed
+// names in the fuzzy bucket.
+type BoltStore struct {
+	fuzzy bool
+	db    *bolt.DB
+}
+
+// OpenBolt opens (or creates) a BoltStore backed by the database at filename
+// (and an optional bool to enable fuzzy lookups). The BoltStore returned
+// should be closed with Close once it is no longer in use.
+func OpenBolt(filename string, fuzzy ...bool) (*BoltStore, error) {
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{linksBucket, fuzzyBucket, orderBucket, seqsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{fuzzy: len(fuzzy) > 0 && fuzzy[0], db: db}, nil
+}
+
+// Close closes the BoltStore returned by OpenBolt.
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltStore) Get(name string) (*Entry, bool) {
+	var e *Entry
+	_ = s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(linksBucket).Get([]byte(name))
+		if v == nil && s.fuzzy {
+			v = tx.Bucket(fuzzyBucket).Get([]byte(fuzz(name)))
+		}
+		if len(v) > 0 {
+			e = decodeEntry(string(v))
+		}
+		return nil
+	})
+	return e, e != nil
+}
+
+func (s *BoltStore) Set(name string, e *Entry) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return s.set(tx, name, e)
+	})
+}
+
+func (s *BoltStore) SetAll(entries map[string]*Entry) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range sortedNames(entries) {
+			if err := s.set(tx, name, entries[name]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) set(tx *bolt.Tx, name string, e *Entry) error {
+	links, order, seqs := tx.Bucket(linksBucket), tx.Bucket(orderBucket), tx.Bucket(seqsBucket)
+
+	key := []byte(name)
+	if seq := seqs.Get(key); seq != nil {
+		if err := order.Delete(seq); err != nil {
+			return err
+		}
+		if err := seqs.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	if s.fuzzy {
+		fuzzy, fuzzed := tx.Bucket(fuzzyBucket), []byte(fuzz(name))
+		if e == nil {
+			if err := fuzzy.Delete(fuzzed); err != nil {
+				return err
+			}
+		} else if err := fuzzy.Put(fuzzed, []byte(encodeEntry(e))); err != nil {
+			return err
+		}
+	}
+
+	if e == nil {
+		return links.Delete(key)
+	}
+
+	n, err := order.NextSequence()
+	if err != nil {
+		return err
+	}
+	seq := make([]byte, 8)
+	// Big endian so that the byte ordering of the keys matches the numeric ordering.
+	binary.BigEndian.PutUint64(seq, n)
+	if err := order.Put(seq, key); err != nil {
+		return err
+	}
+	if err := seqs.Put(key, seq); err != nil {
+		return err
+	}
+	return links.Put(key, []byte(encodeEntry(e)))
+}
+
+func (s *BoltStore) Iterate(cb func(name string, e *Entry) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		links := tx.Bucket(linksBucket)
+		c := tx.Bucket(orderBucket).Cursor()
+		for k, name := c.Last(); k != nil; k, name = c.Prev() {
+			if err := cb(string(name), decodeEntry(string(links.Get(name)))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
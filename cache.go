@@ -0,0 +1,163 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// Cache wraps a StoreCloser to serve recently looked up names from memory,
+// which is worthwhile for stores where every Get is a round trip over the
+// network. Names which weren't found are cached separately, so that scanners
+// requesting many names which don't exist can't evict the names in use. Sets
+// made through the Cache invalidate the names they change, but changes made to
+// the underlying store by anything else (eg. another instance sharing a
+// database) are only seen once the cached entry expires.
+type Cache struct {
+	StoreCloser
+	ttl time.Duration
+
+	lock   sync.Mutex
+	hits   *lru
+	misses *lru
+	// gen is incremented by each invalidation so that Gets which raced with
+	// one don't cache what they read.
+	gen uint64
+}
+
+// Cached returns a Cache for store of at most size entries and misses names
+// which weren't found, which are looked up again after ttl (or never expire if
+// ttl is 0).
+func Cached(store StoreCloser, size, misses int, ttl time.Duration) *Cache {
+	return &Cache{StoreCloser: store, ttl: ttl, hits: newLRU(size), misses: newLRU(misses)}
+}
+
+func (c *Cache) Get(ctx context.Context, name string) (*Entry, error) {
+	c.lock.Lock()
+	if e, ok := c.hits.get(name); ok {
+		c.lock.Unlock()
+		return e, nil
+	}
+	if _, ok := c.misses.get(name); ok {
+		c.lock.Unlock()
+		return nil, ErrNotFound
+	}
+	gen := c.gen
+	c.lock.Unlock()
+
+	e, err := c.StoreCloser.Get(ctx, name)
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if gen == c.gen {
+		expires := time.Now().Add(c.ttl)
+		if c.ttl == 0 {
+			expires = time.Time{}
+		}
+		if err == ErrNotFound {
+			c.misses.add(name, nil, expires)
+		} else {
+			c.hits.add(name, e, expires)
+		}
+	}
+	return e, err
+}
+
+func (c *Cache) Set(ctx context.Context, name string, e *Entry) error {
+	defer c.invalidate(name)
+	return c.StoreCloser.Set(ctx, name, e)
+}
+
+func (c *Cache) SetAll(ctx context.Context, entries map[string]*Entry) error {
+	defer c.invalidate(sortedNames(entries)...)
+	return setAll(ctx, c.StoreCloser, entries)
+}
+
+// Unwrap returns the wrapped store.
+func (c *Cache) Unwrap() Store {
+	return c.StoreCloser
+}
+
+// invalidate removes names from the cache, along with any names which may
+// have been looked up as them with fuzzy matching. This happens after the Set
+// has been made (even if it failed) so that the entry being replaced can't be
+// cached again.
+func (c *Cache) invalidate(names ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.gen++
+	fuzzed := make(map[string]bool, len(names))
+	for _, name := range names {
+		fuzzed[fuzz(name)] = true
+	}
+	match := func(name string) bool { return fuzzed[fuzz(name)] }
+	c.hits.removeIf(match)
+	c.misses.removeIf(match)
+}
+
+// lru holds up to size entries, evicting the least recently used.
+type lru struct {
+	size    int
+	list    *list.List
+	entries map[string]*list.Element
+}
+
+// cached is the value of each element of an lru's list.
+type cached struct {
+	name    string
+	entry   *Entry
+	expires time.Time
+}
+
+func newLRU(size int) *lru {
+	return &lru{size: size, list: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// get returns the entry for name if it's cached and hasn't expired.
+func (l *lru) get(name string) (*Entry, bool) {
+	el, ok := l.entries[name]
+	if !ok {
+		return nil, false
+	}
+	v := el.Value.(*cached)
+	if !v.expires.IsZero() && !time.Now().Before(v.expires) {
+		l.remove(el)
+		return nil, false
+	}
+	l.list.MoveToFront(el)
+	return v.entry, true
+}
+
+// add caches e for name until expires (or forever if expires is zero).
+func (l *lru) add(name string, e *Entry, expires time.Time) {
+	if l.size <= 0 {
+		return
+	}
+	if el, ok := l.entries[name]; ok {
+		l.remove(el)
+	}
+	l.entries[name] = l.list.PushFront(&cached{name: name, entry: e, expires: expires})
+	if l.list.Len() > l.size {
+		l.remove(l.list.Back())
+	}
+}
+
+// removeIf removes the entries for the names which match.
+func (l *lru) removeIf(match func(name string) bool) {
+	for name, el := range l.entries {
+		if match(name) {
+			l.remove(el)
+		}
+	}
+}
+
+func (l *lru) remove(el *list.Element) {
+	l.list.Remove(el)
+	delete(l.entries, el.Value.(*cached).name)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingStore is a StoreCloser which keeps mappings in memory and counts how often it's asked for
+// them, for testing caches.
+type countingStore struct {
+	lock    sync.Mutex
+	entries map[string]*Entry
+	gets    int
+}
+
+func newCountingStore(links map[string]string) *countingStore {
+	s := &countingStore{entries: make(map[string]*Entry)}
+	for name, link := range links {
+		s.entries[name] = &Entry{Link: link}
+	}
+	return s
+}
+
+func (s *countingStore) Get(ctx context.Context, name string) (*Entry, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.gets++
+	if e, ok := s.entries[name]; ok {
+		return e, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (s *countingStore) Set(ctx context.Context, name string, e *Entry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if e == nil {
+		delete(s.entries, name)
+	} else {
+		s.entries[name] = e
+	}
+	return nil
+}
+
+func (s *countingStore) Iterate(ctx context.Context, cb func(string, *Entry) error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for name, e := range s.entries {
+		if err := cb(name, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *countingStore) Close() error {
+	return nil
+}
+
+// count returns how many times s has been asked for a mapping.
+func (s *countingStore) count() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.gets
+}
+
+// checkGet fails t unless looking up name in s returns link, or ErrNotFound if link is empty.
+func checkGet(t *testing.T, s Store, name, link string) {
+	t.Helper()
+	e, err := s.Get(context.Background(), name)
+	if link == "" {
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Get(%q) = %v, %v, want %v", name, e, err, ErrNotFound)
+		}
+		return
+	}
+	if err != nil || e.Link != link {
+		t.Fatalf("Get(%q) = %v, %v, want %q", name, e, err, link)
+	}
+}
+
+func TestCache(t *testing.T) {
+	store := newCountingStore(map[string]string{"a": "https://a.example", "b": "https://b.example"})
+	c := Cached(store, 1, 1, 0)
+
+	checkGet(t, c, "a", "https://a.example")
+	checkGet(t, c, "a", "https://a.example")
+	if n := store.count(); n != 1 {
+		t.Fatalf("%d lookups of a cached name, want 1", n)
+	}
+
+	// Sets through the cache invalidate the name...
+	if err := c.Set(context.Background(), "a", &Entry{Link: "https://a.example/new"}); err != nil {
+		t.Fatal(err)
+	}
+	checkGet(t, c, "a", "https://a.example/new")
+	if n := store.count(); n != 2 {
+		t.Fatalf("%d lookups after a Set, want 2", n)
+	}
+
+	// ... and only size names are kept, least recently used first out.
+	checkGet(t, c, "b", "https://b.example")
+	checkGet(t, c, "a", "https://a.example/new")
+	if n := store.count(); n != 4 {
+		t.Fatalf("%d lookups after evicting a, want 4", n)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	store := newCountingStore(map[string]string{"a": "https://a.example"})
+	c := Cached(store, 10, 10, 20*time.Millisecond)
+
+	checkGet(t, c, "a", "https://a.example")
+	// Changes made to the store by anything else are only seen once the entry expires.
+	if err := store.Set(context.Background(), "a", &Entry{Link: "https://a.example/new"}); err != nil {
+		t.Fatal(err)
+	}
+	checkGet(t, c, "a", "https://a.example")
+	time.Sleep(30 * time.Millisecond)
+	checkGet(t, c, "a", "https://a.example/new")
+}
+
+func TestCacheMisses(t *testing.T) {
+	store := newCountingStore(map[string]string{"a": "https://a.example"})
+	c := Cached(store, 1, 1, 0)
+
+	checkGet(t, c, "a", "https://a.example")
+	checkGet(t, c, "x", "")
+	checkGet(t, c, "x", "")
+	if n := store.count(); n != 2 {
+		t.Fatalf("%d lookups of a missing name, want 2", n)
+	}
+	// Misses are kept separately, so they don't evict hits.
+	checkGet(t, c, "y", "")
+	checkGet(t, c, "a", "https://a.example")
+	if n := store.count(); n != 3 {
+		t.Fatalf("%d lookups after another miss, want 3", n)
+	}
+
+	// Creating a name which was missing invalidates the miss.
+	if err := c.Set(context.Background(), "y", &Entry{Link: "https://y.example"}); err != nil {
+		t.Fatal(err)
+	}
+	checkGet(t, c, "y", "https://y.example")
+	// Deleting a name invalidates it, so that it's found to be missing.
+	if err := c.Set(context.Background(), "y", nil); err != nil {
+		t.Fatal(err)
+	}
+	checkGet(t, c, "y", "")
+}
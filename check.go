@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// check implements the -check mode, which scans the file backing a FileStore
+// for problems and prints a report of them to out, returning the number of
+// problems found. Lines which can't be parsed (or decrypted with c) are
+// malformed, records which don't change the mapping they Set are duplicates,
+// records for names which are later deleted are unreachable and links which
+// aren't valid absolute URLs are invalid. If repair isn't empty a copy of the
+// store without any of the problems is written to it.
+func check(filename string, c *Cipher, repair string, out io.Writer) (int, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	// fixed holds what's left of the store after dropping the problems, and is
+	// dumped to repair once the whole file has been read.
+	fixed := &FileStore{cipher: c, cache: newShards(), history: make(map[string][]*Entry), live: make(map[string]struct{})}
+	current := make(map[string]*Entry)
+	// lines holds the numbers of the lines which Set each name, so records can
+	// be reported as unreachable if the name has been deleted by the end.
+	lines := make(map[string][]int)
+	var malformed, duplicate, unreachable, invalid int
+
+	br := bufio.NewReader(f)
+	n := 0
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if line == "" {
+			break
+		}
+		n++
+		line = strings.TrimSuffix(line, "\n")
+
+		recs, err := checkLine(line, c)
+		if err != nil {
+			malformed++
+			fmt.Fprintf(out, "%s:%d: malformed line (%v): %s\n", filename, n, err, line)
+			continue
+		}
+
+		for _, rec := range recs {
+			prev, ok := current[rec.Name]
+			switch {
+			case rec.Entry == nil && !ok, rec.Entry != nil && ok && prev.Link == rec.Link:
+				duplicate++
+				fmt.Fprintf(out, "%s:%d: duplicate record for %s\n", filename, n, rec.Name)
+				continue
+			case rec.Entry != nil && !isValidLink(rec.Link):
+				invalid++
+				fmt.Fprintf(out, "%s:%d: invalid link for %s: %s\n", filename, n, rec.Name, rec.Link)
+				continue
+			}
+
+			if rec.Entry == nil {
+				delete(current, rec.Name)
+			} else {
+				current[rec.Name] = rec.Entry
+			}
+			lines[rec.Name] = append(lines[rec.Name], n)
+			fixed.order = append(fixed.order, rec.Name)
+			fixed.set(rec.Name, rec.Entry)
+		}
+	}
+
+	var deleted []string
+	for name := range lines {
+		if _, ok := current[name]; !ok {
+			deleted = append(deleted, name)
+		}
+	}
+	sort.Strings(deleted)
+	for _, name := range deleted {
+		for _, l := range lines[name] {
+			unreachable++
+			fmt.Fprintf(out, "%s:%d: unreachable record for deleted %s\n", filename, l, name)
+		}
+	}
+
+	problems := malformed + duplicate + unreachable + invalid
+	fmt.Fprintf(out, "checked %d lines of %s: %d malformed, %d duplicate, %d unreachable, %d invalid links\n",
+		n, filename, malformed, duplicate, unreachable, invalid)
+
+	if repair != "" {
+		if _, err := fixed.dump(repair); err != nil {
+			return problems, err
+		}
+		fmt.Fprintf(out, "wrote %d links to %s\n", len(current), repair)
+	}
+	return problems, nil
+}
+
+// checkLine parses a single line of a store file, decrypting it with c if it
+// is encrypted.
+func checkLine(line string, c *Cipher) ([]record, error) {
+	if strings.HasPrefix(line, encryptedPrefix) {
+		if c == nil {
+			return nil, fmt.Errorf("encrypted but no store key was provided")
+		}
+		plaintext, err := c.open(line)
+		if err != nil {
+			return nil, err
+		}
+		line = plaintext
+	}
+	recs, _, err := parseLine(line)
+	return recs, err
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+)
+
+// clientArgs holds the names of the arguments each of the client subcommands takes.
+var clientArgs = map[string][]string{
+	"add":    {"NAME", "URL"},
+	"rm":     {"NAME"},
+	"ls":     {},
+	"search": {"Q"},
+}
+
+// client implements the 'add', 'rm', 'ls' and 'search' subcommands, which manage links on a
+// running server through the API (authenticating with an API token) or, with -file or -store,
+// directly in a store. Note that a server using the same store won't see changes made directly
+// to it unless the store is shared (eg. a database) or watched for changes.
+func client(cmd string, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	server := fs.String("server", os.Getenv("GOLINKS_SERVER"), "URL of the server to manage links on (defaults to $GOLINKS_SERVER)")
+	token := fs.String("token", os.Getenv("GOLINKS_TOKEN"), "API token to authenticate with the server (defaults to $GOLINKS_TOKEN)")
+	file := fs.String("file", "", "file store to manage links in directly instead of on a server")
+	dsn := fs.String("store", "", "store to manage links in directly instead of on a server")
+	fuzzy := fs.Bool("fuzzy", false, "whether to use fuzzy name semantics with -file or -store")
+	limit := fs.Int("limit", 20, "maximum number of results to search for")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: golinks %s [flags] %s\n", cmd, strings.Join(clientArgs[cmd], " "))
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if *dsn == "" && *file != "" {
+		*dsn = "file:" + *file
+	}
+	if fs.NArg() != len(clientArgs[cmd]) || (*dsn == "" && *server == "") {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	var store StoreCloser
+	if *dsn != "" {
+		var err error
+		if store, err = OpenStore(*dsn, *fuzzy, false); err != nil {
+			return err
+		}
+	} else {
+		store = &remoteStore{server: strings.TrimSuffix(*server, "/"), token: *token, client: &http.Client{Timeout: 30 * time.Second}}
+	}
+
+	err := runClient(context.Background(), store, cmd, fs.Args(), *fuzzy, *limit, out)
+	if cerr := store.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// runClient runs the client subcommand cmd against store.
+func runClient(ctx context.Context, store Store, cmd string, args []string, fuzzy bool, limit int, out io.Writer) error {
+	switch cmd {
+	case "add":
+		name := normalizeName(args[0])
+		if !isValidName(name) {
+			return fmt.Errorf("invalid name %q", name)
+		}
+		link, err := normalizeLink(args[1])
+		if err != nil {
+			return err
+		}
+		existing, err := store.Get(ctx, name)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+		now := time.Now()
+		e := &Entry{Link: link, Created: now, Updated: now, CreatedBy: clientIdentity()}
+		if err == nil {
+			e.Created, e.CreatedBy, e.Owner = existing.Created, existing.CreatedBy, existing.Owner
+		}
+		if err := store.Set(ctx, name, e); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s %s\n", name, link)
+	case "rm":
+		name := normalizeName(args[0])
+		if _, err := store.Get(ctx, name); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		return store.Set(ctx, name, nil)
+	case "ls":
+		return store.Iterate(ctx, func(name string, e *Entry) error {
+			_, err := fmt.Fprintf(out, "%s %s\n", name, e.Link)
+			return err
+		})
+	case "search":
+		var results []searchResult
+		var err error
+		if s, ok := store.(*remoteStore); ok {
+			results, err = s.search(ctx, args[0], limit)
+		} else {
+			results, err = search(ctx, store, args[0], fuzzy, limit)
+		}
+		if err != nil {
+			return err
+		}
+		for _, r := range results {
+			fmt.Fprintf(out, "%s %s\n", r.Name, r.Link)
+		}
+	}
+	return nil
+}
+
+// clientIdentity returns who is responsible for links added with the client, for the CreatedBy of
+// links added directly to a store.
+func clientIdentity() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return "cli"
+}
+
+// remoteStore is a StoreCloser backed by the JSON API of a server. Entries are Set through the API,
+// so the server decides their metadata. Links which already exist can only be Set after they've
+// been fetched with Get, as the server requires the ETag of the version being changed (see
+// checkMatch), which is recorded in etags.
+type remoteStore struct {
+	server string
+	token  string
+	client *http.Client
+	etags  map[string]string
+}
+
+func (s *remoteStore) Get(ctx context.Context, name string) (*Entry, error) {
+	var l apiLink
+	h, err := s.do(ctx, "GET", apiPath+"/"+url.PathEscape(name), nil, nil, &l)
+	if err != nil {
+		return nil, err
+	}
+	if s.etags == nil {
+		s.etags = make(map[string]string)
+	}
+	s.etags[name] = h.Get("ETag")
+	return &l.Entry, nil
+}
+
+func (s *remoteStore) Set(ctx context.Context, name string, e *Entry) error {
+	path := apiPath + "/" + url.PathEscape(name)
+	h := http.Header{}
+	if etag := s.etags[name]; etag != "" {
+		h.Set("If-Match", etag)
+	}
+	var err error
+	if e == nil {
+		_, err = s.do(ctx, "DELETE", path, h, nil, nil)
+	} else {
+		_, err = s.do(ctx, "PUT", path, h, map[string]string{"link": e.Link}, nil)
+	}
+	delete(s.etags, name)
+	return err
+}
+
+func (s *remoteStore) Iterate(ctx context.Context, cb func(name string, e *Entry) error) error {
+	next := fmt.Sprintf("%s?limit=%d", apiPath, maxPage)
+	for next != "" {
+		var page struct {
+			Links []apiLink `json:"links"`
+			Next  string    `json:"next"`
+		}
+		if _, err := s.do(ctx, "GET", next, nil, nil, &page); err != nil {
+			return err
+		}
+		for i := range page.Links {
+			if err := cb(page.Links[i].Name, &page.Links[i].Entry); err != nil {
+				return err
+			}
+		}
+		next = page.Next
+	}
+	return nil
+}
+
+func (s *remoteStore) Close() error {
+	return nil
+}
+
+// search returns the server's results for searching for q.
+func (s *remoteStore) search(ctx context.Context, q string, limit int) ([]searchResult, error) {
+	var res struct {
+		Results []searchResult `json:"results"`
+	}
+	path := fmt.Sprintf("%s?q=%s&limit=%d", searchPath, url.QueryEscape(q), limit)
+	if _, err := s.do(ctx, "GET", path, nil, nil, &res); err != nil {
+		return nil, err
+	}
+	return res.Results, nil
+}
+
+// do makes a request to the API at path with the headers in h and body encoded as JSON (if it
+// isn't nil), decoding the response into out (if it isn't nil) and returning its headers. A 404
+// response results in ErrNotFound.
+func (s *remoteStore) do(ctx context.Context, method, path string, h http.Header, body, out interface{}) (http.Header, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.server+path, r)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 404 {
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error == "" {
+			e.Error = resp.Status
+		}
+		return nil, fmt.Errorf("%s %s: %s", method, path, e.Error)
+	}
+	if out == nil {
+		return resp.Header, nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return nil, fmt.Errorf("invalid response from server: %w", err)
+	}
+	return resp.Header, nil
+}
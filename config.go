@@ -0,0 +1,110 @@
+package main
+
+import "context"
+
+// config is what serve serves (the store along with everything kept alongside it) and how, as set
+// by the flags. Each request's context carries the config it's served with (see configContext),
+// so that handlers can be tested with different configurations without changing any globals.
+type config struct {
+	auth     *Auth
+	store    Store
+	tokens   *Tokens
+	hits     *Hits
+	stats    *Stats
+	events   *Events
+	patterns *Patterns
+	stars    *Stars
+	fuzzy    bool
+
+	// redirectCode and redirectCacheControl are the status code and Cache-Control header (if any)
+	// links are redirected with. By default browsers aren't allowed to cache redirects, so that
+	// changes to a link take effect immediately.
+	redirectCode         int
+	redirectCacheControl string
+	// linkLimiter limits how often each link can be followed, by the name of the mapping it
+	// resolves to, if it isn't nil, so that a link which is suddenly popular can't use up everyone
+	// else's requests. Only following links counts, not the other pages.
+	linkLimiter *RateLimiter
+	// fallbackURL is where names which don't exist are redirected to (with %s replaced by the
+	// name, as in a link), unless they're being created, so that unknown names can be searched for.
+	fallbackURL string
+	// upstream is the parent golinks server names which don't exist here are looked up with, if
+	// any, so that eg. a team's server can layer its own links on top of the company-wide ones.
+	upstream *Upstream
+	// redirectParams are query parameters (eg. utm_source=golinks) appended to every link when
+	// redirecting, unless the link (or its mapping's Params) already has them, so that
+	// destinations can attribute traffic which came through a link.
+	redirectParams map[string]string
+	// stripPunctuation is whether names are also looked up without any trailing punctuation which
+	// may have been copied along with them, as well as trailing slashes and dots (see trimName).
+	stripPunctuation bool
+	// trustedDomains are the domains (including their subdomains) links can redirect to directly.
+	// If there are any, links to other domains are sent to an interstitial page first, so that
+	// people know where they're going before they get there.
+	trustedDomains []string
+	// subdomainHost is the host (eg. go.corp.example) whose subdomains are names, if any, so that
+	// name.go.corp.example resolves the same as go.corp.example/name for tools which only accept
+	// hostnames (with a wildcard DNS record for the subdomains).
+	subdomainHost string
+	// regionHeader is the header a proxy in front of the server sets to the region each request
+	// comes from (eg. X-Region, or CF-IPCountry for a country from a GeoIP lookup), if there is
+	// one. Links with per-region destinations redirect requests from those regions to them (see
+	// Entry.ChooseFor).
+	regionHeader string
+
+	// topLinks is how many of the most followed links are shown at the top of the index.
+	topLinks int
+	// indexSort is the order the index is in unless users choose another (see indexOrder): "set"
+	// for the most recently Set mappings first, or "used" for the most recently followed first.
+	indexSort string
+	// recordSources is whether where links are followed from is recorded (see Stats.Source), which
+	// is off by default for privacy. Only the host of the referrer and the kind of browser and
+	// device are recorded, never anything identifying who followed the link, and links can opt out
+	// (see Entry.Untracked).
+	recordSources bool
+	// linkChecker checks the links periodically, if it's enabled, so that broken ones are flagged.
+	linkChecker *LinkChecker
+	// auditLog records every change to the links, if it's enabled.
+	auditLog *Audit
+
+	// identityHeader is the header an authenticating proxy in front of the server sets to who is
+	// making each request (eg. X-Forwarded-Email), if there is one (see identity).
+	identityHeader string
+	// restrictEdits is whether only the owner of a mapping (or one of the admins) may change it,
+	// and admins are the identities (see identity) who may change any mapping, along with any users
+	// who are admins (see User).
+	restrictEdits bool
+	admins        []string
+	// blockPrivate is whether links to private addresses (see isPrivate) are rejected, for
+	// instances where anyone can create links and they shouldn't be able to point people (or
+	// anything which follows links server-side) at internal services or cloud metadata endpoints.
+	blockPrivate bool
+}
+
+// defaultConfig returns the config with the defaults of the flags, which is used where a context
+// doesn't carry one.
+func defaultConfig() *config {
+	return &config{
+		redirectCode:         302,
+		redirectCacheControl: "no-store",
+		topLinks:             10,
+		indexSort:            "set",
+	}
+}
+
+// configKey is the context key of the config a request is served with (see configContext).
+type configKey struct{}
+
+// configContext returns ctx along with the config c a request is served with.
+func configContext(ctx context.Context, c *config) context.Context {
+	return context.WithValue(ctx, configKey{}, c)
+}
+
+// configOf returns the config a request with ctx is served with (see configContext), or the
+// defaults if there isn't one.
+func configOf(ctx context.Context) *config {
+	if c, ok := ctx.Value(configKey{}).(*config); ok {
+		return c
+	}
+	return defaultConfig()
+}
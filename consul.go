@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func init() {
+	// consul://[agent]/prefix
+	RegisterStore("consul", func(dsn string, fuzzy, compact bool) (StoreCloser, error) {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return nil, err
+		}
+		prefix := strings.TrimPrefix(u.Path, "/")
+		if prefix == "" {
+			prefix = "golinks/"
+		}
+		return OpenConsul(u.Host, prefix, fuzzy)
+	})
+}
+
+// ConsulStore provides an implementation of the Store interface backed by the
+// Consul KV store. Each mapping is stored as a key under prefix holding the
+// encoded Entry, and the modify
+// index Consul assigns to the key provides the last Set ordering required by
+// Iterate. Reads are served from an in-memory copy of the keys which is kept
+// fresh with a blocking query on the prefix, so changes made through other
+// instances (or directly in Consul) are picked up as soon as they happen.
+// Access to order, cache and fuzzed must be guarded by lock.
+type ConsulStore struct {
+	fuzzy  bool
+	prefix string
+	kv     *api.KV
+	cancel context.CancelFunc
+
+	lock   sync.RWMutex
+	order  []string
+	cache  map[string]*Entry
+	fuzzed map[string]*Entry
+}
+
+// OpenConsul returns a ConsulStore for the keys under prefix using the Consul
+// agent at addr, or the agent configured through the standard CONSUL_HTTP_*
+// environment variables if addr is empty (and an optional bool to enable fuzzy
+// lookups). The current mappings are loaded and any subsequent changes are
+// watched for. The ConsulStore returned should be closed with Close once it is
+// no longer in use.
+func OpenConsul(addr, prefix string, fuzzy ...bool) (*ConsulStore, error) {
+	config := api.DefaultConfig()
+	if addr != "" {
+		config.Address = addr
+	}
+	client, err := api.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &ConsulStore{fuzzy: len(fuzzy) > 0 && fuzzy[0], prefix: prefix, kv: client.KV(), cancel: cancel}
+
+	index, err := s.refresh(ctx, 0)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	go s.watch(ctx, index)
+
+	return s, nil
+}
+
+// refresh replaces the in-memory mappings with the keys under the prefix,
+// blocking until they have changed since index (if index is non-zero). The
+// index of the mappings loaded is returned for use in the next refresh.
+func (s *ConsulStore) refresh(ctx context.Context, index uint64) (uint64, error) {
+	q := &api.QueryOptions{WaitIndex: index, WaitTime: 5 * time.Minute, RequireConsistent: index == 0}
+	pairs, meta, err := s.kv.List(s.prefix, q.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].ModifyIndex > pairs[j].ModifyIndex })
+	order := make([]string, 0, len(pairs))
+	cache := make(map[string]*Entry)
+	fuzzed := make(map[string]*Entry)
+	for _, p := range pairs {
+		name, e := strings.TrimPrefix(p.Key, s.prefix), decodeEntry(string(p.Value))
+		order = append(order, name)
+		cache[name] = e
+		// Pairs are newest first, so the most recently Set name wins.
+		if _, ok := fuzzed[fuzz(name)]; s.fuzzy && !ok {
+			fuzzed[fuzz(name)] = e
+		}
+	}
+
+	s.lock.Lock()
+	s.order, s.cache, s.fuzzed = order, cache, fuzzed
+	s.lock.Unlock()
+
+	// Consul's index can go backwards (eg. after a snapshot restore), in which
+	// case the next blocking query must start again from scratch.
+	if meta.LastIndex < index {
+		return 0, nil
+	}
+	return meta.LastIndex, nil
+}
+
+// watch keeps the in-memory mappings fresh until ctx is cancelled.
+func (s *ConsulStore) watch(ctx context.Context, index uint64) {
+	for ctx.Err() == nil {
+		i, err := s.refresh(ctx, index)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("consul refresh failed: %v\n", err)
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+		index = i
+	}
+}
+
+// Close stops watching for changes to the ConsulStore returned by OpenConsul.
+func (s *ConsulStore) Close() error {
+	s.cancel()
+	return nil
+}
+
+func (s *ConsulStore) Get(ctx context.Context, name string) (*Entry, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	e, ok := s.cache[name]
+	if !ok && s.fuzzy {
+		e, ok = s.fuzzed[fuzz(name)]
+	}
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return e, nil
+}
+
+func (s *ConsulStore) Set(ctx context.Context, name string, e *Entry) error {
+	opts := (&api.WriteOptions{}).WithContext(ctx)
+
+	var err error
+	if e == nil {
+		_, err = s.kv.Delete(s.prefix+name, opts)
+	} else {
+		_, err = s.kv.Put(&api.KVPair{Key: s.prefix + name, Value: []byte(encodeEntry(e))}, opts)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Refresh immediately rather than waiting on the watch so that callers
+	// always read their own writes.
+	_, err = s.refresh(ctx, 0)
+	return err
+}
+
+func (s *ConsulStore) Iterate(ctx context.Context, cb func(name string, e *Entry) error) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, name := range s.order {
+		if err := cb(name, s.cache[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
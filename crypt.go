@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// encryptedPrefix marks a line of a store file which has been encrypted.
+const encryptedPrefix = "!"
+
+// Cipher encrypts the lines of the file backing a FileStore with AES-GCM so
+// that links can't be read from the file on disk. Each line is encrypted
+// separately with its own random nonce, so the file can remain append only.
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// NewCipher returns a Cipher using key, which must be the base64 encoding of a
+// 16, 24 or 32 byte AES key (eg. the output of 'openssl rand -base64 32').
+func NewCipher(key string) (*Cipher, error) {
+	k, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid store key: %v", err)
+	}
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, fmt.Errorf("invalid store key: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{aead: aead}, nil
+}
+
+// seal encrypts line (which must not include its newline).
+func (c *Cipher) seal(line string) string {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		// crypto/rand failing means the system is in no state to be serving.
+		panic(err)
+	}
+	sealed := c.aead.Seal(nonce, nonce, []byte(line), nil)
+	return encryptedPrefix + base64.RawStdEncoding.EncodeToString(sealed)
+}
+
+// open is the inverse of seal.
+func (c *Cipher) open(line string) (string, error) {
+	sealed, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(line, encryptedPrefix))
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < c.aead.NonceSize() {
+		return "", errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
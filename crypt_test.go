@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newKey returns a random base64 encoded AES-256 key.
+func newKey(t *testing.T) string {
+	t.Helper()
+	k := make([]byte, 32)
+	if _, err := rand.Read(k); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(k)
+}
+
+// newCipher returns a Cipher with a random key.
+func newCipher(t *testing.T) *Cipher {
+	t.Helper()
+	c, err := NewCipher(newKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestNewCipher(t *testing.T) {
+	for _, key := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := NewCipher(key); err == nil {
+			t.Errorf("NewCipher(%q) succeeded", key)
+		}
+	}
+}
+
+func TestCipher(t *testing.T) {
+	c := newCipher(t)
+	line := `{"name":"a","link":"https://a.example"}`
+	sealed := c.seal(line)
+	if !strings.HasPrefix(sealed, encryptedPrefix) || strings.Contains(sealed, "a.example") {
+		t.Fatalf("seal(%q) = %q", line, sealed)
+	}
+	if other := c.seal(line); other == sealed {
+		t.Error("seal reused a nonce")
+	}
+	if got, err := c.open(sealed); err != nil || got != line {
+		t.Fatalf("open(seal(%q)) = %q, %v", line, got, err)
+	}
+
+	if _, err := newCipher(t).open(sealed); err == nil {
+		t.Error("open succeeded with the wrong key")
+	}
+	tampered := sealed[:len(sealed)-2] + "AA"
+	if tampered == sealed {
+		tampered = sealed[:len(sealed)-2] + "BB"
+	}
+	if _, err := c.open(tampered); err == nil {
+		t.Error("open succeeded with a tampered line")
+	}
+}
+
+func TestOpenEncrypted(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "links")
+	s, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("a", &Entry{Link: "https://a.example"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c := newCipher(t)
+
+	// Opening a plaintext file with a Cipher encrypts it.
+	s, err = OpenEncrypted(filename, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("b", &Entry{Link: "https://b.example"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "example") {
+		t.Fatalf("file isn't encrypted: %q", b)
+	}
+
+	s, err = OpenEncrypted(filename, c)
+	if err != nil {
+		t.Fatalf("OpenEncrypted with the key: %v", err)
+	}
+	checkLink(t, s, "a", "https://a.example")
+	checkLink(t, s, "b", "https://b.example")
+	s.Close()
+
+	if _, err := OpenEncrypted(filename, newCipher(t)); err == nil {
+		t.Error("OpenEncrypted succeeded with the wrong key")
+	}
+	if _, err := Open(filename); err == nil {
+		t.Error("Open succeeded without a key")
+	}
+}
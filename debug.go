@@ -0,0 +1,23 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+)
+
+// debugHandler serves the net/http/pprof profiles under /debug/pprof/ (eg. the CPU profile at
+// /debug/pprof/profile?seconds=30 and the heap at /debug/pprof/heap) and the expvar variables at
+// /debug/vars (see publishVars). It has no authentication, so must only be served on a port which
+// can't be reached from elsewhere (see -debug-port), and no timeouts, as CPU profiles and execution
+// traces take as long as they're asked to.
+func debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+)
+
+// mobileAgent matches the User-Agents of phones and tablets.
+var mobileAgent = regexp.MustCompile(`(?i)mobile|android|iphone|ipad|ipod|blackberry|opera mini|iemobile`)
+
+// normalizeMobile canonicalizes and normalizes the link for phones and tablets (as with
+// normalizeDestinations), which may be empty.
+func normalizeMobile(ctx context.Context, store Store, host, link string) (string, error) {
+	if link == "" {
+		return "", nil
+	}
+	link, err := normalizeLink(canonicalizeAlias(ctx, store, host, link))
+	if err != nil {
+		return "", fmt.Errorf("invalid mobile link: %w", err)
+	}
+	return link, nil
+}
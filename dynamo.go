@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func init() {
+	// dynamo://table
+	RegisterStore("dynamo", func(dsn string, fuzzy, compact bool) (StoreCloser, error) {
+		table := strings.TrimPrefix(dsn, "dynamo://")
+		if table == "" {
+			return nil, fmt.Errorf("missing table in store %q", dsn)
+		}
+		return OpenDynamo(table, fuzzy)
+	})
+}
+
+// dynamoCounter is the name of the item holding the sequence counter. Names
+// containing control characters are never valid, so it can't collide with a
+// real mapping.
+const dynamoCounter = "\x00seq"
+
+// errDynamoConflict is returned when a mapping isn't Set because another
+// instance has concurrently Set a newer one for the same name.
+var errDynamoConflict = errors.New("a newer link was set concurrently")
+
+// DynamoStore provides an implementation of the Store interface backed by a
+// DynamoDB table. Each name is an item holding its link, the encoded Entry and the sequence
+// number (allocated from an atomic counter item) of when it was last Set,
+// which Iterate uses to provide the same ordering as FileStore. Writes are
+// conditional on the stored sequence number being older than the one being
+// written, so concurrent instances can never clobber a newer mapping with a
+// stale one. For the same reason deletes are recorded as tombstones with an
+// empty link rather than removing the item. If initialized with fuzzy, lookups
+// fall back to the fuzzy index of the table.
+type DynamoStore struct {
+	fuzzy bool
+	table string
+	db    *dynamodb.DynamoDB
+}
+
+// OpenDynamo returns a DynamoStore backed by the DynamoDB table, creating it
+// if it doesn't already exist (and an optional bool to enable fuzzy lookups).
+// Credentials and region are configured through the standard AWS environment
+// variables and shared config files.
+func OpenDynamo(table string, fuzzy ...bool) (*DynamoStore, error) {
+	sess, err := session.NewSessionWithOptions(session.Options{SharedConfigState: session.SharedConfigEnable})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &DynamoStore{fuzzy: len(fuzzy) > 0 && fuzzy[0], table: table, db: dynamodb.New(sess)}
+	if err := s.init(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *DynamoStore) init() error {
+	describe := &dynamodb.DescribeTableInput{TableName: aws.String(s.table)}
+	_, err := s.db.DescribeTable(describe)
+	if !isDynamoError(err, dynamodb.ErrCodeResourceNotFoundException) {
+		return err
+	}
+
+	_, err = s.db.CreateTable(&dynamodb.CreateTableInput{
+		TableName:   aws.String(s.table),
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("name"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+			{AttributeName: aws.String("fuzzy"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+			{AttributeName: aws.String("seq"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeN)},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("name"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+		},
+		GlobalSecondaryIndexes: []*dynamodb.GlobalSecondaryIndex{{
+			IndexName: aws.String("fuzzy"),
+			KeySchema: []*dynamodb.KeySchemaElement{
+				{AttributeName: aws.String("fuzzy"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+				{AttributeName: aws.String("seq"), KeyType: aws.String(dynamodb.KeyTypeRange)},
+			},
+			Projection: &dynamodb.Projection{ProjectionType: aws.String(dynamodb.ProjectionTypeAll)},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	return s.db.WaitUntilTableExists(describe)
+}
+
+// Close is a no-op provided for symmetry with the other stores.
+func (s *DynamoStore) Close() error {
+	return nil
+}
+
+func (s *DynamoStore) Get(ctx context.Context, name string) (*Entry, error) {
+	out, err := s.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            dynamoKey(name),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	item := out.Item
+
+	if item == nil && s.fuzzy {
+		// Tombstones are filtered out, which happens after each page is
+		// read, so a page can be empty even though a later one holds the
+		// most recently Set live mapping.
+		in := &dynamodb.QueryInput{
+			TableName:              aws.String(s.table),
+			IndexName:              aws.String("fuzzy"),
+			KeyConditionExpression: aws.String("#fuzzy = :f"),
+			FilterExpression:       aws.String("#link <> :empty"),
+			ExpressionAttributeNames: map[string]*string{
+				"#fuzzy": aws.String("fuzzy"),
+				"#link":  aws.String("link"),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":f":     {S: aws.String(fuzz(name))},
+				":empty": {S: aws.String("")},
+			},
+			ScanIndexForward: aws.Bool(false),
+		}
+		for item == nil {
+			out, err := s.db.QueryWithContext(ctx, in)
+			if err != nil {
+				return nil, err
+			}
+			if len(out.Items) > 0 {
+				item = out.Items[0]
+			}
+			if len(out.LastEvaluatedKey) == 0 {
+				break
+			}
+			in.ExclusiveStartKey = out.LastEvaluatedKey
+		}
+	}
+
+	e := dynamoEntry(item)
+	if e == nil {
+		return nil, ErrNotFound
+	}
+	return e, nil
+}
+
+func (s *DynamoStore) Set(ctx context.Context, name string, e *Entry) error {
+	out, err := s.db.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(s.table),
+		Key:                       dynamoKey(dynamoCounter),
+		UpdateExpression:          aws.String("ADD #seq :one"),
+		ExpressionAttributeNames:  map[string]*string{"#seq": aws.String("seq")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":one": {N: aws.String("1")}},
+		ReturnValues:              aws.String(dynamodb.ReturnValueUpdatedNew),
+	})
+	if err != nil {
+		return err
+	}
+	seq := out.Attributes["seq"]
+
+	item := map[string]*dynamodb.AttributeValue{
+		"name":  {S: aws.String(name)},
+		"fuzzy": {S: aws.String(fuzz(name))},
+		"link":  {S: aws.String("")},
+		"seq":   seq,
+	}
+	if e != nil {
+		item["link"] = &dynamodb.AttributeValue{S: aws.String(e.Link)}
+		item["entry"] = &dynamodb.AttributeValue{S: aws.String(encodeEntry(e))}
+	}
+
+	_, err = s.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName:                 aws.String(s.table),
+		Item:                      item,
+		ConditionExpression:       aws.String("attribute_not_exists(#seq) OR #seq < :seq"),
+		ExpressionAttributeNames:  map[string]*string{"#seq": aws.String("seq")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":seq": seq},
+	})
+	// If the condition failed another instance has already Set a newer link
+	// for name, which takes precedence over ours.
+	if isDynamoError(err, dynamodb.ErrCodeConditionalCheckFailedException) {
+		return errDynamoConflict
+	}
+	return err
+}
+
+func (s *DynamoStore) Iterate(ctx context.Context, cb func(name string, e *Entry) error) error {
+	type item struct {
+		name  string
+		entry *Entry
+		seq   int64
+	}
+
+	var items []item
+	err := s.db.ScanPagesWithContext(ctx, &dynamodb.ScanInput{
+		TableName:      aws.String(s.table),
+		ConsistentRead: aws.Bool(true),
+	}, func(page *dynamodb.ScanOutput, last bool) bool {
+		for _, i := range page.Items {
+			name, e := dynamoString(i, "name"), dynamoEntry(i)
+			if name == dynamoCounter || e == nil {
+				continue
+			}
+			seq, _ := strconv.ParseInt(aws.StringValue(i["seq"].N), 10, 64)
+			items = append(items, item{name, e, seq})
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(items, func(i, j int) bool { return items[i].seq > items[j].seq })
+	for _, i := range items {
+		if err := cb(i.name, i.entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dynamoKey(name string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{"name": {S: aws.String(name)}}
+}
+
+func dynamoString(item map[string]*dynamodb.AttributeValue, attr string) string {
+	v, ok := item[attr]
+	if !ok {
+		return ""
+	}
+	return aws.StringValue(v.S)
+}
+
+// dynamoEntry returns the Entry held by item, or nil if item is a tombstone.
+// Items written before entries existed only have a link.
+func dynamoEntry(item map[string]*dynamodb.AttributeValue) *Entry {
+	link := dynamoString(item, "link")
+	if link == "" {
+		return nil
+	}
+	return rowEntry(link, dynamoString(item, "entry"))
+}
+
+func isDynamoError(err error, code string) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == code
+}
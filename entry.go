@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Entry holds a link along with metadata about the mapping.
+type Entry struct {
+	Link      string    `json:"link"`
+	Created   time.Time `json:"created"`
+	Updated   time.Time `json:"updated"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	// Owner is who the link has been transferred to, if anyone (see OwnedBy).
+	Owner string `json:"owner,omitempty"`
+	// Expires is when the link stops resolving, if ever.
+	Expires *time.Time `json:"expires,omitempty"`
+	// Description is free text telling people what the link is for.
+	Description string `json:"description,omitempty"`
+	// Params are query parameters (eg. utm_source) appended to the link when redirecting, unless
+	// it already has them.
+	Params map[string]string `json:"params,omitempty"`
+	// Mobile is the link requests from phones and tablets redirect to instead, eg. a deep link into
+	// an app.
+	Mobile string `json:"mobile,omitempty"`
+	// Languages are the links requests which accept particular languages redirect to instead,
+	// keyed by BCP 47 language tag.
+	Languages map[string]string `json:"languages,omitempty"`
+	// Regions are the links requests from particular regions redirect to instead (see ChooseFor).
+	Regions map[string]string `json:"regions,omitempty"`
+	// Tags categorize the link, and are lower case without any spaces or commas.
+	Tags []string `json:"tags,omitempty"`
+	// Destinations are the links the entry redirects to in proportion to their weights, if it has
+	// more than one, in which case Link is the first of them.
+	Destinations []Destination `json:"destinations,omitempty"`
+	// Bundle is whether the entry is a bundle of links, eg. go/standup for the board, notes and call
+	// of a meeting, which renders a page listing all of them (see Links) rather than redirecting.
+	Bundle bool `json:"bundle,omitempty"`
+	// Untracked is whether where the link is followed from isn't recorded, even when that is for
+	// other links (see recordSources).
+	Untracked bool `json:"untracked,omitempty"`
+}
+
+// OwnedBy returns who owns the link: whoever it was transferred to, or otherwise its creator.
+func (e Entry) OwnedBy() string {
+	if e.Owner != "" {
+		return e.Owner
+	}
+	return e.CreatedBy
+}
+
+// HasTag returns whether the entry is tagged with tag.
+func (e Entry) HasTag(tag string) bool {
+	for _, t := range e.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Destination is one of several links an entry can redirect to, chosen in proportion to its weight.
+type Destination struct {
+	Link   string `json:"link"`
+	Weight int    `json:"weight"`
+}
+
+// Choose returns the link to redirect to, choosing one of the destinations at random in proportion
+// to their weights if there are several, so that eg. equal weights rotate between mirrors and
+// weights of 9 and 1 send a tenth of requests to a canary.
+func (e Entry) Choose() string {
+	total := 0
+	for _, d := range e.Destinations {
+		total += d.Weight
+	}
+	if total <= 0 {
+		return e.Link
+	}
+	n := rand.Intn(total)
+	for _, d := range e.Destinations {
+		if n -= d.Weight; n < 0 {
+			return d.Link
+		}
+	}
+	return e.Link
+}
+
+// ChooseFor returns the link to redirect a request from v to: the Mobile link for phones and
+// tablets if there is one, the link for the language v prefers most of those there are links for,
+// the link for v's region if there is one, or otherwise as with Choose.
+func (e Entry) ChooseFor(v visitor) string {
+	if v.Mobile && e.Mobile != "" {
+		return e.Mobile
+	}
+	if link, ok := chooseLanguage(e.Languages, v.Languages); ok {
+		return link
+	}
+	if link, ok := e.Regions[v.Region]; ok && v.Region != "" {
+		return link
+	}
+	return e.Choose()
+}
+
+// Links returns each of the entry's destinations, or its link if it only has the one.
+func (e Entry) Links() []string {
+	if len(e.Destinations) == 0 {
+		return []string{e.Link}
+	}
+	links := make([]string, len(e.Destinations))
+	for i, d := range e.Destinations {
+		links[i] = d.Link
+	}
+	return links
+}
+
+// LinkText returns the link as it's edited in the index: the link itself, or each of the
+// destinations prefixed by their weight (see parseDestinations).
+func (e Entry) LinkText() string {
+	if len(e.Destinations) == 0 {
+		return e.Link
+	}
+	dests := make([]string, len(e.Destinations))
+	for i, d := range e.Destinations {
+		dests[i] = fmt.Sprintf("%d:%s", d.Weight, d.Link)
+	}
+	return strings.Join(dests, " ")
+}
+
+// Expired returns whether the entry's link has stopped resolving because it has expired.
+func (e Entry) Expired() bool {
+	return e.Expires != nil && !time.Now().Before(*e.Expires)
+}
+
+// IsTemplate returns whether the entry's link is a template with placeholders which are filled in
+// from the path after the name or the query (see expandLink).
+func (e Entry) IsTemplate() bool {
+	return placeholder.MatchString(e.Link)
+}
+
+// ETag returns an entity tag identifying this version of the entry, which changes whenever it's
+// Set (see checkMatch).
+func (e Entry) ETag() string {
+	h := sha256.Sum256([]byte(encodeEntry(&e)))
+	return fmt.Sprintf(`"%x"`, h[:8])
+}
+
+// encodeEntry serializes e for stores which persist entries as opaque strings.
+func encodeEntry(e *Entry) string {
+	b, _ := json.Marshal(e)
+	return string(b)
+}
+
+// decodeEntry is the inverse of encodeEntry. Values which predate entries were
+// stored as the bare link, so anything which doesn't look like an encoded
+// entry is treated as a link without any metadata.
+func decodeEntry(s string) *Entry {
+	if strings.HasPrefix(s, "{") {
+		var e Entry
+		if err := json.Unmarshal([]byte(s), &e); err == nil {
+			return &e
+		}
+	}
+	return &Entry{Link: s}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func init() {
+	// etcd://host:port[,host:port...]
+	RegisterStore("etcd", func(dsn string, fuzzy, compact bool) (StoreCloser, error) {
+		return OpenEtcd(strings.Split(strings.TrimPrefix(dsn, "etcd://"), ","), fuzzy)
+	})
+}
+
+const etcdPrefix = "golinks/links/"
+
+type etcdEntry struct {
+	entry *Entry
+	rev   int64
+}
+
+// EtcdStore provides an implementation of the Store interface backed by etcd.
+// Each mapping is stored as a key under etcdPrefix holding the encoded Entry,
+// and the modification
+// revision etcd assigns to the key provides the last Set ordering required by
+// Iterate. Reads are served from cache, an in-memory copy of the keys which is
+// kept up to date by watching the prefix, so changes made by other replicas
+// are picked up without polling. Set waits for the watch to observe its own
+// write before returning so that callers always read their own writes. If
+// initialized with fuzzy, fuzzed maps the fuzzed form of each name to the last
+// name Set with it. Access to cache, fuzzed, rev and err must be guarded by
+// lock.
+type EtcdStore struct {
+	fuzzy  bool
+	client *clientv3.Client
+	cancel context.CancelFunc
+
+	lock   sync.RWMutex
+	cond   *sync.Cond
+	cache  map[string]etcdEntry
+	fuzzed map[string]string
+	rev    int64
+	err    error
+}
+
+// OpenEtcd connects to the etcd cluster at endpoints (and an optional bool to
+// enable fuzzy lookups), loading the current mappings and watching for any
+// subsequent changes. The EtcdStore returned should be closed with Close once
+// it is no longer in use.
+func OpenEtcd(endpoints []string, fuzzy ...bool) (*EtcdStore, error) {
+	client, err := clientv3.New(clientv3.Config{Endpoints: endpoints, DialTimeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &EtcdStore{fuzzy: len(fuzzy) > 0 && fuzzy[0], client: client, cancel: cancel}
+	s.cond = sync.NewCond(&s.lock)
+
+	rev, err := s.load(ctx)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	go s.watch(ctx, rev)
+
+	return s, nil
+}
+
+// load replaces the cache with the current contents of etcd, returning the
+// revision the contents correspond to.
+func (s *EtcdStore) load(ctx context.Context) (int64, error) {
+	resp, err := s.client.Get(ctx, etcdPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return 0, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.cache = make(map[string]etcdEntry)
+	s.fuzzed = make(map[string]string)
+	// Sort by revision so fuzzed ends up pointing at the most recently Set name.
+	sort.Slice(resp.Kvs, func(i, j int) bool { return resp.Kvs[i].ModRevision < resp.Kvs[j].ModRevision })
+	for _, kv := range resp.Kvs {
+		s.set(strings.TrimPrefix(string(kv.Key), etcdPrefix), decodeEntry(string(kv.Value)), kv.ModRevision)
+	}
+	s.advance(resp.Header.Revision, nil)
+
+	return resp.Header.Revision, nil
+}
+
+// watch applies changes to the cache as they happen until ctx is cancelled.
+// If the watch fails (eg. because the revision it was watching from has been
+// compacted) the cache is reloaded from scratch and the watch restarted.
+func (s *EtcdStore) watch(ctx context.Context, rev int64) {
+	for {
+		rev = s.follow(ctx, rev)
+
+		if ctx.Err() != nil {
+			s.lock.Lock()
+			s.advance(s.rev, ctx.Err())
+			s.lock.Unlock()
+			return
+		}
+
+		var err error
+		for rev, err = s.load(ctx); err != nil && ctx.Err() == nil; rev, err = s.load(ctx) {
+			log.Printf("etcd reload failed: %v\n", err)
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+// follow applies the changes after rev to the cache until the watch fails or
+// ctx is cancelled, returning the last revision applied.
+func (s *EtcdStore) follow(ctx context.Context, rev int64) int64 {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for resp := range s.client.Watch(ctx, etcdPrefix, clientv3.WithPrefix(), clientv3.WithRev(rev+1)) {
+		if err := resp.Err(); err != nil {
+			log.Printf("etcd watch failed: %v\n", err)
+			return rev
+		}
+
+		s.lock.Lock()
+		for _, ev := range resp.Events {
+			var e *Entry
+			if ev.Type != clientv3.EventTypeDelete {
+				e = decodeEntry(string(ev.Kv.Value))
+			}
+			s.set(strings.TrimPrefix(string(ev.Kv.Key), etcdPrefix), e, ev.Kv.ModRevision)
+		}
+		rev = resp.Header.Revision
+		s.advance(rev, nil)
+		s.lock.Unlock()
+	}
+	return rev
+}
+
+// advance records that the cache reflects revision rev (or that the watch has
+// stopped with err) and wakes any callers waiting in Set.
+func (s *EtcdStore) advance(rev int64, err error) {
+	if rev > s.rev {
+		s.rev = rev
+	}
+	s.err = err
+	s.cond.Broadcast()
+}
+
+// Close stops watching for changes and closes the EtcdStore returned by
+// OpenEtcd.
+func (s *EtcdStore) Close() error {
+	s.cancel()
+	return s.client.Close()
+}
+
+func (s *EtcdStore) Get(ctx context.Context, name string) (*Entry, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	e, ok := s.cache[name]
+	if !ok && s.fuzzy {
+		e, ok = s.cache[s.fuzzed[fuzz(name)]]
+	}
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return e.entry, nil
+}
+
+func (s *EtcdStore) Set(ctx context.Context, name string, e *Entry) error {
+	return s.SetAll(ctx, map[string]*Entry{name: e})
+}
+
+func (s *EtcdStore) SetAll(ctx context.Context, entries map[string]*Entry) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var ops []clientv3.Op
+	for _, name := range sortedNames(entries) {
+		if e := entries[name]; e == nil {
+			ops = append(ops, clientv3.OpDelete(etcdPrefix+name))
+		} else {
+			ops = append(ops, clientv3.OpPut(etcdPrefix+name, encodeEntry(e)))
+		}
+	}
+	resp, err := s.client.Txn(ctx).Then(ops...).Commit()
+	if err != nil {
+		return err
+	}
+	rev := resp.Header.Revision
+
+	// Waiting on cond can't be interrupted by ctx, so wake the waiters when
+	// it's done in case the watch never catches up.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.lock.Lock()
+			s.cond.Broadcast()
+			s.lock.Unlock()
+		case <-done:
+		}
+	}()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for s.rev < rev && s.err == nil && ctx.Err() == nil {
+		s.cond.Wait()
+	}
+	if s.err == nil && s.rev < rev {
+		return ctx.Err()
+	}
+	return s.err
+}
+
+func (s *EtcdStore) Iterate(ctx context.Context, cb func(name string, e *Entry) error) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	names := make([]string, 0, len(s.cache))
+	for name := range s.cache {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return s.cache[names[i]].rev > s.cache[names[j]].rev })
+
+	for _, name := range names {
+		if err := cb(name, s.cache[name].entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *EtcdStore) set(name string, e *Entry, rev int64) {
+	if e == nil {
+		delete(s.cache, name)
+	} else {
+		s.cache[name] = etcdEntry{entry: e, rev: rev}
+	}
+
+	if s.fuzzy {
+		fuzzed := fuzz(name)
+		if e == nil {
+			delete(s.fuzzed, fuzzed)
+		} else {
+			s.fuzzed[fuzzed] = name
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// eventsPath is the path Server-Sent Events are streamed from.
+	eventsPath = "/events"
+	// eventsStream is how long each stream of events lasts before the client has to reconnect
+	// (which EventSource does automatically). This must be less than the server's WriteTimeout.
+	eventsStream = 8 * time.Second
+	// eventsLog is the number of events retained so that clients which reconnect can be sent the
+	// events they missed.
+	eventsLog = 100
+)
+
+// event describes a link being created, updated or deleted, and is the JSON payload both sent to
+// webhooks and streamed by Events. ID is unique to each event (and the same for each attempt to
+// deliver it) so that receivers can ignore duplicates. Text summarizes the change so that the
+// payload can be sent straight to chat services such as Slack's incoming webhooks.
+type event struct {
+	ID       string    `json:"id"`
+	Event    string    `json:"event"`
+	Name     string    `json:"name"`
+	Entry    *Entry    `json:"entry"`
+	Previous *Entry    `json:"previous"`
+	Time     time.Time `json:"time"`
+	Text     string    `json:"text"`
+}
+
+// setEvents Sets entries in store (as with setAll), returning an event for each link which was
+// created, updated or deleted. Callers must prevent concurrent changes to store so that the
+// previous entries the events report are consistent with the changes.
+func setEvents(ctx context.Context, store Store, entries map[string]*Entry) ([]*event, error) {
+	prev := make(map[string]*Entry, len(entries))
+	for name := range entries {
+		e, err := store.Get(ctx, name)
+		if err != nil && err != ErrNotFound {
+			return nil, err
+		}
+		prev[name] = e
+	}
+
+	if err := setAll(ctx, store, entries); err != nil {
+		return nil, err
+	}
+
+	var evs []*event
+	now := time.Now()
+	for _, name := range sortedNames(entries) {
+		ev := &event{Name: name, Entry: entries[name], Previous: prev[name], Time: now}
+		switch {
+		case ev.Entry == nil && ev.Previous == nil:
+			continue
+		case ev.Entry == nil:
+			ev.Event, ev.Text = "link.deleted", fmt.Sprintf("go/%s was deleted (was %s)", name, ev.Previous.Link)
+		case ev.Previous == nil:
+			ev.Event, ev.Text = "link.created", fmt.Sprintf("go/%s was created: %s", name, ev.Entry.Link)
+		default:
+			ev.Event, ev.Text = "link.updated", fmt.Sprintf("go/%s was updated: %s (was %s)", name, ev.Entry.Link, ev.Previous.Link)
+		}
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			panic(err)
+		}
+		ev.ID = hex.EncodeToString(id)
+		evs = append(evs, ev)
+	}
+	return evs, nil
+}
+
+// Events wraps a StoreCloser to record an event whenever a link is created, updated or deleted
+// through it, which clients can follow as Server-Sent Events (see ServeHTTP). As with Primary, the
+// most recent events are kept in a log (numbered within a random epoch) so that clients which
+// reconnect can be sent the events they missed. Access to seq, log and changed must be guarded by
+// lock, which is also held during Set so that events are recorded in the order they happened.
+type Events struct {
+	StoreCloser
+	epoch string
+
+	lock    sync.Mutex
+	seq     uint64
+	log     []*event
+	changed chan struct{}
+}
+
+// NewEvents returns Events for store.
+func NewEvents(store StoreCloser) *Events {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return &Events{StoreCloser: store, epoch: hex.EncodeToString(b), changed: make(chan struct{})}
+}
+
+func (e *Events) Set(ctx context.Context, name string, entry *Entry) error {
+	return e.SetAll(ctx, map[string]*Entry{name: entry})
+}
+
+func (e *Events) SetAll(ctx context.Context, entries map[string]*Entry) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	evs, err := setEvents(ctx, e.StoreCloser, entries)
+	if err != nil || len(evs) == 0 {
+		return err
+	}
+
+	e.seq += uint64(len(evs))
+	e.log = append(e.log, evs...)
+	if len(e.log) > eventsLog {
+		e.log = e.log[len(e.log)-eventsLog:]
+	}
+	close(e.changed)
+	e.changed = make(chan struct{})
+	return nil
+}
+
+// since returns the events after seq in epoch along with the sequence number of the last of them
+// and a channel which is closed when there are more. If the events aren't available (because they
+// were in another epoch or are no longer in the log) ok is false.
+func (e *Events) since(epoch string, seq uint64) (evs []*event, last uint64, changed <-chan struct{}, ok bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if epoch != e.epoch || seq > e.seq || e.seq-seq > uint64(len(e.log)) {
+		return nil, e.seq, e.changed, false
+	}
+	return e.log[uint64(len(e.log))-(e.seq-seq):], e.seq, e.changed, true
+}
+
+// Unwrap returns the wrapped store.
+func (e *Events) Unwrap() Store {
+	return e.StoreCloser
+}
+
+// ServeHTTP streams events to a client as Server-Sent Events for up to eventsStream, with the
+// event's type (eg. "link.created") as the SSE event name and its JSON as the data. Each event's
+// SSE ID identifies its position in the log, so a client which reconnects with a Last-Event-ID is
+// sent the events it missed, or a "reset" event if they're no longer available (after which it
+// should reload whatever it was keeping up to date).
+func (e *Events) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, 500, errors.New("streaming is not supported"))
+		return
+	}
+
+	e.lock.Lock()
+	epoch, seq := e.epoch, e.seq
+	e.lock.Unlock()
+	reconnect := false
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		reconnect = true
+		i := strings.LastIndexByte(id, '-')
+		n, err := strconv.ParseUint(id[i+1:], 10, 64)
+		if i < 0 || err != nil {
+			epoch = ""
+		} else {
+			epoch, seq = id[:i], n
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+
+	timeout := time.After(eventsStream)
+	for first := true; ; first = false {
+		evs, last, changed, ok := e.since(epoch, seq)
+		switch {
+		case !ok && reconnect:
+			fmt.Fprintf(w, "id: %s-%d\nevent: reset\ndata: {}\n\n", e.epoch, last)
+		case first && len(evs) == 0:
+			// An ID on its own isn't dispatched as an event, but is still sent back as the
+			// Last-Event-ID on reconnecting, so that no events are missed in between.
+			fmt.Fprintf(w, "id: %s-%d\n\n", e.epoch, last)
+		}
+		for i, ev := range evs {
+			b, err := json.Marshal(ev)
+			if err != nil {
+				log.Printf("encoding %s event for %s failed: %v\n", ev.Event, ev.Name, err)
+				continue
+			}
+			fmt.Fprintf(w, "id: %s-%d\nevent: %s\ndata: %s\n\n", e.epoch, last-uint64(len(evs)-1-i), ev.Event, b)
+		}
+		flusher.Flush()
+		epoch, seq, reconnect = e.epoch, last, false
+
+		select {
+		case <-changed:
+		case <-timeout:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// serveEvents authenticates requests for events (see apiAuth) before they're streamed by events.
+func serveEvents(auth *Auth, tokens *Tokens, events *Events) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, _ := apiAuth(auth, tokens, r); !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			httpError(w, 401, errors.New("not logged in"))
+			return
+		}
+		if r.Method != "GET" {
+			httpError(w, 405)
+			return
+		}
+		if events == nil {
+			httpError(w, 404)
+			return
+		}
+		events.ServeHTTP(w, r)
+	})
+}
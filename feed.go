@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// feedPath is the path of the Atom feed of recently changed links.
+const feedPath = "/feed.atom"
+
+// feedEntries is the number of the most recently changed links included in the feed.
+const feedEntries = 50
+
+// atomLink is a link in an Atom feed or entry.
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+// atomEntry is an entry in an Atom feed, describing a change to a link.
+type atomEntry struct {
+	ID      string     `xml:"id"`
+	Title   string     `xml:"title"`
+	Updated string     `xml:"updated"`
+	Author  *atomName  `xml:"author,omitempty"`
+	Links   []atomLink `xml:"link"`
+	Summary string     `xml:"summary"`
+}
+
+// atomName is the author of an Atom entry.
+type atomName struct {
+	Name string `xml:"name"`
+}
+
+// feed responds with an Atom feed of the feedEntries most recently created or updated links, so
+// that new links can be discovered with a feed reader. Links which were deleted aren't included,
+// nor are those which predate their times being recorded. As with the API, requests must be
+// authenticated (see apiAuth), and the feed may be requested conditionally (see conditionalPage).
+func feed(auth *Auth, store Store, tokens *Tokens) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, _ := apiAuth(auth, tokens, r); !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			httpError(w, 401, errors.New("not logged in"))
+			return
+		}
+		if r.Method != "GET" {
+			httpError(w, 405)
+			return
+		}
+
+		data, _, ok, err := conditionalPage(w, r, store, nil, 1, feedEntries, r.Host)
+		if err != nil {
+			httpError(w, 500, err)
+			return
+		}
+		if !ok {
+			return
+		}
+
+		base := fmt.Sprintf("https://%s/", r.Host)
+		doc := struct {
+			XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+			ID      string      `xml:"id"`
+			Title   string      `xml:"title"`
+			Updated string      `xml:"updated"`
+			Links   []atomLink  `xml:"link"`
+			Entries []atomEntry `xml:"entry"`
+		}{
+			ID:      base + feedPath[1:],
+			Title:   fmt.Sprintf("go links on %s", r.Host),
+			Updated: time.Now().UTC().Format(time.RFC3339),
+			Links:   []atomLink{{Rel: "self", Href: base + feedPath[1:]}, {Href: base}},
+		}
+		for _, nl := range data {
+			if nl.Updated.IsZero() {
+				continue
+			}
+			if len(doc.Entries) == 0 {
+				doc.Updated = nl.Updated.UTC().Format(time.RFC3339)
+			}
+			doc.Entries = append(doc.Entries, feedEntry(nl, r.Host, base))
+		}
+
+		w.Header().Set("Content-Type", "application/atom+xml")
+		_, _ = io.WriteString(w, xml.Header)
+		if err := xml.NewEncoder(w).Encode(doc); err != nil {
+			log.Printf("writing response failed: %v\n", err)
+		}
+	})
+}
+
+// feedEntry returns the entry describing the last change to nl. Each change has its own ID, so
+// that feed readers show a link again when it's updated.
+func feedEntry(nl NameLink, host, base string) atomEntry {
+	verb := "updated"
+	if nl.Updated.Equal(nl.Created) {
+		verb = "created"
+	}
+	e := atomEntry{
+		ID:      fmt.Sprintf("tag:%s,%s:%s@%d", (&url.URL{Host: host}).Hostname(), nl.Updated.UTC().Format("2006-01-02"), nl.Name, nl.Updated.UnixNano()),
+		Title:   fmt.Sprintf("go/%s %s", nl.Name, verb),
+		Updated: nl.Updated.UTC().Format(time.RFC3339),
+		Links:   []atomLink{{Rel: "alternate", Href: nl.Link}, {Rel: "related", Href: base + nl.Name + "+"}},
+		Summary: fmt.Sprintf("go/%s now links to %s", nl.Name, nl.Link),
+	}
+	if nl.CreatedBy != "" {
+		e.Author = &atomName{nl.CreatedBy}
+	}
+	return e
+}
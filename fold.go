@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// Canonicalizer is implemented by stores which treat names differing only in case as the same.
+type Canonicalizer interface {
+	// Canonical returns the name that name is stored as, which may differ in case, or name
+	// itself if it isn't stored.
+	Canonical(ctx context.Context, name string) (string, error)
+}
+
+// canonical returns the name that name is stored as if store is (or wraps) a Canonicalizer, or name
+// itself otherwise.
+func canonical(ctx context.Context, store Store, name string) string {
+	for ; store != nil; store = unwrap(store) {
+		if c, ok := store.(Canonicalizer); ok {
+			if n, err := c.Canonical(ctx, name); err == nil {
+				return n
+			}
+			break
+		}
+	}
+	return name
+}
+
+// CaseInsensitive wraps a StoreCloser so that names which differ only in case are the same name,
+// stored with the case it was first Set with (its canonical case). The canonical names are kept
+// in memory, so changes which aren't made through CaseInsensitive (eg. by another server sharing
+// the store) aren't seen until it's reopened. Access to names must be guarded by lock, which is
+// also held during Set so that names are canonicalized consistently.
+type CaseInsensitive struct {
+	StoreCloser
+
+	lock  sync.RWMutex
+	names map[string]string
+}
+
+// NewCaseInsensitive returns CaseInsensitive for store, reading the canonical names from it.
+func NewCaseInsensitive(store StoreCloser) (*CaseInsensitive, error) {
+	c := &CaseInsensitive{StoreCloser: store, names: make(map[string]string)}
+	err := store.Iterate(context.Background(), func(name string, e *Entry) error {
+		if _, ok := c.names[strings.ToLower(name)]; !ok {
+			c.names[strings.ToLower(name)] = name
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Canonical returns the name that name is stored as.
+func (c *CaseInsensitive) Canonical(ctx context.Context, name string) (string, error) {
+	return c.canonical(name), nil
+}
+
+// canonical returns the name that name is stored as, or name if it doesn't exist.
+func (c *CaseInsensitive) canonical(name string) string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.canonicalLocked(name)
+}
+
+// canonicalLocked is as with canonical, but must be called with lock held.
+func (c *CaseInsensitive) canonicalLocked(name string) string {
+	if n, ok := c.names[strings.ToLower(name)]; ok {
+		return n
+	}
+	return name
+}
+
+func (c *CaseInsensitive) Get(ctx context.Context, name string) (*Entry, error) {
+	return c.StoreCloser.Get(ctx, c.canonical(name))
+}
+
+func (c *CaseInsensitive) Set(ctx context.Context, name string, e *Entry) error {
+	return c.SetAll(ctx, map[string]*Entry{name: e})
+}
+
+func (c *CaseInsensitive) SetAll(ctx context.Context, entries map[string]*Entry) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Deletions are canonicalized first so that a name can be renamed to a different case, in
+	// which case it's Set with the new case instead of the canonical one being deleted.
+	canonical := make(map[string]*Entry, len(entries))
+	for name, e := range entries {
+		if e == nil {
+			canonical[c.canonicalLocked(name)] = nil
+		}
+	}
+	for name, e := range entries {
+		if e == nil {
+			continue
+		}
+		if n := c.canonicalLocked(name); n != name {
+			if _, deleted := canonical[n]; !deleted {
+				name = n
+			}
+		}
+		canonical[name] = e
+	}
+	if err := setAll(ctx, c.StoreCloser, canonical); err != nil {
+		return err
+	}
+	for name, e := range canonical {
+		if e == nil {
+			delete(c.names, strings.ToLower(name))
+		}
+	}
+	for name, e := range canonical {
+		if e != nil {
+			c.names[strings.ToLower(name)] = name
+		}
+	}
+	return nil
+}
+
+// History returns the history of name if the wrapped store is a Historian.
+func (c *CaseInsensitive) History(ctx context.Context, name string) ([]*Entry, error) {
+	return history(ctx, c.StoreCloser, c.canonical(name))
+}
+
+// Unwrap returns the wrapped store.
+func (c *CaseInsensitive) Unwrap() Store {
+	return c.StoreCloser
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// Disambiguator is implemented by stores which can tell which of the names they store a name
+// matches with fuzzy name semantics (see fuzz).
+type Disambiguator interface {
+	// Candidates returns the names stored which name matches with fuzzy name semantics, sorted.
+	Candidates(ctx context.Context, name string) ([]string, error)
+}
+
+// candidates returns the names stored which name matches if store is (or wraps) a Disambiguator, or
+// nil otherwise.
+func candidates(ctx context.Context, store Store, name string) []string {
+	for ; store != nil; store = unwrap(store) {
+		if d, ok := store.(Disambiguator); ok {
+			if names, err := d.Candidates(ctx, name); err == nil {
+				return names
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// Fuzzy wraps a StoreCloser with fuzzy name semantics so that the names which a fuzzy name matches
+// are known, as stores only look up one of them. Several names which differ only in the characters
+// fuzzy semantics ignore (eg. my-doc and mydoc) can then be disambiguated rather than one of them
+// being picked arbitrarily. As with CaseInsensitive the names are kept in memory, so changes which
+// aren't made through Fuzzy aren't seen until it's reopened. Access to names must be guarded by lock.
+type Fuzzy struct {
+	StoreCloser
+
+	lock  sync.RWMutex
+	names map[string]map[string]bool
+}
+
+// NewFuzzy returns Fuzzy for store, reading the names from it.
+func NewFuzzy(store StoreCloser) (*Fuzzy, error) {
+	f := &Fuzzy{StoreCloser: store, names: make(map[string]map[string]bool)}
+	err := store.Iterate(context.Background(), func(name string, e *Entry) error {
+		f.add(name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Candidates returns the names stored which name matches.
+func (f *Fuzzy) Candidates(ctx context.Context, name string) ([]string, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	names := make([]string, 0, len(f.names[fuzz(name)]))
+	for n := range f.names[fuzz(name)] {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// add records that name is stored, and must be called with lock held (or before f is shared).
+func (f *Fuzzy) add(name string) {
+	k := fuzz(name)
+	if f.names[k] == nil {
+		f.names[k] = make(map[string]bool)
+	}
+	f.names[k][name] = true
+}
+
+// remove records that name is no longer stored, and must be called with lock held.
+func (f *Fuzzy) remove(name string) {
+	k := fuzz(name)
+	if delete(f.names[k], name); len(f.names[k]) == 0 {
+		delete(f.names, k)
+	}
+}
+
+func (f *Fuzzy) Set(ctx context.Context, name string, e *Entry) error {
+	return f.SetAll(ctx, map[string]*Entry{name: e})
+}
+
+func (f *Fuzzy) SetAll(ctx context.Context, entries map[string]*Entry) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	// The names are recorded as they're stored, which may differ in case (see Canonicalizer).
+	deleted := make([]string, 0, len(entries))
+	for name, e := range entries {
+		if e == nil {
+			deleted = append(deleted, canonical(ctx, f.StoreCloser, name))
+		}
+	}
+	if err := setAll(ctx, f.StoreCloser, entries); err != nil {
+		return err
+	}
+	for _, name := range deleted {
+		f.remove(name)
+	}
+	for name, e := range entries {
+		if e != nil {
+			f.add(canonical(ctx, f.StoreCloser, name))
+		}
+	}
+	return nil
+}
+
+// Unwrap returns the wrapped store.
+func (f *Fuzzy) Unwrap() Store {
+	return f.StoreCloser
+}
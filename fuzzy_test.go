@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newFuzzy returns Fuzzy for a fuzzy FileStore in a temporary directory with links.
+func newFuzzy(t *testing.T, links map[string]string) *Fuzzy {
+	t.Helper()
+	s, err := Open(filepath.Join(t.TempDir(), "links"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	for name, link := range links {
+		if err := s.Set(name, &Entry{Link: link}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := NewFuzzy(Adapt(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestFuzzyCandidates(t *testing.T) {
+	ctx := context.Background()
+	f := newFuzzy(t, map[string]string{
+		"my-doc": "https://docs.example/mine",
+		"mydoc":  "https://docs.example/my",
+		"other":  "https://other.example",
+	})
+	check := func(name string, want ...string) {
+		t.Helper()
+		got, err := f.Candidates(ctx, name)
+		if err != nil || len(got) != len(want) || len(want) > 0 && !reflect.DeepEqual(got, want) {
+			t.Fatalf("Candidates(%q) = %v, %v, want %v", name, got, err, want)
+		}
+	}
+	check("my_doc", "my-doc", "mydoc")
+	check("other", "other")
+	check("missing")
+
+	// Sets through Fuzzy keep the candidates current.
+	if err := f.Set(ctx, "my_doc", &Entry{Link: "https://docs.example/ours"}); err != nil {
+		t.Fatal(err)
+	}
+	check("MyDoc", "my-doc", "my_doc", "mydoc")
+	if err := f.SetAll(ctx, map[string]*Entry{"my-doc": nil, "mydoc": nil}); err != nil {
+		t.Fatal(err)
+	}
+	check("mydoc", "my_doc")
+}
+
+func TestGetLinkDisambiguates(t *testing.T) {
+	f := newFuzzy(t, map[string]string{
+		"my-doc": "https://docs.example/mine",
+		"my_doc": "https://docs.example/my",
+		"other":  "https://other.example",
+	})
+	tests := []struct {
+		name     string
+		code     int
+		location string
+	}{
+		{"mydoc", 300, ""},
+		{"My-Doc", 300, ""},
+		// Names which are one of the candidates, or only match one, aren't ambiguous.
+		{"my_doc", 302, "https://docs.example/my"},
+		{"my-doc", 302, "https://docs.example/mine"},
+		{"Other", 302, "https://other.example"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		getLink(NewAuth("", nil, nil, nil), f, nil, nil, nil, nil, tt.name).ServeHTTP(w, httptest.NewRequest("GET", "/"+tt.name, nil))
+		if w.Code != tt.code || w.Header().Get("Location") != tt.location {
+			t.Errorf("GET /%s = %d to %q, want %d to %q", tt.name, w.Code, w.Header().Get("Location"), tt.code, tt.location)
+		}
+		if tt.code == 300 {
+			for _, link := range []string{"https://docs.example/mine", "https://docs.example/my"} {
+				if !strings.Contains(w.Body.String(), link) {
+					t.Errorf("GET /%s doesn't offer %s", tt.name, link)
+				}
+			}
+		}
+	}
+}
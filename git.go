@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/mail"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+func init() {
+	// git:///path/to/repo?author=golinks+<golinks@localhost>&remote=origin&sync=always
+	RegisterStore("git", func(dsn string, fuzzy, compact bool) (StoreCloser, error) {
+		path, query, err := openPath(dsn)
+		if err != nil {
+			return nil, err
+		}
+		author := query.Get("author")
+		if author == "" {
+			author = "golinks <golinks@localhost>"
+		}
+		policy, interval, err := ParseSyncPolicy(query.Get("sync"))
+		if err != nil {
+			return nil, err
+		}
+		s, err := OpenGit(path, author, query.Get("remote"), fuzzy, compact)
+		if err != nil {
+			return nil, err
+		}
+		s.SetSyncPolicy(policy, interval)
+		return Adapt(s), nil
+	})
+}
+
+// gitFile is the name of the file within the repository backing a GitStore.
+const gitFile = "links"
+
+// GitStore provides an implementation of the Store interface which keeps the
+// file backing a FileStore inside of a git repository, committing the file
+// after every Set. This provides a complete history of every change made to
+// the store (which can be inspected with the usual git tools), and if
+// configured with a remote each commit is pushed to it as an off-site backup.
+// Pushes are best effort - failures are logged but don't cause Set to fail,
+// as the next successful push will include all of the commits. lock
+// serializes Set so that commits are made in the same order as the writes to
+// the file.
+type GitStore struct {
+	*FileStore
+	dir    string
+	author *mail.Address
+	remote string
+	lock   sync.Mutex
+}
+
+// OpenGit opens a GitStore backed by the repository at dir (which will be
+// initialized if necessary), attributing commits to author and pushing them to
+// remote if it is non-empty. The optional bools enable fuzzy lookups and
+// compaction as with Open. The GitStore returned should be closed with Close
+// once it is no longer in use.
+func OpenGit(dir, author, remote string, bools ...bool) (*GitStore, error) {
+	addr, err := mail.ParseAddress(author)
+	if err != nil {
+		return nil, fmt.Errorf("invalid git author %q: %v", author, err)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &GitStore{dir: dir, author: addr, remote: remote}
+	if _, err := os.Stat(filepath.Join(dir, ".git")); os.IsNotExist(err) {
+		if err := s.git("init", "-q"); err != nil {
+			return nil, err
+		}
+	}
+
+	s.FileStore, err = Open(filepath.Join(dir, gitFile), bools...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Commit anything left uncommitted by a previous crash or from compaction.
+	if err := s.commit("Open store"); err != nil {
+		s.FileStore.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *GitStore) Set(name string, e *Entry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.FileStore.Set(name, e); err != nil {
+		return err
+	}
+
+	return s.commit(gitMessage(name, e))
+}
+
+func (s *GitStore) SetAll(entries map[string]*Entry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.FileStore.SetAll(entries); err != nil {
+		return err
+	}
+
+	var msgs []string
+	for _, name := range sortedNames(entries) {
+		msgs = append(msgs, gitMessage(name, entries[name]))
+	}
+	return s.commit(strings.Join(msgs, "\n"))
+}
+
+// gitMessage returns the commit message for Setting name to e.
+func gitMessage(name string, e *Entry) string {
+	if e == nil {
+		return fmt.Sprintf("Delete %s", name)
+	}
+	return fmt.Sprintf("Set %s to %s", name, e.Link)
+}
+
+// commit commits the file backing the store with msg if it has changed, and
+// pushes the commit to the remote if one is configured.
+func (s *GitStore) commit(msg string) error {
+	if err := s.git("add", gitFile); err != nil {
+		return err
+	}
+	// 'diff --cached --quiet' exits with a non-zero status iff there are changes.
+	if err := s.git("diff", "--cached", "--quiet"); err == nil {
+		return nil
+	}
+	if err := s.git("commit", "-q", "-m", msg); err != nil {
+		return err
+	}
+
+	if s.remote != "" {
+		if err := s.git("push", "-q", s.remote, "HEAD"); err != nil {
+			log.Printf("git push to %s failed: %v\n", s.remote, err)
+		}
+	}
+	return nil
+}
+
+// git runs the git command with args in the repository.
+func (s *GitStore) git(args ...string) error {
+	cmd := exec.Command("git", append([]string{"-C", s.dir}, args...)...)
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME="+s.author.Name, "GIT_AUTHOR_EMAIL="+s.author.Address,
+		"GIT_COMMITTER_NAME="+s.author.Name, "GIT_COMMITTER_EMAIL="+s.author.Address)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -2,88 +2,420 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"html/template"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/goware/urlx"
-	"github.com/scheibo/a1"
 	"github.com/tdewolff/minify"
 	"github.com/tdewolff/minify/css"
 	"github.com/tdewolff/minify/html"
 	"github.com/tdewolff/minify/js"
 	"github.com/tdewolff/minify/svg"
+	"golang.org/x/net/idna"
+	"golang.org/x/text/language"
+	"golang.org/x/text/unicode/norm"
 )
 
-// NameLink holds a (name, link) pair for rendering.
+// NameLink holds a (name, entry) pair for rendering.
 type NameLink struct {
 	Name string
-	Link string
+	Entry
 }
 
-// Store provides the ability to get/set and iterate through name -> link pairs,
+// Store provides the ability to get/set and iterate through name -> entry pairs. Each method
+// takes a context so that stores backed by a network service can honor request deadlines.
 type Store interface {
-	// Get returns the link and true Set for name, or "" and false if it doesn't exist.
-	Get(name string) (string, bool)
-	// Set associates a link with a name. Set can be used to 'delete' a mapping by
-	// specifying "" as the link.
-	Set(name, link string) error
-	// Iterates through all the (name, link) pairs stored in the order they were last Set.
+	// Get returns the entry Set for name, or ErrNotFound if it doesn't exist. Any other error
+	// means the store was unable to determine whether name exists.
+	Get(ctx context.Context, name string) (*Entry, error)
+	// Set associates an entry with a name. Set can be used to 'delete' a mapping by
+	// specifying nil as the entry.
+	Set(ctx context.Context, name string, e *Entry) error
+	// Iterates through all the (name, entry) pairs stored in the order they were last Set.
 	// If cb returns an error the iteration is stopped and Iterate will return with the same error.
-	Iterate(cb func(name, link string) error) error
+	Iterate(ctx context.Context, cb func(name string, e *Entry) error) error
 }
 
+// ErrNotFound is returned by Store.Get for names which don't exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrQuotaExceeded is returned (wrapped with the limit which was reached) by stores which refuse
+// to Set a mapping because they're full.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Batcher is implemented by stores which can Set multiple names atomically.
+type Batcher interface {
+	// SetAll associates each name in entries with its entry (deleting those with nil entries) as
+	// a single atomic operation.
+	SetAll(ctx context.Context, entries map[string]*Entry) error
+}
+
+// setAll Sets each of entries in store, atomically if store is a Batcher.
+func setAll(ctx context.Context, store Store, entries map[string]*Entry) error {
+	if b, ok := store.(Batcher); ok {
+		return b.SetAll(ctx, entries)
+	}
+	return setEach(entries, func(name string, e *Entry) error {
+		return store.Set(ctx, name, e)
+	})
+}
+
+// setEach calls set for each of entries, Setting the new entries before any deletions so that a
+// failure part way through never loses a link.
+func setEach(entries map[string]*Entry, set func(name string, e *Entry) error) error {
+	names := sortedNames(entries)
+	for _, deletions := range []bool{false, true} {
+		for _, name := range names {
+			if (entries[name] == nil) != deletions {
+				continue
+			}
+			if err := set(name, entries[name]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sortedNames returns the names in entries in sorted order, so that batches are applied
+// deterministically.
+func sortedNames(entries map[string]*Entry) []string {
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Wrapper is implemented by stores which wrap another store (eg. Cache), so that the optional
+// interfaces below are used from the wrapped store unless the wrapper implements them itself.
+type Wrapper interface {
+	// Unwrap returns the wrapped store.
+	Unwrap() Store
+}
+
+// unwrap returns the store which store wraps if it's a Wrapper, or nil otherwise.
+func unwrap(store Store) Store {
+	if w, ok := store.(Wrapper); ok {
+		return w.Unwrap()
+	}
+	return nil
+}
+
+// Historian is implemented by stores which retain previous versions of entries.
+type Historian interface {
+	// History returns the versions of the entry for name that are retained (including the
+	// current one), oldest first.
+	History(ctx context.Context, name string) ([]*Entry, error)
+}
+
+// errNoHistory is returned by history for stores which aren't a Historian.
+var errNoHistory = errors.New("store does not retain history")
+
+// history returns the History of name if store is (or wraps) a Historian.
+func history(ctx context.Context, store Store, name string) ([]*Entry, error) {
+	for ; store != nil; store = unwrap(store) {
+		if h, ok := store.(Historian); ok {
+			return h.History(ctx, name)
+		}
+	}
+	return nil, errNoHistory
+}
+
+// Ranger is implemented by stores which can efficiently Iterate over part of their mappings.
+type Ranger interface {
+	// IterateRange is as with Iterate, but skips the first offset mappings and stops after limit
+	// mappings.
+	IterateRange(ctx context.Context, offset, limit int, cb func(name string, e *Entry) error) error
+}
+
+// Revisioner is implemented by stores which can cheaply identify the current state of their
+// mappings, so that conditional requests can be answered without iterating over them.
+type Revisioner interface {
+	// Revision returns an identifier which changes whenever any mapping does, or "" if the store
+	// can't currently provide one.
+	Revision(ctx context.Context) (string, error)
+}
+
+// revision returns the Revision of store if it's (or wraps) a Revisioner, or "" otherwise.
+func revision(ctx context.Context, store Store) (string, error) {
+	for ; store != nil; store = unwrap(store) {
+		if r, ok := store.(Revisioner); ok {
+			return r.Revision(ctx)
+		}
+	}
+	return "", nil
+}
+
+// Checker is implemented by stores which can check that they're able to serve requests more
+// thoroughly than looking up a name does (see checkStore).
+type Checker interface {
+	// Check returns an error if the store can't currently serve requests.
+	Check(ctx context.Context) error
+}
+
+// checkStore returns an error if store can't currently serve requests, using Check if store is (or
+// wraps) a Checker and otherwise looking up a name which can't exist.
+func checkStore(ctx context.Context, store Store) error {
+	for s := store; s != nil; s = unwrap(s) {
+		if c, ok := s.(Checker); ok {
+			return c.Check(ctx)
+		}
+	}
+	_, err := store.Get(ctx, "readyz")
+	if err == ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// errStop is returned by Iterate callbacks to stop iterating early.
+var errStop = errors.New("stop iterating")
+
+// iterateRange calls cb with up to limit of the mappings in store after the first offset, using
+// IterateRange if store is (or wraps) a Ranger.
+func iterateRange(ctx context.Context, store Store, offset, limit int, cb func(name string, e *Entry) error) error {
+	for s := store; s != nil; s = unwrap(s) {
+		if r, ok := s.(Ranger); ok {
+			return r.IterateRange(ctx, offset, limit, cb)
+		}
+	}
+	return iterateWindow(func(cb func(name string, e *Entry) error) error {
+		return store.Iterate(ctx, cb)
+	}, offset, limit, cb)
+}
+
+// iterateWindow calls cb with up to limit of the mappings iterate calls its callback with, after
+// skipping the first offset.
+func iterateWindow(iterate func(cb func(name string, e *Entry) error) error, offset, limit int, cb func(name string, e *Entry) error) error {
+	i := 0
+	err := iterate(func(name string, e *Entry) error {
+		i++
+		switch {
+		case i <= offset:
+			return nil
+		case i > offset+limit:
+			return errStop
+		}
+		return cb(name, e)
+	})
+	if err == errStop {
+		return nil
+	}
+	return err
+}
+
+const (
+	// indexPage is the default number of mappings shown on each page of the index.
+	indexPage = 1000
+	// maxPage is the most mappings which can be requested in a single page.
+	maxPage = 1000
+)
+
 var healthy int32
 
-// serve acts as the router for the application: "favicon.ico", "/login", "/logout" are
-// treated specially, everything else will either add or display mappings from name to links.
-func serve(auth *a1.Client, store Store) http.Handler {
+// sortCookie is the cookie which remembers the order each user chose for the index.
+const sortCookie = "sort"
+
+// subdomainName returns the name host is a subdomain for (see config.subdomainHost) and the host
+// it's a subdomain of (along with any port), if it's one.
+func (c *config) subdomainName(host string) (name, base string, ok bool) {
+	if c.subdomainHost == "" {
+		return "", "", false
+	}
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		h, port = host, ""
+	}
+	h = strings.ToLower(strings.TrimSuffix(h, "."))
+	if name = strings.TrimSuffix(h, "."+c.subdomainHost); name == h || name == "" {
+		return "", "", false
+	}
+	base = c.subdomainHost
+	if port != "" {
+		base = net.JoinHostPort(base, port)
+	}
+	return name, base, true
+}
+
+// requestScheme returns the scheme the request r was made with, which is https if either it was
+// made over TLS or a proxy in front of us says it was (with X-Forwarded-Proto).
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
+		return "https"
+	}
+	return "http"
+}
+
+// serve acts as the router for the application: "favicon.ico", "/login", "/logout" and the other
+// pages are treated specially, the JSON API is served under "/api/v1" and GraphQL at "/graphql",
+// and everything else will either add or display mappings from name to links. Requests are handled
+// with c in their context (see configContext).
+func serve(c *config) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(configContext(r.Context(), c))
+		if userOf(r.Context()) == nil {
+			if u := c.auth.User(r); u != nil {
+				r = r.WithContext(userContext(r.Context(), u))
+			}
+		}
+		if c.auditLog != nil {
+			r = r.WithContext(actorContext(r.Context(), requestActor(r, c.tokens)))
+		}
 		path := r.URL.Path
-		log.Printf("%s %s\n", r.Method, path)
+		// Subdomains are redirected to the names they're for, so that they're handled the same way.
+		if name, base, ok := c.subdomainName(r.Host); ok {
+			u := url.URL{Scheme: requestScheme(r), Host: base, Path: "/" + name, RawQuery: r.URL.RawQuery}
+			if path != "/" {
+				u.Path += path
+			}
+			http.Redirect(w, r, u.String(), c.redirectCode)
+			return
+		}
 		switch path {
 		case "/healthz":
 			healthz().ServeHTTP(w, r)
+		case "/livez":
+			livez().ServeHTTP(w, r)
+		case "/readyz":
+			readyz(c.store).ServeHTTP(w, r)
 		case "/favicon.ico":
 			http.ServeFile(w, r, resource("favicon.ico"))
+		case suggestPath:
+			suggest(c.auth, c.store, c.tokens, c.fuzzy).ServeHTTP(w, r)
+		case openSearchPath:
+			openSearch().ServeHTTP(w, r)
+		case feedPath:
+			feed(c.auth, c.store, c.tokens).ServeHTTP(w, r)
+		case eventsPath:
+			serveEvents(c.auth, c.tokens, c.events).ServeHTTP(w, r)
+		case openAPIPath:
+			http.ServeFile(w, r, resource("openapi.json"))
 		case "/login":
 			switch r.Method {
 			case "GET":
-				auth.CustomLoginPage("/favicon.ico", fmt.Sprintf("login - %s", r.Host), "/login").ServeHTTP(w, r)
+				c.auth.LoginPage(fmt.Sprintf("login - %s", r.Host), "/login").ServeHTTP(w, r)
 			case "POST":
-				auth.Login("/login", "/").ServeHTTP(w, r)
+				c.auth.Login("/login", "/").ServeHTTP(w, r)
 			default:
 				httpError(w, 405)
 			}
+		case oidcCallbackPath:
+			c.auth.Callback("/").ServeHTTP(w, r)
 		case "/logout":
-			auth.Logout("/").ServeHTTP(w, r)
+			c.auth.Logout("/").ServeHTTP(w, r)
+		case usersPath:
+			switch r.Method {
+			case "GET":
+				getUsers(c.auth).ServeHTTP(w, r)
+			case "POST":
+				c.auth.CheckXSRF(c.auth.EnsureAuth(postUsers(c.auth))).ServeHTTP(w, r)
+			default:
+				httpError(w, 405)
+			}
+		case statsPath:
+			getStats(c.auth, c.stats).ServeHTTP(w, r)
+		case auditPath:
+			getAudit(c.auth).ServeHTTP(w, r)
+		case stalePath:
+			switch r.Method {
+			case "GET":
+				getStale(c.auth, c.store, c.hits).ServeHTTP(w, r)
+			case "POST":
+				c.auth.CheckXSRF(c.auth.EnsureAuth(postStale(c.store))).ServeHTTP(w, r)
+			default:
+				httpError(w, 405)
+			}
+		case settingsPath:
+			switch r.Method {
+			case "GET":
+				getSettings(c.auth, c.tokens, c.patterns, "").ServeHTTP(w, r)
+			case "POST":
+				c.auth.CheckXSRF(c.auth.EnsureAuth(postSettings(c.auth, c.tokens, c.patterns))).ServeHTTP(w, r)
+			default:
+				httpError(w, 405)
+			}
+		case replicationPath:
+			if p, ok := c.store.(*Primary); ok {
+				p.ServeHTTP(w, r)
+			} else {
+				httpError(w, 404)
+			}
+		case apiPath, importPath, exportPath, searchPath, resolvePath, brokenPath, staleAPIPath, statsExportPath, metricsPath, varsPath:
+			serveAPI(c.auth, c.store, c.tokens, c.hits, c.stats, c.fuzzy).ServeHTTP(w, r)
+		case graphqlPath:
+			serveGraphQL(c.auth, c.store, c.tokens).ServeHTTP(w, r)
 		default:
-			name := path[1:]
+			if strings.HasPrefix(path, apiPath+"/") {
+				serveAPI(c.auth, c.store, c.tokens, c.hits, c.stats, c.fuzzy).ServeHTTP(w, r)
+				return
+			}
+			name := normalizeName(path[1:])
+			_, preview := r.URL.Query()["preview"]
+			if strings.HasSuffix(name, "+") {
+				name, preview = strings.TrimSuffix(name, "+"), true
+			}
 			if !isValidName(name) {
 				httpError(w, 400)
 				return
 			}
 			switch r.Method {
-			case "GET":
-				// NOTE: we only check auth within getLink as sometimes we redirect.
-				getLink(auth, store, name).ServeHTTP(w, r)
+			case "GET", "HEAD":
+				if _, ok := r.URL.Query()["history"]; ok {
+					getHistory(c.auth, c.store, name).ServeHTTP(w, r)
+					return
+				}
+				if preview {
+					getPreview(c.auth, c.store, c.hits, c.stats, name).ServeHTTP(w, r)
+					return
+				}
+				if name == "" {
+					w.Header().Add("Vary", "Accept")
+					if prefersJSON(r) {
+						serveAPI(c.auth, c.store, c.tokens, c.hits, c.stats, c.fuzzy).ServeHTTP(w, r)
+						return
+					}
+				}
+				// NOTE: we only check c.auth within getLink as sometimes we redirect.
+				getLink(c.auth, c.store, c.hits, c.stats, c.patterns, c.stars, name).ServeHTTP(w, r)
 			case "POST", "UPDATE":
+				if _, transfer := r.URL.Query()["transfer"]; transfer {
+					c.auth.CheckXSRF(c.auth.EnsureAuth(postTransfer(c.store, name))).ServeHTTP(w, r)
+					return
+				}
+				_, star := r.URL.Query()["star"]
+				if _, unstar := r.URL.Query()["unstar"]; star || unstar {
+					c.auth.CheckXSRF(c.auth.EnsureAuth(postStar(c.store, c.stars, name, star))).ServeHTTP(w, r)
+					return
+				}
 				update := r.Method == "UPDATE"
-				auth.CheckXSRF(auth.EnsureAuth(postLink(store, name, update))).ServeHTTP(w, r)
+				c.auth.CheckXSRF(c.auth.EnsureAuth(postLink(c.store, name, update))).ServeHTTP(w, r)
 			case "DELETE":
-				auth.CheckXSRF(auth.EnsureAuth(deleteLink(store, name))).ServeHTTP(w, r)
+				c.auth.CheckXSRF(c.auth.EnsureAuth(deleteLink(c.store, name))).ServeHTTP(w, r)
 			default:
 				httpError(w, 405)
 			}
@@ -91,68 +423,968 @@ func serve(auth *a1.Client, store Store) http.Handler {
 	})
 }
 
-// getLink is the handler for any GET request - if we know of a mapping we redirect, otherwise
-// we check auth and render the index with the name already filled into the new entry field.
-func getLink(auth *a1.Client, store Store, name string) http.Handler {
+// getLink is the handler for any GET (or HEAD) request - if we know of a mapping (or, failing that,
+// a pattern matching the name) we redirect, otherwise we check auth and render the index with the
+// name already filled into the new entry field.
+func getLink(auth *Auth, store Store, hits *Hits, stats *Stats, patterns *Patterns, stars *Stars, name string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		link, ok := store.Get(name)
-		if ok {
-			http.Redirect(w, r, link, 302)
+		outcome := "error"
+		defer func(start time.Time) { linkSeconds.Since(outcome, start) }(time.Now())
+
+		cfg := configOf(r.Context())
+		start := time.Now()
+		match, e, link, err := resolve(visitorContext(r), store, r.Host, name)
+		if t := cfg.trimName(name); t != name && t != "" && !keepName(name, match, err) {
+			name = t
+			match, e, link, err = resolve(visitorContext(r), store, r.Host, name)
+		}
+		lookupSeconds.Since(lookupResult(err), start)
+		if names := ambiguous(r.Context(), store, name, match, err); names != nil {
+			outcome = "disambiguation"
+			disambiguate(w, r, store, name, names)
+			return
+		}
+		if m := strings.TrimSuffix(match, "/*"); len(m) <= len(name) && m != name[:len(m)] && strings.EqualFold(m, name[:len(m)]) {
+			// Names are redirected to the case they're stored with before being resolved.
+			u := *r.URL
+			u.Path = "/" + m + name[len(m):]
+			outcome = "redirect"
+			http.Redirect(w, r, u.String(), 302)
+			return
+		}
+		if err == nil {
+			if cfg.linkLimiter != nil && !cfg.linkLimiter.Allow(strings.ToLower(match)) {
+				outcome = "limited"
+				w.Header().Set("Retry-After", "1")
+				httpError(w, 429)
+				return
+			}
+			// Only following a link counts, not HEAD requests from link checkers.
+			if hits != nil && r.Method == "GET" {
+				hits.Hit(match)
+			}
+			if stats != nil && r.Method == "GET" {
+				stats.Hit(match)
+				if cfg.recordSources && !e.Untracked {
+					stats.Source(match, referrerHost(r), clientClass(r))
+				}
+			}
+			if e.Bundle {
+				outcome = "bundle"
+				bundle(w, r, name, e)
+				return
+			}
+			outcome = "redirect"
+			redirect(w, r, name, link)
+			return
+		}
+		if errors.Is(err, errExpired) {
+			outcome = "gone"
+			httpError(w, 410, fmt.Errorf("go/%s %w", match, err))
+			return
+		}
+		if errors.Is(err, errAliasLoop) {
+			httpError(w, 508, err)
+			return
+		}
+		if err == ErrNotFound && patterns != nil {
+			if _, link, err = patterns.Resolve(name); err == nil {
+				outcome = "pattern"
+				redirect(w, r, name, withParams(link, cfg.redirectParams))
+				return
+			}
+		}
+		if err != ErrNotFound {
+			httpError(w, 500, err)
+			return
+		}
+		if stats != nil && r.Method == "GET" && name != "" {
+			stats.Miss(name)
+		}
+		// Names which don't exist are looked up upstream or sent to the fallbackURL, unless they're
+		// being created.
+		_, create := r.URL.Query()["create"]
+		if cfg.upstream != nil && name != "" && !create {
+			link, err := cfg.upstream.Resolve(r, name)
+			if err == nil {
+				outcome = "upstream"
+				redirect(w, r, name, withParams(link, cfg.redirectParams))
+				return
+			}
+			if err != ErrNotFound {
+				httpError(w, 502, err)
+				return
+			}
+		}
+		if cfg.fallbackURL != "" && name != "" && !create {
+			outcome = "fallback"
+			http.Redirect(w, r, expandLink(cfg.fallbackURL, "/"+name, r.URL.Query()), 302)
+			return
+		}
+
+		if !auth.IsAuth(r) {
+			outcome = "login"
+			http.Redirect(w, r, "/login", 302)
+			return
+		}
+
+		// The index is the page for creating the name, or just the index if there isn't one.
+		outcome = "create"
+		if name == "" {
+			outcome = "index"
+		}
+		getIndex(store, hits, stars, auth.XSRF(r), name).ServeHTTP(w, r)
+	})
+}
+
+// lookupResult returns the result label of lookupSeconds for err, the error resolving a name.
+func lookupResult(err error) string {
+	switch {
+	case err == nil:
+		return "found"
+	case err == ErrNotFound:
+		return "not_found"
+	case errors.Is(err, errExpired):
+		return "expired"
+	}
+	return "error"
+}
+
+// trimName returns name without any trailing slashes or dots (or other trailing punctuation, if
+// stripPunctuation is set), which are usually left over from where the name was copied from, eg.
+// the end of a sentence.
+func (c *config) trimName(name string) string {
+	cutset := "/."
+	if c.stripPunctuation {
+		cutset += `,;:!?'"()[]<>`
+	}
+	return strings.TrimRight(name, cutset)
+}
+
+// keepName returns whether name is looked up as it is rather than without its trailing punctuation
+// (see trimName), given the match and err resolving it returned: that is if it has a mapping of its
+// own rather than only a prefix of it, or looking it up failed for some other reason.
+func keepName(name, match string, err error) bool {
+	if err == ErrNotFound {
+		return false
+	}
+	return match == "" || strings.EqualFold(match, name)
+}
+
+// ambiguous returns the names which name fuzzily matches (see Disambiguator) if there are several
+// and match, the mapping resolving it found (along with err), isn't one of them, so that it's
+// disambiguated rather than resolved to whichever of them the store looked up. Names which didn't
+// resolve aren't ambiguous, and nor are those stored exactly.
+func ambiguous(ctx context.Context, store Store, name, match string, err error) []string {
+	if err != nil && !errors.Is(err, errExpired) {
+		return nil
+	}
+	if names := candidates(ctx, store, name); len(names) > 1 && !contains(names, match) {
+		return names
+	}
+	return nil
+}
+
+// disambiguate renders the names a fuzzy name matches (and their links) for the user to choose
+// between, with a 300 Multiple Choices.
+func disambiguate(w http.ResponseWriter, r *http.Request, store Store, name string, names []string) {
+	var data []NameLink
+	for _, n := range names {
+		e, err := store.Get(r.Context(), n)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			httpError(w, 500, err)
 			return
 		}
+		data = append(data, NameLink{Name: n, Entry: *e})
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusMultipleChoices)
+	render(w, "disambiguation.html", struct {
+		Title string
+		Name  string
+		Data  []NameLink
+	}{
+		fmt.Sprintf("go/%s - %s", name, r.Host), name, data,
+	})
+}
+
+// bundle renders the links of the bundle e which name resolved to (with its Params and the
+// redirectParams appended, see withParams), along with a button to open all of them at once.
+func bundle(w http.ResponseWriter, r *http.Request, name string, e *Entry) {
+	var links []string
+	for _, link := range e.Links() {
+		links = append(links, withParams(link, e.Params, configOf(r.Context()).redirectParams))
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	render(w, "bundle.html", struct {
+		Title       string
+		Name        string
+		Description string
+		Links       []string
+	}{
+		fmt.Sprintf("go/%s - %s", name, r.Host), name, e.Description, links,
+	})
+}
+
+// contains returns whether names contains name.
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// redirect redirects name to link with redirectCode and redirectCacheControl, unless link isn't
+// trusted (see isTrusted) in which case an interstitial page is rendered with a link to continue
+// to it instead.
+func redirect(w http.ResponseWriter, r *http.Request, name, link string) {
+	cfg := configOf(r.Context())
+	if cfg.redirectCacheControl != "" {
+		w.Header().Set("Cache-Control", cfg.redirectCacheControl)
+	}
+	w.Header().Add("Vary", "User-Agent")
+	w.Header().Add("Vary", "Accept-Language")
+	if cfg.regionHeader != "" {
+		w.Header().Add("Vary", cfg.regionHeader)
+	}
+	if !isTrusted(r, link) {
+		render(w, "interstitial.html", struct {
+			Title string
+			Name  string
+			Link  string
+		}{
+			fmt.Sprintf("leaving via go/%s", name), name, link,
+		})
+		return
+	}
+	http.Redirect(w, r, link, cfg.redirectCode)
+}
+
+// isTrusted returns whether link is on one of the trustedDomains (or any domain if there aren't
+// any), or on the same host as the request r for it.
+func isTrusted(r *http.Request, link string) bool {
+	trustedDomains := configOf(r.Context()).trustedDomains
+	if len(trustedDomains) == 0 {
+		return true
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	if u.Host == r.Host {
+		return true
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, d := range trustedDomains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxAliases is the most aliases (links to other names on the same host) resolve follows.
+const maxAliases = 8
+
+// errAliasLoop is returned by resolve for names whose aliases loop or go on for too long.
+var errAliasLoop = errors.New("alias loop")
 
-		n := name
-		i := -1
-		for !ok {
-			i = strings.LastIndexByte(n, '/')
-			if i < 0 {
+// resolve returns the link name redirects to and the name and entry of the mapping it was resolved
+// with (see resolveName), following any aliases to other names on host server-side so that browsers
+// aren't bounced through several redirects. Aliases to names which don't exist are left as they
+// are, and errAliasLoop is returned if they visit a name twice or there are more than maxAliases.
+// The Params of the mappings followed are appended to the link, and then the redirectParams (see
+// withParams). Aliases to bundles aren't followed, so that they lead to the bundle's page.
+func resolve(ctx context.Context, store Store, host, name string) (match string, e *Entry, link string, err error) {
+	match, e, link, err = resolveName(ctx, store, name)
+	var params []map[string]string
+	if e != nil {
+		params = append(params, e.Params)
+	}
+	seen := map[string]bool{name: true}
+	for err == nil {
+		next, ok := aliasName(host, link)
+		if !ok {
+			break
+		}
+		if seen[next] || len(seen) > maxAliases {
+			return match, e, link, fmt.Errorf("%w at go/%s", errAliasLoop, next)
+		}
+		seen[next] = true
+
+		_, ne, l, lerr := resolveName(ctx, store, next)
+		if lerr == ErrNotFound || (ne != nil && ne.Bundle) {
+			break
+		}
+		if ne != nil {
+			params = append(params, ne.Params)
+		}
+		link, err = l, lerr
+	}
+	if err == nil {
+		link = withParams(link, append(params, configOf(ctx).redirectParams)...)
+	}
+	return match, e, link, err
+}
+
+// withParams appends each of the query parameters in params to link unless it already has them,
+// with earlier params taking precedence over later ones. The existing query is left as it is.
+func withParams(link string, params ...map[string]string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return link
+	}
+	q, added := u.Query(), url.Values{}
+	for _, p := range params {
+		for k, v := range p {
+			if _, ok := q[k]; !ok {
+				q.Set(k, v)
+				added.Set(k, v)
+			}
+		}
+	}
+	if len(added) == 0 {
+		return link
+	}
+
+	link, fragment, hasFragment := strings.Cut(link, "#")
+	sep := "&"
+	if u.RawQuery == "" {
+		sep = "?"
+		link = strings.TrimSuffix(link, "?")
+	}
+	link += sep + added.Encode()
+	if hasFragment {
+		link += "#" + fragment
+	}
+	return link
+}
+
+// checkLoop returns errAliasLoop if mapping name to link (or to any of dests, if there are any)
+// would make it an alias which leads back to name, either directly or through other aliases, so
+// that a typo can't create a link which bounces browsers around forever.
+func checkLoop(ctx context.Context, store Store, host, name, link string, dests []Destination) error {
+	links := []string{link}
+	for _, d := range dests {
+		links = append(links, d.Link)
+	}
+	for _, link := range links {
+		seen, path := map[string]bool{}, []string{"go/" + name}
+		for {
+			next, ok := aliasName(host, link)
+			if !ok {
+				break
+			}
+			path = append(path, "go/"+next)
+			if next == name || strings.HasPrefix(next, name+"/") || seen[next] || len(seen) >= maxAliases {
+				return fmt.Errorf("%w: %s", errAliasLoop, strings.Join(path, " -> "))
+			}
+			seen[next] = true
+
+			_, _, l, err := resolveName(ctx, store, next)
+			if err == ErrNotFound {
 				break
 			}
-			n = n[:i]
-			link, ok = store.Get(n)
+			if err != nil && !errors.Is(err, errExpired) {
+				return err
+			}
+			link = l
 		}
+	}
+	return nil
+}
 
-		if ok {
-			http.Redirect(w, r, link + name[i:len(name)], 302)
-			return
+// aliasName returns the name link is an alias of if it's a link to a name on host.
+func aliasName(host, link string) (string, bool) {
+	u, err := url.Parse(link)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host != host ||
+		u.RawQuery != "" || u.Fragment != "" {
+		return "", false
+	}
+	name := normalizeName(strings.TrimPrefix(u.Path, "/"))
+	if name == "" || !isValidName(name) {
+		return "", false
+	}
+	return name, true
+}
+
+// resolveName returns the link name redirects to along with the name and entry of the mapping it
+// was resolved with: the link of its own mapping if there is one, otherwise the link of the longest
+// prefix of its path components with a mapping, given the rest of the path (see expandLink), so
+// that eg. go/drive/folders/abc redirects to the folders/abc path of go/drive. A wildcard mapping
+// for the prefix (eg. drive/*), which only matches paths under it, takes precedence over the
+// prefix's own mapping. The link is chosen for the visitor the request ctx is for comes from (see
+// visitorContext). The name of the mapping is returned in the case it's stored with (see
+// Canonicalizer). ErrNotFound is returned if there are no such mappings, and errExpired (along
+// with the match, entry and link) if the mapping has expired.
+func resolveName(ctx context.Context, store Store, name string) (match string, e *Entry, link string, err error) {
+	v := visitorOf(ctx)
+	e, err = store.Get(ctx, name)
+	if err == nil {
+		return canonical(ctx, store, name), e, expandLink(e.ChooseFor(v), "", v.Query), expired(e)
+	}
+
+	n := name
+	for err == ErrNotFound {
+		i := strings.LastIndexByte(n, '/')
+		if i < 0 {
+			break
+		}
+		n = n[:i]
+		for _, m := range []string{n + "/*", n} {
+			if e, err = store.Get(ctx, m); err == nil {
+				return canonical(ctx, store, m), e, expandLink(e.ChooseFor(v), name[i:], v.Query), expired(e)
+			}
+			if err != ErrNotFound {
+				break
+			}
+		}
+	}
+	return "", nil, "", err
+}
+
+// errExpired is returned by resolve for mappings which have expired (see Entry.Expires).
+var errExpired = errors.New("expired")
+
+// expired returns errExpired if e has expired.
+func expired(e *Entry) error {
+	if e.Expired() {
+		return fmt.Errorf("%w on %s", errExpired, e.Expires.Format("2006-01-02 15:04"))
+	}
+	return nil
+}
+
+// placeholder matches the placeholders in templated links, which are either numbered from 1, the
+// %s used by other golinks services for the whole rest of the path, or named after a query
+// parameter and optionally followed by '=' and its default, eg. {env=prod}.
+var placeholder = regexp.MustCompile(`\{([1-9][0-9]*)\}|%s|\{([A-Za-z_][A-Za-z0-9_]*)(?:=([^{}]*))?\}`)
+
+// escapedPlaceholder matches placeholders which have had their braces escaped.
+var escapedPlaceholder = regexp.MustCompile(`(?i)%7B([1-9][0-9]*|[a-z_][a-z0-9_]*(?:=.*?)?)%7D`)
+
+// expandLink returns where link redirects to given the rest of the path after the name it was
+// resolved with (suffix, which is either empty or starts with '/') and the query of the request
+// (if there is one). If link is a template, its placeholders {1}, {2}, ... are replaced with the
+// corresponding segments of suffix (or removed if there aren't that many), so that eg.
+// go/jira/ABC-123 with the link https://jira/browse/{1} redirects to https://jira/browse/ABC-123.
+// A %s placeholder is replaced with all of suffix, for compatibility with links from other golinks
+// services. Named placeholders are replaced with the query parameter they're named after (or their
+// default, or removed if there isn't one), so that eg. go/logs?service=api with the link
+// https://logs/search?service={service}&env={env=prod} redirects to
+// https://logs/search?service=api&env=prod. Any segments which aren't used are appended to the path
+// (see appendPath).
+func expandLink(link, suffix string, query url.Values) string {
+	if !placeholder.MatchString(link) {
+		if suffix == "" {
+			return link
+		}
+		return appendPath(link, suffix)
+	}
+
+	var args []string
+	if suffix != "" {
+		args = strings.Split(suffix[1:], "/")
+	}
+	// Segments and parameters are escaped for the part of the link their placeholder is in, while
+	// defaults are already escaped (as they're part of the link) unless they're invalid.
+	queryAt := strings.IndexAny(link, "?#")
+	escape := func(i int, s string) string {
+		if queryAt >= 0 && i > queryAt {
+			return url.QueryEscape(s)
+		}
+		return url.PathEscape(s)
+	}
+	unescape := func(i int, s string) string {
+		u, err := url.PathUnescape(s)
+		if queryAt >= 0 && i > queryAt {
+			u, err = url.QueryUnescape(s)
+		}
+		if err != nil {
+			return s
 		}
+		return u
+	}
+	var b strings.Builder
+	used, last := 0, 0
+	for _, m := range placeholder.FindAllStringSubmatchIndex(link, -1) {
+		b.WriteString(link[last:m[0]])
+		last = m[1]
+		switch {
+		case m[4] >= 0:
+			v, ok := query[link[m[4]:m[5]]]
+			switch {
+			case ok && len(v) > 0:
+				b.WriteString(escape(m[0], v[0]))
+			case m[6] >= 0:
+				b.WriteString(escape(m[0], unescape(m[0], link[m[6]:m[7]])))
+			}
+		case m[2] < 0:
+			used = len(args)
+			if queryAt >= 0 && m[0] > queryAt {
+				b.WriteString(url.QueryEscape(strings.Join(args, "/")))
+				continue
+			}
+			for i, arg := range args {
+				if i > 0 {
+					b.WriteByte('/')
+				}
+				b.WriteString(url.PathEscape(arg))
+			}
+		default:
+			n, _ := strconv.Atoi(link[m[2]:m[3]])
+			if n > used {
+				used = n
+			}
+			if n <= len(args) {
+				b.WriteString(escape(m[0], args[n-1]))
+			}
+		}
+	}
+	b.WriteString(link[last:])
+
+	link = b.String()
+	if used < len(args) {
+		link = appendPath(link, "/"+strings.Join(args[used:], "/"))
+	}
+	return link
+}
+
+// appendPath returns link with suffix (a path starting with '/') appended to its path, before any
+// query or fragment and without doubling up the slash if its path already ends with one.
+func appendPath(link, suffix string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return link + suffix
+	}
+	p := strings.TrimSuffix(u.EscapedPath(), "/") + (&url.URL{Path: suffix}).EscapedPath()
+	if u.Path, err = url.PathUnescape(p); err != nil {
+		return link + suffix
+	}
+	u.RawPath = p
+	return u.String()
+}
 
+// getPreview renders where name would redirect to (as with getLink) along with who owns the
+// mapping and how often it's been followed, instead of redirecting, so that links can be checked
+// before being followed. The mapping can be transferred to another owner from there. Where it's
+// been followed from over the last month is shown too, if that's recorded (see recordSources).
+func getPreview(auth *Auth, store Store, hits *Hits, stats *Stats, name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !auth.IsAuth(r) {
 			http.Redirect(w, r, "/login", 302)
 			return
 		}
 
-		getIndex(store, auth.XSRF(), name).ServeHTTP(w, r)
+		match, e, link, err := resolve(visitorContext(r), store, r.Host, name)
+		if err == ErrNotFound {
+			httpError(w, 404, err)
+			return
+		}
+		if errors.Is(err, errAliasLoop) {
+			httpError(w, 508, err)
+			return
+		}
+		if err != nil && !errors.Is(err, errExpired) {
+			httpError(w, 500, err)
+			return
+		}
+		var hit Hit
+		if hits != nil {
+			hit = hits.Get(match)
+		}
+		var referrers, clients []Count
+		if stats != nil && configOf(r.Context()).recordSources {
+			referrers, clients = stats.Sources(match, statsWindows["month"])
+		}
+
+		render(w, "preview.html", struct {
+			Title     string
+			Token     string
+			Name      string
+			Match     string
+			Link      string
+			Entry     *Entry
+			Hits      Hit
+			Referrers []Count
+			Clients   []Count
+		}{
+			fmt.Sprintf("preview - %s", name), auth.XSRF(r), name, match, link, e, hit, referrers, clients,
+		})
 	})
 }
 
-// getIndex renders the index of all saved name -> link mappings for an authed user.
-func getIndex(store Store, token string, name string) http.Handler {
+// getHistory renders the history of name, allowing any previous version to be reverted to.
+func getHistory(auth *Auth, store Store, name string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var data []NameLink
-		_ = store.Iterate(func(name, link string) error {
-			data = append(data, NameLink{Name: name, Link: link})
-			return nil
-		})
+		if !auth.IsAuth(r) {
+			http.Redirect(w, r, "/login", 302)
+			return
+		}
+
+		versions, err := history(r.Context(), store, name)
+		if err == errNoHistory {
+			httpError(w, 404, err)
+			return
+		}
+		if err != nil {
+			httpError(w, 500, err)
+			return
+		}
+		if len(versions) == 0 {
+			httpError(w, 404)
+			return
+		}
 
-		t := template.Must(compileTemplates(resource("index.html")))
-		_ = t.Execute(w, struct {
+		// Display the most recent version first.
+		data := make([]NameLink, len(versions))
+		for i, e := range versions {
+			data[len(versions)-1-i] = NameLink{Name: name, Entry: *e}
+		}
+
+		render(w, "history.html", struct {
 			Title string
 			Token string
 			Name  string
 			Data  []NameLink
 		}{
-			fmt.Sprintf("goto - %s", r.Host), token, name, data,
+			fmt.Sprintf("history - %s", name), auth.XSRF(r), name, data,
 		})
 	})
 }
 
+// IndexLink is a mapping shown on the index, which may have been starred by the user viewing it,
+// along with when it was last followed (which is zero if it hasn't been since hits were counted)
+// and which of its links were broken when they were last checked (see linkChecker).
+type IndexLink struct {
+	NameLink
+	Starred  bool
+	LastUsed time.Time
+	Broken   []LinkCheck
+}
+
+// getIndex renders a page of the index of all saved name -> link mappings for an authed user (see
+// paginate and indexOrder), optionally filtered by the tag query parameter.
+func getIndex(store Store, hits *Hits, stars *Stars, token string, name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := configOf(r.Context())
+		page, limit, err := paginate(r, indexPage)
+		if err != nil {
+			httpError(w, 400, err)
+			return
+		}
+		order, err := indexOrder(w, r)
+		if err != nil {
+			httpError(w, 400, err)
+			return
+		}
+		var byUse *Hits
+		if order == "used" {
+			byUse = hits
+		}
+		starred, err := fetchStarred(r.Context(), store, stars, identity(r), r.URL.Query().Get("tag"))
+		if err != nil {
+			httpError(w, 500, err)
+			return
+		}
+		var top []Count
+		if page == 1 {
+			if top, err = fetchTop(r.Context(), store, hits, cfg.topLinks, r.URL.Query().Get("tag")); err != nil {
+				httpError(w, 500, err)
+				return
+			}
+		}
+		// The page is requested conditionally (see conditionalPage), so it varies with everything
+		// else shown on it.
+		vary := []string{token, name, r.Host, order}
+		for _, nl := range starred {
+			vary = append(vary, nl.Name, nl.ETag())
+		}
+		for _, c := range top {
+			vary = append(vary, c.Name)
+		}
+		if hits != nil {
+			vary = append(vary, strconv.FormatInt(hits.Days(), 10))
+		}
+		if cfg.linkChecker != nil {
+			vary = append(vary, cfg.linkChecker.Checked().String())
+		}
+		data, more, ok, err := conditionalPage(w, r, store, byUse, page, limit, vary...)
+		if err != nil {
+			httpError(w, 500, err)
+			return
+		}
+		if !ok {
+			return
+		}
+
+		// The starred mappings are shown at the top of the first page instead of where they'd
+		// otherwise be.
+		var links []IndexLink
+		isStarred := make(map[string]bool, len(starred))
+		for _, nl := range starred {
+			isStarred[nl.Name] = true
+			if page == 1 {
+				links = append(links, IndexLink{NameLink: nl, Starred: true})
+			}
+		}
+		for _, nl := range data {
+			if !isStarred[nl.Name] {
+				links = append(links, IndexLink{NameLink: nl})
+			}
+		}
+		for i := range links {
+			if hits != nil {
+				links[i].LastUsed = hits.Get(links[i].Name).Last
+			}
+			if cfg.linkChecker != nil {
+				links[i].Broken = cfg.linkChecker.Broken(links[i].Name)
+			}
+		}
+
+		prev, next := page-1, 0
+		if more {
+			next = page + 1
+		}
+		render(w, "index.html", struct {
+			Title string
+			Token string
+			Name  string
+			Top   []Count
+			Data  []IndexLink
+			Prev  int
+			Next  int
+			Limit int
+			Tag   string
+			Sort  string
+		}{
+			fmt.Sprintf("goto - %s", r.Host), token, name, top, links, prev, next, limit, r.URL.Query().Get("tag"), order,
+		})
+	})
+}
+
+// indexOrder returns the order the index should be in for r (see indexSort): the sort query
+// parameter if it's given, which is remembered in the sortCookie for later requests, or otherwise
+// the order the cookie remembers, if any.
+func indexOrder(w http.ResponseWriter, r *http.Request) (string, error) {
+	if order := r.URL.Query().Get("sort"); order != "" {
+		if order != "set" && order != "used" {
+			return "", fmt.Errorf("invalid sort %q: must be set or used", order)
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     sortCookie,
+			Value:    order,
+			Path:     "/",
+			MaxAge:   365 * 24 * 60 * 60,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		return order, nil
+	}
+	if c, err := r.Cookie(sortCookie); err == nil && (c.Value == "set" || c.Value == "used") {
+		return c.Value, nil
+	}
+	return configOf(r.Context()).indexSort, nil
+}
+
+// fetchStarred returns the mappings user has starred which still exist (and have tag, if it isn't
+// empty), most recently starred first.
+func fetchStarred(ctx context.Context, store Store, stars *Stars, user, tag string) ([]NameLink, error) {
+	if stars == nil {
+		return nil, nil
+	}
+	var starred []NameLink
+	for _, name := range stars.Starred(user) {
+		e, err := store.Get(ctx, name)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if tag == "" || e.HasTag(tag) {
+			starred = append(starred, NameLink{Name: name, Entry: *e})
+		}
+	}
+	return starred, nil
+}
+
+// fetchTop returns the n most followed mappings which still exist (and have tag, if it isn't
+// empty), most followed first.
+func fetchTop(ctx context.Context, store Store, hits *Hits, n int, tag string) ([]Count, error) {
+	if hits == nil || n <= 0 {
+		return nil, nil
+	}
+	var top []Count
+	for _, c := range hits.Ranked() {
+		if len(top) == n {
+			break
+		}
+		e, err := store.Get(ctx, c.Name)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if tag == "" || e.HasTag(tag) {
+			top = append(top, c)
+		}
+	}
+	return top, nil
+}
+
+// paginate returns the page (starting from 1) and number of mappings per page requested by the
+// page and limit query parameters of r, which default to the first page of def mappings. Pages
+// can be at most maxPage mappings.
+func paginate(r *http.Request, def int) (page, limit int, err error) {
+	page, limit = 1, def
+	q := r.URL.Query()
+	if p := q.Get("page"); p != "" {
+		if page, err = strconv.Atoi(p); err != nil || page < 1 {
+			return 0, 0, fmt.Errorf("invalid page %q", p)
+		}
+	}
+	if l := q.Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > maxPage {
+			return 0, 0, fmt.Errorf("invalid limit %q", l)
+		}
+	}
+	return page, limit, nil
+}
+
+// iterateByUse calls cb with the mappings in store (with tag, if it isn't empty) in order of when
+// they were last followed according to hits, most recently first. Mappings which have never been
+// followed come last, most recently Set first.
+func iterateByUse(ctx context.Context, store Store, hits *Hits, tag string, cb func(name string, e *Entry) error) error {
+	var all []NameLink
+	err := store.Iterate(ctx, func(name string, e *Entry) error {
+		if tag == "" || e.HasTag(tag) {
+			all = append(all, NameLink{Name: name, Entry: *e})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	last := make(map[string]time.Time, len(all))
+	for _, nl := range all {
+		last[nl.Name] = hits.Get(nl.Name).Last
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		return last[all[i].Name].After(last[all[j].Name])
+	})
+	for _, nl := range all {
+		if err := cb(nl.Name, &nl.Entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// conditionalPage fetches page of the store as with fetchPage (of only the mappings with the tag
+// query parameter, if it's given) for a request which may be conditional, setting an ETag which
+// identifies the page (along with anything in vary which the response also depends on). If the
+// request's If-None-Match matches, a 304 is sent and ok is false. The ETag is derived from the
+// store's revision if it's a Revisioner, so that the page doesn't have to be fetched to send a
+// 304, and otherwise (or if the mappings are ordered by use, which the revision doesn't reflect)
+// from the mappings on the page.
+func conditionalPage(w http.ResponseWriter, r *http.Request, store Store, byUse *Hits, page, limit int, vary ...string) (data []NameLink, more, ok bool, err error) {
+	rev, err := revision(r.Context(), store)
+	if err != nil {
+		return nil, false, false, err
+	}
+	tag := r.URL.Query().Get("tag")
+	fetched := rev == "" || byUse != nil
+	if fetched {
+		if data, more, err = fetchPage(r.Context(), store, byUse, page, limit, tag); err != nil {
+			return nil, false, false, err
+		}
+		b, _ := json.Marshal(data)
+		rev = fmt.Sprintf("%x", sha256.Sum256(b))
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%d\n%d\n%s\n%s", rev, page, limit, tag, strings.Join(vary, "\n"))
+	etag := fmt.Sprintf(`W/"%x"`, h.Sum(nil)[:16])
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if matchETag(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil, false, false, nil
+	}
+
+	if !fetched {
+		if data, more, err = fetchPage(r.Context(), store, nil, page, limit, tag); err != nil {
+			return nil, false, false, err
+		}
+	}
+	return data, more, true, nil
+}
+
+// matchETag returns whether the If-None-Match header inm matches etag, using weak comparison.
+func matchETag(inm, etag string) bool {
+	for _, t := range strings.Split(inm, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchPage returns the mappings on page of the store when split into pages of limit mappings,
+// along with whether there are any later pages. If tag isn't empty only the mappings with it are
+// included, which requires iterating over every mapping before the page. If byUse isn't nil the
+// mappings are ordered by when they were last followed (see Hits), most recently first, rather
+// than by when they were last Set, which requires iterating over every mapping.
+func fetchPage(ctx context.Context, store Store, byUse *Hits, page, limit int, tag string) ([]NameLink, bool, error) {
+	data := []NameLink{}
+	cb := func(name string, e *Entry) error {
+		data = append(data, NameLink{Name: name, Entry: *e})
+		return nil
+	}
+	// An extra mapping is fetched to find out whether there's another page.
+	var err error
+	switch {
+	case byUse != nil:
+		err = iterateWindow(func(cb func(name string, e *Entry) error) error {
+			return iterateByUse(ctx, store, byUse, tag, cb)
+		}, (page-1)*limit, limit+1, cb)
+	case tag == "":
+		err = iterateRange(ctx, store, (page-1)*limit, limit+1, cb)
+	default:
+		err = iterateWindow(func(cb func(name string, e *Entry) error) error {
+			return store.Iterate(ctx, func(name string, e *Entry) error {
+				if !e.HasTag(tag) {
+					return nil
+				}
+				return cb(name, e)
+			})
+		}, (page-1)*limit, limit+1, cb)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if len(data) > limit {
+		return data[:limit], true, nil
+	}
+	return data, false, nil
+}
+
 // postLink handlers creating new mappings or updating/deleting mappings from name to
 // the link parameter it receives in the request. If update is true, this will only support
-// updating already existing mappings.
+// updating already existing mappings. Changes must be made to the version of the mapping they were
+// loaded from (see checkMatch) by someone allowed to make them (see checkOwner).
 func postLink(store Store, name string, update bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		n := r.PostFormValue("name")
+		n := normalizeName(r.PostFormValue("name"))
 		link := r.PostFormValue("link")
 
 		// Empty or missing link means we attempt to delete.
@@ -165,40 +1397,208 @@ func postLink(store Store, name string, update bool) http.Handler {
 			return
 		}
 
+		updates.Lock()
+		defer updates.Unlock()
+
 		// If link we actually an alias ("name" or "go/name") instead of a URL, we convert it.
-		// We also normalize the link so everything follows a uniform pattern.
-		link, err := normalizeLink(canonicalizeAlias(store, r.Host, link))
+		// We also normalize the link so everything follows a uniform pattern. Several links
+		// (optionally weighted) can be given to choose between.
+		link, dests, err := parseDestinations(r.Context(), store, r.Host, link)
 		if err != nil {
 			httpError(w, 400)
 			return
 		}
-
-		// If the name in the form body is present and doesn't match name then we delete the
-		// original name and use the name from the body instead/
-		del := ""
-		if n != "" && n != name {
-			del = name
-			name = n
+
+		// The mapping being changed must not have changed since it was loaded.
+		current, err := store.Get(r.Context(), name)
+		if err != nil && err != ErrNotFound {
+			httpError(w, 500, err)
+			return
+		}
+		if code, err := checkMatch(ifMatch(r), current); code != 0 {
+			httpError(w, code, err)
+			return
+		}
+		if err := checkOwner(r, current); err != nil {
+			httpError(w, 403, err)
+			return
+		}
+
+		// If the name in the form body is present and doesn't match name then we delete the
+		// original name and use the name from the body instead/
+		del := ""
+		if n != "" && n != name {
+			del = name
+			name = n
+		}
+		if err := checkLoop(r.Context(), store, r.Host, name, link, dests); err != nil {
+			httpError(w, 400, err)
+			return
+		}
+		if err := checkPublic(r.Context(), r.Host, link, dests); err != nil {
+			httpError(w, 400, err)
+			return
+		}
+
+		// UPDATE should only work on links which already existed
+		existing, err := store.Get(r.Context(), name)
+		if update && err == ErrNotFound {
+			httpError(w, 404)
+			return
+		}
+		if err == nil && del != "" {
+			if err := checkOwner(r, existing); err != nil {
+				httpError(w, 403, err)
+				return
+			}
+		}
+
+		// When renaming, the metadata carries over from the original name.
+		if del != "" && (err == nil || err == ErrNotFound) {
+			existing, err = store.Get(r.Context(), del)
+		}
+		if err != nil && err != ErrNotFound {
+			httpError(w, 500, err)
+			return
+		}
+		now := time.Now()
+		e := &Entry{Link: link, Created: now, Updated: now, CreatedBy: identity(r), Destinations: dests}
+		if err == nil {
+			e.Created, e.CreatedBy, e.Expires, e.Tags = existing.Created, existing.CreatedBy, existing.Expires, existing.Tags
+			e.Owner, e.Description, e.Params = existing.Owner, existing.Description, existing.Params
+			e.Regions, e.Languages, e.Mobile, e.Bundle = existing.Regions, existing.Languages, existing.Mobile, existing.Bundle
+			e.Untracked = existing.Untracked
+		}
+		// The expiry, tags, description, params, regions, languages, mobile link and whether it's a
+		// bundle or untracked carry over unless they're given, and are removed if they're given empty.
+		if _, ok := r.PostForm["expires"]; ok {
+			if e.Expires, err = parseExpires(r.PostFormValue("expires")); err != nil {
+				httpError(w, 400, err)
+				return
+			}
+		}
+		if _, ok := r.PostForm["tags"]; ok {
+			if e.Tags, err = parseTags(r.PostFormValue("tags")); err != nil {
+				httpError(w, 400, err)
+				return
+			}
+		}
+		if _, ok := r.PostForm["description"]; ok {
+			if e.Description, err = normalizeDescription(r.PostFormValue("description")); err != nil {
+				httpError(w, 400, err)
+				return
+			}
+		}
+		if _, ok := r.PostForm["params"]; ok {
+			if e.Params, err = parseParams(r.PostFormValue("params")); err != nil {
+				httpError(w, 400, err)
+				return
+			}
+		}
+		if _, ok := r.PostForm["regions"]; ok {
+			if e.Regions, err = parseRegions(r.Context(), store, r.Host, r.PostFormValue("regions")); err != nil {
+				httpError(w, 400, err)
+				return
+			}
+			if err := checkLoop(r.Context(), store, r.Host, name, "", linkDestinations(e.Regions)); err != nil {
+				httpError(w, 400, err)
+				return
+			}
+			if err := checkPublic(r.Context(), r.Host, "", linkDestinations(e.Regions)); err != nil {
+				httpError(w, 400, err)
+				return
+			}
+		}
+		if _, ok := r.PostForm["languages"]; ok {
+			if e.Languages, err = parseLanguages(r.Context(), store, r.Host, r.PostFormValue("languages")); err != nil {
+				httpError(w, 400, err)
+				return
+			}
+			if err := checkLoop(r.Context(), store, r.Host, name, "", linkDestinations(e.Languages)); err != nil {
+				httpError(w, 400, err)
+				return
+			}
+			if err := checkPublic(r.Context(), r.Host, "", linkDestinations(e.Languages)); err != nil {
+				httpError(w, 400, err)
+				return
+			}
+		}
+		if _, ok := r.PostForm["mobile"]; ok {
+			if e.Mobile, err = normalizeMobile(r.Context(), store, r.Host, r.PostFormValue("mobile")); err != nil {
+				httpError(w, 400, err)
+				return
+			}
+			if err := checkLoop(r.Context(), store, r.Host, name, e.Mobile, nil); err != nil {
+				httpError(w, 400, err)
+				return
+			}
+			if err := checkPublic(r.Context(), r.Host, e.Mobile, nil); err != nil {
+				httpError(w, 400, err)
+				return
+			}
+		}
+		if _, ok := r.PostForm["bundle"]; ok {
+			if e.Bundle, err = parseBool("bundle", r.PostFormValue("bundle")); err != nil {
+				httpError(w, 400, err)
+				return
+			}
+		}
+		if _, ok := r.PostForm["untracked"]; ok {
+			if e.Untracked, err = parseBool("untracked", r.PostFormValue("untracked")); err != nil {
+				httpError(w, 400, err)
+				return
+			}
+		}
+
+		// Renames delete the original name in the same batch so that they're atomic.
+		entries := map[string]*Entry{name: e}
+		if del != "" {
+			entries[del] = nil
+		}
+
+		err = setAll(r.Context(), store, entries)
+		if errors.Is(err, ErrQuotaExceeded) {
+			httpError(w, 507, err)
+			return
+		}
+		if err != nil {
+			httpError(w, 500, err)
+			return
+		}
+
+		http.Redirect(w, r, "/", 302)
+	})
+}
+
+// deleteLink removes any mappings for name from the store, provided it's the version in the
+// etag parameter or If-Match header if either is given (see checkMatch) and the request is allowed
+// to change it (see checkOwner).
+func deleteLink(store Store, name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		updates.Lock()
+		defer updates.Unlock()
+
+		e, err := store.Get(r.Context(), name)
+		if err == ErrNotFound {
+			httpError(w, 404)
+			return
+		}
+		if err != nil {
+			httpError(w, 500, err)
+			return
 		}
-
-		// UPDATE should only work on links which already existed
-		if update {
-			_, ok := store.Get(name)
-			if !ok {
-				httpError(w, 404)
+		if match := ifMatch(r); match != "" {
+			if code, err := checkMatch(match, e); code != 0 {
+				httpError(w, code, err)
 				return
 			}
 		}
-
-		if del != "" {
-			err = store.Set(del, "")
-			if err != nil {
-				httpError(w, 500, err)
-				return
-			}
+		if err := checkOwner(r, e); err != nil {
+			httpError(w, 403, err)
+			return
 		}
 
-		err = store.Set(name, link)
+		err = store.Set(r.Context(), name, nil)
 		if err != nil {
 			httpError(w, 500, err)
 			return
@@ -208,17 +1608,29 @@ func postLink(store Store, name string, update bool) http.Handler {
 	})
 }
 
-// deleteLink removes any mappings for name from the store.
-func deleteLink(store Store, name string) http.Handler {
+// postStar stars name for the user making the request (see identity), or unstars it if star is
+// false, so that it's shown at the top of their index.
+func postStar(store Store, stars *Stars, name string, star bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		_, ok := store.Get(name)
-		if !ok {
+		if stars == nil {
 			httpError(w, 404)
 			return
 		}
-
-		err := store.Set(name, "")
-		if err != nil {
+		name = canonical(r.Context(), store, name)
+		if star {
+			if _, err := store.Get(r.Context(), name); err != nil {
+				if err == ErrNotFound {
+					httpError(w, 404)
+				} else {
+					httpError(w, 500, err)
+				}
+				return
+			}
+			if err := stars.Star(identity(r), name); err != nil {
+				httpError(w, 500, err)
+				return
+			}
+		} else if err := stars.Unstar(identity(r), name); err != nil {
 			httpError(w, 500, err)
 			return
 		}
@@ -230,26 +1642,33 @@ func deleteLink(store Store, name string) http.Handler {
 // canonicalizeAliases turns a link 'alias' into the correct absolute URL. Aliases
 // are of the form "name" or "go/name" provided "name" exists in the store.
 // We canonicalize the alias to point to the full link with the specified host.
-func canonicalizeAlias(store Store, host, link string) string {
+func canonicalizeAlias(ctx context.Context, store Store, host, link string) string {
 	if !strings.HasPrefix("http", link) {
 		link = strings.TrimPrefix(link, "go/")
-		_, ok := store.Get(link)
-		if ok {
+		_, err := store.Get(ctx, link)
+		if err == nil {
 			return fmt.Sprintf("https://%s/%s", host, link)
 		}
 	}
 	return link
 }
 
+// normalizeName normalizes name to Unicode Normalization Form C, so that names typed in different
+// ways (eg. with a precomposed character or a combining accent) are the same name.
+func normalizeName(name string) string {
+	return norm.NFC.String(name)
+}
+
 // normalizeLink ensures link is valid and then normalizes it so all links follow the
-// same uniform pattern.
+// same uniform pattern (with hosts in punycode, see punycodeHost). Templates must number their
+// placeholders consecutively from {1}.
 func normalizeLink(link string) (string, error) {
 	err := errors.New("invalid link")
 	if !isValidLink(link) {
 		return "", err
 	}
 
-	u, err := urlx.Parse(link)
+	u, err := urlx.Parse(escapePercentS(link))
 	if err != nil {
 		return "", err
 	}
@@ -257,20 +1676,362 @@ func normalizeLink(link string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	// normalizing escapes the braces of any placeholders in templates
+	normal = escapedPlaceholder.ReplaceAllString(normal, "{$1}")
+	normal = strings.ReplaceAll(normal, "%25s", "%s")
+	if normal, err = punycodeHost(normal); err != nil {
+		return "", err
+	}
+	used := make(map[string]bool)
+	for _, m := range placeholder.FindAllStringSubmatch(normal, -1) {
+		if m[1] != "" {
+			used[m[1]] = true
+		}
+	}
+	for i := 1; i <= len(used); i++ {
+		if !used[strconv.Itoa(i)] {
+			return "", fmt.Errorf("invalid template: missing placeholder {%d}", i)
+		}
+	}
 	// silly Google Docs analytics cruft
 	return strings.TrimSuffix(normal, "?usp=sharing"), nil
 }
 
+// punycodeHost encodes an internationalized host in link with punycode (eg. bücher.de as
+// xn--bcher-kva.de), so that it's the same however it was written.
+func punycodeHost(link string) (string, error) {
+	i := strings.Index(link, "://")
+	if i < 0 {
+		return link, nil
+	}
+	start := i + 3
+	end := len(link)
+	if j := strings.IndexAny(link[start:], "/?#"); j >= 0 {
+		end = start + j
+	}
+	if j := strings.LastIndexByte(link[start:end], '@'); j >= 0 {
+		start += j + 1
+	}
+	host := link[start:end]
+	if j := strings.LastIndexByte(host, ':'); j >= 0 && !strings.HasSuffix(host, "]") {
+		end, host = start+j, host[:j]
+	}
+
+	host, err := url.PathUnescape(host)
+	if err != nil {
+		return "", err
+	}
+	if isASCII(host) {
+		return link, nil
+	}
+	ascii, err := idna.Lookup.ToASCII(host)
+	if err != nil {
+		return "", err
+	}
+	return link[:start] + ascii + link[end:], nil
+}
+
+// isASCII returns whether s only contains ASCII characters.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// parseDestinations parses the links separated by whitespace in s, each of which may be prefixed
+// by its weight and a colon (eg. "9:https://example.com/a 1:https://example.com/b", with a weight
+// of 1 if none is given), canonicalizing any aliases and normalizing them. It returns the first
+// link and, if there are several, the destinations to choose between (see Entry.Choose).
+func parseDestinations(ctx context.Context, store Store, host, s string) (string, []Destination, error) {
+	fields := strings.Fields(s)
+	dests := make([]Destination, len(fields))
+	for i, f := range fields {
+		dests[i] = Destination{Link: f, Weight: 1}
+		if j := strings.IndexByte(f, ':'); j > 0 {
+			if w, err := strconv.Atoi(f[:j]); err == nil {
+				dests[i] = Destination{Link: f[j+1:], Weight: w}
+			}
+		}
+	}
+	return normalizeDestinations(ctx, store, host, dests)
+}
+
+// normalizeDestinations canonicalizes and normalizes the links of dests (which must have positive
+// weights), returning the first link along with them, unless there's only one destination.
+func normalizeDestinations(ctx context.Context, store Store, host string, dests []Destination) (string, []Destination, error) {
+	if len(dests) == 0 {
+		return "", nil, errors.New("invalid link")
+	}
+	normal := make([]Destination, len(dests))
+	for i, d := range dests {
+		if d.Weight <= 0 {
+			return "", nil, fmt.Errorf("invalid weight %d", d.Weight)
+		}
+		link, err := normalizeLink(canonicalizeAlias(ctx, store, host, d.Link))
+		if err != nil {
+			return "", nil, err
+		}
+		normal[i] = Destination{Link: link, Weight: d.Weight}
+	}
+	if len(normal) == 1 {
+		return normal[0].Link, nil, nil
+	}
+	return normal[0].Link, normal, nil
+}
+
+// linkDestinations returns the links in links (eg. the per-region links of a mapping) as
+// destinations, so that they can be checked along with its other destinations (see checkLoop and
+// checkPublic).
+func linkDestinations(links map[string]string) []Destination {
+	dests := make([]Destination, 0, len(links))
+	for _, link := range links {
+		dests = append(dests, Destination{Link: link})
+	}
+	return dests
+}
+
+// validTag matches the tags which links can have.
+var validTag = regexp.MustCompile(`^[\p{Ll}\p{Lo}\p{N}][\p{Ll}\p{Lo}\p{N}._-]*$`)
+
+// parseTags returns the tags separated by commas or whitespace in s (see normalizeTags).
+func parseTags(s string) ([]string, error) {
+	return normalizeTags(strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	}))
+}
+
+// normalizeTags lower cases tags and removes any duplicates, returning an error if any of them
+// aren't valid.
+func normalizeTags(tags []string) ([]string, error) {
+	var normal []string
+	seen := make(map[string]bool, len(tags))
+	for _, t := range tags {
+		t = strings.ToLower(normalizeName(t))
+		if !validTag.MatchString(t) {
+			return nil, fmt.Errorf("invalid tag %q", t)
+		}
+		if !seen[t] {
+			seen[t] = true
+			normal = append(normal, t)
+		}
+	}
+	return normal, nil
+}
+
+// maxDescription is the longest description a link can have, in characters.
+const maxDescription = 1000
+
+// normalizeDescription collapses the whitespace in a link's description (which is shown on a
+// single line), returning an error if it's longer than maxDescription.
+func normalizeDescription(s string) (string, error) {
+	s = strings.Join(strings.Fields(normalizeName(s)), " ")
+	if utf8.RuneCountInString(s) > maxDescription {
+		return "", fmt.Errorf("description longer than %d characters", maxDescription)
+	}
+	return s, nil
+}
+
+// parseParams parses the query parameters to append to a link from a query string such as
+// utm_source=golinks&utm_campaign=launch (only the first value of each is used).
+func parseParams(s string) (map[string]string, error) {
+	q, err := url.ParseQuery(strings.TrimPrefix(s, "?"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid params: %w", err)
+	}
+	return normalizeParams(flattenQuery(q))
+}
+
+// flattenQuery returns the first value of each of the parameters in q.
+func flattenQuery(q url.Values) map[string]string {
+	params := make(map[string]string, len(q))
+	for k := range q {
+		params[k] = q.Get(k)
+	}
+	return params
+}
+
+// normalizeParams returns an error if any of params has an empty name, and nil if there aren't any.
+func normalizeParams(params map[string]string) (map[string]string, error) {
+	if len(params) == 0 {
+		return nil, nil
+	}
+	for k := range params {
+		if k == "" {
+			return nil, errors.New("invalid params: empty name")
+		}
+	}
+	return params, nil
+}
+
+// parseExpires parses when a link expires from either an RFC 3339 time or a date (which the link
+// expires at the start of, in local time). An empty string means the link never expires.
+func parseExpires(s string) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		if t, err = time.ParseInLocation("2006-01-02", s, time.Local); err != nil {
+			return nil, errors.New("invalid expiry: must be a date or RFC 3339 time")
+		}
+	}
+	return &t, nil
+}
+
+// parseBool parses the value s of the form parameter param from a boolean or the "on" of a
+// checkbox. An empty string means false.
+func parseBool(param, s string) (bool, error) {
+	if s == "" || s == "on" {
+		return s == "on", nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: must be a boolean", param)
+	}
+	return b, nil
+}
+
+// identity returns who is responsible for the request r: the identityHeader set by an
+// authenticating proxy if there is one, or the user it's logged in as with user accounts (see
+// userContext), or otherwise (with the single shared password) the best we can do is the address
+// of the client.
+func identity(r *http.Request) string {
+	if id := knownIdentity(r); id != "" {
+		return id
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// knownIdentity returns who is responsible for the request r as identity does, or nothing if only
+// the address of the client is known.
+func knownIdentity(r *http.Request) string {
+	if identityHeader := configOf(r.Context()).identityHeader; identityHeader != "" {
+		if id := r.Header.Get(identityHeader); id != "" {
+			return id
+		}
+	}
+	if u := userOf(r.Context()); u != nil {
+		return u.Name
+	}
+	return ""
+}
+
+// visitor describes who a request comes from (and what it asks for), which links can redirect to
+// different destinations for (see Entry.ChooseFor and expandLink).
+type visitor struct {
+	// Region is the region the request comes from (see regionHeader), if it's known.
+	Region string
+	// Mobile is whether the request comes from a phone or tablet.
+	Mobile bool
+	// Languages are the languages the request accepts, in order of preference.
+	Languages []language.Tag
+	// Query is the query of the request, which fills in the named placeholders of templates.
+	Query url.Values
+}
+
+// visitorKey is the context key of the visitor a request comes from.
+type visitorKey struct{}
+
+// visitorContext returns the context of r along with the visitor it comes from (see visitorOf).
+func visitorContext(r *http.Request) context.Context {
+	v := visitor{Mobile: mobileAgent.MatchString(r.UserAgent()), Query: r.URL.Query()}
+	if regionHeader := configOf(r.Context()).regionHeader; regionHeader != "" {
+		v.Region = strings.ToLower(strings.TrimSpace(r.Header.Get(regionHeader)))
+	}
+	if accept := r.Header.Get("Accept-Language"); accept != "" {
+		v.Languages, _, _ = language.ParseAcceptLanguage(accept)
+	}
+	return context.WithValue(r.Context(), visitorKey{}, v)
+}
+
+// visitorOf returns the visitor the request ctx is for comes from, which is unknown unless the
+// context is from visitorContext.
+func visitorOf(ctx context.Context) visitor {
+	v, _ := ctx.Value(visitorKey{}).(visitor)
+	return v
+}
+
+// updates is held while checking the preconditions of changes and making them, so that concurrent
+// changes to the same mapping through this instance can't both pass the check.
+var updates sync.Mutex
+
+// ifMatch returns the ETags the version of a mapping which r changes must match, from either the
+// If-Match header or the etag parameter of forms.
+func ifMatch(r *http.Request) string {
+	if match := r.Header.Get("If-Match"); match != "" {
+		return match
+	}
+	return r.PostFormValue("etag")
+}
+
+// checkMatch returns the status code (and error) with which to reject a change to existing (which
+// is nil if the mapping doesn't exist) given the ETags it must match, or 0 if it may be made. A
+// change to an existing mapping must match its ETag (or "*"), so that people editing the same
+// mapping can't silently overwrite each other's changes.
+func checkMatch(match string, existing *Entry) (int, error) {
+	if match == "" {
+		if existing != nil {
+			return 428, errors.New("it already exists, so the version being changed must be given")
+		}
+		return 0, nil
+	}
+	if existing != nil {
+		for _, t := range strings.Split(match, ",") {
+			if t = strings.TrimSpace(t); t == "*" || t == existing.ETag() {
+				return 0, nil
+			}
+		}
+	}
+	return 412, errors.New("it has been changed since it was loaded")
+}
+
 // isValidName confirms that name is a valid path.
 func isValidName(name string) bool {
 	if name == "healthz" ||
+		name == "livez" ||
+		name == "readyz" ||
 		name == "favicon.ico" ||
 		name == "login" ||
-		name == "logout" {
+		name == oidcCallbackPath[1:] ||
+		name == "logout" ||
+		name == settingsPath[1:] ||
+		name == usersPath[1:] ||
+		name == statsPath[1:] ||
+		name == auditPath[1:] ||
+		name == suggestPath[1:] ||
+		name == openSearchPath[1:] ||
+		name == feedPath[1:] ||
+		name == eventsPath[1:] ||
+		name == replicationPath[1:] ||
+		name == graphqlPath[1:] ||
+		name == importPath[1:] ||
+		name == exportPath[1:] ||
+		name == searchPath[1:] ||
+		name == resolvePath[1:] ||
+		name == brokenPath[1:] ||
+		name == staleAPIPath[1:] ||
+		name == statsExportPath[1:] ||
+		name == metricsPath[1:] ||
+		name == varsPath[1:] ||
+		name == stalePath[1:] ||
+		name == openAPIPath[1:] ||
+		name == apiPath[1:] || strings.HasPrefix(name, apiPath[1:]+"/") {
 		// shouldn't be possible anyway, but reject just in case
 		return false
 	}
 
+	// a trailing '+' requests a preview of the name without it
+	if strings.HasSuffix(name, "+") {
+		return false
+	}
+
 	// this also should be somewhat redundant - if the name wasn't valid how
 	// did we get here in the first place?
 	_, err := url.Parse("/" + name)
@@ -279,13 +2040,19 @@ func isValidName(name string) bool {
 
 // isValidLink confirms that link is a valid, absolute URL.
 func isValidLink(link string) bool {
-	u, err := url.Parse(link)
+	u, err := url.Parse(escapePercentS(link))
 	if err != nil {
 		return false
 	}
 	return u.IsAbs()
 }
 
+// escapePercentS escapes any %s placeholders in link, which aren't valid escapes themselves, so
+// that it can be parsed.
+func escapePercentS(link string) string {
+	return strings.ReplaceAll(link, "%s", "%25s")
+}
+
 func httpError(w http.ResponseWriter, code int, err ...error) {
 	msg := http.StatusText(code)
 	if len(err) > 0 {
@@ -299,6 +2066,14 @@ func resource(filename string) string {
 	return filepath.Join(filepath.Dir(src), filename)
 }
 
+// render renders the template in filename (see resource) with data to w, recording how long it
+// took (see renderSeconds).
+func render(w io.Writer, filename string, data interface{}) {
+	defer renderSeconds.Since(filename, time.Now())
+	t := template.Must(compileTemplates(resource(filename)))
+	_ = t.Execute(w, data)
+}
+
 func compileTemplates(filenames ...string) (*template.Template, error) {
 	m := minify.New()
 	m.AddFunc("text/css", css.Minify)
@@ -332,6 +2107,8 @@ func compileTemplates(filenames ...string) (*template.Template, error) {
 	return tmpl, nil
 }
 
+// healthz reports whether the server is serving requests, which it stops doing once it starts to
+// shut down. It predates livez and readyz, which should be preferred.
 func healthz() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if atomic.LoadInt32(&healthy) == 1 {
@@ -342,6 +2119,36 @@ func healthz() http.Handler {
 	})
 }
 
+// livez is the liveness probe, which succeeds as long as the process is able to respond at all.
+func livez() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// readyzTimeout is how long readyz waits for the store to be checked.
+const readyzTimeout = 2 * time.Second
+
+// readyz is the readiness probe, which fails once the server starts to shut down or while the
+// store can't serve requests (see checkStore), so that instances whose store is broken stop being
+// routed requests they'd fail.
+func readyz(store Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&healthy) != 1 {
+			httpError(w, http.StatusServiceUnavailable, errors.New("shutting down"))
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), readyzTimeout)
+		defer cancel()
+		if err := checkStore(ctx, store); err != nil {
+			log.Printf("readiness check failed: %v\n", err)
+			httpError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
 func start(srv *http.Server) {
 	done := make(chan bool)
 	quit := make(chan os.Signal, 1)
@@ -370,43 +2177,378 @@ func start(srv *http.Server) {
 }
 
 func main() {
-	var hash, file string
-	var fuzzy, compact bool
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate(os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "users" {
+		if err := usersCommand(os.Args[2:], os.Stdin, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && clientArgs[os.Args[1]] != nil {
+		if err := client(os.Args[1], os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	cfg := defaultConfig()
+	var hash, dsn, file, syncPolicy, key, primary, token, repair string
+	var maxLinks, maxSize int64
+	var cacheSize, cacheMisses, grpcPort, debugPort int
+	var grpcToken, tokensFile, hitsFile, patternsFile, starsFile, statsFile, webhooks, webhookSecret, trusted, admin, appendParams, parent, parentToken string
+	var accessLogFile, auditFile, usersFile, sessionsFile string
+	var oidcIssuer, oidcClientID, oidcClientSecret, oidcDomain, oidcRedirect string
+	var accessLogSize, accessLogBackups int
+	var cacheTTL, compactEvery, checkLinks time.Duration
+	var compactMaxBytes int64
+	var clientQPS, linkQPS float64
+	var fuzzy, compact, recovery, fsck, insensitive bool
 	var port int64
 
-	flag.StringVar(&file, "file", "", "file for store")
-	flag.StringVar(&hash, "hash", os.Getenv("GOTO_PASSWORD_HASH"), "hash of password")
+	flag.StringVar(&dsn, "store", "", fmt.Sprintf("store to use, eg. 'sqlite:///var/lib/golinks.db' (one of: %s)", strings.Join(Stores(), ", ")))
+	flag.StringVar(&file, "file", "", "file for store (shorthand for -store file:FILE)")
+	flag.StringVar(&key, "store-key", "", "base64 AES key to encrypt the -file store with (defaults to $GOLINKS_STORE_KEY)")
+	flag.StringVar(&syncPolicy, "sync", "always", "when to fsync the -file store: 'always', 'never' or 'interval' (or an interval such as '5s')")
+	flag.StringVar(&hash, "hash", os.Getenv("GOTO_PASSWORD_HASH"), "hash of the shared password, unless there are -users")
+	flag.StringVar(&oidcIssuer, "oidc-issuer", "", "OpenID Connect provider to log in with instead of (or as well as) a password, eg. 'https://accounts.google.com' (disabled if empty)")
+	flag.StringVar(&oidcClientID, "oidc-client-id", "", "client ID registered with the -oidc-issuer")
+	flag.StringVar(&oidcClientSecret, "oidc-client-secret", os.Getenv("GOLINKS_OIDC_CLIENT_SECRET"), "client secret registered with the -oidc-issuer")
+	flag.StringVar(&oidcDomain, "oidc-domain", "", "domain accounts must be in to log in with the -oidc-issuer, eg. the Google Workspace domain 'corp.example' (required for Google)")
+	flag.StringVar(&oidcRedirect, "oidc-redirect-url", "", "URL the -oidc-issuer redirects back to, which must be registered with it (https://HOST/login/callback if empty)")
+	flag.StringVar(&usersFile, "users", "", "file to keep user accounts in, who each log in with their own password instead of the -hash and are managed with the 'users' subcommand and at /users (disabled if empty)")
+	flag.StringVar(&sessionsFile, "sessions", "", "file to keep login sessions in, so that nobody has to log in again after a restart (only kept in memory if empty)")
 	flag.BoolVar(&fuzzy, "fuzzy", false, "whether to use fuzzy name semantics")
-	flag.BoolVar(&compact, "compact", false, "whether to compact the store")
+	flag.BoolVar(&insensitive, "case-insensitive", false, "whether names differing only in case are the same name (redirecting to the case they were created with)")
+	flag.BoolVar(&compact, "compact", false, "whether to compact the store on startup")
+	flag.DurationVar(&compactEvery, "compact-every", 0, "how often to compact the -file store if it has dead lines (only when mostly dead if 0)")
+	flag.Int64Var(&compactMaxBytes, "compact-max-bytes", 0, "size in bytes above which to compact the -file store if it has dead lines (only when mostly dead if 0)")
+	flag.Int64Var(&maxLinks, "max-links", 0, "maximum number of links in the -file store (unlimited if 0)")
+	flag.Int64Var(&maxSize, "max-size", 0, "maximum size in bytes of the -file store's file (unlimited if 0)")
+	flag.IntVar(&cacheSize, "cache-size", 0, "number of links to cache in memory, for stores where lookups are slow (disabled if 0)")
+	flag.IntVar(&cacheMisses, "cache-misses", 0, "number of names which don't exist to cache in memory, for stores where lookups are slow (disabled if 0)")
+	flag.DurationVar(&cacheTTL, "cache-ttl", time.Minute, "how long cached links are used before being looked up again")
+	flag.BoolVar(&recovery, "recover", false, "skip invalid lines in the -file store, moving them to FILE.corrupt, instead of failing to start")
 	flag.Int64Var(&port, "port", 8968, "Port")
+	flag.StringVar(&primary, "primary", "", "URL of the primary to replicate from, making this instance a read-only replica")
+	flag.StringVar(&token, "replication-token", os.Getenv("GOLINKS_REPLICATION_TOKEN"), "token replicas use to authenticate with the primary (replication is disabled if empty)")
+	flag.IntVar(&grpcPort, "grpc-port", 0, "port to serve the gRPC API on (disabled if 0)")
+	flag.IntVar(&debugPort, "debug-port", 0, "port to serve pprof profiles (under /debug/pprof/) and expvar variables (at /debug/vars) on, which is only reachable from localhost (disabled if 0)")
+	flag.StringVar(&grpcToken, "grpc-token", os.Getenv("GOLINKS_GRPC_TOKEN"), "token gRPC clients must present")
+	flag.StringVar(&auditFile, "audit-log", "", "file to append a record of every link created, updated or deleted to, who by and what it was before and after, which is shown at /audit (not recorded if empty)")
+	flag.StringVar(&webhooks, "webhooks", "", "comma-separated URLs to POST an event to whenever a link is created, updated or deleted")
+	flag.StringVar(&webhookSecret, "webhook-secret", os.Getenv("GOLINKS_WEBHOOK_SECRET"), "secret to sign -webhooks events with")
+	flag.StringVar(&tokensFile, "tokens", "", "file to keep API tokens in, which are managed from /settings (disabled if empty)")
+	flag.StringVar(&hitsFile, "hits", "", "file to keep counts of how often each link is followed in (only kept in memory if empty)")
+	flag.StringVar(&accessLogFile, "access-log", "", "file to log requests to in the Apache combined log format, or '-' for stderr (not logged if empty)")
+	flag.IntVar(&accessLogSize, "access-log-max-size", 100, "size in megabytes the -access-log file is rotated at (never if 0)")
+	flag.IntVar(&accessLogBackups, "access-log-backups", 5, "number of rotated -access-log files to keep")
+	flag.DurationVar(&checkLinks, "check-links", 0, "how often to check every link for being broken, eg. '24h', which is shown on the index and reported at /api/v1/broken (never if 0)")
+	flag.Float64Var(&clientQPS, "rate-limit", 10, "requests per second allowed from each client address, above which they're rejected with a 429 (unlimited if 0)")
+	flag.Float64Var(&linkQPS, "link-rate-limit", 100, "requests per second allowed to follow each link, above which they're rejected with a 429 (unlimited if 0)")
+	flag.StringVar(&cfg.indexSort, "index-sort", cfg.indexSort, "order of the index unless users choose another: 'set' for the most recently set links first, or 'used' for the most recently followed first")
+	flag.IntVar(&cfg.topLinks, "top-links", cfg.topLinks, "number of the most followed links to show at the top of the index (none if 0)")
+	flag.BoolVar(&cfg.recordSources, "record-sources", false, "whether to record the referrer host and kind of browser and device links are followed from for /stats and previews, unless they opt out")
+	flag.StringVar(&statsFile, "stats", "", "file to keep daily counts of the links followed and names missed in for /stats (only kept in memory if empty)")
+	flag.StringVar(&starsFile, "stars", "", "file to keep the links each user has starred in (only kept in memory if empty)")
+	flag.StringVar(&patternsFile, "patterns", "", "file to keep pattern links in, which are managed from /settings (disabled if empty)")
+	flag.IntVar(&cfg.redirectCode, "redirect-code", cfg.redirectCode, "status code to redirect links with: 301, 302, 303, 307 or 308")
+	flag.StringVar(&cfg.redirectCacheControl, "redirect-cache-control", cfg.redirectCacheControl, "Cache-Control header to redirect links with (none if empty)")
+	flag.StringVar(&parent, "fallback-golinks", "", "URL of a parent golinks server to look up names which don't exist here with, eg. 'https://go.corp.example' (before -fallback-url)")
+	flag.StringVar(&parentToken, "fallback-golinks-token", os.Getenv("GOLINKS_FALLBACK_TOKEN"), "API token for the -fallback-golinks server to resolve names through its API with, so names it doesn't know are handled here (requests are redirected to it if empty)")
+	flag.StringVar(&cfg.fallbackURL, "fallback-url", "", "URL to redirect names which don't exist to, with %s replaced by the name, eg. 'https://wiki.corp/search?q=%s' (go/name?create creates them instead)")
+	flag.StringVar(&appendParams, "append-params", "", "query parameters to append to links when redirecting unless they already have them, eg. 'utm_source=golinks&utm_medium=link'")
+	flag.BoolVar(&cfg.stripPunctuation, "strip-punctuation", false, "whether to look up names which don't exist without any trailing punctuation (trailing slashes and dots always are)")
+	flag.StringVar(&cfg.regionHeader, "region-header", "", "header set by a proxy to the region (or country) requests come from, eg. 'X-Region', for links with per-region destinations")
+	flag.StringVar(&cfg.subdomainHost, "subdomains", "", "host whose subdomains resolve the same as its names, eg. 'go.corp.example' for name.go.corp.example (disabled if empty)")
+	flag.StringVar(&trusted, "trusted-domains", "", "comma-separated domains links can redirect to without an interstitial page first (all if empty)")
+	flag.StringVar(&cfg.identityHeader, "identity-header", "", "header set by an authenticating proxy to who is making each request, eg. 'X-Forwarded-Email' (the client's address is used if empty)")
+	flag.BoolVar(&cfg.restrictEdits, "restrict-edits", false, "whether only the owner of a link (or one of the -admins) can change or delete it")
+	flag.StringVar(&admin, "admins", "", "comma-separated identities (see -identity-header) who can change any link with -restrict-edits and manage -users")
+	flag.BoolVar(&cfg.blockPrivate, "block-private", false, "whether to reject links to hosts which resolve to private, loopback or link-local addresses (eg. cloud metadata endpoints)")
+	flag.BoolVar(&fsck, "check", false, "check the -file store for problems and exit instead of serving")
+	flag.StringVar(&repair, "repair", "", "file to write a repaired copy of the -file store to with -check")
 
 	flag.Parse()
 
-	if hash == "" || file == "" {
+	if fsck {
+		if file == "" {
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+		if key == "" {
+			key = os.Getenv("GOLINKS_STORE_KEY")
+		}
+		var c *Cipher
+		if key != "" {
+			var err error
+			if c, err = NewCipher(key); err != nil {
+				log.Fatal(err)
+			}
+		}
+		problems, err := check(file, c, repair, os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if problems > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if dsn == "" && file != "" {
+		dsn = "file:" + file + "?sync=" + url.QueryEscape(syncPolicy)
+		if key != "" {
+			dsn += "&key=" + url.QueryEscape(key)
+		}
+		if recovery {
+			dsn += "&recover=true"
+		}
+		if maxLinks > 0 {
+			dsn += fmt.Sprintf("&max-links=%d", maxLinks)
+		}
+		if maxSize > 0 {
+			dsn += fmt.Sprintf("&max-size=%d", maxSize)
+		}
+		if compactEvery > 0 {
+			dsn += "&compact-every=" + compactEvery.String()
+		}
+		if compactMaxBytes > 0 {
+			dsn += fmt.Sprintf("&compact-max-bytes=%d", compactMaxBytes)
+		}
+	}
+	if (hash == "" && usersFile == "" && oidcIssuer == "") || dsn == "" {
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
+	switch cfg.redirectCode {
+	case 301, 302, 303, 307, 308:
+	default:
+		log.Fatalf("-redirect-code must be 301, 302, 303, 307 or 308, not %d", cfg.redirectCode)
+	}
+	if cfg.indexSort != "set" && cfg.indexSort != "used" {
+		log.Fatalf("-index-sort must be set or used, not %q", cfg.indexSort)
+	}
+	if cfg.fallbackURL != "" && !isValidLink(cfg.fallbackURL) {
+		log.Fatalf("-fallback-url must be an absolute URL, not %q", cfg.fallbackURL)
+	}
+	if parent != "" {
+		if !isValidLink(parent) {
+			log.Fatalf("-fallback-golinks must be an absolute URL, not %q", parent)
+		}
+		cfg.upstream = NewUpstream(parent, parentToken)
+	}
+	params, err := parseParams(appendParams)
+	if err != nil {
+		log.Fatalf("-append-params: %v", err)
+	}
+	cfg.redirectParams = params
+	cfg.subdomainHost = strings.ToLower(strings.Trim(cfg.subdomainHost, "."))
+	for _, d := range strings.Split(trusted, ",") {
+		if d = strings.ToLower(strings.TrimSpace(d)); d != "" {
+			cfg.trustedDomains = append(cfg.trustedDomains, d)
+		}
+	}
+	for _, a := range strings.Split(admin, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			cfg.admins = append(cfg.admins, a)
+		}
+	}
 
-	auth := a1.New(hash)
-	store, err := Open(file, fuzzy, compact)
+	var users *Users
+	if usersFile != "" {
+		if users, err = OpenUsers(usersFile); err != nil {
+			log.Fatal(err)
+		}
+		if len(users.List()) == 0 {
+			log.Printf("No users in %s, add one with 'golinks users -file %s -admin add NAME'", usersFile, usersFile)
+		}
+	}
+	var oidc *OIDC
+	if oidcIssuer != "" {
+		if oidcClientID == "" || oidcClientSecret == "" {
+			log.Fatal("-oidc-issuer requires -oidc-client-id and -oidc-client-secret")
+		}
+		if oidcDomain == "" && strings.TrimSuffix(oidcIssuer, "/") == googleIssuer {
+			log.Fatal("-oidc-issuer for Google requires -oidc-domain, or anyone with a Google account could log in")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		oidc, err = NewOIDC(ctx, oidcIssuer, oidcClientID, oidcClientSecret, oidcDomain, oidcRedirect)
+		cancel()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	sessions, err := OpenSessions(sessionsFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	auth := NewAuth(hash, users, oidc, sessions)
+	store, err := OpenStore(dsn, fuzzy, compact)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cacheSize > 0 || cacheMisses > 0 {
+		store = Cached(store, cacheSize, cacheMisses, cacheTTL)
+	}
+	if insensitive {
+		if store, err = NewCaseInsensitive(store); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if fuzzy {
+		if store, err = NewFuzzy(store); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if webhooks != "" {
+		if primary != "" {
+			log.Fatal("-webhooks must be configured on the primary instead of replicas")
+		}
+		if webhookSecret == "" {
+			log.Fatal("-webhooks requires -webhook-secret")
+		}
+		store = NewWebhooks(store, strings.Split(webhooks, ","), webhookSecret)
+	}
+	if auditFile != "" {
+		if primary != "" {
+			log.Fatal("-audit-log must be configured on the primary instead of replicas")
+		}
+		if cfg.auditLog, err = OpenAudit(store, auditFile); err != nil {
+			log.Fatal(err)
+		}
+		store = cfg.auditLog
+	}
+	events := NewEvents(store)
+	store = events
+	var tokens *Tokens
+	if tokensFile != "" {
+		if tokens, err = OpenTokens(tokensFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	hits, err := OpenHits(hitsFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var patterns *Patterns
+	if patternsFile != "" {
+		if patterns, err = OpenPatterns(patternsFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	stars, err := OpenStars(starsFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	stats, err := OpenStats(statsFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	publishVars(store, hits)
+	if primary == "" && token != "" {
+		store = NewPrimary(store, token)
+	}
+	cfg.auth, cfg.store, cfg.tokens, cfg.hits, cfg.stats = auth, store, tokens, hits, stats
+	cfg.events, cfg.patterns, cfg.stars, cfg.fuzzy = events, patterns, stars, fuzzy
+	if linkQPS > 0 {
+		cfg.linkLimiter = NewRateLimiter(linkQPS)
+	}
+	if checkLinks > 0 {
+		cfg.linkChecker = NewLinkChecker(checkLinks)
+	}
+	handler := serve(cfg)
+	if primary != "" {
+		if token == "" {
+			log.Fatal("-primary requires -replication-token")
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go follow(ctx, primary, token, store)
+		handler = readOnly(primary, handler)
+	}
+
+	if cfg.linkChecker != nil {
+		ctx, cancel := context.WithCancel(configContext(context.Background(), cfg))
+		defer cancel()
+		go cfg.linkChecker.Run(ctx, store)
+	}
+
+	if debugPort != 0 {
+		// The debug server isn't authenticated, so it's only reachable from the same host (eg.
+		// through an SSH tunnel).
+		lis, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", debugPort))
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			if err := http.Serve(lis, debugHandler()); err != nil && !errors.Is(err, net.ErrClosed) {
+				log.Printf("Could not serve debugging endpoints on %s: %v\n", lis.Addr(), err)
+			}
+		}()
+		defer lis.Close()
+	}
+
+	if grpcPort != 0 {
+		if grpcToken == "" {
+			log.Fatal("-grpc-port requires -grpc-token")
+		}
+		lis, err := net.Listen("tcp", fmt.Sprintf(":%d", grpcPort))
+		if err != nil {
+			log.Fatal(err)
+		}
+		g := newGRPCServer(store, grpcToken, primary)
+		go func() {
+			if err := g.Serve(lis); err != nil {
+				log.Fatalf("Could not serve gRPC on %s: %v\n", lis.Addr(), err)
+			}
+		}()
+		defer g.GracefulStop()
+	}
+
 	// Set up the server with timeouts such that it can be used in production. Furthermore, we rate
-	// limit our actions to 10 QPS for some slight mitigation against scanning attacks. Note: this
-	// will not prevent a motivated attacker - URLs which are secret or do not have their own auth
-	// should not be used with *any* URL shortening service.
+	// limit each client (10 QPS by default) for some slight mitigation against scanning attacks, and
+	// each link so that a hot one can't starve the others (see rateLimit and config.linkLimiter).
+	// Note: this will not prevent a motivated attacker - URLs which are secret or do not have their
+	// own auth should not be used with *any* URL shortening service.
+	var perClient *RateLimiter
+	if clientQPS > 0 {
+		perClient = NewRateLimiter(clientQPS)
+	}
 	srv := &http.Server{
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  120 * time.Second,
 		Addr:         fmt.Sprintf(":%v", port),
-		Handler:      a1.RateLimit(10, serve(auth, store)),
+		Handler:      rateLimit(perClient, handler),
+	}
+	// Requests are logged before being rate limited, so that those which are rejected are too.
+	switch accessLogFile {
+	case "":
+	case "-":
+		srv.Handler = accessLog(os.Stderr, cfg, srv.Handler)
+	default:
+		f, err := OpenRotatingFile(accessLogFile, int64(accessLogSize)<<20, accessLogBackups)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		srv.Handler = accessLog(f, cfg, srv.Handler)
 	}
 
 	start(srv)
 
+	if err := hits.Close(); err != nil {
+		log.Print(err)
+	}
+	if err := stats.Close(); err != nil {
+		log.Print(err)
+	}
 	err = store.Close()
 	if err != nil {
 		log.Fatal(err)
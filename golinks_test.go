@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestExpandLink(t *testing.T) {
+	tests := []struct {
+		link, suffix, query string
+		want                string
+	}{
+		// Links without placeholders have the suffix appended to their path.
+		{"https://a.example", "", "", "https://a.example"},
+		{"https://a.example/", "", "", "https://a.example/"},
+		{"https://a.example/docs", "/x/y", "", "https://a.example/docs/x/y"},
+		{"https://a.example/docs/", "/x", "", "https://a.example/docs/x"},
+		{"https://a.example/search?q=1#top", "/x", "", "https://a.example/search/x?q=1#top"},
+
+		// Numbered placeholders are replaced with segments of the suffix, or removed.
+		{"https://jira.example/browse/{1}", "/ABC-123", "", "https://jira.example/browse/ABC-123"},
+		{"https://jira.example/browse/{1}", "", "", "https://jira.example/browse/"},
+		{"https://a.example/{2}/{1}", "/x/y/z", "", "https://a.example/y/x/z"},
+		{"https://a.example/{1}", "/a b", "", "https://a.example/a%20b"},
+		{"https://a.example/{1}", "/a?b", "", "https://a.example/a%3Fb"},
+		{"https://a.example/search?q={1}", "/a b&c", "", "https://a.example/search?q=a+b%26c"},
+
+		// %s is replaced with the whole suffix, or removed if there isn't one.
+		{"https://a.example/%s", "/x/y", "", "https://a.example/x/y"},
+		{"https://a.example/%s", "", "", "https://a.example/"},
+		{"https://a.example/search?q=%s", "", "", "https://a.example/search?q="},
+		{"https://a.example/search?q=%s", "/x/y z", "", "https://a.example/search?q=x%2Fy+z"},
+
+		// Named placeholders are replaced with query parameters, or their defaults.
+		{"https://logs.example/?service={service}&env={env=prod}", "", "service=api", "https://logs.example/?service=api&env=prod"},
+		{"https://logs.example/?service={service}&env={env=prod}", "", "env=dev", "https://logs.example/?service=&env=dev"},
+		{"https://logs.example/?q={q}", "", "q=a%26b", "https://logs.example/?q=a%26b"},
+		{"https://logs.example/{path=a%2Fb}", "", "", "https://logs.example/a%2Fb"},
+		{"https://logs.example/{path}", "", "path=a/b", "https://logs.example/a%2Fb"},
+	}
+	for _, tt := range tests {
+		query, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := expandLink(tt.link, tt.suffix, query); got != tt.want {
+			t.Errorf("expandLink(%q, %q, %q) = %q, want %q", tt.link, tt.suffix, tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestAppendPath(t *testing.T) {
+	tests := []struct {
+		link, suffix string
+		want         string
+	}{
+		{"https://a.example", "/x", "https://a.example/x"},
+		{"https://a.example/", "/x", "https://a.example/x"},
+		{"https://a.example/a%2Fb", "/x", "https://a.example/a%2Fb/x"},
+		{"https://a.example/docs", "/a b", "https://a.example/docs/a%20b"},
+		{"https://a.example/docs?q=1", "/x", "https://a.example/docs/x?q=1"},
+		{"https://a.example/docs#top", "/x", "https://a.example/docs/x#top"},
+		{"https://a.example/docs?q=1#top", "/x/", "https://a.example/docs/x/?q=1#top"},
+	}
+	for _, tt := range tests {
+		if got := appendPath(tt.link, tt.suffix); got != tt.want {
+			t.Errorf("appendPath(%q, %q) = %q, want %q", tt.link, tt.suffix, got, tt.want)
+		}
+	}
+}
+
+func TestWithParams(t *testing.T) {
+	tests := []struct {
+		link   string
+		params []map[string]string
+		want   string
+	}{
+		{"https://a.example/x", nil, "https://a.example/x"},
+		{"https://a.example/x", []map[string]string{{"src": "go"}}, "https://a.example/x?src=go"},
+		{"https://a.example/x?", []map[string]string{{"src": "go"}}, "https://a.example/x?src=go"},
+		{"https://a.example/x?q=1", []map[string]string{{"src": "go"}}, "https://a.example/x?q=1&src=go"},
+		{"https://a.example/x?src=mine", []map[string]string{{"src": "go"}}, "https://a.example/x?src=mine"},
+		{"https://a.example/x#top", []map[string]string{{"src": "go"}}, "https://a.example/x?src=go#top"},
+		{"https://a.example/x?q=a+b", []map[string]string{{"v": "a b&c"}}, "https://a.example/x?q=a+b&v=a+b%26c"},
+		{"https://a.example/x", []map[string]string{{"src": "link"}, {"src": "default"}}, "https://a.example/x?src=link"},
+		{"https://a.example/x", []map[string]string{{"a": "1"}, {"b": "2"}}, "https://a.example/x?a=1&b=2"},
+	}
+	for _, tt := range tests {
+		if got := withParams(tt.link, tt.params...); got != tt.want {
+			t.Errorf("withParams(%q, %v) = %q, want %q", tt.link, tt.params, got, tt.want)
+		}
+	}
+}
+
+func TestIsValidName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"docs", true},
+		{"docs/team", true},
+		{"a.b-c_d", true},
+		{"login", false},
+		{"logout", false},
+		{"healthz", false},
+		{"favicon.ico", false},
+		{settingsPath[1:], false},
+		{usersPath[1:], false},
+		{statsPath[1:], false},
+		{oidcCallbackPath[1:], false},
+		{apiPath[1:], false},
+		{apiPath[1:] + "/docs", false},
+		{"docs+", false},
+		{"%zz", false},
+	}
+	for _, tt := range tests {
+		if got := isValidName(tt.name); got != tt.valid {
+			t.Errorf("isValidName(%q) = %v, want %v", tt.name, got, tt.valid)
+		}
+	}
+}
+
+func TestCheckMatch(t *testing.T) {
+	e := &Entry{Link: "https://a.example"}
+	tests := []struct {
+		match    string
+		existing *Entry
+		code     int
+	}{
+		{"", nil, 0},
+		{"", e, 428},
+		{"*", e, 0},
+		{e.ETag(), e, 0},
+		{`"stale", ` + e.ETag(), e, 0},
+		{`"stale"`, e, 412},
+		{"*", nil, 412},
+		{e.ETag(), nil, 412},
+	}
+	for _, tt := range tests {
+		code, err := checkMatch(tt.match, tt.existing)
+		if code != tt.code || (err != nil) != (tt.code != 0) {
+			t.Errorf("checkMatch(%q, %v) = %d, %v, want %d", tt.match, tt.existing, code, err, tt.code)
+		}
+	}
+}
+
+func TestSubdomainRedirect(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.auth = NewAuth("", nil, nil, nil)
+	cfg.subdomainHost, cfg.redirectCode = "go.corp.example", 307
+
+	tests := []struct {
+		target, proto string
+		want          string
+	}{
+		{"http://docs.go.corp.example/", "", "http://go.corp.example/docs"},
+		{"http://docs.go.corp.example/team?q=1", "", "http://go.corp.example/docs/team?q=1"},
+		{"http://docs.go.corp.example:8080/", "", "http://go.corp.example:8080/docs"},
+		{"http://docs.go.corp.example/", "https", "https://go.corp.example/docs"},
+		{"https://docs.go.corp.example/", "", "https://go.corp.example/docs"},
+	}
+	handler := serve(cfg)
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.target, nil)
+		if tt.proto != "" {
+			r.Header.Set("X-Forwarded-Proto", tt.proto)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != cfg.redirectCode || w.Header().Get("Location") != tt.want {
+			t.Errorf("GET %s redirected with %d to %q, want %d to %q",
+				tt.target, w.Code, w.Header().Get("Location"), cfg.redirectCode, tt.want)
+		}
+	}
+}
+
+// memStore is a Store which keeps mappings in memory, for testing handlers.
+type memStore map[string]*Entry
+
+func (m memStore) Get(ctx context.Context, name string) (*Entry, error) {
+	if e, ok := m[name]; ok {
+		return e, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (m memStore) Set(ctx context.Context, name string, e *Entry) error {
+	if e == nil {
+		delete(m, name)
+	} else {
+		m[name] = e
+	}
+	return nil
+}
+
+func (m memStore) Iterate(ctx context.Context, cb func(string, *Entry) error) error {
+	for name, e := range m {
+		if err := cb(name, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestLinkLimiter(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.linkLimiter = NewRateLimiter(1)
+	store := memStore{"a": {Link: "https://a.example"}, "b": {Link: "https://b.example"}}
+	auth := NewAuth("", nil, nil, nil)
+	tests := []struct {
+		name string
+		code int
+	}{
+		{"a", cfg.redirectCode},
+		{"a", 429},
+		{"a/docs", 429},
+		{"b", cfg.redirectCode},
+		// Names which don't exist redirect to log in however often they're requested.
+		{"missing", 302},
+		{"missing", 302},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/"+tt.name, nil)
+		getLink(auth, store, nil, nil, nil, nil, tt.name).ServeHTTP(w, r.WithContext(configContext(r.Context(), cfg)))
+		if w.Code != tt.code {
+			t.Errorf("GET /%s = %d, want %d", tt.name, w.Code, tt.code)
+		}
+	}
+}
+
+func TestServeVars(t *testing.T) {
+	if publishedVars == nil {
+		publishVars(memStore{"a": {Link: "https://a.example"}}, nil)
+	}
+	w := httptest.NewRecorder()
+	serveVars().ServeHTTP(w, httptest.NewRequest("GET", varsPath, nil))
+	var vars map[string]json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &vars); err != nil {
+		t.Fatalf("invalid JSON %q: %v", w.Body, err)
+	}
+	if _, ok := vars["cmdline"]; ok {
+		t.Error("the command line was served")
+	}
+	for _, name := range []string{"goroutines", "uptime", "healthy", "store"} {
+		if _, ok := vars[name]; !ok {
+			t.Errorf("%s wasn't served", name)
+		}
+	}
+}
+
+func TestGetLinkTrims(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.stripPunctuation = true
+	store := memStore{"docs": {Link: "https://docs.example"}, "v1.": {Link: "https://v1.example"}}
+	auth := NewAuth("", nil, nil, nil)
+	tests := []struct {
+		name, location string
+	}{
+		{"docs.", "https://docs.example"},
+		{"docs/", "https://docs.example"},
+		{"docs).", "https://docs.example"},
+		{"docs/guide", "https://docs.example/guide"},
+		// Names which exist as they are aren't trimmed.
+		{"v1.", "https://v1.example"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/"+tt.name, nil)
+		getLink(auth, store, nil, nil, nil, nil, tt.name).ServeHTTP(w, r.WithContext(configContext(r.Context(), cfg)))
+		if w.Code != cfg.redirectCode || w.Header().Get("Location") != tt.location {
+			t.Errorf("GET /%s = %d to %q, want %d to %q", tt.name, w.Code, w.Header().Get("Location"), cfg.redirectCode, tt.location)
+		}
+	}
+}
+
+func TestUnwrap(t *testing.T) {
+	ctx := context.Background()
+	f := newFuzzy(t, map[string]string{"my-doc": "https://docs.example/mine", "my_doc": "https://docs.example/my"})
+	// The optional interfaces of the stores wrapped are used through any number of wrappers.
+	s := NewEvents(Cached(f, 10, 10, 0))
+	if got := candidates(ctx, s, "mydoc"); len(got) != 2 {
+		t.Errorf("candidates(mydoc) = %v, want both docs", got)
+	}
+	if versions, err := history(ctx, s, "my-doc"); err != nil || len(versions) != 1 {
+		t.Errorf("history(my-doc) = %d versions, %v, want 1", len(versions), err)
+	}
+	if rev, err := revision(ctx, s); err != nil || rev == "" {
+		t.Errorf("revision = %q, %v, want one", rev, err)
+	}
+	var names []string
+	if err := iterateRange(ctx, s, 1, 1, func(name string, e *Entry) error {
+		names = append(names, name)
+		return nil
+	}); err != nil || len(names) != 1 {
+		t.Errorf("iterateRange(1, 1) = %v, %v, want 1 name", names, err)
+	}
+	if _, err := history(ctx, memStore{}, "my-doc"); err != errNoHistory {
+		t.Errorf("history of a memStore = %v, want %v", err, errNoHistory)
+	}
+}
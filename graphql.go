@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/graphql-go/graphql"
+)
+
+// graphqlPath is the path of the GraphQL endpoint.
+const graphqlPath = "/graphql"
+
+// serveGraphQL serves queries over the links in store, along with mutations for creating,
+// updating and deleting them. Queries may be sent either as the query parameter of a GET request
+// or as a JSON body ({"query": ..., "variables": ..., "operationName": ...}) of a POST request,
+// while mutations are only accepted in POST requests (and not with read-only API tokens). As with
+// the JSON API, requests must be authenticated and POST requests must be sent as JSON instead of
+// using XSRF tokens.
+func serveGraphQL(auth *Auth, store Store, tokens *Tokens) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, write := apiAuth(auth, tokens, r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			apiError(w, 401, errors.New("not logged in"))
+			return
+		}
+
+		var req struct {
+			Query         string                 `json:"query"`
+			Variables     map[string]interface{} `json:"variables"`
+			OperationName string                 `json:"operationName"`
+		}
+		switch r.Method {
+		case "GET":
+			q := r.URL.Query()
+			req.Query, req.OperationName = q.Get("query"), q.Get("operationName")
+			if v := q.Get("variables"); v != "" {
+				if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+					apiError(w, 400, err)
+					return
+				}
+			}
+		case "POST":
+			if t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); t != "application/json" {
+				apiError(w, 415, errors.New("body must be application/json"))
+				return
+			}
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+				apiError(w, 400, err)
+				return
+			}
+		default:
+			apiError(w, 405)
+			return
+		}
+
+		schema, err := graphqlSchema(store, r, write && r.Method == "POST")
+		if err != nil {
+			apiError(w, 500, err)
+			return
+		}
+		writeJSON(w, 200, graphql.Do(graphql.Params{
+			Schema:         schema,
+			RequestString:  req.Query,
+			VariableValues: req.Variables,
+			OperationName:  req.OperationName,
+			Context:        r.Context(),
+		}))
+	})
+}
+
+// graphqlSchema returns the schema for requests made by r:
+//
+//	type Link {
+//	  name: String!
+//	  link: String!
+//	  created: DateTime
+//	  updated: DateTime
+//	  createdBy: String
+//	}
+//
+//	type Query {
+//	  link(name: String!): Link
+//	  links(prefix: String, createdBy: String, offset: Int, limit: Int): [Link!]!
+//	}
+//
+//	type Mutation {
+//	  createLink(name: String!, link: String!): Link!
+//	  updateLink(name: String!, link: String!): Link!
+//	  deleteLink(name: String!): Boolean!
+//	}
+//
+// The Mutation type is only included if mutate is true.
+func graphqlSchema(store Store, r *http.Request, mutate bool) (graphql.Schema, error) {
+	link := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Link",
+		Fields: graphql.Fields{
+			"name":      &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"link":      &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"created":   &graphql.Field{Type: graphql.DateTime},
+			"updated":   &graphql.Field{Type: graphql.DateTime},
+			"createdBy": &graphql.Field{Type: graphql.String},
+		},
+	})
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"link": &graphql.Field{
+				Type: link,
+				Args: graphql.FieldConfigArgument{
+					"name": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					name := normalizeName(p.Args["name"].(string))
+					e, err := store.Get(p.Context, name)
+					if err == ErrNotFound {
+						return nil, nil
+					}
+					if err != nil {
+						return nil, err
+					}
+					return graphqlLink(name, e), nil
+				},
+			},
+			"links": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(link))),
+				Args: graphql.FieldConfigArgument{
+					"prefix":    &graphql.ArgumentConfig{Type: graphql.String},
+					"createdBy": &graphql.ArgumentConfig{Type: graphql.String},
+					"offset":    &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 0},
+					"limit":     &graphql.ArgumentConfig{Type: graphql.Int},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					prefix, _ := p.Args["prefix"].(string)
+					createdBy, hasCreatedBy := p.Args["createdBy"].(string)
+					offset, _ := p.Args["offset"].(int)
+					limit, ok := p.Args["limit"].(int)
+					if !ok {
+						limit = math.MaxInt32
+					}
+
+					links := []map[string]interface{}{}
+					match := func(cb func(name string, e *Entry) error) func(name string, e *Entry) error {
+						return func(name string, e *Entry) error {
+							if !strings.HasPrefix(name, prefix) || (hasCreatedBy && e.CreatedBy != createdBy) {
+								return nil
+							}
+							return cb(name, e)
+						}
+					}
+					err := iterateWindow(func(cb func(name string, e *Entry) error) error {
+						return store.Iterate(p.Context, match(cb))
+					}, offset, limit, func(name string, e *Entry) error {
+						links = append(links, graphqlLink(name, e))
+						return nil
+					})
+					return links, err
+				},
+			},
+		},
+	})
+
+	config := graphql.SchemaConfig{Query: query}
+	if mutate {
+		args := graphql.FieldConfigArgument{
+			"name": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+			"link": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+		}
+		config.Mutation = graphql.NewObject(graphql.ObjectConfig{
+			Name: "Mutation",
+			Fields: graphql.Fields{
+				"createLink": &graphql.Field{
+					Type: graphql.NewNonNull(link),
+					Args: args,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return graphqlSet(p, store, r, true)
+					},
+				},
+				"updateLink": &graphql.Field{
+					Type: graphql.NewNonNull(link),
+					Args: args,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return graphqlSet(p, store, r, false)
+					},
+				},
+				"deleteLink": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.Boolean),
+					Args: graphql.FieldConfigArgument{
+						"name": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					},
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						name := normalizeName(p.Args["name"].(string))
+						e, err := store.Get(p.Context, name)
+						if err != nil {
+							return nil, err
+						}
+						if err := checkOwner(r, e); err != nil {
+							return nil, err
+						}
+						if err := store.Set(p.Context, name, nil); err != nil {
+							return nil, err
+						}
+						return true, nil
+					},
+				},
+			},
+		})
+	}
+	return graphql.NewSchema(config)
+}
+
+// graphqlSet resolves the createLink and updateLink mutations, which Set the name argument to
+// the link argument. If create is true the name must not already exist, otherwise it must.
+func graphqlSet(p graphql.ResolveParams, store Store, r *http.Request, create bool) (interface{}, error) {
+	name := normalizeName(p.Args["name"].(string))
+	if name == "" || !isValidName(name) {
+		return nil, errors.New("invalid name")
+	}
+	link, err := normalizeLink(canonicalizeAlias(p.Context, store, r.Host, p.Args["link"].(string)))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkLoop(p.Context, store, r.Host, name, link, nil); err != nil {
+		return nil, err
+	}
+	if err := checkPublic(p.Context, r.Host, link, nil); err != nil {
+		return nil, err
+	}
+
+	existing, err := store.Get(p.Context, name)
+	switch {
+	case create && err == nil:
+		return nil, fmt.Errorf("%s already exists", name)
+	case err != nil && (!create || err != ErrNotFound):
+		return nil, err
+	}
+
+	now := time.Now()
+	e := &Entry{Link: link, Created: now, Updated: now, CreatedBy: identity(r)}
+	if err == nil {
+		if err := checkOwner(r, existing); err != nil {
+			return nil, err
+		}
+		e.Created, e.CreatedBy, e.Owner = existing.Created, existing.CreatedBy, existing.Owner
+	}
+	if err := store.Set(p.Context, name, e); err != nil {
+		return nil, err
+	}
+	return graphqlLink(name, e), nil
+}
+
+// graphqlLink returns the Link object for name, omitting the times of mappings which predate
+// them being recorded.
+func graphqlLink(name string, e *Entry) map[string]interface{} {
+	l := map[string]interface{}{"name": name, "link": e.Link, "createdBy": e.CreatedBy}
+	if !e.Created.IsZero() {
+		l["created"] = e.Created
+	}
+	if !e.Updated.IsZero() {
+		l["updated"] = e.Updated
+	}
+	return l
+}
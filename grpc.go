@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// linksService is the name of the service defined in golinks.proto.
+const linksService = "golinks.v1.Links"
+
+// linkServer implements the Links service defined in golinks.proto for store,
+// accepting requests which present token. If primary is set the server is a
+// read-only replica of it.
+type linkServer struct {
+	store   Store
+	token   string
+	primary string
+}
+
+// newGRPCServer returns a gRPC server serving the Links service for store.
+// The messages are small and fixed, so rather than depending on generated code
+// they're encoded by hand with the codec the server is forced to use.
+func newGRPCServer(store Store, token, primary string) *grpc.Server {
+	srv := grpc.NewServer(grpc.ForceServerCodec(wireCodec{}))
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: linksService,
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{
+			unary("Get", func() wireMessage { return &pbGetRequest{} }, (*linkServer).get),
+			unary("Set", func() wireMessage { return &pbSetRequest{} }, (*linkServer).set),
+			unary("Delete", func() wireMessage { return &pbDeleteRequest{} }, (*linkServer).delete),
+			unary("List", func() wireMessage { return &pbListRequest{} }, (*linkServer).list),
+		},
+		Metadata: "golinks.proto",
+	}, &linkServer{store: store, token: token, primary: primary})
+	return srv
+}
+
+// unary returns the description of a unary method of the Links service, which
+// decodes its request into the message returned by req before authenticating
+// and calling call.
+func unary(method string, req func() wireMessage, call func(*linkServer, context.Context, wireMessage) (wireMessage, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: method,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			in := req()
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			s := srv.(*linkServer)
+			handler := func(ctx context.Context, in interface{}) (interface{}, error) {
+				if err := s.authenticate(ctx); err != nil {
+					return nil, err
+				}
+				return call(s, ctx, in.(wireMessage))
+			}
+			if interceptor == nil {
+				return handler(ctx, in)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + linksService + "/" + method}
+			return interceptor(ctx, in, info, handler)
+		},
+	}
+}
+
+// authenticate checks the request presented the server's token.
+func (s *linkServer) authenticate(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, auth := range md.Get("authorization") {
+		if subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(s.token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "missing or invalid token")
+}
+
+func (s *linkServer) get(ctx context.Context, in wireMessage) (wireMessage, error) {
+	name := normalizeName(in.(*pbGetRequest).Name)
+	e, err := s.store.Get(ctx, name)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return newPBLink(name, e), nil
+}
+
+func (s *linkServer) set(ctx context.Context, in wireMessage) (wireMessage, error) {
+	if s.primary != "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "read-only replica, make changes at %s", s.primary)
+	}
+	l := in.(*pbSetRequest).Link
+	if l == nil || l.Name == "" || !isValidName(l.Name) {
+		return nil, status.Error(codes.InvalidArgument, "invalid name")
+	}
+	l.Name = normalizeName(l.Name)
+	link, err := normalizeLink(l.Link)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	existing, err := s.store.Get(ctx, l.Name)
+	if err != nil && err != ErrNotFound {
+		return nil, grpcError(err)
+	}
+	now := time.Now()
+	e := &Entry{Link: link, Created: now, Updated: now, CreatedBy: "grpc"}
+	if p, ok := peer.FromContext(ctx); ok {
+		e.CreatedBy = p.Addr.String()
+	}
+	if err == nil {
+		e.Created, e.CreatedBy, e.Owner = existing.Created, existing.CreatedBy, existing.Owner
+	}
+
+	if err := s.store.Set(grpcActor(ctx), l.Name, e); err != nil {
+		return nil, grpcError(err)
+	}
+	return newPBLink(l.Name, e), nil
+}
+
+// grpcActor returns ctx along with the address of the gRPC client as who is making changes with it
+// (see actorContext).
+func grpcActor(ctx context.Context) context.Context {
+	actor := "grpc"
+	if p, ok := peer.FromContext(ctx); ok {
+		actor += " " + p.Addr.String()
+	}
+	return actorContext(ctx, actor)
+}
+
+func (s *linkServer) delete(ctx context.Context, in wireMessage) (wireMessage, error) {
+	if s.primary != "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "read-only replica, make changes at %s", s.primary)
+	}
+	name := normalizeName(in.(*pbDeleteRequest).Name)
+	if _, err := s.store.Get(ctx, name); err != nil {
+		return nil, grpcError(err)
+	}
+	if err := s.store.Set(grpcActor(ctx), name, nil); err != nil {
+		return nil, grpcError(err)
+	}
+	return &pbDeleteResponse{}, nil
+}
+
+func (s *linkServer) list(ctx context.Context, in wireMessage) (wireMessage, error) {
+	out := &pbListResponse{}
+	err := s.store.Iterate(ctx, func(name string, e *Entry) error {
+		out.Links = append(out.Links, newPBLink(name, e))
+		return nil
+	})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return out, nil
+}
+
+// grpcError converts an error from the store into a gRPC status.
+func grpcError(err error) error {
+	switch {
+	case err == ErrNotFound:
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrQuotaExceeded):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+// wireMessage is implemented by the messages of the Links service, which
+// encode themselves in the protobuf wire format.
+type wireMessage interface {
+	marshal() []byte
+	unmarshal(b []byte) error
+}
+
+// wireCodec is a grpc encoding.Codec for wireMessages.
+type wireCodec struct{}
+
+func (wireCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(wireMessage)
+	if !ok {
+		return nil, fmt.Errorf("unexpected message %T", v)
+	}
+	return m.marshal(), nil
+}
+
+func (wireCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(wireMessage)
+	if !ok {
+		return fmt.Errorf("unexpected message %T", v)
+	}
+	return m.unmarshal(data)
+}
+
+func (wireCodec) Name() string {
+	return "proto"
+}
+
+// unmarshalFields calls field with the number, type and encoded value of each
+// field in b. field returns the length of the value it consumed, 0 to skip an
+// unknown field or a negative number if the value was invalid.
+func unmarshalFields(b []byte, field func(num protowire.Number, typ protowire.Type, b []byte) int) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if n = field(num, typ, b); n == 0 {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// pbString returns a field callback for unmarshalFields which decodes the
+// string field numbered want into v.
+func pbString(want protowire.Number, v *string) func(num protowire.Number, typ protowire.Type, b []byte) int {
+	return func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if num != want || typ != protowire.BytesType {
+			return 0
+		}
+		var n int
+		*v, n = protowire.ConsumeString(b)
+		return n
+	}
+}
+
+type pbLink struct {
+	Name      string
+	Link      string
+	Created   int64
+	Updated   int64
+	CreatedBy string
+}
+
+func newPBLink(name string, e *Entry) *pbLink {
+	l := &pbLink{Name: name, Link: e.Link, CreatedBy: e.CreatedBy}
+	if !e.Created.IsZero() {
+		l.Created = e.Created.Unix()
+	}
+	if !e.Updated.IsZero() {
+		l.Updated = e.Updated.Unix()
+	}
+	return l
+}
+
+func (l *pbLink) marshal() []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, l.Name)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendString(b, l.Link)
+	b = protowire.AppendTag(b, 3, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(l.Created))
+	b = protowire.AppendTag(b, 4, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(l.Updated))
+	b = protowire.AppendTag(b, 5, protowire.BytesType)
+	return protowire.AppendString(b, l.CreatedBy)
+}
+
+func (l *pbLink) unmarshal(b []byte) error {
+	return unmarshalFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		var n int
+		var v uint64
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			l.Name, n = protowire.ConsumeString(b)
+		case num == 2 && typ == protowire.BytesType:
+			l.Link, n = protowire.ConsumeString(b)
+		case num == 3 && typ == protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+			l.Created = int64(v)
+		case num == 4 && typ == protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+			l.Updated = int64(v)
+		case num == 5 && typ == protowire.BytesType:
+			l.CreatedBy, n = protowire.ConsumeString(b)
+		}
+		return n
+	})
+}
+
+type pbGetRequest struct {
+	Name string
+}
+
+func (r *pbGetRequest) marshal() []byte {
+	return protowire.AppendString(protowire.AppendTag(nil, 1, protowire.BytesType), r.Name)
+}
+
+func (r *pbGetRequest) unmarshal(b []byte) error {
+	return unmarshalFields(b, pbString(1, &r.Name))
+}
+
+type pbSetRequest struct {
+	Link *pbLink
+}
+
+func (r *pbSetRequest) marshal() []byte {
+	if r.Link == nil {
+		return nil
+	}
+	return protowire.AppendBytes(protowire.AppendTag(nil, 1, protowire.BytesType), r.Link.marshal())
+}
+
+func (r *pbSetRequest) unmarshal(b []byte) error {
+	return unmarshalFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if num != 1 || typ != protowire.BytesType {
+			return 0
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n
+		}
+		r.Link = &pbLink{}
+		if err := r.Link.unmarshal(v); err != nil {
+			return -1
+		}
+		return n
+	})
+}
+
+type pbDeleteRequest struct {
+	Name string
+}
+
+func (r *pbDeleteRequest) marshal() []byte {
+	return protowire.AppendString(protowire.AppendTag(nil, 1, protowire.BytesType), r.Name)
+}
+
+func (r *pbDeleteRequest) unmarshal(b []byte) error {
+	return unmarshalFields(b, pbString(1, &r.Name))
+}
+
+type pbDeleteResponse struct{}
+
+func (r *pbDeleteResponse) marshal() []byte {
+	return nil
+}
+
+func (r *pbDeleteResponse) unmarshal(b []byte) error {
+	return unmarshalFields(b, func(protowire.Number, protowire.Type, []byte) int { return 0 })
+}
+
+type pbListRequest struct{}
+
+func (r *pbListRequest) marshal() []byte {
+	return nil
+}
+
+func (r *pbListRequest) unmarshal(b []byte) error {
+	return unmarshalFields(b, func(protowire.Number, protowire.Type, []byte) int { return 0 })
+}
+
+type pbListResponse struct {
+	Links []*pbLink
+}
+
+func (r *pbListResponse) marshal() []byte {
+	var b []byte
+	for _, l := range r.Links {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, l.marshal())
+	}
+	return b
+}
+
+func (r *pbListResponse) unmarshal(b []byte) error {
+	return unmarshalFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if num != 1 || typ != protowire.BytesType {
+			return 0
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n
+		}
+		l := &pbLink{}
+		if err := l.unmarshal(v); err != nil {
+			return -1
+		}
+		r.Links = append(r.Links, l)
+		return n
+	})
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// hitsFlush is how often counts which have changed are written to the hits file.
+const hitsFlush = time.Minute
+
+// Hit records how many times a name has been followed, and when it last was.
+type Hit struct {
+	Count int64     `json:"count"`
+	Last  time.Time `json:"last"`
+}
+
+// Hits counts how many times each name is followed. Counts are kept in memory and, if Hits has a
+// file, written to it as JSON every hitsFlush (if they've changed) and when it's closed, so at most
+// hitsFlush of hits are lost if the server doesn't shut down cleanly. Access to hits, days and
+// dirty must be guarded by lock.
+type Hits struct {
+	filename string
+	done     chan struct{}
+	wg       sync.WaitGroup
+
+	lock  sync.Mutex
+	hits  map[string]*Hit
+	days  int64
+	dirty bool
+}
+
+// OpenHits returns Hits persisted to filename, which is created once the first name is followed.
+// If filename is empty the counts are only kept in memory.
+func OpenHits(filename string) (*Hits, error) {
+	// days starts from when Hits is opened so that it doesn't repeat across restarts.
+	h := &Hits{filename: filename, done: make(chan struct{}), hits: make(map[string]*Hit), days: time.Now().UnixNano()}
+	if filename != "" {
+		b, err := ioutil.ReadFile(filename)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			if err := json.Unmarshal(b, &h.hits); err != nil {
+				return nil, fmt.Errorf("reading hits from %s: %w", filename, err)
+			}
+		}
+		h.wg.Add(1)
+		go h.flush()
+	}
+	return h, nil
+}
+
+// Hit records that name was followed.
+func (h *Hits) Hit(name string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	hit, ok := h.hits[name]
+	if !ok {
+		hit = &Hit{}
+		h.hits[name] = hit
+	}
+	now := time.Now()
+	if hit.Last.Format("2006-01-02") != now.Format("2006-01-02") {
+		h.days++
+	}
+	hit.Count++
+	hit.Last = now
+	h.dirty = true
+}
+
+// Days returns a number which changes whenever the day any name was last followed on changes, so
+// that pages which show them (at the precision of a day) can tell when they have.
+func (h *Hits) Days() int64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.days
+}
+
+// Get returns how many times name has been followed, and when it last was.
+func (h *Hits) Get(name string) Hit {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if hit, ok := h.hits[name]; ok {
+		return *hit
+	}
+	return Hit{}
+}
+
+// Ranked returns the names which have been followed, most followed first.
+func (h *Hits) Ranked() []Count {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	ranked := make([]Count, 0, len(h.hits))
+	for name, hit := range h.hits {
+		ranked = append(ranked, Count{name, hit.Count})
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Count != ranked[j].Count {
+			return ranked[i].Count > ranked[j].Count
+		}
+		return ranked[i].Name < ranked[j].Name
+	})
+	return ranked
+}
+
+// flush saves the counts every hitsFlush until Hits is closed.
+func (h *Hits) flush() {
+	defer h.wg.Done()
+	t := time.NewTicker(hitsFlush)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := h.save(); err != nil {
+				log.Printf("saving hits to %s failed: %v\n", h.filename, err)
+			}
+		case <-h.done:
+			return
+		}
+	}
+}
+
+// save writes the counts to the file if they've changed, replacing it atomically.
+func (h *Hits) save() error {
+	h.lock.Lock()
+	if !h.dirty {
+		h.lock.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(h.hits)
+	h.dirty = false
+	h.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := h.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		h.markDirty()
+		return err
+	}
+	if err := os.Rename(tmp, h.filename); err != nil {
+		h.markDirty()
+		return err
+	}
+	return nil
+}
+
+// markDirty records that the counts need to be saved again after a failed save.
+func (h *Hits) markDirty() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.dirty = true
+}
+
+// Close stops flushing the counts and saves them a final time.
+func (h *Hits) Close() error {
+	if h.filename == "" {
+		return nil
+	}
+	close(h.done)
+	h.wg.Wait()
+	return h.save()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+// parseLanguages parses per-language destinations separated by whitespace in s, each of which is a
+// language tag followed by '=' and its link, eg. de=https://docs.corp/de fr=https://docs.corp/fr
+// (see normalizeLanguages).
+func parseLanguages(ctx context.Context, store Store, host, s string) (map[string]string, error) {
+	langs := make(map[string]string)
+	for _, f := range strings.Fields(s) {
+		i := strings.IndexByte(f, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid language destination %q", f)
+		}
+		langs[f[:i]] = f[i+1:]
+	}
+	return normalizeLanguages(ctx, store, host, langs)
+}
+
+// normalizeLanguages canonicalizes the language tags and canonicalizes and normalizes their links
+// (as with normalizeDestinations), returning nil if there aren't any.
+func normalizeLanguages(ctx context.Context, store Store, host string, langs map[string]string) (map[string]string, error) {
+	if len(langs) == 0 {
+		return nil, nil
+	}
+	normal := make(map[string]string, len(langs))
+	for lang, link := range langs {
+		tag, err := language.Parse(lang)
+		if err != nil {
+			return nil, fmt.Errorf("invalid language %q", lang)
+		}
+		link, err := normalizeLink(canonicalizeAlias(ctx, store, host, link))
+		if err != nil {
+			return nil, fmt.Errorf("invalid link for language %s: %w", tag, err)
+		}
+		normal[tag.String()] = link
+	}
+	return normal, nil
+}
+
+// chooseLanguage returns the link in langs for the language most preferred by accept (eg. the link
+// for de given de-AT), if any of them are acceptable.
+func chooseLanguage(langs map[string]string, accept []language.Tag) (string, bool) {
+	if len(langs) == 0 || len(accept) == 0 {
+		return "", false
+	}
+	tags := make([]language.Tag, 0, len(langs))
+	for lang := range langs {
+		tags = append(tags, language.Make(lang))
+	}
+	_, i, conf := language.NewMatcher(tags).Match(accept...)
+	if conf == language.No {
+		return "", false
+	}
+	return langs[tags[i].String()], true
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// brokenPath is the path of the API endpoint reporting the links which are broken.
+const brokenPath = "/api/v1/broken"
+
+// LinkCheck is the result of checking one of the links a mapping redirects to.
+type LinkCheck struct {
+	Link string `json:"link"`
+	// Status is the status code of the response once any redirects were followed, if there was one.
+	Status int `json:"status,omitempty"`
+	// Error is why there wasn't a response, if there wasn't.
+	Error   string    `json:"error,omitempty"`
+	Checked time.Time `json:"checked"`
+}
+
+// Broken returns whether the link is broken: it couldn't be requested, doesn't exist (or no longer
+// does) or the server failed. Links which require logging in aren't broken, as the checker can't.
+func (c LinkCheck) Broken() bool {
+	return c.Error != "" || c.Status == 404 || c.Status == 410 || c.Status >= 500
+}
+
+// LinkChecker checks every link in a store with a HEAD request (or a GET, for servers which don't
+// support HEAD) every so often, and keeps the results of the last complete check in memory. Only
+// the links mappings redirect to by default (see Entry.Links) are checked, and templates, links
+// which aren't to websites and links which checkPublic rejects are skipped. Access to results and
+// checked must be guarded by lock.
+type LinkChecker struct {
+	every  time.Duration
+	client *http.Client
+
+	lock    sync.RWMutex
+	results map[string][]LinkCheck
+	checked time.Time
+}
+
+// NewLinkChecker returns a LinkChecker which checks the links every interval.
+func NewLinkChecker(every time.Duration) *LinkChecker {
+	return &LinkChecker{
+		every:   every,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		results: make(map[string][]LinkCheck),
+	}
+}
+
+// Run checks the links in store straight away and then every interval until ctx is done.
+func (c *LinkChecker) Run(ctx context.Context, store Store) {
+	t := time.NewTicker(c.every)
+	defer t.Stop()
+	for {
+		if err := c.CheckAll(ctx, store); err != nil && ctx.Err() == nil {
+			log.Printf("checking links failed: %v\n", err)
+		}
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// CheckAll checks all of the links in store, replacing the results once they've all been checked.
+func (c *LinkChecker) CheckAll(ctx context.Context, store Store) error {
+	links := make(map[string][]string)
+	err := store.Iterate(ctx, func(name string, e *Entry) error {
+		if !e.IsTemplate() {
+			links[name] = e.Links()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	results := make(map[string][]LinkCheck, len(links))
+	for name, ls := range links {
+		for _, link := range ls {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if u, err := url.Parse(link); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				continue
+			}
+			if err := checkPublic(ctx, "", link, nil); err != nil {
+				continue
+			}
+			results[name] = append(results[name], c.check(ctx, link))
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.results, c.checked = results, time.Now()
+	return nil
+}
+
+// Checked returns when the links were last all checked, which is zero if they haven't been yet.
+func (c *LinkChecker) Checked() time.Time {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.checked
+}
+
+// check requests link, retrying with GET if the server doesn't allow HEAD.
+func (c *LinkChecker) check(ctx context.Context, link string) LinkCheck {
+	res := LinkCheck{Link: link, Checked: time.Now()}
+	for _, method := range []string{"HEAD", "GET"} {
+		req, err := http.NewRequestWithContext(ctx, method, link, nil)
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		req.Header.Set("User-Agent", "golinks link checker")
+		resp, err := c.client.Do(req)
+		if err != nil {
+			var uerr *url.Error
+			if errors.As(err, &uerr) {
+				err = uerr.Err
+			}
+			res.Error = err.Error()
+			return res
+		}
+		resp.Body.Close()
+		res.Status = resp.StatusCode
+		if resp.StatusCode != 405 && resp.StatusCode != 501 {
+			break
+		}
+	}
+	return res
+}
+
+// Broken returns the links of name which were broken when they were last checked.
+func (c *LinkChecker) Broken(name string) []LinkCheck {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	var broken []LinkCheck
+	for _, r := range c.results[name] {
+		if r.Broken() {
+			broken = append(broken, r)
+		}
+	}
+	return broken
+}
+
+// BrokenLink is a mapping with links which were broken when they were last checked.
+type BrokenLink struct {
+	Name  string      `json:"name"`
+	Links []LinkCheck `json:"links"`
+}
+
+// Report returns the mappings with broken links, sorted by name.
+func (c *LinkChecker) Report() []BrokenLink {
+	c.lock.RLock()
+	names := make([]string, 0, len(c.results))
+	for name := range c.results {
+		names = append(names, name)
+	}
+	c.lock.RUnlock()
+
+	sort.Strings(names)
+	report := []BrokenLink{}
+	for _, name := range names {
+		if broken := c.Broken(name); len(broken) > 0 {
+			report = append(report, BrokenLink{name, broken})
+		}
+	}
+	return report
+}
+
+// apiBroken responds with the mappings which have broken links (see LinkChecker.Report), or a 404
+// if links aren't being checked.
+func apiBroken() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		linkChecker := configOf(r.Context()).linkChecker
+		if linkChecker == nil {
+			apiError(w, 404, errors.New("links aren't being checked"))
+			return
+		}
+		writeJSON(w, 200, struct {
+			Links []BrokenLink `json:"links"`
+		}{linkChecker.Report()})
+	})
+}
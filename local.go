@@ -0,0 +1,105 @@
+package main
+
+import "context"
+
+// LocalStore is a simpler form of StoreCloser for stores which serve requests
+// from memory (or a local file), and so have no use for a context and can't
+// fail to look up a name. Adapt turns a LocalStore into a StoreCloser. A
+// LocalStore may also implement SetAll and History without a context, which
+// the adapter will use to implement Batcher and Historian respectively,
+// IterateRange without a context to make Ranger efficient, Check without a
+// context to implement Checker and Revision without a context to implement
+// Revisioner.
+type LocalStore interface {
+	// Get returns the entry and true Set for name, or nil and false if it doesn't exist.
+	Get(name string) (*Entry, bool)
+	// Set is as with Store.Set.
+	Set(name string, e *Entry) error
+	// Iterate is as with Store.Iterate.
+	Iterate(cb func(name string, e *Entry) error) error
+	// Close closes the store.
+	Close() error
+}
+
+// Adapt returns a StoreCloser (which is also a Batcher, a Historian, a Ranger,
+// a Checker and a Revisioner) backed by s.
+func Adapt(s LocalStore) StoreCloser {
+	return local{s}
+}
+
+type local struct {
+	s LocalStore
+}
+
+func (l local) Get(ctx context.Context, name string) (*Entry, error) {
+	e, ok := l.s.Get(name)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return e, nil
+}
+
+func (l local) Set(ctx context.Context, name string, e *Entry) error {
+	return l.s.Set(name, e)
+}
+
+func (l local) Iterate(ctx context.Context, cb func(name string, e *Entry) error) error {
+	return l.s.Iterate(cb)
+}
+
+func (l local) Close() error {
+	return l.s.Close()
+}
+
+// SetAll Sets entries atomically if the LocalStore supports it.
+func (l local) SetAll(ctx context.Context, entries map[string]*Entry) error {
+	if b, ok := l.s.(interface {
+		SetAll(entries map[string]*Entry) error
+	}); ok {
+		return b.SetAll(entries)
+	}
+	return setEach(entries, l.s.Set)
+}
+
+// IterateRange iterates over part of the mappings, using the LocalStore's
+// IterateRange if it has one.
+func (l local) IterateRange(ctx context.Context, offset, limit int, cb func(name string, e *Entry) error) error {
+	if r, ok := l.s.(interface {
+		IterateRange(offset, limit int, cb func(name string, e *Entry) error) error
+	}); ok {
+		return r.IterateRange(offset, limit, cb)
+	}
+	return iterateWindow(l.s.Iterate, offset, limit, cb)
+}
+
+// History returns the history of name if the LocalStore retains it, or
+// errNoHistory otherwise.
+func (l local) History(ctx context.Context, name string) ([]*Entry, error) {
+	if h, ok := l.s.(interface {
+		History(name string) ([]*Entry, error)
+	}); ok {
+		return h.History(name)
+	}
+	return nil, errNoHistory
+}
+
+// Check checks the LocalStore if it supports it. Otherwise it's assumed to
+// always be able to serve requests, as it can't fail to look up a name.
+func (l local) Check(ctx context.Context) error {
+	if c, ok := l.s.(interface {
+		Check() error
+	}); ok {
+		return c.Check()
+	}
+	return nil
+}
+
+// Revision returns the LocalStore's revision if it has one, or "" otherwise.
+func (l local) Revision(ctx context.Context) (string, error) {
+	if r, ok := l.s.(interface {
+		Revision() string
+	}); ok {
+		return r.Revision(), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// metricsPath is the path of the API endpoint exposing metrics in the Prometheus text format.
+const metricsPath = "/api/v1/metrics"
+
+// metricsBuckets are the upper bounds of the buckets of the histograms, in seconds. Lookups in
+// stores which are kept in memory take well under a millisecond, so the buckets start lower than
+// usual.
+var metricsBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+var (
+	// lookupSeconds is how long resolving names takes, by whether they were found.
+	lookupSeconds = NewHistogram("golinks_lookup_seconds", "Time taken to resolve a name.", "result")
+	// linkSeconds is how long requests for names take to be responded to, by how they were.
+	linkSeconds = NewHistogram("golinks_link_request_seconds", "Time taken to respond to a request for a name.", "outcome")
+	// renderSeconds is how long rendering each of the templates takes.
+	renderSeconds = NewHistogram("golinks_render_seconds", "Time taken to render a page.", "template")
+)
+
+// histograms are the histograms exposed by serveMetrics, in the order they're written in.
+var histograms = []*Histogram{lookupSeconds, linkSeconds, renderSeconds}
+
+// Histogram counts durations in metricsBuckets, separately for each value of its label. Access
+// to series must be guarded by lock.
+type Histogram struct {
+	name, help, label string
+
+	lock   sync.Mutex
+	series map[string]*series
+}
+
+// series is the counts of a Histogram for one value of its label.
+type series struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// NewHistogram returns a Histogram called name, described by help, which is partitioned by label.
+func NewHistogram(name, help, label string) *Histogram {
+	return &Histogram{name: name, help: help, label: label, series: make(map[string]*series)}
+}
+
+// Observe records that something with the label value took d.
+func (h *Histogram) Observe(value string, d time.Duration) {
+	secs := d.Seconds()
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	s, ok := h.series[value]
+	if !ok {
+		s = &series{buckets: make([]uint64, len(metricsBuckets))}
+		h.series[value] = s
+	}
+	if i := sort.SearchFloat64s(metricsBuckets, secs); i < len(metricsBuckets) {
+		s.buckets[i]++
+	}
+	s.count++
+	s.sum += secs
+}
+
+// Since records the time since start for the label value, for deferring.
+func (h *Histogram) Since(value string, start time.Time) {
+	h.Observe(value, time.Since(start))
+}
+
+// write writes the histogram to w in the Prometheus text format, with cumulative buckets.
+func (h *Histogram) write(w io.Writer) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	values := make([]string, 0, len(h.series))
+	for v := range h.series {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name); err != nil {
+		return err
+	}
+	for _, v := range values {
+		s, label := h.series[v], fmt.Sprintf("%s=%q", h.label, v)
+		var n uint64
+		for i, le := range metricsBuckets {
+			n += s.buckets[i]
+			le := strconv.FormatFloat(le, 'g', -1, 64)
+			if _, err := fmt.Fprintf(w, "%s_bucket{%s,le=%q} %d\n", h.name, label, le, n); err != nil {
+				return err
+			}
+		}
+		_, err := fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n%s_sum{%s} %s\n%s_count{%s} %d\n",
+			h.name, label, s.count, h.name, label, strconv.FormatFloat(s.sum, 'g', -1, 64), h.name, label, s.count)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveMetrics responds with the histograms in the Prometheus text format, so that they can be
+// scraped (with a read-only API token, see apiAuth).
+func serveMetrics() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		for _, h := range histograms {
+			if err := h.write(w); err != nil {
+				return
+			}
+		}
+	})
+}
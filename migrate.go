@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// migrate implements the 'migrate' subcommand, which copies every mapping from
+// one store to another. Mappings are Set in the destination in the same order
+// they were last Set in the source, so the index looks the same after
+// migrating. With -dry-run the mappings which would be copied are printed
+// instead.
+func migrate(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := fs.String("from", "", "store to copy mappings from, eg. 'file:links.txt'")
+	to := fs.String("to", "", "store to copy mappings to, eg. 'sqlite:links.db'")
+	dryRun := fs.Bool("dry-run", false, "print the mappings which would be copied without copying them")
+	_ = fs.Parse(args)
+
+	if *from == "" || (*to == "" && !*dryRun) {
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	src, err := OpenStore(*from, false, false)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// Iterate returns the most recently Set mapping first, but we need to Set
+	// the oldest mapping first to preserve the order.
+	var data []NameLink
+	err = src.Iterate(ctx, func(name string, e *Entry) error {
+		data = append(data, NameLink{Name: name, Entry: *e})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		for i := len(data) - 1; i >= 0; i-- {
+			fmt.Fprintf(out, "%s %s\n", data[i].Name, data[i].Link)
+		}
+		fmt.Fprintf(out, "would migrate %d links from %s to %s\n", len(data), *from, *to)
+		return nil
+	}
+
+	dst, err := OpenStore(*to, false, false)
+	if err != nil {
+		return err
+	}
+
+	for i := len(data) - 1; i >= 0; i-- {
+		e := data[i].Entry
+		if err := dst.Set(ctx, data[i].Name, &e); err != nil {
+			dst.Close()
+			return err
+		}
+	}
+	fmt.Fprintf(out, "migrated %d links from %s to %s\n", len(data), *from, *to)
+
+	return dst.Close()
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"google.golang.org/api/googleapi"
+)
+
+func init() {
+	opener := func(dsn string, fuzzy, compact bool) (StoreCloser, error) {
+		s, err := OpenObject(dsn, fuzzy)
+		if err != nil {
+			return nil, err
+		}
+		return Adapt(s), nil
+	}
+	RegisterStore("s3", opener)
+	RegisterStore("gs", opener)
+}
+
+// errPrecondition is returned by an object when a conditional write fails
+// because the object was modified since it was last read.
+var errPrecondition = errors.New("object modified concurrently")
+
+// object is a single object in an object storage bucket. Objects are versioned,
+// with read returning the version of the data read ("" if the object doesn't
+// exist) and write only succeeding if the object is still at version.
+type object interface {
+	read(ctx context.Context) (data []byte, version string, err error)
+	write(ctx context.Context, data []byte, version string) (string, error)
+}
+
+// ObjectStore provides an implementation of the Store interface backed by a
+// single object in S3 or GCS, allowing golinks to run without a persistent
+// volume. The object contains the same lines as the file backing a
+// (compacted) FileStore and is loaded into memory at startup. Every Set
+// rewrites the whole object with a conditional put, so if another instance
+// has modified the object in the meantime the latest version is reloaded and
+// the Set retried instead of silently losing the other instance's changes.
+// Access to all fields except fuzzy and obj must be guarded by lock.
+type ObjectStore struct {
+	fuzzy   bool
+	obj     object
+	version string
+	order   []string
+	cache   map[string]*Entry
+	fuzzed  map[string]*Entry
+	lock    sync.RWMutex
+}
+
+// OpenObject returns an ObjectStore backed by the object at rawurl, which must
+// be of the form "s3://bucket/key" or "gs://bucket/key" (and an optional bool
+// to enable fuzzy lookups). Credentials are configured through the standard
+// environment variables for the respective cloud provider.
+func OpenObject(rawurl string, fuzzy ...bool) (*ObjectStore, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || key == "" {
+		return nil, fmt.Errorf("invalid object url: %s", rawurl)
+	}
+
+	s := &ObjectStore{fuzzy: len(fuzzy) > 0 && fuzzy[0]}
+	switch u.Scheme {
+	case "s3":
+		sess, err := session.NewSessionWithOptions(session.Options{SharedConfigState: session.SharedConfigEnable})
+		if err != nil {
+			return nil, err
+		}
+		s.obj = &s3Object{client: s3.New(sess), bucket: u.Host, key: key}
+	case "gs":
+		client, err := storage.NewClient(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		s.obj = &gcsObject{handle: client.Bucket(u.Host).Object(key)}
+	default:
+		return nil, fmt.Errorf("unsupported object url scheme: %s", u.Scheme)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.load(context.Background()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load replaces the in-memory mappings with the latest version of the object.
+func (s *ObjectStore) load(ctx context.Context) error {
+	data, version, err := s.obj.read(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.version, s.order = version, nil
+	s.cache, s.fuzzed = make(map[string]*Entry), make(map[string]*Entry)
+	// Objects needing to be rewritten (eg. because they're in a legacy format)
+	// are rewritten the next time they're written to.
+	_, err = read(bytes.NewReader(data), "object", nil, false, s.set)
+	return err
+}
+
+// Close is a no-op provided for symmetry with the other stores.
+func (s *ObjectStore) Close() error {
+	return nil
+}
+
+func (s *ObjectStore) Get(name string) (*Entry, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	e, ok := s.cache[name]
+	if !ok && s.fuzzy {
+		e, ok = s.fuzzed[fuzz(name)]
+	}
+	return e, ok
+}
+
+func (s *ObjectStore) Set(name string, e *Entry) error {
+	return s.SetAll(map[string]*Entry{name: e})
+}
+
+func (s *ObjectStore) SetAll(entries map[string]*Entry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	names := sortedNames(entries)
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		// Write out what the object would contain after the Set without
+		// modifying any of our own state in case the write fails.
+		var buf bytes.Buffer
+		for _, n := range s.order {
+			if _, ok := entries[n]; !ok {
+				buf.WriteString(format(n, s.cache[n]))
+			}
+		}
+		for _, name := range names {
+			if e := entries[name]; e != nil {
+				buf.WriteString(format(name, e))
+			}
+		}
+
+		version, err := s.obj.write(ctx, buf.Bytes(), s.version)
+		if err == errPrecondition {
+			if err := s.load(ctx); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		s.version = version
+		for _, name := range names {
+			s.set(name, entries[name])
+		}
+		return nil
+	}
+	return errPrecondition
+}
+
+func (s *ObjectStore) Iterate(cb func(name string, e *Entry) error) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for i := len(s.order) - 1; i >= 0; i-- {
+		if err := cb(s.order[i], s.cache[s.order[i]]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// set updates the in-memory mappings, ensuring order only ever contains a
+// single entry per name.
+func (s *ObjectStore) set(name string, e *Entry) {
+	if _, ok := s.cache[name]; ok {
+		for i, n := range s.order {
+			if n == name {
+				s.order = append(s.order[:i], s.order[i+1:]...)
+				break
+			}
+		}
+	}
+
+	if e == nil {
+		delete(s.cache, name)
+	} else {
+		s.order = append(s.order, name)
+		s.cache[name] = e
+	}
+
+	if s.fuzzy {
+		if e == nil {
+			delete(s.fuzzed, fuzz(name))
+		} else {
+			s.fuzzed[fuzz(name)] = e
+		}
+	}
+}
+
+// s3Object is an object stored in S3, versioned by its ETag.
+type s3Object struct {
+	client      *s3.S3
+	bucket, key string
+}
+
+func (o *s3Object) read(ctx context.Context) ([]byte, string, error) {
+	out, err := o.client.GetObjectWithContext(ctx, &s3.GetObjectInput{Bucket: aws.String(o.bucket), Key: aws.String(o.key)})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	defer out.Body.Close()
+
+	data, err := ioutil.ReadAll(out.Body)
+	return data, aws.StringValue(out.ETag), err
+}
+
+func (o *s3Object) write(ctx context.Context, data []byte, version string) (string, error) {
+	in := &s3.PutObjectInput{Bucket: aws.String(o.bucket), Key: aws.String(o.key), Body: bytes.NewReader(data)}
+	// The SDK doesn't model S3's conditional writes, so the preconditions are set as headers.
+	header := map[string]string{"If-Match": version}
+	if version == "" {
+		header = map[string]string{"If-None-Match": "*"}
+	}
+
+	out, err := o.client.PutObjectWithContext(ctx, in, request.WithSetRequestHeaders(header))
+	if rerr, ok := err.(awserr.RequestFailure); ok &&
+		(rerr.StatusCode() == http.StatusPreconditionFailed || rerr.StatusCode() == http.StatusConflict) {
+		return "", errPrecondition
+	}
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.ETag), nil
+}
+
+// gcsObject is an object stored in GCS, versioned by its generation.
+type gcsObject struct {
+	handle *storage.ObjectHandle
+}
+
+func (o *gcsObject) read(ctx context.Context) ([]byte, string, error) {
+	r, err := o.handle.NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	return data, strconv.FormatInt(r.Attrs.Generation, 10), err
+}
+
+func (o *gcsObject) write(ctx context.Context, data []byte, version string) (string, error) {
+	cond := storage.Conditions{DoesNotExist: true}
+	if version != "" {
+		generation, err := strconv.ParseInt(version, 10, 64)
+		if err != nil {
+			return "", err
+		}
+		cond = storage.Conditions{GenerationMatch: generation}
+	}
+
+	w := o.handle.If(cond).NewWriter(ctx)
+	if _, err := io.Copy(w, bytes.NewReader(data)); err != nil {
+		w.Close()
+		return "", err
+	}
+	err := w.Close()
+	if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusPreconditionFailed {
+		return "", errPrecondition
+	}
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(w.Attrs().Generation, 10), nil
+}
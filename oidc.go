@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oidcCallbackPath is the path the OpenID Connect provider redirects back to after logging in,
+// which must be registered with it as a redirect URI (see OIDC.redirectURL).
+const oidcCallbackPath = "/login/callback"
+
+// oidcStateCookie is the name of the cookie binding a login in progress to the browser which
+// started it, so that someone else's login can't be completed in it.
+const oidcStateCookie = "oidc_state"
+
+// oidcLoginTimeout is how long logins in progress are allowed to take.
+const oidcLoginTimeout = 10 * time.Minute
+
+// googleIssuer is the issuer of Google accounts, whose ID tokens say which Google Workspace domain
+// accounts belong to (in the hd claim) if any.
+const googleIssuer = "https://accounts.google.com"
+
+// errOIDCDomain is returned when logging in with an account which isn't in the allowed domain.
+var errOIDCDomain = errors.New("account isn't in the allowed domain")
+
+// OIDC logs users in with an OpenID Connect provider, eg. Google Workspace, using the
+// authorization code flow. If domain isn't empty only accounts in it can log in, as determined by
+// their hosted domain (the hd claim) where the provider sets one, or otherwise by their verified
+// email address. Access to states must be guarded by lock.
+type OIDC struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	domain       string
+	redirect     string
+	authURL      string
+	tokenURL     string
+	client       *http.Client
+
+	lock   sync.Mutex
+	states map[string]*oidcState
+}
+
+// oidcState is a login in progress, with the nonce the ID token it results in must contain.
+type oidcState struct {
+	nonce   string
+	expires time.Time
+}
+
+// idClaims are the claims of ID tokens which are checked when logging in.
+type idClaims struct {
+	Issuer        string      `json:"iss"`
+	Audience      interface{} `json:"aud"`
+	Expires       int64       `json:"exp"`
+	Nonce         string      `json:"nonce"`
+	Email         string      `json:"email"`
+	EmailVerified *bool       `json:"email_verified"`
+	HostedDomain  string      `json:"hd"`
+}
+
+// NewOIDC returns OIDC for the provider issuer, which is looked up with OpenID Connect discovery,
+// authenticating as the client with clientID and clientSecret and only allowing accounts in
+// domain (unless it's empty) to log in. Users are redirected back to redirect, or if it's empty to
+// oidcCallbackPath on whichever host they logged in to.
+func NewOIDC(ctx context.Context, issuer, clientID, clientSecret, domain, redirect string) (*OIDC, error) {
+	o := &OIDC{
+		issuer:       strings.TrimSuffix(issuer, "/"),
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		domain:       strings.ToLower(domain),
+		redirect:     redirect,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		states:       make(map[string]*oidcState),
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", o.issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("discovering %s: %s", o.issuer, resp.Status)
+	}
+	var config struct {
+		Issuer   string `json:"issuer"`
+		AuthURL  string `json:"authorization_endpoint"`
+		TokenURL string `json:"token_endpoint"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+		return nil, fmt.Errorf("discovering %s: %w", o.issuer, err)
+	}
+	if config.Issuer != o.issuer {
+		return nil, fmt.Errorf("discovering %s: issuer is %q", o.issuer, config.Issuer)
+	}
+	if !isValidLink(config.AuthURL) || !strings.HasPrefix(config.TokenURL, "https://") {
+		return nil, fmt.Errorf("discovering %s: invalid endpoints", o.issuer)
+	}
+	o.authURL, o.tokenURL = config.AuthURL, config.TokenURL
+	return o, nil
+}
+
+// redirectURL returns the URL the provider redirects back to after the request r logs in.
+func (o *OIDC) redirectURL(r *http.Request) string {
+	if o.redirect != "" {
+		return o.redirect
+	}
+	return "https://" + r.Host + oidcCallbackPath
+}
+
+// Start redirects the request r to the provider to log in, remembering the login in progress in
+// both states and a cookie (see oidcStateCookie).
+func (o *OIDC) Start(w http.ResponseWriter, r *http.Request) {
+	state, nonce := randomHex(16), randomHex(16)
+	now := time.Now()
+	o.lock.Lock()
+	for s, st := range o.states {
+		if st.expires.Before(now) {
+			delete(o.states, s)
+		}
+	}
+	o.states[state] = &oidcState{nonce: nonce, expires: now.Add(oidcLoginTimeout)}
+	o.lock.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Path:     oidcCallbackPath,
+		Expires:  now.Add(oidcLoginTimeout),
+	})
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {o.clientID},
+		"redirect_uri":  {o.redirectURL(r)},
+		"scope":         {"openid email"},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	if o.domain != "" && o.issuer == googleIssuer {
+		// Only a hint to show the accounts in the domain, which is enforced by Callback.
+		q.Set("hd", o.domain)
+	}
+	sep := "?"
+	if strings.Contains(o.authURL, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, o.authURL+sep+q.Encode(), 302)
+}
+
+// Callback completes the login in progress for the request r redirected back from the provider,
+// returning the email address of the account which logged in.
+func (o *OIDC) Callback(w http.ResponseWriter, r *http.Request) (string, error) {
+	q := r.URL.Query()
+	c, err := r.Cookie(oidcStateCookie)
+	if err != nil || q.Get("state") == "" || c.Value != q.Get("state") {
+		return "", errors.New("invalid login state")
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Value: "", Path: oidcCallbackPath, Expires: time.Unix(0, 0)})
+
+	o.lock.Lock()
+	st, ok := o.states[c.Value]
+	delete(o.states, c.Value)
+	o.lock.Unlock()
+	if !ok || st.expires.Before(time.Now()) {
+		return "", errors.New("login expired")
+	}
+	if e := q.Get("error"); e != "" {
+		return "", fmt.Errorf("login failed: %s", e)
+	}
+
+	claims, err := o.exchange(r.Context(), q.Get("code"), o.redirectURL(r))
+	if err != nil {
+		return "", err
+	}
+	if err := o.check(claims, st.nonce); err != nil {
+		return "", err
+	}
+	return strings.ToLower(claims.Email), nil
+}
+
+// exchange exchanges the authorization code for an ID token at the provider's token endpoint,
+// returning its claims. As the token comes directly from the provider over TLS, authenticated with
+// the client secret, its signature doesn't need checking (see OpenID Connect Core 1.0, section
+// 3.1.3.7).
+func (o *OIDC) exchange(ctx context.Context, code, redirect string) (*idClaims, error) {
+	if code == "" {
+		return nil, errors.New("missing authorization code")
+	}
+	form := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {redirect}}
+	req, err := http.NewRequestWithContext(ctx, "POST", o.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(o.clientID), url.QueryEscape(o.clientSecret))
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("exchanging authorization code: %s", resp.Status)
+	}
+	var tok struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return nil, fmt.Errorf("exchanging authorization code: %w", err)
+	}
+
+	parts := strings.Split(tok.IDToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("invalid ID token")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %w", err)
+	}
+	var claims idClaims
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return nil, fmt.Errorf("invalid ID token: %w", err)
+	}
+	return &claims, nil
+}
+
+// check returns an error unless claims are of an ID token issued to us for the login with nonce,
+// for a verified email address allowed to log in.
+func (o *OIDC) check(claims *idClaims, nonce string) error {
+	if claims.Issuer != o.issuer {
+		return fmt.Errorf("ID token issued by %q", claims.Issuer)
+	}
+	var aud []string
+	switch a := claims.Audience.(type) {
+	case string:
+		aud = []string{a}
+	case []interface{}:
+		for _, s := range a {
+			if s, ok := s.(string); ok {
+				aud = append(aud, s)
+			}
+		}
+	}
+	ours := false
+	for _, a := range aud {
+		ours = ours || a == o.clientID
+	}
+	if !ours {
+		return errors.New("ID token issued to another client")
+	}
+	if time.Now().After(time.Unix(claims.Expires, 0)) {
+		return errors.New("ID token expired")
+	}
+	if claims.Nonce != nonce {
+		return errors.New("ID token for another login")
+	}
+	if claims.Email == "" || (claims.EmailVerified != nil && !*claims.EmailVerified) {
+		return errors.New("account has no verified email address")
+	}
+
+	if o.domain == "" {
+		return nil
+	}
+	// Google accounts outside of Workspace can have an email address in any domain, so only the
+	// hosted domain says whether they belong to it.
+	if claims.HostedDomain != "" || o.issuer == googleIssuer {
+		if strings.ToLower(claims.HostedDomain) != o.domain {
+			return errOIDCDomain
+		}
+		return nil
+	}
+	if !strings.HasSuffix(strings.ToLower(claims.Email), "@"+o.domain) {
+		return errOIDCDomain
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// errNotOwner is returned when changing a mapping that belongs to someone else.
+var errNotOwner = errors.New("only the owner of a link can change it")
+
+// isAdmin returns whether the request r is made by one of the admins, or is logged in as a user who
+// is an admin.
+func isAdmin(r *http.Request) bool {
+	if u := userOf(r.Context()); u != nil && u.Admin {
+		return true
+	}
+	id := identity(r)
+	for _, a := range configOf(r.Context()).admins {
+		if id == a {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOwner returns errNotOwner if edits are restricted and the existing mapping e (which is nil
+// if the mapping doesn't exist) is owned by someone other than who is making the request r, unless
+// they're an admin. Mappings without an owner can be changed by anyone.
+func checkOwner(r *http.Request, e *Entry) error {
+	if !configOf(r.Context()).restrictEdits || e == nil || e.OwnedBy() == "" || e.OwnedBy() == identity(r) || isAdmin(r) {
+		return nil
+	}
+	return fmt.Errorf("%w (%s)", errNotOwner, e.OwnedBy())
+}
+
+// postTransfer transfers the ownership of name to the owner parameter, which may only be done by
+// its current owner (or an admin) if edits are restricted.
+func postTransfer(store Store, name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		owner := strings.TrimSpace(r.PostFormValue("owner"))
+		if owner == "" {
+			httpError(w, 400, errors.New("missing owner"))
+			return
+		}
+
+		updates.Lock()
+		defer updates.Unlock()
+
+		e, err := store.Get(r.Context(), name)
+		if err == ErrNotFound {
+			httpError(w, 404)
+			return
+		}
+		if err != nil {
+			httpError(w, 500, err)
+			return
+		}
+		if err := checkOwner(r, e); err != nil {
+			httpError(w, 403, err)
+			return
+		}
+		if match := ifMatch(r); match != "" {
+			if code, err := checkMatch(match, e); code != 0 {
+				httpError(w, code, err)
+				return
+			}
+		}
+
+		transferred := *e
+		transferred.Owner = owner
+		if err := store.Set(r.Context(), name, &transferred); err != nil {
+			httpError(w, 500, err)
+			return
+		}
+
+		http.Redirect(w, r, "/"+name+"+", 302)
+	})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Pattern maps every name matching a regular expression to a link, in which $1, ${1}, ${name}
+// etc. are replaced with the corresponding submatches of the name (as with regexp.Expand), so that
+// eg. the pattern ^b/(\d+)$ with the link https://bugs.corp/show?id=$1 redirects go/b/123 to
+// https://bugs.corp/show?id=123. Patterns match anywhere in the name unless they're anchored.
+type Pattern struct {
+	Pattern string    `json:"pattern"`
+	Link    string    `json:"link"`
+	Created time.Time `json:"created"`
+
+	re *regexp.Regexp
+}
+
+// Patterns holds the pattern links which have been added, persisting them as JSON to a file.
+// They're kept apart from the store so that looking up a name there doesn't involve them, and are
+// only tried (in the order they were added) for names which aren't found. Access to patterns must
+// be guarded by lock.
+type Patterns struct {
+	filename string
+	lock     sync.RWMutex
+	patterns []*Pattern
+}
+
+// OpenPatterns returns Patterns persisted to filename, which is created once the first pattern is
+// added.
+func OpenPatterns(filename string) (*Patterns, error) {
+	p := &Patterns{filename: filename}
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &p.patterns); err != nil {
+		return nil, fmt.Errorf("reading patterns from %s: %w", filename, err)
+	}
+	for _, pat := range p.patterns {
+		if pat.re, err = regexp.Compile(pat.Pattern); err != nil {
+			return nil, fmt.Errorf("reading patterns from %s: %w", filename, err)
+		}
+	}
+	return p, nil
+}
+
+// Add adds a pattern mapping names which match it to link, replacing the link of the pattern if
+// it has already been added.
+func (p *Patterns) Add(pattern, link string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid pattern: %w", err)
+	}
+	if pattern == "" {
+		return errors.New("invalid pattern: empty")
+	}
+	if !isValidLink(link) {
+		return errors.New("invalid link")
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, pat := range p.patterns {
+		if pat.Pattern == pattern {
+			prev := pat.Link
+			pat.Link = link
+			if err := p.save(); err != nil {
+				pat.Link = prev
+				return err
+			}
+			return nil
+		}
+	}
+	p.patterns = append(p.patterns, &Pattern{Pattern: pattern, Link: link, Created: time.Now(), re: re})
+	if err := p.save(); err != nil {
+		p.patterns = p.patterns[:len(p.patterns)-1]
+		return err
+	}
+	return nil
+}
+
+// Remove removes pattern so that names matching it no longer redirect anywhere.
+func (p *Patterns) Remove(pattern string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for i, pat := range p.patterns {
+		if pat.Pattern == pattern {
+			prev := p.patterns
+			p.patterns = append(append([]*Pattern(nil), prev[:i]...), prev[i+1:]...)
+			if err := p.save(); err != nil {
+				p.patterns = prev
+				return err
+			}
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// List returns every pattern, in the order they're tried.
+func (p *Patterns) List() []Pattern {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	patterns := make([]Pattern, 0, len(p.patterns))
+	for _, pat := range p.patterns {
+		patterns = append(patterns, *pat)
+	}
+	return patterns
+}
+
+// Resolve returns the link name redirects to given the first pattern it matches, along with the
+// pattern. ErrNotFound is returned if it doesn't match any.
+func (p *Patterns) Resolve(name string) (pattern, link string, err error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	for _, pat := range p.patterns {
+		if m := pat.re.FindStringSubmatchIndex(name); m != nil {
+			return pat.Pattern, string(pat.re.ExpandString(nil, pat.Link, name, m)), nil
+		}
+	}
+	return "", "", ErrNotFound
+}
+
+// save writes the patterns to the file, replacing it atomically.
+func (p *Patterns) save() error {
+	b, err := json.MarshalIndent(p.patterns, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := p.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.filename)
+}
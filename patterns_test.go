@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestPatterns(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "patterns")
+	p, err := OpenPatterns(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pat := range [][2]string{
+		{`^b/(\d+)$`, "https://bugs.corp.example/show?id=$1"},
+		{`^cl/(?P<change>\d+)`, "https://review.corp.example/c/${change}"},
+		{`docs`, "https://docs.corp.example"},
+		{`^b/`, "https://bugs.corp.example"},
+	} {
+		if err := p.Add(pat[0], pat[1]); err != nil {
+			t.Fatalf("Add(%q, %q): %v", pat[0], pat[1], err)
+		}
+	}
+
+	tests := []struct {
+		name, pattern, link string
+	}{
+		{"b/123", `^b/(\d+)$`, "https://bugs.corp.example/show?id=123"},
+		{"cl/45/diff", `^cl/(?P<change>\d+)`, "https://review.corp.example/c/45"},
+		// Patterns match anywhere in the name unless they're anchored...
+		{"team/docs/x", `docs`, "https://docs.corp.example"},
+		// ... and are tried in the order they were added.
+		{"b/new", `^b/`, "https://bugs.corp.example"},
+		{"a/b/123", "", ""},
+	}
+	check := func(p *Patterns) {
+		t.Helper()
+		for _, tt := range tests {
+			pattern, link, err := p.Resolve(tt.name)
+			if tt.pattern == "" {
+				if !errors.Is(err, ErrNotFound) {
+					t.Errorf("Resolve(%q) = %q, %q, %v, want %v", tt.name, pattern, link, err, ErrNotFound)
+				}
+				continue
+			}
+			if err != nil || pattern != tt.pattern || link != tt.link {
+				t.Errorf("Resolve(%q) = %q, %q, %v, want %q, %q", tt.name, pattern, link, err, tt.pattern, tt.link)
+			}
+		}
+	}
+	check(p)
+
+	// The patterns are persisted.
+	reopened, err := OpenPatterns(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(reopened)
+	if got := len(reopened.List()); got != 4 {
+		t.Errorf("%d patterns after reopening, want 4", got)
+	}
+}
+
+func TestPatternsChange(t *testing.T) {
+	p, err := OpenPatterns(filepath.Join(t.TempDir(), "patterns"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pat := range [][2]string{{"(", "https://a.example"}, {"", "https://a.example"}, {"a", "not a link"}} {
+		if err := p.Add(pat[0], pat[1]); err == nil {
+			t.Errorf("Add(%q, %q) succeeded", pat[0], pat[1])
+		}
+	}
+
+	if err := p.Add("^a$", "https://a.example"); err != nil {
+		t.Fatal(err)
+	}
+	// Adding a pattern again replaces its link.
+	if err := p.Add("^a$", "https://a.example/new"); err != nil {
+		t.Fatal(err)
+	}
+	if _, link, _ := p.Resolve("a"); link != "https://a.example/new" || len(p.List()) != 1 {
+		t.Errorf("Resolve(a) = %q with %d patterns, want the new link with 1", link, len(p.List()))
+	}
+
+	if err := p.Remove("^a$"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := p.Resolve("a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Resolve(a) after Remove = %v, want %v", err, ErrNotFound)
+	}
+	if err := p.Remove("^a$"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Remove of a removed pattern = %v, want %v", err, ErrNotFound)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+
+	_ "github.com/lib/pq"
+)
+
+func init() {
+	// lib/pq understands postgres:// URLs directly.
+	opener := func(dsn string, fuzzy, compact bool) (StoreCloser, error) {
+		return OpenPostgres(dsn, fuzzy)
+	}
+	RegisterStore("postgres", opener)
+	RegisterStore("postgresql", opener)
+}
+
+// postgresMigrations are applied in order to bring the schema up to date, with
+// the number of migrations already applied tracked in schema_migrations.
+// Existing migrations must never be modified - changes to the schema should
+// always be made by appending a new migration.
+var postgresMigrations = []string{
+	`CREATE SEQUENCE golinks_seq;
+	CREATE TABLE links (
+		name  TEXT PRIMARY KEY,
+		fuzzy TEXT NOT NULL,
+		link  TEXT NOT NULL,
+		seq   BIGINT NOT NULL DEFAULT nextval('golinks_seq')
+	);
+	CREATE INDEX links_fuzzy ON links (fuzzy, seq);
+	CREATE INDEX links_seq ON links (seq);`,
+	`ALTER TABLE links ADD COLUMN entry TEXT NOT NULL DEFAULT '';`,
+}
+
+// PostgresStore provides an implementation of the Store interface backed by
+// PostgreSQL. Each mapping is a row in the links table (with the encoded Entry
+// in the entry column), with seq assigned from
+// a sequence every time the mapping is Set so that Iterate can match the
+// semantics of FileStore. All queries are prepared up front, and writes are
+// single atomic upserts so multiple golinks instances can safely share the
+// same database. Like FileStore, the store supports 'fuzzy' lookups if
+// initialized with fuzzy.
+type PostgresStore struct {
+	fuzzy bool
+	db    *sql.DB
+
+	get, getFuzzy, upsert, del, iterate, iterateRange *sql.Stmt
+}
+
+// OpenPostgres connects to the PostgreSQL database described by dsn, migrating
+// the schema if necessary (and an optional bool to enable fuzzy lookups). The
+// PostgresStore returned should be closed with Close once it is no longer in
+// use.
+func OpenPostgres(dsn string, fuzzy ...bool) (*PostgresStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &PostgresStore{fuzzy: len(fuzzy) > 0 && fuzzy[0], db: db}
+	if err := s.init(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *PostgresStore) init() error {
+	if err := migratePostgres(s.db); err != nil {
+		return err
+	}
+
+	var err error
+	prepare := func(query string) *sql.Stmt {
+		if err != nil {
+			return nil
+		}
+		var stmt *sql.Stmt
+		stmt, err = s.db.Prepare(query)
+		return stmt
+	}
+
+	s.get = prepare("SELECT link, entry FROM links WHERE name = $1")
+	s.getFuzzy = prepare("SELECT link, entry FROM links WHERE fuzzy = $1 ORDER BY seq DESC LIMIT 1")
+	s.upsert = prepare(`
+		INSERT INTO links (name, fuzzy, link, entry) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (name) DO UPDATE
+		SET fuzzy = EXCLUDED.fuzzy, link = EXCLUDED.link, entry = EXCLUDED.entry, seq = nextval('golinks_seq')`)
+	s.del = prepare("DELETE FROM links WHERE name = $1")
+	s.iterate = prepare("SELECT name, link, entry FROM links ORDER BY seq DESC")
+	s.iterateRange = prepare("SELECT name, link, entry FROM links ORDER BY seq DESC LIMIT $1 OFFSET $2")
+	return err
+}
+
+// migratePostgres applies any postgresMigrations which haven't already been
+// applied to db. An advisory lock is held for the duration of the transaction
+// so that instances starting up concurrently don't race each other.
+func migratePostgres(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("SELECT pg_advisory_xact_lock(hashtext('golinks'))")
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER NOT NULL)")
+	if err != nil {
+		return err
+	}
+
+	var version int
+	err = tx.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for ; version < len(postgresMigrations); version++ {
+		if _, err := tx.Exec(postgresMigrations[version]); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO schema_migrations (version) VALUES ($1)", version+1); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Close closes the PostgresStore returned by OpenPostgres.
+func (s *PostgresStore) Close() error {
+	for _, stmt := range []*sql.Stmt{s.get, s.getFuzzy, s.upsert, s.del, s.iterate, s.iterateRange} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	return s.db.Close()
+}
+
+func (s *PostgresStore) Get(ctx context.Context, name string) (*Entry, error) {
+	var link, entry string
+	err := s.get.QueryRowContext(ctx, name).Scan(&link, &entry)
+	if err == sql.ErrNoRows && s.fuzzy {
+		err = s.getFuzzy.QueryRowContext(ctx, fuzz(name)).Scan(&link, &entry)
+	}
+	return rowResult(link, entry, err)
+}
+
+func (s *PostgresStore) Set(ctx context.Context, name string, e *Entry) error {
+	var err error
+	if e == nil {
+		_, err = s.del.ExecContext(ctx, name)
+	} else {
+		_, err = s.upsert.ExecContext(ctx, name, fuzz(name), e.Link, encodeEntry(e))
+	}
+	return err
+}
+
+func (s *PostgresStore) SetAll(ctx context.Context, entries map[string]*Entry) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	del, upsert := tx.StmtContext(ctx, s.del), tx.StmtContext(ctx, s.upsert)
+	for _, name := range sortedNames(entries) {
+		if e := entries[name]; e == nil {
+			_, err = del.ExecContext(ctx, name)
+		} else {
+			_, err = upsert.ExecContext(ctx, name, fuzz(name), e.Link, encodeEntry(e))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStore) Iterate(ctx context.Context, cb func(name string, e *Entry) error) error {
+	rows, err := s.iterate.QueryContext(ctx)
+	if err != nil {
+		return err
+	}
+	return iterateRows(rows, cb)
+}
+
+func (s *PostgresStore) IterateRange(ctx context.Context, offset, limit int, cb func(name string, e *Entry) error) error {
+	rows, err := s.iterateRange.QueryContext(ctx, limit, offset)
+	if err != nil {
+		return err
+	}
+	return iterateRows(rows, cb)
+}
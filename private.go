@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// errPrivate is returned for links which are rejected by blockPrivate.
+var errPrivate = errors.New("links to private addresses aren't allowed")
+
+// sharedAddressSpace is the carrier-grade NAT range, which isn't reachable from the internet.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// isPrivate returns whether ip isn't a public internet address: loopback, private, link-local
+// (which includes the 169.254.169.254 metadata endpoint of most clouds), unspecified or in the
+// shared address space.
+func isPrivate(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip)
+}
+
+// checkPublic returns errPrivate if blockPrivate is set and link (or any of dests, if there are
+// any) is on a host which resolves to a private address. Aliases to names on host and links which
+// aren't to websites (eg. deep links into apps) are allowed, while links which can't be checked
+// are rejected: templates (and pattern links) with placeholders in their host and hosts which
+// don't resolve.
+func checkPublic(ctx context.Context, host, link string, dests []Destination) error {
+	if !configOf(ctx).blockPrivate {
+		return nil
+	}
+	links := []string{link}
+	for _, d := range dests {
+		links = append(links, d.Link)
+	}
+	for _, link := range links {
+		if link == "" {
+			continue
+		}
+		u, err := url.Parse(escapePercentS(link))
+		if err != nil {
+			return fmt.Errorf("%w: %v", errPrivate, err)
+		}
+		if u.Host == host || (u.Scheme != "http" && u.Scheme != "https") {
+			continue
+		}
+		h := u.Hostname()
+		if strings.ContainsAny(h, "{}%$") {
+			return fmt.Errorf("%w: %s has a placeholder in its host", errPrivate, link)
+		}
+		ips := []net.IP{net.ParseIP(h)}
+		if ips[0] == nil {
+			addrs, err := net.DefaultResolver.LookupIPAddr(ctx, h)
+			if err != nil {
+				return fmt.Errorf("%w: %s doesn't resolve", errPrivate, h)
+			}
+			ips = ips[:0]
+			for _, a := range addrs {
+				ips = append(ips, a.IP)
+			}
+		}
+		for _, ip := range ips {
+			switch {
+			case !isPrivate(ip):
+			case ip.String() == h:
+				return fmt.Errorf("%w: %s", errPrivate, h)
+			default:
+				return fmt.Errorf("%w: %s resolves to %s", errPrivate, h, ip)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// rateLimitKeys is how many buckets a RateLimiter keeps before dropping those which have refilled,
+// so that scanning many names (or from many addresses) can't grow it without bound.
+const rateLimitKeys = 10000
+
+// RateLimiter limits the rate of requests with a token bucket for each key, eg. the address of
+// the client. Each bucket holds up to a second's worth of requests. Access to buckets must be
+// guarded by lock.
+type RateLimiter struct {
+	qps   float64
+	burst float64
+
+	lock    sync.Mutex
+	buckets map[string]*bucket
+}
+
+// bucket is the tokens left for a key as of when it was last updated.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter allowing qps requests a second for each key.
+func NewRateLimiter(qps float64) *RateLimiter {
+	return &RateLimiter{qps: qps, burst: math.Max(1, math.Ceil(qps)), buckets: make(map[string]*bucket)}
+}
+
+// Allow returns whether a request for key is allowed, taking a token from its bucket if it is.
+func (l *RateLimiter) Allow(key string) bool {
+	now := time.Now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= rateLimitKeys {
+			l.prune(now)
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.qps)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune drops the buckets which would have refilled by now, as they're the same as new ones. It
+// must be called with lock held.
+func (l *RateLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.qps >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimit limits the requests handled by h from each client address with perClient (unless it's
+// nil), responding with a 429 to those over the limit, so that a noisy scanner can't use up
+// everyone else's requests. Links are limited separately as they're resolved (see linkLimiter).
+func rateLimit(perClient *RateLimiter, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if perClient != nil {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				host = r.RemoteAddr
+			}
+			if !perClient.Allow(host) {
+				w.Header().Set("Retry-After", "1")
+				httpError(w, 429)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
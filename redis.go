@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	redisLinks = "golinks:links"
+	redisFuzzy = "golinks:fuzzy"
+	redisOrder = "golinks:order"
+	redisSeq   = "golinks:seq"
+)
+
+func init() {
+	// redis://host:port/db
+	RegisterStore("redis", func(dsn string, fuzzy, compact bool) (StoreCloser, error) {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return nil, err
+		}
+		addr, db := u.Host, 0
+		if addr == "" {
+			addr = "localhost:6379"
+		}
+		if p := strings.TrimPrefix(u.Path, "/"); p != "" {
+			db, err = strconv.Atoi(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid redis database %q", p)
+			}
+		}
+		return OpenRedis(addr, db, fuzzy)
+	})
+}
+
+// RedisStore provides an implementation of the Store interface backed by
+// Redis, allowing multiple golinks instances to share the same mappings.
+// Encoded entries are stored in the golinks:links hash, and the golinks:order sorted set
+// scores each name by the sequence number (from the golinks:seq counter) of
+// when it was last Set, which Iterate uses to provide the same ordering as
+// FileStore. If initialized with fuzzy, entries are additionally stored under
+// their fuzzed names in the golinks:fuzzy hash.
+type RedisStore struct {
+	fuzzy  bool
+	client *redis.Client
+}
+
+// OpenRedis connects to the Redis server at addr and returns a RedisStore
+// using database db (and an optional bool to enable fuzzy lookups). The
+// RedisStore returned should be closed with Close once it is no longer in use.
+func OpenRedis(addr string, db int, fuzzy ...bool) (*RedisStore, error) {
+	client := redis.NewClient(&redis.Options{Addr: addr, DB: db})
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &RedisStore{fuzzy: len(fuzzy) > 0 && fuzzy[0], client: client}, nil
+}
+
+// Close closes the RedisStore returned by OpenRedis.
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
+
+func (s *RedisStore) Get(ctx context.Context, name string) (*Entry, error) {
+	v, err := s.client.HGet(ctx, redisLinks, name).Result()
+	if err == redis.Nil && s.fuzzy {
+		v, err = s.client.HGet(ctx, redisFuzzy, fuzz(name)).Result()
+	}
+	if err == redis.Nil || (err == nil && v == "") {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeEntry(v), nil
+}
+
+func (s *RedisStore) Set(ctx context.Context, name string, e *Entry) error {
+	return s.SetAll(ctx, map[string]*Entry{name: e})
+}
+
+func (s *RedisStore) SetAll(ctx context.Context, entries map[string]*Entry) error {
+	// Allocate a block of sequence numbers, one for each entry.
+	names := sortedNames(entries)
+	seq, err := s.client.IncrBy(ctx, redisSeq, int64(len(names))).Result()
+	if err != nil {
+		return err
+	}
+	seq -= int64(len(names))
+
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, name := range names {
+			seq++
+			e := entries[name]
+			if e == nil {
+				pipe.HDel(ctx, redisLinks, name)
+				pipe.ZRem(ctx, redisOrder, name)
+				if s.fuzzy {
+					pipe.HDel(ctx, redisFuzzy, fuzz(name))
+				}
+				continue
+			}
+
+			v := encodeEntry(e)
+			pipe.HSet(ctx, redisLinks, name, v)
+			pipe.ZAdd(ctx, redisOrder, &redis.Z{Score: float64(seq), Member: name})
+			if s.fuzzy {
+				pipe.HSet(ctx, redisFuzzy, fuzz(name), v)
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+func (s *RedisStore) Iterate(ctx context.Context, cb func(name string, e *Entry) error) error {
+	names, err := s.client.ZRevRange(ctx, redisOrder, 0, -1).Result()
+	if err != nil || len(names) == 0 {
+		return err
+	}
+
+	values, err := s.client.HMGet(ctx, redisLinks, names...).Result()
+	if err != nil {
+		return err
+	}
+
+	for i, name := range names {
+		// The name may have been deleted between fetching the order and the entries.
+		v, ok := values[i].(string)
+		if !ok {
+			continue
+		}
+		if err := cb(name, decodeEntry(v)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// parseRegions parses per-region destinations separated by whitespace in s, each of which is a
+// region followed by '=' and its link, eg. eu=https://eu.vpn.corp us=https://us.vpn.corp (see
+// normalizeRegions).
+func parseRegions(ctx context.Context, store Store, host, s string) (map[string]string, error) {
+	regions := make(map[string]string)
+	for _, f := range strings.Fields(s) {
+		i := strings.IndexByte(f, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid region destination %q", f)
+		}
+		regions[f[:i]] = f[i+1:]
+	}
+	return normalizeRegions(ctx, store, host, regions)
+}
+
+// normalizeRegions lower cases the regions and canonicalizes and normalizes their links (as with
+// normalizeDestinations), returning nil if there aren't any.
+func normalizeRegions(ctx context.Context, store Store, host string, regions map[string]string) (map[string]string, error) {
+	if len(regions) == 0 {
+		return nil, nil
+	}
+	normal := make(map[string]string, len(regions))
+	for region, link := range regions {
+		region = strings.ToLower(strings.TrimSpace(region))
+		if region == "" || strings.ContainsAny(region, " =") {
+			return nil, fmt.Errorf("invalid region %q", region)
+		}
+		link, err := normalizeLink(canonicalizeAlias(ctx, store, host, link))
+		if err != nil {
+			return nil, fmt.Errorf("invalid link for region %s: %w", region, err)
+		}
+		normal[region] = link
+	}
+	return normal, nil
+}
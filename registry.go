@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// StoreCloser is a Store which must be closed once it is no longer in use.
+type StoreCloser interface {
+	Store
+	Close() error
+}
+
+// Opener opens the StoreCloser described by dsn, a URL-like string such as
+// "sqlite:///var/lib/golinks.db" whose scheme was used to select the Opener.
+// Openers are responsible for parsing the rest of dsn however makes sense for
+// their backend. fuzzy and compact enable fuzzy lookups and compaction for
+// backends which support them.
+type Opener func(dsn string, fuzzy, compact bool) (StoreCloser, error)
+
+var (
+	openersLock sync.RWMutex
+	openers     = make(map[string]Opener)
+)
+
+// RegisterStore makes a Store backend available to OpenStore under scheme.
+// Backends typically call RegisterStore from an init function in the file
+// which implements them, so additional backends can be compiled in simply by
+// adding a file to the package. RegisterStore panics if called twice with the
+// same scheme or if opener is nil.
+func RegisterStore(scheme string, opener Opener) {
+	openersLock.Lock()
+	defer openersLock.Unlock()
+
+	if opener == nil {
+		panic("golinks: RegisterStore opener is nil")
+	}
+	if _, dup := openers[scheme]; dup {
+		panic("golinks: RegisterStore called twice for " + scheme)
+	}
+	openers[scheme] = opener
+}
+
+// Stores returns a sorted list of the schemes of the registered backends.
+func Stores() []string {
+	openersLock.RLock()
+	defer openersLock.RUnlock()
+
+	var schemes []string
+	for scheme := range openers {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// OpenStore opens the StoreCloser described by dsn using the Opener registered
+// for the scheme of dsn.
+func OpenStore(dsn string, fuzzy, compact bool) (StoreCloser, error) {
+	i := strings.Index(dsn, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("invalid store %q: missing scheme", dsn)
+	}
+
+	openersLock.RLock()
+	opener, ok := openers[dsn[:i]]
+	openersLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown store %q (registered: %s)", dsn[:i], strings.Join(Stores(), ", "))
+	}
+	return opener(dsn, fuzzy, compact)
+}
+
+// storePath returns the path portion of a dsn which refers to a local file,
+// supporting both the "scheme:relative/path" and "scheme:///absolute/path"
+// forms.
+func storePath(u *url.URL) (string, error) {
+	path := u.Opaque
+	if path == "" {
+		path = u.Host + u.Path
+	}
+	if path == "" {
+		return "", fmt.Errorf("missing path in store %q", u.String())
+	}
+	return path, nil
+}
+
+// openPath parses dsn and returns its path (as per storePath) along with its
+// query parameters.
+func openPath(dsn string) (string, url.Values, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", nil, err
+	}
+	path, err := storePath(u)
+	return path, u.Query(), err
+}
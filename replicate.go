@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// replicationPath is the path replicas poll on the primary.
+	replicationPath = "/_replicate"
+	// replicationWait is how long a poll waits for a change before returning an empty batch. This
+	// must be less than the server's WriteTimeout.
+	replicationWait = 5 * time.Second
+	// replicationLog is the number of changes the primary retains. Replicas which have fallen
+	// further behind than this are sent a snapshot.
+	replicationLog = 1000
+)
+
+// batch is the response to a replica's poll, containing the changes made after the sequence number
+// the replica asked for (or all of the mappings if Snapshot is set) in the order they were made.
+type batch struct {
+	Epoch    string   `json:"epoch"`
+	Seq      uint64   `json:"seq"`
+	Snapshot bool     `json:"snapshot"`
+	Changes  []record `json:"changes"`
+}
+
+// Primary wraps a StoreCloser to record every Set in an in-memory log which replicas poll (see
+// ServeHTTP) to follow the changes. The log only contains the most recent changes and is lost on
+// restart, so each Primary has a random epoch and replicas which don't share it (or have fallen too
+// far behind) are sent a snapshot of all the mappings instead. Access to seq, log and changed must
+// be guarded by lock, which is also held during Set so that snapshots are consistent with the log.
+type Primary struct {
+	StoreCloser
+	token string
+	epoch string
+
+	lock    sync.Mutex
+	seq     uint64
+	log     []record
+	changed chan struct{}
+}
+
+// NewPrimary returns a Primary for store which accepts polls from replicas presenting token.
+func NewPrimary(store StoreCloser, token string) *Primary {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return &Primary{StoreCloser: store, token: token, epoch: hex.EncodeToString(b), changed: make(chan struct{})}
+}
+
+func (p *Primary) Set(ctx context.Context, name string, e *Entry) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if err := p.StoreCloser.Set(ctx, name, e); err != nil {
+		return err
+	}
+
+	p.append(record{Name: name, Entry: e})
+	return nil
+}
+
+func (p *Primary) SetAll(ctx context.Context, entries map[string]*Entry) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if err := setAll(ctx, p.StoreCloser, entries); err != nil {
+		return err
+	}
+
+	var recs []record
+	for _, name := range sortedNames(entries) {
+		recs = append(recs, record{Name: name, Entry: entries[name]})
+	}
+	p.append(recs...)
+	return nil
+}
+
+// append adds recs to the log and wakes any replicas waiting for changes.
+func (p *Primary) append(recs ...record) {
+	p.seq += uint64(len(recs))
+	p.log = append(p.log, recs...)
+	if len(p.log) > replicationLog {
+		p.log = p.log[len(p.log)-replicationLog:]
+	}
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// Unwrap returns the wrapped store.
+func (p *Primary) Unwrap() Store {
+	return p.StoreCloser
+}
+
+// ServeHTTP handles a replica's poll for the changes after the 'seq' query parameter in the 'epoch'
+// query parameter, waiting up to replicationWait for a change if there are none yet.
+func (p *Primary) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(auth), []byte(p.token)) != 1 {
+		httpError(w, 401)
+		return
+	}
+	seq, err := strconv.ParseUint(r.URL.Query().Get("seq"), 10, 64)
+	if err != nil {
+		seq = 0
+	}
+	epoch := r.URL.Query().Get("epoch")
+
+	p.lock.Lock()
+	if epoch == p.epoch && seq == p.seq {
+		changed := p.changed
+		p.lock.Unlock()
+		select {
+		case <-changed:
+		case <-time.After(replicationWait):
+		case <-r.Context().Done():
+			return
+		}
+		p.lock.Lock()
+	}
+	b, err := p.batch(r.Context(), epoch, seq)
+	p.lock.Unlock()
+	if err != nil {
+		httpError(w, 500, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(b); err != nil {
+		log.Printf("replication response failed: %v\n", err)
+	}
+}
+
+// batch returns the changes after seq in epoch, or a snapshot if they aren't available.
+func (p *Primary) batch(ctx context.Context, epoch string, seq uint64) (*batch, error) {
+	b := &batch{Epoch: p.epoch, Seq: p.seq, Changes: []record{}}
+	if epoch == p.epoch && seq <= p.seq && p.seq-seq <= uint64(len(p.log)) {
+		b.Changes = append(b.Changes, p.log[uint64(len(p.log))-(p.seq-seq):]...)
+		return b, nil
+	}
+
+	b.Snapshot = true
+	err := p.StoreCloser.Iterate(ctx, func(name string, e *Entry) error {
+		b.Changes = append(b.Changes, record{Name: name, Entry: e})
+		return nil
+	})
+	// Iterate returns the most recently Set mapping first.
+	for i, j := 0, len(b.Changes)-1; i < j; i, j = i+1, j-1 {
+		b.Changes[i], b.Changes[j] = b.Changes[j], b.Changes[i]
+	}
+	return b, err
+}
+
+// follow keeps store in sync with the primary at the given URL until ctx is cancelled,
+// authenticating with token.
+func follow(ctx context.Context, primary, token string, store Store) {
+	var epoch string
+	var seq uint64
+	client := &http.Client{Timeout: 2 * replicationWait}
+	for ctx.Err() == nil {
+		b, err := poll(ctx, client, primary, token, epoch, seq)
+		if err == nil {
+			err = apply(ctx, store, b)
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("replication from %s failed: %v\n", primary, err)
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+		epoch, seq = b.Epoch, b.Seq
+	}
+}
+
+// poll fetches the next batch of changes after seq from the primary.
+func poll(ctx context.Context, client *http.Client, primary, token, epoch string, seq uint64) (*batch, error) {
+	u := fmt.Sprintf("%s%s?epoch=%s&seq=%d", strings.TrimSuffix(primary, "/"), replicationPath, url.QueryEscape(epoch), seq)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var b batch
+	if err := json.NewDecoder(resp.Body).Decode(&b); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// apply makes the changes in b to store. Applying a snapshot also deletes any mappings in store
+// which aren't in the snapshot.
+func apply(ctx context.Context, store Store, b *batch) error {
+	var stale map[string]bool
+	if b.Snapshot {
+		stale = make(map[string]bool)
+		err := store.Iterate(ctx, func(name string, e *Entry) error {
+			stale[name] = true
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, c := range b.Changes {
+		delete(stale, c.Name)
+		if err := store.Set(ctx, c.Name, c.Entry); err != nil {
+			return err
+		}
+	}
+	for name := range stale {
+		if err := store.Set(ctx, name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readOnly wraps the handler of a replica to reject any changes, which must instead be made on the
+// primary. Logging in and out and resolving names (which is POSTed but changes nothing) are still
+// allowed.
+func readOnly(primary string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" || r.Method == "HEAD":
+		case r.URL.Path == "/login" || r.URL.Path == "/logout" || r.URL.Path == resolvePath:
+		default:
+			httpError(w, 403, fmt.Errorf("read-only replica, make changes at %s", primary))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// tempStore opens an empty FileStore in a temporary directory.
+func tempStore(t *testing.T) *FileStore {
+	t.Helper()
+	s, err := Open(filepath.Join(t.TempDir(), "links"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// names returns the names mapped in s, most recently Set first.
+func names(t *testing.T, s *FileStore) []string {
+	t.Helper()
+	var ns []string
+	if err := s.Iterate(func(name string, e *Entry) error {
+		ns = append(ns, name)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return ns
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		batch *batch
+		want  map[string]string
+	}{
+		// Changes are applied on top of what the replica already has...
+		{&batch{Changes: []record{
+			{Name: "a", Entry: &Entry{Link: "https://a.example/new"}},
+			{Name: "b"},
+			{Name: "c", Entry: &Entry{Link: "https://c.example"}},
+		}}, map[string]string{"a": "https://a.example/new", "c": "https://c.example", "d": "https://d.example"}},
+		// ... while a snapshot replaces it.
+		{&batch{Snapshot: true, Changes: []record{
+			{Name: "a", Entry: &Entry{Link: "https://a.example/new"}},
+			{Name: "c", Entry: &Entry{Link: "https://c.example"}},
+		}}, map[string]string{"a": "https://a.example/new", "c": "https://c.example"}},
+	}
+	for i, tt := range tests {
+		s := tempStore(t)
+		for _, name := range []string{"a", "b", "d"} {
+			if err := s.Set(name, &Entry{Link: "https://" + name + ".example"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := apply(context.Background(), Adapt(s), tt.batch); err != nil {
+			t.Fatalf("%d: apply: %v", i, err)
+		}
+		if got := names(t, s); len(got) != len(tt.want) {
+			t.Errorf("%d: names after apply = %v, want %d of them", i, got, len(tt.want))
+		}
+		for name, link := range tt.want {
+			checkLink(t, s, name, link)
+		}
+	}
+}
+
+func TestPrimaryBatch(t *testing.T) {
+	p := NewPrimary(Adapt(tempStore(t)), "token")
+	for _, name := range []string{"a", "b", "c"} {
+		if err := p.Set(context.Background(), name, &Entry{Link: "https://" + name + ".example"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		epoch    string
+		seq      uint64
+		snapshot bool
+		want     []string
+	}{
+		{p.epoch, 1, false, []string{"b", "c"}},
+		{p.epoch, 3, false, nil},
+		// Replicas following another primary, or ahead of this one, need a snapshot.
+		{"other", 1, true, []string{"a", "b", "c"}},
+		{p.epoch, 4, true, []string{"a", "b", "c"}},
+	}
+	for _, tt := range tests {
+		p.lock.Lock()
+		b, err := p.batch(context.Background(), tt.epoch, tt.seq)
+		p.lock.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, c := range b.Changes {
+			got = append(got, c.Name)
+		}
+		if b.Epoch != p.epoch || b.Seq != 3 || b.Snapshot != tt.snapshot || len(got) != len(tt.want) {
+			t.Errorf("batch(%q, %d) = %+v with %v, want snapshot %v with %v", tt.epoch, tt.seq, b, got, tt.snapshot, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("batch(%q, %d) changed %v, want %v", tt.epoch, tt.seq, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestFollow(t *testing.T) {
+	p := NewPrimary(Adapt(tempStore(t)), "token")
+	if err := p.Set(context.Background(), "a", &Entry{Link: "https://a.example"}); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	replica := tempStore(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		follow(ctx, srv.URL, "token", Adapt(replica))
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	waitFor(t, "the snapshot", func() bool {
+		_, ok := replica.Get("a")
+		return ok
+	})
+	if err := p.Set(context.Background(), "b", &Entry{Link: "https://b.example"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Set(context.Background(), "a", nil); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the changes", func() bool {
+		_, ok := replica.Get("a")
+		return !ok
+	})
+	checkLink(t, replica, "b", "https://b.example")
+}
+
+func TestPrimaryToken(t *testing.T) {
+	p := NewPrimary(Adapt(tempStore(t)), "token")
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+	if _, err := poll(context.Background(), srv.Client(), srv.URL, "wrong", "", 0); err == nil {
+		t.Error("poll succeeded with the wrong token")
+	}
+	if _, err := poll(context.Background(), srv.Client(), srv.URL, "token", "", 0); err != nil {
+		t.Errorf("poll with the token: %v", err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	h := readOnly("https://primary.example", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := []struct {
+		method, path string
+		code         int
+	}{
+		{"GET", "/name", 200},
+		{"HEAD", "/name", 200},
+		{"POST", "/login", 200},
+		{"POST", "/logout", 200},
+		{"POST", resolvePath, 200},
+		{"POST", "/name", 403},
+		{"DELETE", "/name", 403},
+		{"POST", apiPath, 403},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.code {
+			t.Errorf("%s %s = %d, want %d", tt.method, tt.path, w.Code, tt.code)
+		}
+	}
+}
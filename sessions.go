@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// loginSession is a logged in session, for User (which is empty with the shared password) as of
+// when their password hash was Hash, so that changing it (or removing them) ends the session.
+// Sessions logged in with the OpenID Connect provider are SSO, for the user's email address.
+type loginSession struct {
+	User    string    `json:"user,omitempty"`
+	Hash    string    `json:"hash,omitempty"`
+	SSO     bool      `json:"sso,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// Sessions holds the logged in sessions, along with the key XSRF tokens are generated with, and
+// persists them as JSON to a file (if Sessions has one) whenever they change so that nobody has
+// to log in again after a restart. Sessions are keyed by a hash of their ID (see sessionKey), so
+// that the file can't be used to log in. Access to sessions must be guarded by lock.
+type Sessions struct {
+	filename string
+	xsrfKey  string
+
+	lock     sync.Mutex
+	sessions map[string]*loginSession
+}
+
+// sessionsFile is the contents of a Sessions file.
+type sessionsFile struct {
+	XSRFKey  string                   `json:"xsrf_key"`
+	Sessions map[string]*loginSession `json:"sessions"`
+}
+
+// OpenSessions returns Sessions persisted to filename, which is created once the first session is
+// started. If filename is empty the sessions are only kept in memory.
+func OpenSessions(filename string) (*Sessions, error) {
+	s := &Sessions{filename: filename, xsrfKey: randomHex(32), sessions: make(map[string]*loginSession)}
+	if filename == "" {
+		return s, nil
+	}
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f sessionsFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("reading sessions from %s: %w", filename, err)
+	}
+	if f.XSRFKey != "" {
+		s.xsrfKey = f.XSRFKey
+	}
+	if f.Sessions != nil {
+		s.sessions = f.Sessions
+	}
+	return s, nil
+}
+
+// sessionKey returns the key the session with id is kept under.
+func sessionKey(id string) string {
+	h := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(h[:])
+}
+
+// Start starts session, returning its ID. Any sessions which have expired are dropped.
+func (s *Sessions) Start(session *loginSession) (string, error) {
+	id := randomHex(32)
+	now := time.Now()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for key, o := range s.sessions {
+		if o.Expires.Before(now) {
+			delete(s.sessions, key)
+		}
+	}
+	s.sessions[sessionKey(id)] = session
+	if err := s.save(); err != nil {
+		delete(s.sessions, sessionKey(id))
+		return "", err
+	}
+	return id, nil
+}
+
+// Get returns the session with id, if it exists and hasn't expired.
+func (s *Sessions) Get(id string) (*loginSession, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	session, ok := s.sessions[sessionKey(id)]
+	if !ok || session.Expires.Before(time.Now()) {
+		return nil, false
+	}
+	c := *session
+	return &c, true
+}
+
+// End ends the session with id, if it exists.
+func (s *Sessions) End(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := sessionKey(id)
+	session, ok := s.sessions[key]
+	if !ok {
+		return nil
+	}
+	delete(s.sessions, key)
+	if err := s.save(); err != nil {
+		s.sessions[key] = session
+		return err
+	}
+	return nil
+}
+
+// save writes the sessions to the file (if there is one), replacing it atomically. As they can be
+// used to forge XSRF tokens the file is only readable by its owner.
+func (s *Sessions) save() error {
+	if s.filename == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(sessionsFile{XSRFKey: s.xsrfKey, Sessions: s.sessions}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.filename)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/option"
+	"google.golang.org/api/sheets/v4"
+)
+
+func init() {
+	// sheets://spreadsheet-id/sheet-name?poll=1m
+	RegisterStore("sheets", func(dsn string, fuzzy, compact bool) (StoreCloser, error) {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return nil, err
+		}
+		sheet, poll := strings.TrimPrefix(u.Path, "/"), time.Minute
+		if sheet == "" {
+			sheet = "Sheet1"
+		}
+		if p := u.Query().Get("poll"); p != "" {
+			poll, err = time.ParseDuration(p)
+			if err != nil {
+				return nil, err
+			}
+		}
+		s, err := OpenSheets(u.Host, sheet, poll, fuzzy)
+		if err != nil {
+			return nil, err
+		}
+		return Adapt(s), nil
+	})
+}
+
+// SheetsStore provides an implementation of the Store interface backed by a
+// Google Sheet, allowing links to be curated directly in the spreadsheet. The
+// first two columns of the sheet hold names and links respectively, followed by
+// the optional created and updated times (RFC 3339) and creator of the entry,
+// with later rows taking precedence over earlier ones and rows with an empty
+// name or link being ignored. Because rows can be edited by hand, the sheet is reloaded
+// every poll interval, and Set always reloads before writing so that it
+// modifies the row currently holding the name: updates are made in place,
+// deletes clear the row and new mappings are appended to the bottom of the
+// sheet. Iterate walks the rows from the bottom up. Credentials are the
+// Application Default Credentials (eg. a service account key referenced by
+// GOOGLE_APPLICATION_CREDENTIALS), and the sheet must be shared with the
+// account. Access to rows, cache and fuzzed must be guarded by lock.
+type SheetsStore struct {
+	fuzzy  bool
+	id     string
+	sheet  string
+	srv    *sheets.Service
+	cancel context.CancelFunc
+
+	lock   sync.RWMutex
+	rows   map[string]int
+	order  []string
+	cache  map[string]*Entry
+	fuzzed map[string]*Entry
+}
+
+// OpenSheets returns a SheetsStore for the sheet named sheet in the
+// spreadsheet with the given id, polling for changes every poll (and an
+// optional bool to enable fuzzy lookups). The SheetsStore returned should be
+// closed with Close once it is no longer in use.
+func OpenSheets(id, sheet string, poll time.Duration, fuzzy ...bool) (*SheetsStore, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	srv, err := sheets.NewService(ctx, option.WithScopes(sheets.SpreadsheetsScope))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	s := &SheetsStore{fuzzy: len(fuzzy) > 0 && fuzzy[0], id: id, sheet: sheet, srv: srv, cancel: cancel}
+	if err := s.load(ctx); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	go func() {
+		ticker := time.NewTicker(poll)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := s.load(ctx); err != nil {
+					log.Printf("sheets reload failed: %v\n", err)
+				}
+			}
+		}
+	}()
+
+	return s, nil
+}
+
+// load replaces the in-memory mappings with the current contents of the sheet.
+func (s *SheetsStore) load(ctx context.Context) error {
+	vr, err := s.srv.Spreadsheets.Values.Get(s.id, s.cells("A", "E")).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+
+	rows := make(map[string]int)
+	order := make([]string, 0, len(vr.Values))
+	cache := make(map[string]*Entry)
+	fuzzed := make(map[string]*Entry)
+	for i, row := range vr.Values {
+		if len(row) < 2 {
+			continue
+		}
+		cell := func(j int) string {
+			if j >= len(row) {
+				return ""
+			}
+			return strings.TrimSpace(fmt.Sprint(row[j]))
+		}
+		name, link := cell(0), cell(1)
+		if name == "" || link == "" {
+			continue
+		}
+		// Times which have been mangled by hand are treated as unknown.
+		created, _ := time.Parse(time.RFC3339, cell(2))
+		updated, _ := time.Parse(time.RFC3339, cell(3))
+		e := &Entry{Link: link, Created: created, Updated: updated, CreatedBy: cell(4)}
+		if _, ok := rows[name]; ok {
+			for j, n := range order {
+				if n == name {
+					order = append(order[:j], order[j+1:]...)
+					break
+				}
+			}
+		}
+		// Rows are 1-indexed.
+		rows[name] = i + 1
+		order = append(order, name)
+		cache[name] = e
+		if s.fuzzy {
+			fuzzed[fuzz(name)] = e
+		}
+	}
+
+	s.lock.Lock()
+	s.rows, s.order, s.cache, s.fuzzed = rows, order, cache, fuzzed
+	s.lock.Unlock()
+	return nil
+}
+
+// sheetsRow returns the values of the cells after the name for e.
+func sheetsRow(e *Entry) []interface{} {
+	var created, updated string
+	if !e.Created.IsZero() {
+		created = e.Created.Format(time.RFC3339)
+	}
+	if !e.Updated.IsZero() {
+		updated = e.Updated.Format(time.RFC3339)
+	}
+	return []interface{}{e.Link, created, updated, e.CreatedBy}
+}
+
+// cells returns the A1 notation for the cells from start to end in the sheet.
+func (s *SheetsStore) cells(start, end string) string {
+	return fmt.Sprintf("'%s'!%s:%s", strings.Replace(s.sheet, "'", "''", -1), start, end)
+}
+
+// Close stops polling the sheet backing the SheetsStore returned by
+// OpenSheets.
+func (s *SheetsStore) Close() error {
+	s.cancel()
+	return nil
+}
+
+func (s *SheetsStore) Get(name string) (*Entry, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	e, ok := s.cache[name]
+	if !ok && s.fuzzy {
+		e, ok = s.fuzzed[fuzz(name)]
+	}
+	return e, ok
+}
+
+func (s *SheetsStore) Set(name string, e *Entry) error {
+	ctx := context.Background()
+	if err := s.load(ctx); err != nil {
+		return err
+	}
+
+	s.lock.RLock()
+	row, ok := s.rows[name]
+	s.lock.RUnlock()
+
+	var err error
+	values := s.srv.Spreadsheets.Values
+	switch {
+	case e == nil && !ok:
+		return nil
+	case e == nil:
+		cells := s.cells(fmt.Sprintf("A%d", row), fmt.Sprintf("E%d", row))
+		_, err = values.Clear(s.id, cells, &sheets.ClearValuesRequest{}).Context(ctx).Do()
+	case ok:
+		cells := s.cells(fmt.Sprintf("B%d", row), fmt.Sprintf("E%d", row))
+		vr := &sheets.ValueRange{Values: [][]interface{}{sheetsRow(e)}}
+		_, err = values.Update(s.id, cells, vr).ValueInputOption("RAW").Context(ctx).Do()
+	default:
+		vr := &sheets.ValueRange{Values: [][]interface{}{append([]interface{}{name}, sheetsRow(e)...)}}
+		_, err = values.Append(s.id, s.cells("A", "E"), vr).
+			ValueInputOption("RAW").InsertDataOption("INSERT_ROWS").Context(ctx).Do()
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.load(ctx)
+}
+
+func (s *SheetsStore) Iterate(cb func(name string, e *Entry) error) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for i := len(s.order) - 1; i >= 0; i-- {
+		if err := cb(s.order[i], s.cache[s.order[i]]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// browsers are the browser families clientClass distinguishes, in the order they're checked in, as
+// eg. Edge's User-Agent also mentions Chrome and Safari.
+var browsers = []struct{ token, name string }{
+	{"Edg/", "edge"},
+	{"OPR/", "opera"},
+	{"Firefox/", "firefox"},
+	{"Chrome/", "chrome"},
+	{"Safari/", "safari"},
+}
+
+// referrerHost returns the host of the page the request r was linked from, or "direct" if it
+// wasn't (or the page's address wasn't sent).
+func referrerHost(r *http.Request) string {
+	u, err := url.Parse(r.Referer())
+	if err != nil || u.Host == "" {
+		return "direct"
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// clientClass returns the kind of browser and device the request r comes from, eg. "chrome
+// desktop" or "safari mobile".
+func clientClass(r *http.Request) string {
+	browser := "other"
+	ua := r.UserAgent()
+	for _, b := range browsers {
+		if strings.Contains(ua, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	if mobileAgent.MatchString(ua) {
+		return browser + " mobile"
+	}
+	return browser + " desktop"
+}
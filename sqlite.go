@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	_ "modernc.org/sqlite"
+)
+
+func init() {
+	RegisterStore("sqlite", func(dsn string, fuzzy, compact bool) (StoreCloser, error) {
+		path, _, err := openPath(dsn)
+		if err != nil {
+			return nil, err
+		}
+		return OpenSQLite(path, fuzzy, compact)
+	})
+}
+
+// sqliteMigrations are applied in order to bring the schema up to date, with
+// the number of migrations already applied tracked in the user_version pragma.
+// Existing migrations must never be modified - changes to the schema should
+// always be made by appending a new migration.
+var sqliteMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS links (
+		seq   INTEGER PRIMARY KEY AUTOINCREMENT,
+		name  TEXT NOT NULL UNIQUE,
+		fuzzy TEXT NOT NULL,
+		link  TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS links_fuzzy ON links (fuzzy);`,
+	`ALTER TABLE links ADD COLUMN entry TEXT NOT NULL DEFAULT '';`,
+}
+
+// SQLiteStore provides an implementation of the Store interface backed by a
+// SQLite database. Each mapping is a row in the links table, with the entry
+// column holding the encoded Entry (the link column is kept for the benefit
+// of anyone querying the database directly). seq
+// recording the order in which the mappings were last Set so that Iterate can
+// match the semantics of FileStore. Deleted mappings are removed from the
+// table outright, so unlike FileStore the database does not grow without
+// bound. Like FileStore, the store supports 'fuzzy' lookups if initialized
+// with fuzzy, in which case the fuzzed name is stored alongside each row.
+type SQLiteStore struct {
+	fuzzy bool
+	db    *sql.DB
+}
+
+// OpenSQLite opens (or creates) a SQLiteStore backed by the database at
+// filename (and optional bools to enable fuzzy lookups and compaction, which
+// for SQLite means running VACUUM). The SQLiteStore returned should be closed
+// with Close once it is no longer in use.
+func OpenSQLite(filename string, bools ...bool) (*SQLiteStore, error) {
+	fuzzy, compact := false, false
+	if len(bools) > 0 {
+		fuzzy = bools[0]
+		if len(bools) > 1 {
+			compact = bools[1]
+		}
+	}
+
+	// SQLite only supports a single writer - rather than surfacing SQLITE_BUSY
+	// to callers we have concurrent writers wait on each other.
+	db, err := sql.Open("sqlite", filename+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+
+	err = migrateSQLite(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if compact {
+		_, err = db.Exec("VACUUM")
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	return &SQLiteStore{fuzzy: fuzzy, db: db}, nil
+}
+
+// migrateSQLite applies any sqliteMigrations which haven't already been applied
+// to db.
+func migrateSQLite(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var version int
+	err = tx.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for ; version < len(sqliteMigrations); version++ {
+		if _, err := tx.Exec(sqliteMigrations[version]); err != nil {
+			return err
+		}
+	}
+	// Pragmas can't be parameterized.
+	if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Close closes the SQLiteStore returned by OpenSQLite.
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteStore) Get(ctx context.Context, name string) (*Entry, error) {
+	var link, entry string
+	err := s.db.QueryRowContext(ctx, "SELECT link, entry FROM links WHERE name = ?", name).Scan(&link, &entry)
+	if err == sql.ErrNoRows && s.fuzzy {
+		err = s.db.QueryRowContext(ctx,
+			"SELECT link, entry FROM links WHERE fuzzy = ? ORDER BY seq DESC LIMIT 1", fuzz(name)).Scan(&link, &entry)
+	}
+	return rowResult(link, entry, err)
+}
+
+func (s *SQLiteStore) Set(ctx context.Context, name string, e *Entry) error {
+	return s.SetAll(ctx, map[string]*Entry{name: e})
+}
+
+func (s *SQLiteStore) SetAll(ctx context.Context, entries map[string]*Entry) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, name := range sortedNames(entries) {
+		// Deleting and reinserting (as opposed to updating in place) assigns the
+		// mapping a new seq, which keeps Iterate in last Set order.
+		_, err = tx.ExecContext(ctx, "DELETE FROM links WHERE name = ?", name)
+		if err != nil {
+			return err
+		}
+		if e := entries[name]; e != nil {
+			_, err = tx.ExecContext(ctx, "INSERT INTO links (name, fuzzy, link, entry) VALUES (?, ?, ?, ?)",
+				name, fuzz(name), e.Link, encodeEntry(e))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) Iterate(ctx context.Context, cb func(name string, e *Entry) error) error {
+	rows, err := s.db.QueryContext(ctx, "SELECT name, link, entry FROM links ORDER BY seq DESC")
+	if err != nil {
+		return err
+	}
+	return iterateRows(rows, cb)
+}
+
+func (s *SQLiteStore) IterateRange(ctx context.Context, offset, limit int, cb func(name string, e *Entry) error) error {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT name, link, entry FROM links ORDER BY seq DESC LIMIT ? OFFSET ?", limit, offset)
+	if err != nil {
+		return err
+	}
+	return iterateRows(rows, cb)
+}
+
+// iterateRows calls cb with the mapping in each of rows, which must be the
+// name, link and entry columns of a SQL store, and then closes rows.
+func iterateRows(rows *sql.Rows, cb func(name string, e *Entry) error) error {
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, link, entry string
+		if err := rows.Scan(&name, &link, &entry); err != nil {
+			return err
+		}
+		if err := cb(name, rowEntry(link, entry)); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// rowEntry returns the Entry for a row of a SQL store with the given link and
+// entry columns. Rows written before entries existed have an empty entry
+// column.
+func rowEntry(link, entry string) *Entry {
+	if entry == "" {
+		return &Entry{Link: link}
+	}
+	return decodeEntry(entry)
+}
+
+// rowResult returns the result of Get for a SQL store given the link and entry
+// columns of the row and the error from scanning it.
+func rowResult(link, entry string, err error) (*Entry, error) {
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rowEntry(link, entry), nil
+}
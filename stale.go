@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// stalePath is the path of the page of links which haven't been used in a while.
+const stalePath = "/stale"
+
+// staleAPIPath is the path of the API endpoint listing the links which haven't been used lately.
+const staleAPIPath = "/api/v1/stale"
+
+// staleDays is how many days links must not have been used for to be stale by default.
+const staleDays = 90
+
+// StaleLink is a mapping which hasn't been followed in a while, or ever.
+type StaleLink struct {
+	Name string `json:"name"`
+	Link string `json:"link"`
+	// LastUsed is when the mapping was last followed, if it ever has been.
+	LastUsed *time.Time `json:"last_used,omitempty"`
+	Hits     int64      `json:"hits"`
+	Created  time.Time  `json:"created"`
+}
+
+// fetchStale returns the mappings which haven't been followed in the last days (see Hits), never
+// used ones first and then those which were last used longest ago. Mappings which were created
+// within the last days are left out, as they haven't had the chance to be used.
+func fetchStale(ctx context.Context, store Store, hits *Hits, days int) ([]StaleLink, error) {
+	cutoff := time.Now().AddDate(0, 0, -days)
+	var stale []StaleLink
+	err := store.Iterate(ctx, func(name string, e *Entry) error {
+		hit := Hit{}
+		if hits != nil {
+			hit = hits.Get(name)
+		}
+		if e.Created.After(cutoff) || hit.Last.After(cutoff) {
+			return nil
+		}
+		sl := StaleLink{Name: name, Link: e.Link, Hits: hit.Count, Created: e.Created}
+		if !hit.Last.IsZero() {
+			sl.LastUsed = &hit.Last
+		}
+		stale = append(stale, sl)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(stale, func(i, j int) bool {
+		a, b := stale[i].LastUsed, stale[j].LastUsed
+		switch {
+		case a == nil && b == nil:
+			return stale[i].Name < stale[j].Name
+		case a == nil || b == nil:
+			return a == nil
+		case !a.Equal(*b):
+			return a.Before(*b)
+		}
+		return stale[i].Name < stale[j].Name
+	})
+	return stale, nil
+}
+
+// staleDaysParam returns the days query parameter of r, which defaults to staleDays.
+func staleDaysParam(r *http.Request) (int, error) {
+	d := r.URL.Query().Get("days")
+	if d == "" {
+		return staleDays, nil
+	}
+	days, err := strconv.Atoi(d)
+	if err != nil || days < 1 {
+		return 0, fmt.Errorf("invalid days %q", d)
+	}
+	return days, nil
+}
+
+// getStale renders the mappings which haven't been used in the days query parameter (see
+// fetchStale), which can be selected to be deleted all at once (see postStale).
+func getStale(auth *Auth, store Store, hits *Hits) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !auth.IsAuth(r) {
+			http.Redirect(w, r, "/login", 302)
+			return
+		}
+		days, err := staleDaysParam(r)
+		if err != nil {
+			httpError(w, 400, err)
+			return
+		}
+		stale, err := fetchStale(r.Context(), store, hits, days)
+		if err != nil {
+			httpError(w, 500, err)
+			return
+		}
+
+		render(w, "stale.html", struct {
+			Title string
+			Token string
+			Days  int
+			Data  []StaleLink
+		}{
+			fmt.Sprintf("stale - %s", r.Host), auth.XSRF(r), days, stale,
+		})
+	})
+}
+
+// postStale deletes all of the mappings in the name parameters at once, provided the request is
+// allowed to change every one of them (see checkOwner). Names which no longer exist are skipped.
+func postStale(store Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			httpError(w, 400, err)
+			return
+		}
+		names := r.PostForm["name"]
+		if len(names) == 0 {
+			httpError(w, 400, errors.New("no links selected"))
+			return
+		}
+
+		updates.Lock()
+		defer updates.Unlock()
+
+		entries := make(map[string]*Entry, len(names))
+		for _, name := range names {
+			e, err := store.Get(r.Context(), name)
+			if err == ErrNotFound {
+				continue
+			}
+			if err != nil {
+				httpError(w, 500, err)
+				return
+			}
+			if err := checkOwner(r, e); err != nil {
+				httpError(w, 403, fmt.Errorf("go/%s: %w", name, err))
+				return
+			}
+			entries[name] = nil
+		}
+		if err := setAll(r.Context(), store, entries); err != nil {
+			httpError(w, 500, err)
+			return
+		}
+
+		http.Redirect(w, r, r.URL.RequestURI(), 302)
+	})
+}
+
+// apiStale responds with the mappings which haven't been used in the days query parameter (see
+// fetchStale).
+func apiStale(store Store, hits *Hits) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		days, err := staleDaysParam(r)
+		if err != nil {
+			apiError(w, 400, err)
+			return
+		}
+		stale, err := fetchStale(r.Context(), store, hits, days)
+		if err != nil {
+			apiError(w, 500, err)
+			return
+		}
+		if stale == nil {
+			stale = []StaleLink{}
+		}
+		writeJSON(w, 200, struct {
+			Days  int         `json:"days"`
+			Links []StaleLink `json:"links"`
+		}{days, stale})
+	})
+}
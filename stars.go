@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// Stars holds the names each user has starred, so that they float to the top of their index. Users
+// are identified as with identity, and their stars are persisted as JSON to a file (if Stars has
+// one) whenever they change. Names are kept when their mappings are renamed or deleted, and are
+// simply skipped while they don't exist. Access to stars must be guarded by lock.
+type Stars struct {
+	filename string
+	lock     sync.RWMutex
+	stars    map[string][]string
+}
+
+// OpenStars returns Stars persisted to filename, which is created once the first name is starred.
+// If filename is empty the stars are only kept in memory.
+func OpenStars(filename string) (*Stars, error) {
+	s := &Stars{filename: filename, stars: make(map[string][]string)}
+	if filename == "" {
+		return s, nil
+	}
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.stars); err != nil {
+		return nil, fmt.Errorf("reading stars from %s: %w", filename, err)
+	}
+	return s, nil
+}
+
+// Star stars name for user, moving it to the front of their stars if it's already starred.
+func (s *Stars) Star(user, name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	prev := s.stars[user]
+	s.stars[user] = append([]string{name}, without(prev, name)...)
+	if err := s.save(); err != nil {
+		s.stars[user] = prev
+		return err
+	}
+	return nil
+}
+
+// Unstar removes name from user's stars.
+func (s *Stars) Unstar(user, name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	prev := s.stars[user]
+	if names := without(prev, name); len(names) > 0 {
+		s.stars[user] = names
+	} else {
+		delete(s.stars, user)
+	}
+	if err := s.save(); err != nil {
+		s.stars[user] = prev
+		return err
+	}
+	return nil
+}
+
+// Starred returns the names user has starred, most recently starred first.
+func (s *Stars) Starred(user string) []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return append([]string(nil), s.stars[user]...)
+}
+
+// without returns a copy of names with name removed.
+func without(names []string, name string) []string {
+	var rest []string
+	for _, n := range names {
+		if n != name {
+			rest = append(rest, n)
+		}
+	}
+	return rest
+}
+
+// save writes the stars to the file (if there is one), replacing it atomically.
+func (s *Stars) save() error {
+	if s.filename == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(s.stars, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.filename)
+}
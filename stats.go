@@ -0,0 +1,435 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// statsPath is the path of the page of statistics about how links are followed.
+const statsPath = "/stats"
+
+// statsExportPath is the path of the API endpoint for exporting how often every link is followed.
+const statsExportPath = "/api/v1/stats/export"
+
+const (
+	// statsDays is how many days of counts are kept.
+	statsDays = 31
+	// statsTop is how many of the most followed links (and most missed names) are shown.
+	statsTop = 20
+	// statsMisses is how many different names which don't exist are counted each day, so that
+	// scanning for names can't grow the counts without bound. Any others are only counted in total.
+	statsMisses = 1000
+)
+
+// statsWindows are the windows stats can be shown over, in days.
+var statsWindows = map[string]int{"day": 1, "week": 7, "month": 30}
+
+// statsDay holds how many times each name was followed (or missed, for names which don't exist)
+// during a day, and where from if that's recorded (see recordSources).
+type statsDay struct {
+	Hits        map[string]int64            `json:"hits,omitempty"`
+	Misses      map[string]int64            `json:"misses,omitempty"`
+	OtherMisses int64                       `json:"other_misses,omitempty"`
+	Referrers   map[string]map[string]int64 `json:"referrers,omitempty"`
+	Clients     map[string]map[string]int64 `json:"clients,omitempty"`
+}
+
+// Stats counts how many times each name is followed, and how many times names which don't exist are
+// requested, per day for the last statsDays. As with Hits, counts are kept in memory and, if Stats
+// has a file, written to it as JSON every hitsFlush (if they've changed) and when it's closed.
+// Access to days and dirty must be guarded by lock.
+type Stats struct {
+	filename string
+	done     chan struct{}
+	wg       sync.WaitGroup
+
+	lock  sync.Mutex
+	days  map[string]*statsDay
+	dirty bool
+}
+
+// OpenStats returns Stats persisted to filename, which is created once the first name is followed.
+// If filename is empty the counts are only kept in memory.
+func OpenStats(filename string) (*Stats, error) {
+	s := &Stats{filename: filename, done: make(chan struct{}), days: make(map[string]*statsDay)}
+	if filename != "" {
+		b, err := ioutil.ReadFile(filename)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			if err := json.Unmarshal(b, &s.days); err != nil {
+				return nil, fmt.Errorf("reading stats from %s: %w", filename, err)
+			}
+		}
+		s.wg.Add(1)
+		go s.flush()
+	}
+	return s, nil
+}
+
+// Hit records that name was followed.
+func (s *Stats) Hit(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	d := s.today()
+	if d.Hits == nil {
+		d.Hits = make(map[string]int64)
+	}
+	d.Hits[name]++
+	s.dirty = true
+}
+
+// Miss records that name was requested but doesn't exist.
+func (s *Stats) Miss(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	d := s.today()
+	if d.Misses == nil {
+		d.Misses = make(map[string]int64)
+	}
+	if _, ok := d.Misses[name]; ok || len(d.Misses) < statsMisses {
+		d.Misses[name]++
+	} else {
+		d.OtherMisses++
+	}
+	s.dirty = true
+}
+
+// Source records that name was followed from a page on the referrer host by the client (see
+// referrerHost and clientClass).
+func (s *Stats) Source(name, referrer, client string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	d := s.today()
+	if d.Referrers == nil {
+		d.Referrers, d.Clients = make(map[string]map[string]int64), make(map[string]map[string]int64)
+	}
+	if d.Referrers[name] == nil {
+		d.Referrers[name], d.Clients[name] = make(map[string]int64), make(map[string]int64)
+	}
+	d.Referrers[name][referrer]++
+	d.Clients[name][client]++
+	s.dirty = true
+}
+
+// Sources returns where name was followed from over the last days (including today): the
+// statsTop most common referrer hosts and kinds of clients.
+func (s *Stats) Sources(name string, days int) (referrers, clients []Count) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	refs, cls := make(map[string]int64), make(map[string]int64)
+	oldest := time.Now().AddDate(0, 0, 1-days).Format("2006-01-02")
+	for k, d := range s.days {
+		if k < oldest {
+			continue
+		}
+		for ref, n := range d.Referrers[name] {
+			refs[ref] += n
+		}
+		for c, n := range d.Clients[name] {
+			cls[c] += n
+		}
+	}
+	return topCounts(refs), topCounts(cls)
+}
+
+// today returns the counts for the current day, dropping those which are older than statsDays when
+// it starts. It must be called with lock held.
+func (s *Stats) today() *statsDay {
+	now := time.Now()
+	key := now.Format("2006-01-02")
+	if d, ok := s.days[key]; ok {
+		return d
+	}
+	oldest := now.AddDate(0, 0, 1-statsDays).Format("2006-01-02")
+	for k := range s.days {
+		if k < oldest {
+			delete(s.days, k)
+		}
+	}
+	d := &statsDay{}
+	s.days[key] = d
+	return d
+}
+
+// Count is how many times a name was followed or missed.
+type Count struct {
+	Name  string
+	Count int64
+}
+
+// StatsWindow summarizes the counts over a number of days.
+type StatsWindow struct {
+	Days      int
+	Hits      int64
+	Misses    int64
+	Names     int
+	TopHits   []Count
+	TopMisses []Count
+}
+
+// Window returns the totals over the last days (including today), along with the statsTop most
+// followed names and most missed names.
+func (s *Stats) Window(days int) StatsWindow {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	w := StatsWindow{Days: days}
+	hits, misses := make(map[string]int64), make(map[string]int64)
+	oldest := time.Now().AddDate(0, 0, 1-days).Format("2006-01-02")
+	for k, d := range s.days {
+		if k < oldest {
+			continue
+		}
+		for name, n := range d.Hits {
+			hits[name] += n
+			w.Hits += n
+		}
+		for name, n := range d.Misses {
+			misses[name] += n
+			w.Misses += n
+		}
+		w.Misses += d.OtherMisses
+	}
+	w.Names = len(hits)
+	w.TopHits, w.TopMisses = topCounts(hits), topCounts(misses)
+	return w
+}
+
+// Counts returns how many times each name was followed over the last days (including today).
+func (s *Stats) Counts(days int) map[string]int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	counts := make(map[string]int64)
+	oldest := time.Now().AddDate(0, 0, 1-days).Format("2006-01-02")
+	for k, d := range s.days {
+		if k < oldest {
+			continue
+		}
+		for name, n := range d.Hits {
+			counts[name] += n
+		}
+	}
+	return counts
+}
+
+// topCounts returns the statsTop names with the highest counts, highest first.
+func topCounts(counts map[string]int64) []Count {
+	top := make([]Count, 0, len(counts))
+	for name, n := range counts {
+		top = append(top, Count{name, n})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Name < top[j].Name
+	})
+	if len(top) > statsTop {
+		top = top[:statsTop]
+	}
+	return top
+}
+
+// flush saves the counts every hitsFlush until Stats is closed.
+func (s *Stats) flush() {
+	defer s.wg.Done()
+	t := time.NewTicker(hitsFlush)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := s.save(); err != nil {
+				log.Printf("saving stats to %s failed: %v\n", s.filename, err)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// save writes the counts to the file if they've changed, replacing it atomically.
+func (s *Stats) save() error {
+	s.lock.Lock()
+	if !s.dirty {
+		s.lock.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(s.days)
+	s.dirty = false
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := s.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		s.markDirty()
+		return err
+	}
+	if err := os.Rename(tmp, s.filename); err != nil {
+		s.markDirty()
+		return err
+	}
+	return nil
+}
+
+// markDirty records that the counts need to be saved again after a failed save.
+func (s *Stats) markDirty() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.dirty = true
+}
+
+// Close stops flushing the counts and saves them a final time.
+func (s *Stats) Close() error {
+	if s.filename == "" {
+		return nil
+	}
+	close(s.done)
+	s.wg.Wait()
+	return s.save()
+}
+
+// getStats renders the totals, most followed links and most missed names over the window query
+// parameter (day, week or month, which is the default).
+func getStats(auth *Auth, stats *Stats) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !auth.IsAuth(r) {
+			http.Redirect(w, r, "/login", 302)
+			return
+		}
+		if r.Method != "GET" {
+			httpError(w, 405)
+			return
+		}
+		window := r.URL.Query().Get("window")
+		if window == "" {
+			window = "week"
+		}
+		days, ok := statsWindows[window]
+		if !ok {
+			httpError(w, 400, fmt.Errorf("invalid window %q: must be day, week or month", window))
+			return
+		}
+
+		render(w, "stats.html", struct {
+			Title  string
+			Window string
+			Stats  StatsWindow
+		}{
+			fmt.Sprintf("stats - %s", r.Host), window, stats.Window(days),
+		})
+	})
+}
+
+// StatsExport is how often a mapping has been followed, in total (see Hits) and over each of the
+// statsWindows (see Stats).
+type StatsExport struct {
+	Name      string     `json:"name"`
+	Link      string     `json:"link"`
+	Hits      int64      `json:"hits"`
+	LastUsed  *time.Time `json:"last_used,omitempty"`
+	Created   time.Time  `json:"created"`
+	Updated   time.Time  `json:"updated"`
+	HitsDay   int64      `json:"hits_day"`
+	HitsWeek  int64      `json:"hits_week"`
+	HitsMonth int64      `json:"hits_month"`
+}
+
+// apiStatsExport responds with how often every mapping has been followed (see StatsExport), for
+// analysing usage elsewhere. As with apiExport, the format query parameter selects either CSV
+// (with a header naming the columns) or JSON, which is the default, and the mappings are streamed
+// as they're read from the store.
+func apiStatsExport(store Store, hits *Hits, stats *Stats) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var write func(se StatsExport) error
+		var done func() error
+		switch format := r.URL.Query().Get("format"); format {
+		case "csv":
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", `attachment; filename="golinks-stats.csv"`)
+			cw := csv.NewWriter(w)
+			_ = cw.Write([]string{"name", "link", "hits", "last_used", "created", "updated", "hits_day", "hits_week", "hits_month"})
+			write = func(se StatsExport) error {
+				last := ""
+				if se.LastUsed != nil {
+					last = exportTime(*se.LastUsed)
+				}
+				return cw.Write([]string{
+					se.Name, se.Link, strconv.FormatInt(se.Hits, 10), last, exportTime(se.Created), exportTime(se.Updated),
+					strconv.FormatInt(se.HitsDay, 10), strconv.FormatInt(se.HitsWeek, 10), strconv.FormatInt(se.HitsMonth, 10),
+				})
+			}
+			done = func() error {
+				cw.Flush()
+				return cw.Error()
+			}
+		case "json", "":
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Disposition", `attachment; filename="golinks-stats.json"`)
+			_, _ = io.WriteString(w, `{"links":[`)
+			first := true
+			write = func(se StatsExport) error {
+				b, err := json.Marshal(se)
+				if err != nil {
+					return err
+				}
+				if !first {
+					b = append([]byte{','}, b...)
+				}
+				first = false
+				_, err = w.Write(b)
+				return err
+			}
+			done = func() error {
+				_, err := io.WriteString(w, "]}\n")
+				return err
+			}
+		default:
+			apiError(w, 400, fmt.Errorf("unknown format %q", format))
+			return
+		}
+
+		var day, week, month map[string]int64
+		if stats != nil {
+			day, week, month = stats.Counts(statsWindows["day"]), stats.Counts(statsWindows["week"]), stats.Counts(statsWindows["month"])
+		}
+		err := store.Iterate(r.Context(), func(name string, e *Entry) error {
+			se := StatsExport{
+				Name: name, Link: e.Link, Created: e.Created, Updated: e.Updated,
+				HitsDay: day[name], HitsWeek: week[name], HitsMonth: month[name],
+			}
+			if hits != nil {
+				hit := hits.Get(name)
+				se.Hits = hit.Count
+				if !hit.Last.IsZero() {
+					se.LastUsed = &hit.Last
+				}
+			}
+			return write(se)
+		})
+		if err == nil {
+			err = done()
+		}
+		if err != nil {
+			log.Printf("exporting stats failed: %v\n", err)
+		}
+	})
+}
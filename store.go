@@ -2,12 +2,126 @@ package main
 
 import (
 	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
+func init() {
+	// file:path/to/links?sync=always&key=base64-key&recover=true&max-links=1000&max-size=1048576
+	//   &compact-every=1h&compact-max-bytes=1048576
+	RegisterStore("file", func(dsn string, fuzzy, compact bool) (StoreCloser, error) {
+		path, query, err := openPath(dsn)
+		if err != nil {
+			return nil, err
+		}
+		policy, interval, err := ParseSyncPolicy(query.Get("sync"))
+		if err != nil {
+			return nil, err
+		}
+		var c *Cipher
+		key := query.Get("key")
+		if key == "" {
+			key = os.Getenv("GOLINKS_STORE_KEY")
+		}
+		if key != "" {
+			c, err = NewCipher(key)
+			if err != nil {
+				return nil, err
+			}
+		}
+		recovery := false
+		if r := query.Get("recover"); r != "" {
+			recovery, err = strconv.ParseBool(r)
+			if err != nil {
+				return nil, fmt.Errorf("invalid recover %q in store %q", r, dsn)
+			}
+		}
+		s, err := OpenEncrypted(path, c, fuzzy, compact, recovery)
+		if err != nil {
+			return nil, err
+		}
+		s.SetSyncPolicy(policy, interval)
+		var links, size int64
+		for param, limit := range map[string]*int64{"max-links": &links, "max-size": &size} {
+			if v := query.Get(param); v != "" {
+				*limit, err = strconv.ParseInt(v, 10, 64)
+				if err != nil || *limit < 0 {
+					s.Close()
+					return nil, fmt.Errorf("invalid %s %q in store %q", param, v, dsn)
+				}
+			}
+		}
+		s.SetLimits(int(links), size)
+		var every time.Duration
+		if v := query.Get("compact-every"); v != "" {
+			every, err = time.ParseDuration(v)
+			if err != nil || every < 0 {
+				s.Close()
+				return nil, fmt.Errorf("invalid compact-every %q in store %q", v, dsn)
+			}
+		}
+		var maxBytes int64
+		if v := query.Get("compact-max-bytes"); v != "" {
+			maxBytes, err = strconv.ParseInt(v, 10, 64)
+			if err != nil || maxBytes < 0 {
+				s.Close()
+				return nil, fmt.Errorf("invalid compact-max-bytes %q in store %q", v, dsn)
+			}
+		}
+		s.SetCompaction(every, maxBytes)
+		return Adapt(s), nil
+	})
+}
+
+// SyncPolicy controls when a FileStore fsyncs its file after a Set.
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs the file before every Set returns, so a Set which
+	// returned successfully is never lost.
+	SyncAlways SyncPolicy = iota
+	// SyncInterval fsyncs the file periodically if it has been written to, so
+	// at most the Sets made during the last interval can be lost in a crash.
+	SyncInterval
+	// SyncNever leaves it up to the operating system to flush the file.
+	SyncNever
+)
+
+// defaultSyncInterval is the interval used by SyncInterval if none is given.
+const defaultSyncInterval = time.Second
+
+// ParseSyncPolicy parses a policy of the form "always", "never", "interval"
+// or a duration such as "500ms" (which implies SyncInterval), returning the
+// policy and the interval to use with it. The empty string is parsed as
+// "always".
+func ParseSyncPolicy(policy string) (SyncPolicy, time.Duration, error) {
+	switch policy {
+	case "", "always":
+		return SyncAlways, 0, nil
+	case "never":
+		return SyncNever, 0, nil
+	case "interval":
+		return SyncInterval, defaultSyncInterval, nil
+	}
+	interval, err := time.ParseDuration(policy)
+	if err != nil || interval <= 0 {
+		return 0, 0, fmt.Errorf("invalid sync policy %q", policy)
+	}
+	return SyncInterval, interval, nil
+}
+
 // FileStore provides a simple file-backed implementation of the Store
 // interface. The mapping between names and links is written to the file for
 // persistence and resiliency to restarts, but cache serves as the in-memory
@@ -16,29 +130,123 @@ import (
 // 'fuzzy' lookup if initialized with fuzzy - hyphens and underscores and
 // capitalization will be ignored in name during lookups. Access to all fields
 // except fuzzy must be guarded by lock.
+//
+// Each line of the file is a JSON record (see record) holding the name along
+// with its Entry, or just the name for a deletion (or an array of records Set
+// together by SetAll). Files written in the older
+// space separated "name link" or "name link created updated creator" formats
+// are still understood and are automatically upgraded by compacting the file
+// on Open. If the last line of the file was only partially written before a
+// crash it is discarded (and the file compacted) rather than failing to Open.
+// If opened with a Cipher (see OpenEncrypted) each line is encrypted.
+//
+// The file may also be modified by something other than the store (eg. edited
+// by hand or synced from another machine), in which case the store reloads it
+// (see watch). size is the size of the file as far as the store knows, which
+// allows the store to distinguish its own writes from external ones.
+//
+// By default the file is fsynced before each Set returns - SetSyncPolicy can
+// be used to trade durability for write throughput. dirty records whether the
+// file has been written to since it was last synced. Sets are handed to a
+// single writer goroutine (see writeLoop) through writes, which appends all of
+// the Sets waiting at once before syncing the file, so concurrent Sets share
+// a sync rather than each waiting for their own.
+//
+// lock guards everything except cache, which is split into shards with their
+// own locks (see shards) so that Get never waits on a Set or compaction.
+//
+// revision counts the changes made to the mappings since the store was opened,
+// which together with epoch (random for each Open) identifies their current
+// state so that clients can make conditional requests (see Revisioner).
+//
+// As the file is append only it accumulates lines for mappings which have
+// since been overwritten or deleted, so it is periodically compacted in the
+// background once these dead lines make up most of the file (see
+// compactRatio), or on the schedule and at the size configured with
+// SetCompaction (compactAfter and compactBytes, with compacted being when the
+// file was last compacted). The lines are also the history of each name, which is kept
+// in history: compaction retains the last historyLimit versions of each name
+// which still exists, though the history of deleted names is discarded.
+//
+// live holds the names which currently have mappings, so that Sets can be
+// checked against maxLinks without counting them all each time.
 type FileStore struct {
-	fuzzy bool
-	order []string
-	cache map[string]string
-	file  *os.File
-	lock  sync.RWMutex
+	fuzzy        bool
+	recovery     bool
+	order        []string
+	cache        *shards
+	history      map[string][]*Entry
+	live         map[string]struct{}
+	file         *os.File
+	size         int64
+	policy       SyncPolicy
+	maxLinks     int
+	maxSize      int64
+	compactAfter time.Duration
+	compactBytes int64
+	compacted    time.Time
+	dirty        bool
+	cipher       *Cipher
+	done         chan struct{}
+	closed       chan struct{}
+	writes       chan *pending
+	stopped      chan struct{}
+	epoch        string
+	revision     uint64
+	lock         sync.RWMutex
 }
 
+// pending is a Set waiting for the writer goroutine to append line to the file
+// and then make the changes in entries (recs in the order they're written).
+type pending struct {
+	entries map[string]*Entry
+	recs    []record
+	line    string
+	done    chan error
+}
+
+// errClosed is returned by Sets made after a FileStore has been closed.
+var errClosed = errors.New("store is closed")
+
+// historyLimit is the number of versions of each name retained by a FileStore.
+const historyLimit = 10
+
+const (
+	// compactInterval is how often the file is checked for dead lines.
+	compactInterval = time.Minute
+	// compactRatio is the fraction of lines which must be dead before the file
+	// is compacted in the background...
+	compactRatio = 0.5
+	// ... provided there are at least compactMinLines of them, so small files
+	// aren't constantly rewritten.
+	compactMinLines = 1000
+)
+
 // Open a FileStore backed by filename (and optional bools to enable fuzzy
-// lookups and compaction). If the file already exists the store will
-// initialize its state with the contents, otherwise future calls to Set will
-// write to the file for future startups. The FileStore returned should be
-// closed with Close once it is no longer in use.
+// lookups, compaction and recovery from corrupt lines). If the file already
+// exists the store will initialize its state with the contents, otherwise
+// future calls to Set will write to the file for future startups. The
+// FileStore returned should be closed with Close once it is no longer in use.
 func Open(filename string, bools ...bool) (*FileStore, error) {
-	fuzzy, compact := false, false
+	return OpenEncrypted(filename, nil, bools...)
+}
+
+// OpenEncrypted opens a FileStore as with Open, but with each line of the file
+// encrypted with c. A file which isn't already encrypted will be encrypted
+// when opened, though an encrypted file can't be opened without c.
+func OpenEncrypted(filename string, c *Cipher, bools ...bool) (*FileStore, error) {
+	fuzzy, compact, recovery := false, false, false
 	if len(bools) > 0 {
 		fuzzy = bools[0]
 		if len(bools) > 1 {
 			compact = bools[1]
+			if len(bools) > 2 {
+				recovery = bools[2]
+			}
 		}
 	}
 
-	s := &FileStore{fuzzy: fuzzy, cache: make(map[string]string)}
+	s := &FileStore{fuzzy: fuzzy, recovery: recovery, cipher: c, cache: newShards(), history: make(map[string][]*Entry), live: make(map[string]struct{})}
 
 	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
 	if err != nil {
@@ -46,24 +254,16 @@ func Open(filename string, bools ...bool) (*FileStore, error) {
 	}
 	s.file = f
 
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		split := strings.Split(scanner.Text(), " ")
-		s.order = append(s.order, split[0])
-		switch len(split) {
-		case 1:
-			s.set(split[0], "")
-		case 2:
-			s.set(split[0], split[1])
-		default:
-			return nil, fmt.Errorf("invalid line in %s: %s", filename, scanner.Text())
-		}
-	}
-	if err := scanner.Err(); err != nil {
+	rewrite, err := read(f, filename, c, recovery, func(name string, e *Entry) {
+		s.order = append(s.order, name)
+		s.set(name, e)
+	})
+	if err != nil {
+		f.Close()
 		return nil, err
 	}
 
-	if compact {
+	if compact || rewrite {
 		err = f.Close()
 		if err != nil {
 			return nil, err
@@ -74,58 +274,445 @@ func Open(filename string, bools ...bool) (*FileStore, error) {
 		}
 		// Re-read the compacted dump, taking care to make sure compact is set to
 		// false so we don't infinitely recurse.
-		s, err := Open(filename, fuzzy, false)
+		s, err := OpenEncrypted(filename, c, fuzzy, false, recovery)
 		return s, err
 	}
 
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.size = fi.Size()
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.epoch = hex.EncodeToString(b)
+
+	s.compacted = time.Now()
+	s.closed = make(chan struct{})
+	s.writes, s.stopped = make(chan *pending), make(chan struct{})
+	go s.writeLoop(s.closed)
+	go s.compactEvery(compactInterval, s.closed)
+	if err := s.watch(s.closed); err != nil {
+		log.Printf("unable to watch %s for changes: %v\n", filename, err)
+	}
+
 	return s, nil
 }
 
-// Close closes the FileStore returned by Open.
+// compactEvery checks whether the file should be compacted every interval (or
+// more often if required by SetCompaction) until closed is closed.
+func (s *FileStore) compactEvery(interval time.Duration, closed chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+			s.lock.Lock()
+			if s.shouldCompact() {
+				if err := s.compact(); err != nil {
+					log.Printf("compaction of %s failed: %v\n", s.file.Name(), err)
+				}
+			}
+			next := interval
+			if s.compactAfter > 0 && s.compactAfter < next {
+				next = s.compactAfter
+			}
+			s.lock.Unlock()
+			ticker.Reset(next)
+		}
+	}
+}
+
+// shouldCompact returns whether the file has dead lines and either enough of
+// them to reach compactRatio, it's larger than compactBytes or it hasn't been
+// compacted for compactAfter.
+func (s *FileStore) shouldCompact() bool {
+	dead := len(s.order) - s.retained()
+	switch {
+	case dead == 0:
+		return false
+	case dead >= compactMinLines && float64(dead) >= compactRatio*float64(len(s.order)):
+		return true
+	case s.compactBytes > 0 && s.size > s.compactBytes:
+		return true
+	case s.compactAfter > 0 && time.Since(s.compacted) >= s.compactAfter:
+		return true
+	}
+	return false
+}
+
+// SetCompaction configures the FileStore to also be compacted in the
+// background every interval or whenever the file is larger than maxBytes
+// (either of which may be 0 to disable it), provided the file has lines which
+// compaction would remove.
+func (s *FileStore) SetCompaction(every time.Duration, maxBytes int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.compactAfter, s.compactBytes = every, maxBytes
+}
+
+// Compact atomically rewrites the file to contain only the current mappings.
+func (s *FileStore) Compact() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.compact()
+}
+
+func (s *FileStore) compact() error {
+	filename := s.file.Name()
+	order, err := s.dump(filename)
+	if err != nil {
+		return err
+	}
+
+	// The dump replaced the file, so future writes need to go to the new one.
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file.Close()
+	s.file, s.size, s.dirty = f, fi.Size(), false
+	s.order = order
+	s.compacted = time.Now()
+
+	// The history of deleted names wasn't retained.
+	for name := range s.history {
+		if _, ok := s.cache.get(name); !ok {
+			delete(s.history, name)
+		}
+	}
+	return nil
+}
+
+// retained returns the number of lines in the file which would be retained by
+// compaction.
+func (s *FileStore) retained() int {
+	n := 0
+	_ = s.iterate(func(name string, e *Entry) error {
+		n += len(s.versions(name, e))
+		return nil
+	})
+	return n
+}
+
+// History returns the retained versions of the entry for name, oldest first.
+func (s *FileStore) History(name string) ([]*Entry, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return append([]*Entry(nil), s.history[name]...), nil
+}
+
+// versions returns the versions of name which are retained given that e is the
+// current version, oldest first.
+func (s *FileStore) versions(name string, e *Entry) []*Entry {
+	h := s.history[name]
+	if len(h) == 0 || h[len(h)-1] != e {
+		return []*Entry{e}
+	}
+	return h
+}
+
+// SetLimits sets the maximum number of links the FileStore may hold and the
+// maximum size of its file, with 0 meaning unlimited. Sets which would exceed
+// either limit fail with ErrQuotaExceeded, though links can always be deleted
+// to make room.
+func (s *FileStore) SetLimits(links int, size int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.maxLinks, s.maxSize = links, size
+}
+
+// allow returns an error if writing line to make the changes in entries would
+// exceed the limits of the store. The file is compacted if that would bring it
+// back under the size limit.
+func (s *FileStore) allow(entries map[string]*Entry, line string) error {
+	added, deletes := 0, true
+	for name, e := range entries {
+		if _, ok := s.live[name]; e != nil && !ok {
+			added++
+		}
+		deletes = deletes && e == nil
+	}
+	if s.maxLinks > 0 && added > 0 {
+		if len(s.live)+added > s.maxLinks {
+			return fmt.Errorf("%w: the store is limited to %d links", ErrQuotaExceeded, s.maxLinks)
+		}
+	}
+
+	if deletes || s.maxSize <= 0 || s.size+int64(len(line)) <= s.maxSize {
+		return nil
+	}
+	if s.retained() < len(s.order) {
+		if err := s.compact(); err != nil {
+			return err
+		}
+		if s.size+int64(len(line)) <= s.maxSize {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: the store is limited to %d bytes", ErrQuotaExceeded, s.maxSize)
+}
+
+// SetSyncPolicy changes when the FileStore fsyncs its file, with interval
+// being the period between syncs for SyncInterval.
+func (s *FileStore) SetSyncPolicy(policy SyncPolicy, interval time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.done != nil {
+		close(s.done)
+		s.done = nil
+	}
+	s.policy = policy
+
+	if policy == SyncInterval {
+		s.done = make(chan struct{})
+		go s.syncEvery(interval, s.done)
+	}
+}
+
+// syncEvery fsyncs the file every interval if it is dirty until done is
+// closed.
+func (s *FileStore) syncEvery(interval time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			s.lock.Lock()
+			if err := s.sync(); err != nil {
+				log.Printf("sync of %s failed: %v\n", s.file.Name(), err)
+			}
+			s.lock.Unlock()
+		}
+	}
+}
+
+// sync fsyncs the file if it has been written to since it was last synced.
+func (s *FileStore) sync() error {
+	if !s.dirty {
+		return nil
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// Close closes the FileStore returned by Open, first syncing any writes which
+// haven't been synced yet.
 func (s *FileStore) Close() error {
+	s.lock.Lock()
+	if s.done != nil {
+		close(s.done)
+		s.done = nil
+	}
+	if s.closed != nil {
+		close(s.closed)
+		s.closed = nil
+	}
+	s.lock.Unlock()
+
+	// The writer needs the lock to finish any write it's in the middle of.
+	<-s.stopped
+
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
+	if err := s.sync(); err != nil {
+		s.file.Close()
+		return err
+	}
 	return s.file.Close()
 }
 
-func (s *FileStore) Get(name string) (string, bool) {
+// Check returns an error if the FileStore can't make Sets, because it has been
+// closed or its file has been removed or can't be written to.
+func (s *FileStore) Check() error {
+	select {
+	case <-s.stopped:
+		return errClosed
+	default:
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	name := s.file.Name()
+	fi, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	other, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(fi, other) {
+		return fmt.Errorf("%s has been replaced", name)
+	}
+	return nil
+}
+
+func (s *FileStore) Get(name string) (*Entry, bool) {
+	return s.get(name)
+}
+
+// Revision returns an identifier for the current state of the mappings, which
+// changes whenever they do.
+func (s *FileStore) Revision() string {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 
-	link, ok := s.get(name)
-	if !ok || link == "" {
-		return "", false
+	return fmt.Sprintf("%s-%d", s.epoch, s.revision)
+}
+
+func (s *FileStore) Set(name string, e *Entry) error {
+	return s.submit(map[string]*Entry{name: e}, []record{{Name: name, Entry: e}}, s.format(name, e))
+}
+
+// SetAll Sets all of entries atomically by writing them as a single line.
+func (s *FileStore) SetAll(entries map[string]*Entry) error {
+	names := sortedNames(entries)
+	recs := make([]record, len(names))
+	for i, name := range names {
+		recs[i] = record{Name: name, Entry: entries[name]}
+	}
+	b, _ := json.Marshal(recs)
+
+	return s.submit(entries, recs, s.seal(string(b)+"\n"))
+}
+
+// submit hands a Set to the writer goroutine and waits for it to be made.
+func (s *FileStore) submit(entries map[string]*Entry, recs []record, line string) error {
+	p := &pending{entries: entries, recs: recs, line: line, done: make(chan error, 1)}
+	select {
+	case s.writes <- p:
+		return <-p.done
+	case <-s.stopped:
+		return errClosed
 	}
-	return link, true
 }
 
-func (s *FileStore) Set(name, link string) error {
+// writeLoop makes the Sets sent to writes until closed is closed. Any other
+// Sets already waiting when one arrives are made along with it, and the file
+// is only synced (if required by the policy) once they've all been written.
+func (s *FileStore) writeLoop(closed chan struct{}) {
+	defer close(s.stopped)
+	for {
+		var batch []*pending
+		select {
+		case <-closed:
+			return
+		case p := <-s.writes:
+			batch = append(batch, p)
+		}
+	more:
+		for {
+			select {
+			case p := <-s.writes:
+				batch = append(batch, p)
+			default:
+				break more
+			}
+		}
+		s.commit(batch)
+	}
+}
+
+// commit makes each Set in batch, replying to each once the file has been
+// synced.
+func (s *FileStore) commit(batch []*pending) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	_, err := s.file.WriteString(fmt.Sprintf("%s %s\n", name, link))
+	var written []*pending
+	for _, p := range batch {
+		err := s.allow(p.entries, p.line)
+		if err == nil {
+			err = s.write(p.line)
+		}
+		if err != nil {
+			p.done <- err
+			continue
+		}
+		for _, rec := range p.recs {
+			s.order = append(s.order, rec.Name)
+			s.set(rec.Name, rec.Entry)
+		}
+		s.revision++
+		written = append(written, p)
+	}
+
+	var err error
+	if s.policy == SyncAlways {
+		err = s.sync()
+	}
+	for _, p := range written {
+		p.done <- err
+	}
+}
+
+// write appends line to the file.
+func (s *FileStore) write(line string) error {
+	n, err := s.file.WriteString(line)
+	s.size += int64(n)
 	if err != nil {
 		return err
 	}
-	s.order = append(s.order, name)
-	s.set(name, link)
+	s.dirty = true
 	return nil
 }
 
-func (s *FileStore) Iterate(cb func(name, link string) error) error {
+func (s *FileStore) Iterate(cb func(name string, e *Entry) error) error {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 
+	return s.iterate(cb)
+}
+
+// IterateRange is as with Iterate, but skips the first offset mappings and
+// stops after limit mappings.
+func (s *FileStore) IterateRange(offset, limit int, cb func(name string, e *Entry) error) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return iterateWindow(s.iterate, offset, limit, cb)
+}
+
+func (s *FileStore) iterate(cb func(name string, e *Entry) error) error {
 	seen := make(map[string]bool)
 	for i := len(s.order) - 1; i >= 0; i-- {
 		next := s.order[i]
 		_, ok := seen[next]
 		seen[next] = true
 		if !ok {
-			link, ok := s.get(next)
+			e, ok := s.get(next)
 			if ok {
-				if err := cb(next, link); err != nil {
+				if err := cb(next, e); err != nil {
 					return err
 				}
 			}
@@ -134,54 +721,329 @@ func (s *FileStore) Iterate(cb func(name, link string) error) error {
 	return nil
 }
 
-// Dump writes out a cleaned version of the store's state to filename.
+// Dump writes out a cleaned version of the store's state to filename. The
+// state is first written to a temporary file which is then renamed to
+// filename, so filename is never left partially written.
 func (s *FileStore) Dump(filename string) error {
-	var lines []string
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	_, err := s.dump(filename)
+	return err
+}
+
+// dump implements Dump, returning the names of the lines written in order.
+func (s *FileStore) dump(filename string) ([]string, error) {
+	var names, lines []string
 	// Unfortunately, we can't output it in the iteration order because then it
 	// be in reverse once read back in. Instead we save the lines we want to write
-	// and iterate through backwards after.
-	_ = s.Iterate(func(name, link string) error {
-		lines = append(lines, fmt.Sprintf("%s %s\n", name, link))
+	// and iterate through backwards after. The retained versions of each name are
+	// written before its current version.
+	_ = s.iterate(func(name string, e *Entry) error {
+		versions := s.versions(name, e)
+		for i := len(versions) - 1; i >= 0; i-- {
+			names = append(names, name)
+			lines = append(lines, s.format(name, versions[i]))
+		}
 		return nil
 	})
 
-	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	tmp := filename + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	order := make([]string, 0, len(names))
 	for i := len(lines) - 1; i >= 0; i-- {
 		_, err = f.WriteString(lines[i])
 		if err != nil {
-			return err
+			f.Close()
+			return nil, err
 		}
+		order = append(order, names[i])
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
 	}
+	return order, os.Rename(tmp, filename)
+}
+
+// format returns the line for the mapping from name to e, encrypted if the
+// store has a cipher.
+func (s *FileStore) format(name string, e *Entry) string {
+	return s.seal(format(name, e))
+}
+
+// seal encrypts line if the store has a cipher.
+func (s *FileStore) seal(line string) string {
+	if s.cipher == nil {
+		return line
+	}
+	return s.cipher.seal(strings.TrimSuffix(line, "\n")) + "\n"
+}
+
+// record is a single mapping in the file backing a FileStore. Entry is nil for
+// records representing deletions.
+type record struct {
+	Name string `json:"name"`
+	*Entry
+}
 
+// format returns the line representing the mapping from name to e (or the
+// deletion of name if e is nil). Encoding the record as JSON escapes any
+// newlines in the name or link, so the record always fits on a single line.
+func format(name string, e *Entry) string {
+	b, _ := json.Marshal(record{Name: name, Entry: e})
+	return string(b) + "\n"
+}
+
+// read parses the lines from r (which was read from filename), calling cb with
+// each mapping in order. Records without an entry represent deletions and
+// result in cb being called with a nil Entry. Encrypted lines are decrypted
+// with c, which may be nil if the lines aren't expected to be encrypted.
+// rewrite is true if the contents should be rewritten, either because some
+// lines were in one of the old space separated formats, some lines weren't
+// encrypted despite c being provided or the final line was missing its
+// newline. A final line which is both missing its newline and invalid is
+// assumed to be the result of a write interrupted by a crash and is ignored.
+// Any other invalid line is an error unless recovery is set, in which case the
+// line is skipped and quarantined to filename.corrupt (see quarantine).
+func read(r io.Reader, filename string, c *Cipher, recovery bool, cb func(name string, e *Entry)) (rewrite bool, err error) {
+	br := bufio.NewReader(r)
+	valid, corrupt := 0, 0
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return rewrite, err
+		}
+		if line == "" {
+			// A file where no line can be read is more likely to have been
+			// opened with the wrong key than to be entirely corrupt, and
+			// quarantining everything would leave the store empty.
+			if corrupt > 0 && valid == 0 {
+				return rewrite, fmt.Errorf("no valid lines in %s, refusing to recover", filename)
+			}
+			return rewrite, nil
+		}
+		complete := strings.HasSuffix(line, "\n")
+		line = strings.TrimSuffix(line, "\n")
+
+		encrypted := strings.HasPrefix(line, encryptedPrefix)
+		if encrypted && c == nil {
+			return rewrite, fmt.Errorf("%s is encrypted but no store key was provided", filename)
+		}
+
+		var recs []record
+		var legacy bool
+		var perr error
+		if encrypted {
+			var plaintext string
+			if plaintext, perr = c.open(line); perr == nil {
+				recs, legacy, perr = parseLine(plaintext)
+			} else if complete && !recovery {
+				return rewrite, fmt.Errorf("unable to decrypt line in %s (wrong store key?)", filename)
+			}
+		} else {
+			recs, legacy, perr = parseLine(line)
+		}
+
+		switch {
+		case perr == nil:
+			valid++
+			for _, rec := range recs {
+				cb(rec.Name, rec.Entry)
+			}
+			rewrite = rewrite || legacy || !complete || (c != nil && !encrypted)
+		case !complete:
+			log.Printf("ignoring truncated line at end of %s: %s\n", filename, line)
+			return true, nil
+		case recovery:
+			corrupt++
+			log.Printf("quarantining invalid line in %s: %s\n", filename, line)
+			if err := quarantine(filename, line); err != nil {
+				return rewrite, err
+			}
+			rewrite = true
+		default:
+			return rewrite, fmt.Errorf("invalid line in %s: %s", filename, line)
+		}
+	}
+}
+
+// quarantine appends line to filename.corrupt so that a line which had to be
+// skipped when reading filename isn't lost once the file is rewritten.
+func quarantine(filename, line string) error {
+	f, err := os.OpenFile(filename+".corrupt", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(line + "\n"); err != nil {
+		f.Close()
+		return err
+	}
 	return f.Close()
 }
 
-func (s *FileStore) get(name string) (string, bool) {
-	link, ok := s.cache[name]
-	if (!ok || link == "") && s.fuzzy {
-		link, ok = s.cache[fuzz(name)]
+// parseLine parses a single line (without its newline), returning the records
+// it holds and whether it was in one of the legacy formats. Lines normally hold
+// a single record, but the records Set together by SetAll are written as a
+// single line holding an array of records so that they're applied atomically.
+func parseLine(line string) (recs []record, legacy bool, err error) {
+	if strings.HasPrefix(line, "{") || strings.HasPrefix(line, "[") {
+		if strings.HasPrefix(line, "{") {
+			recs = make([]record, 1)
+			err = json.Unmarshal([]byte(line), &recs[0])
+		} else {
+			err = json.Unmarshal([]byte(line), &recs)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		for _, rec := range recs {
+			if rec.Name == "" {
+				return nil, false, errors.New("missing name")
+			}
+		}
+		return recs, false, nil
+	}
+
+	// The legacy formats didn't escape links, so a link containing spaces spans
+	// several fields. None of the fields after the link in the 5 field format
+	// can contain spaces, so the link is everything between the name and them.
+	split := strings.Split(line, " ")
+	switch {
+	case len(split) == 1:
+		return []record{{Name: split[0]}}, true, nil
+	case len(split) == 2 && split[1] == "":
+		// Deletions were originally written as "name " rather than just "name".
+		return []record{{Name: split[0]}}, true, nil
+	case len(split) >= 5:
+		n := len(split) - 3
+		if e, err := parse(append([]string{strings.Join(split[1:n], " ")}, split[n:]...)); err == nil {
+			return []record{{Name: split[0], Entry: e}}, true, nil
+		}
 	}
-	return link, ok
+	return []record{{Name: split[0], Entry: &Entry{Link: strings.Join(split[1:], " ")}}}, true, nil
 }
 
-func (s *FileStore) set(name, link string) {
-	if link == "" {
-		delete(s.cache, name)
+// parse converts the "link created updated creator" fields of a legacy line
+// into an Entry, where created and updated are Unix timestamps and creator is
+// query escaped ("-" if unknown).
+func parse(fields []string) (*Entry, error) {
+	created, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	creator := ""
+	if fields[3] != "-" {
+		creator, err = url.QueryUnescape(fields[3])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Entry{Link: fields[0], Created: fromUnix(created), Updated: fromUnix(updated), CreatedBy: creator}, nil
+}
+
+// fromUnix returns the time for the Unix timestamp sec, with 0 mapping to the
+// zero time.
+func fromUnix(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
+
+func (s *FileStore) get(name string) (*Entry, bool) {
+	e, ok := s.cache.get(name)
+	if !ok && s.fuzzy {
+		e, ok = s.cache.get(fuzz(name))
+	}
+	return e, ok
+}
+
+// set updates the mapping for name, and must be called with lock held.
+func (s *FileStore) set(name string, e *Entry) {
+	s.cache.set(name, e)
+	if e == nil {
+		delete(s.live, name)
 	} else {
-		s.cache[name] = link
+		s.live[name] = struct{}{}
+		h := append(s.history[name], e)
+		if len(h) > historyLimit {
+			h = h[len(h)-historyLimit:]
+		}
+		s.history[name] = h
 	}
 
 	if s.fuzzy {
-		fuzzed := fuzz(name)
-		if link == "" {
-			delete(s.cache, fuzzed)
-		} else {
-			s.cache[fuzzed] = link
-		}
+		s.cache.set(fuzz(name), e)
+	}
+}
+
+// cacheShards is the number of shards the cache of a FileStore is split into.
+const cacheShards = 32
+
+// shards maps names to entries, with the names split between shards by their
+// hash so that each shard can be locked independently.
+type shards [cacheShards]struct {
+	lock    sync.RWMutex
+	entries map[string]*Entry
+}
+
+func newShards() *shards {
+	var s shards
+	for i := range s {
+		s[i].entries = make(map[string]*Entry)
+	}
+	return &s
+}
+
+// shard returns the index of the shard holding name.
+func (s *shards) shard(name string) int {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int(h.Sum32() % cacheShards)
+}
+
+func (s *shards) get(name string) (*Entry, bool) {
+	i := s.shard(name)
+	s[i].lock.RLock()
+	defer s[i].lock.RUnlock()
+
+	e, ok := s[i].entries[name]
+	return e, ok
+}
+
+// set maps name to e, or removes name if e is nil.
+func (s *shards) set(name string, e *Entry) {
+	i := s.shard(name)
+	s[i].lock.Lock()
+	defer s[i].lock.Unlock()
+
+	if e == nil {
+		delete(s[i].entries, name)
+	} else {
+		s[i].entries[name] = e
+	}
+}
+
+// replace replaces the contents of s with the contents of other, which must
+// not be used afterwards.
+func (s *shards) replace(other *shards) {
+	for i := range s {
+		s[i].lock.Lock()
+		s[i].entries = other[i].entries
+		s[i].lock.Unlock()
 	}
 }
 
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// openTemp opens a FileStore backed by a file in a temporary directory holding contents, returning
+// the store and the file's name.
+func openTemp(t *testing.T, contents string) (*FileStore, string) {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "links")
+	if err := os.WriteFile(filename, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(filename)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, filename
+}
+
+// checkLink fails t unless s maps name to link.
+func checkLink(t *testing.T, s *FileStore, name, link string) {
+	t.Helper()
+	e, ok := s.Get(name)
+	if !ok {
+		t.Fatalf("Get(%q): not found, want %q", name, link)
+	}
+	if e.Link != link {
+		t.Fatalf("Get(%q) = %q, want %q", name, e.Link, link)
+	}
+}
+
+func TestOpenTruncatedLine(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "links")
+	s, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if err := s.Set(name, &Entry{Link: "https://" + name + ".example"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Crash part of the way through writing the last line.
+	fi, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(filename, fi.Size()-10); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = Open(filename)
+	if err != nil {
+		t.Fatalf("Open after truncation: %v", err)
+	}
+	checkLink(t, s, "a", "https://a.example")
+	checkLink(t, s, "b", "https://b.example")
+	if _, ok := s.Get("c"); ok {
+		t.Fatal("Get(c) found the truncated line")
+	}
+
+	// The partial line is discarded, so later lines aren't appended to it.
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(b), "\n") || strings.Contains(string(b), "c.example") {
+		t.Fatalf("truncated line wasn't repaired: %q", b)
+	}
+	if err := s.Set("d", &Entry{Link: "https://d.example"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = Open(filename)
+	if err != nil {
+		t.Fatalf("Open after repair: %v", err)
+	}
+	defer s.Close()
+	checkLink(t, s, "a", "https://a.example")
+	checkLink(t, s, "d", "https://d.example")
+}
+
+func TestOpenInvalidLine(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "links")
+	contents := `{"name":"a","entry":{"link":"https://a.example"}}` + "\n{garbage\n"
+	if err := os.WriteFile(filename, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Only the last line can have been partially written, so a complete invalid line is an error.
+	if _, err := Open(filename); err == nil {
+		t.Fatal("Open succeeded with an invalid complete line")
+	}
+}
+
+func TestOpenLegacy(t *testing.T) {
+	s, filename := openTemp(t, strings.Join([]string{
+		"a https://a.example",
+		"b https://b.example/with spaces",
+		"c https://c.example 1600000000 1600000100 alice%40corp.example",
+		"d https://d.example 1600000000 1600000100 -",
+		"e https://e.example",
+		"e ",
+		"",
+	}, "\n"))
+
+	checkLink(t, s, "a", "https://a.example")
+	checkLink(t, s, "b", "https://b.example/with spaces")
+	checkLink(t, s, "c", "https://c.example")
+	checkLink(t, s, "d", "https://d.example")
+	if _, ok := s.Get("e"); ok {
+		t.Fatal("Get(e) found a deleted name")
+	}
+
+	c, _ := s.Get("c")
+	if !c.Created.Equal(time.Unix(1600000000, 0)) || !c.Updated.Equal(time.Unix(1600000100, 0)) {
+		t.Fatalf("Get(c) times = %v, %v", c.Created, c.Updated)
+	}
+	if c.CreatedBy != "alice@corp.example" {
+		t.Fatalf("Get(c).CreatedBy = %q, want alice@corp.example", c.CreatedBy)
+	}
+	if d, _ := s.Get("d"); d.CreatedBy != "" {
+		t.Fatalf("Get(d).CreatedBy = %q, want none", d.CreatedBy)
+	}
+
+	// Opening upgrades the file to the current format.
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		if !strings.HasPrefix(line, "{") && !strings.HasPrefix(line, "[") {
+			t.Fatalf("line wasn't upgraded: %q", line)
+		}
+	}
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	tests := []struct {
+		in       string
+		policy   SyncPolicy
+		interval time.Duration
+		err      bool
+	}{
+		{"always", SyncAlways, 0, false},
+		{"never", SyncNever, 0, false},
+		{"interval", SyncInterval, defaultSyncInterval, false},
+		{"500ms", SyncInterval, 500 * time.Millisecond, false},
+		{"sometimes", 0, 0, true},
+		{"-1s", 0, 0, true},
+	}
+	for _, tt := range tests {
+		policy, interval, err := ParseSyncPolicy(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("ParseSyncPolicy(%q) error = %v, want error %v", tt.in, err, tt.err)
+			continue
+		}
+		if err == nil && (policy != tt.policy || interval != tt.interval) {
+			t.Errorf("ParseSyncPolicy(%q) = %v, %v, want %v, %v", tt.in, policy, interval, tt.policy, tt.interval)
+		}
+	}
+}
+
+func TestSyncPolicies(t *testing.T) {
+	for _, policy := range []SyncPolicy{SyncAlways, SyncInterval, SyncNever} {
+		filename := filepath.Join(t.TempDir(), "links")
+		s, err := Open(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.SetSyncPolicy(policy, 10*time.Millisecond)
+		if err := s.Set("a", &Entry{Link: "https://a.example"}); err != nil {
+			t.Fatalf("policy %v: Set: %v", policy, err)
+		}
+
+		s.lock.RLock()
+		dirty := s.dirty
+		s.lock.RUnlock()
+		if policy == SyncAlways && dirty {
+			t.Errorf("policy %v: file not synced by Set", policy)
+		}
+		if policy != SyncAlways && !dirty {
+			t.Errorf("policy %v: file synced by Set", policy)
+		}
+		if policy == SyncInterval {
+			deadline := time.Now().Add(time.Second)
+			for dirty && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+				s.lock.RLock()
+				dirty = s.dirty
+				s.lock.RUnlock()
+			}
+			if dirty {
+				t.Errorf("policy %v: file not synced after the interval", policy)
+			}
+		}
+
+		// Close syncs whatever hasn't been, so the link survives reopening with every policy.
+		if err := s.Close(); err != nil {
+			t.Fatalf("policy %v: Close: %v", policy, err)
+		}
+		s, err = Open(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkLink(t, s, "a", "https://a.example")
+		s.Close()
+	}
+}
+
+// countLines returns the number of lines in filename.
+func countLines(t *testing.T, filename string) int {
+	t.Helper()
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(b), "\n")
+}
+
+func TestCompact(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "links")
+	s, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, set := range []struct{ name, link string }{
+		{"a", "https://a.example/old"},
+		{"a", "https://a.example"},
+		{"b", "https://b.example"},
+		{"b", ""},
+		{"c", "https://c.example"},
+	} {
+		var e *Entry
+		if set.link != "" {
+			e = &Entry{Link: set.link}
+		}
+		if err := s.Set(set.name, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := countLines(t, filename); n != 5 {
+		t.Fatalf("%d lines before compaction, want 5", n)
+	}
+
+	if err := s.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	// a's previous version is retained as its history, but b's isn't as it was deleted.
+	if n := countLines(t, filename); n != 3 {
+		t.Fatalf("%d lines after compaction, want 3", n)
+	}
+	if _, err := os.Stat(filename + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temporary file left behind: %v", err)
+	}
+	checkLink(t, s, "a", "https://a.example")
+
+	// Later writes go to the compacted file.
+	if err := s.Set("d", &Entry{Link: "https://d.example"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLink(t, s, "a", "https://a.example")
+	checkLink(t, s, "c", "https://c.example")
+	checkLink(t, s, "d", "https://d.example")
+	if _, ok := s.Get("b"); ok {
+		t.Fatal("Get(b) found a deleted name after compaction")
+	}
+}
+
+func TestCompactEvery(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "links")
+	s, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetSyncPolicy(SyncNever, 0)
+	versions := compactMinLines + historyLimit
+	for i := 0; i < versions; i++ {
+		if err := s.Set("a", &Entry{Link: "https://a.example/" + strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	closed := make(chan struct{})
+	defer close(closed)
+	go s.compactEvery(5*time.Millisecond, closed)
+	deadline := time.Now().Add(time.Second)
+	for countLines(t, filename) > historyLimit && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := countLines(t, filename); n != historyLimit {
+		t.Fatalf("%d lines after background compaction, want %d", n, historyLimit)
+	}
+	checkLink(t, s, "a", "https://a.example/"+strconv.Itoa(versions-1))
+}
+
+func TestHistory(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "links")
+	s, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions := historyLimit + 5
+	for i := 0; i < versions; i++ {
+		if err := s.Set("a", &Entry{Link: "https://a.example/" + strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Set("b", &Entry{Link: "https://b.example"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("b", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the last historyLimit versions are retained, oldest first, including through compaction
+	// and reopening.
+	check := func(when string) {
+		t.Helper()
+		h, err := s.History("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(h) != historyLimit {
+			t.Fatalf("%s: %d versions of a, want %d", when, len(h), historyLimit)
+		}
+		for i, e := range h {
+			if want := "https://a.example/" + strconv.Itoa(versions-historyLimit+i); e.Link != want {
+				t.Fatalf("%s: version %d of a is %q, want %q", when, i, e.Link, want)
+			}
+		}
+	}
+	check("after Set")
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check("after compaction")
+	if n := countLines(t, filename); n != historyLimit {
+		t.Fatalf("%d lines after compaction, want %d", n, historyLimit)
+	}
+	if h, _ := s.History("b"); len(h) != 0 {
+		t.Fatalf("%d versions of deleted b retained, want none", len(h))
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	check("after reopening")
+}
+
+func TestShards(t *testing.T) {
+	s := newShards()
+	used := make(map[int]bool)
+	for i := 0; i < 100; i++ {
+		name := "name" + strconv.Itoa(i)
+		s.set(name, &Entry{Link: "https://" + name + ".example"})
+		used[s.shard(name)] = true
+	}
+	if len(used) < 2 {
+		t.Fatalf("names were only split between %d shards", len(used))
+	}
+	if e, ok := s.get("name42"); !ok || e.Link != "https://name42.example" {
+		t.Fatalf("get(name42) = %v, %v", e, ok)
+	}
+	s.set("name42", nil)
+	if _, ok := s.get("name42"); ok {
+		t.Fatal("get(name42) found a removed name")
+	}
+
+	other := newShards()
+	other.set("other", &Entry{Link: "https://other.example"})
+	s.replace(other)
+	if _, ok := s.get("name1"); ok {
+		t.Fatal("get(name1) found a name after replace")
+	}
+	if _, ok := s.get("other"); !ok {
+		t.Fatal("get(other) didn't find a name after replace")
+	}
+}
+
+// newPending returns a Set of name to link for s's writer.
+func newPending(s *FileStore, name, link string) *pending {
+	e := &Entry{Link: link}
+	return &pending{
+		entries: map[string]*Entry{name: e},
+		recs:    []record{{Name: name, Entry: e}},
+		line:    s.format(name, e),
+		done:    make(chan error, 1),
+	}
+}
+
+func TestCommit(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "links")
+	s, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetLimits(2, 0)
+
+	// Each Set in a batch succeeds or fails by itself, and the batch is synced once.
+	batch := []*pending{
+		newPending(s, "a", "https://a.example"),
+		newPending(s, "b", "https://b.example"),
+		newPending(s, "c", "https://c.example"),
+	}
+	s.commit(batch)
+	for i, want := range []error{nil, nil, ErrQuotaExceeded} {
+		if err := <-batch[i].done; !errors.Is(err, want) {
+			t.Errorf("Set %d of the batch = %v, want %v", i, err, want)
+		}
+	}
+	s.lock.RLock()
+	dirty := s.dirty
+	s.lock.RUnlock()
+	if dirty {
+		t.Error("batch wasn't synced")
+	}
+	if n := countLines(t, filename); n != 2 {
+		t.Errorf("%d lines written by the batch, want 2", n)
+	}
+	checkLink(t, s, "b", "https://b.example")
+}
+
+func TestConcurrentSets(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "links")
+	s, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			errs <- s.Set(name, &Entry{Link: "https://" + name + ".example"})
+		}("name" + strconv.Itoa(i))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("late", &Entry{Link: "https://late.example"}); err != errClosed {
+		t.Fatalf("Set after Close = %v, want %v", err, errClosed)
+	}
+
+	s, err = Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 0; i < 50; i++ {
+		name := "name" + strconv.Itoa(i)
+		checkLink(t, s, name, "https://"+name+".example")
+	}
+}
+
+func TestMaxLinks(t *testing.T) {
+	s, _ := openTemp(t, "")
+	s.SetLimits(2, 0)
+	for _, name := range []string{"a", "b"} {
+		if err := s.Set(name, &Entry{Link: "https://" + name + ".example"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Set("c", &Entry{Link: "https://c.example"}); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("Set(c) error = %v, want %v", err, ErrQuotaExceeded)
+	}
+	// Updating an existing link doesn't add one.
+	if err := s.Set("a", &Entry{Link: "https://a.example/new"}); err != nil {
+		t.Fatalf("Set(a): %v", err)
+	}
+	// Deleting a link makes room for another.
+	if err := s.Set("b", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("c", &Entry{Link: "https://c.example"}); err != nil {
+		t.Fatalf("Set(c) after deleting b: %v", err)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// settingsPath is the path of the settings page for managing API tokens and pattern links.
+const settingsPath = "/settings"
+
+// tokenPrefix is prepended to API tokens to make them easy to recognize (eg. by secret scanners).
+const tokenPrefix = "golinks_"
+
+// Scopes which can be granted to API tokens.
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+)
+
+// Token describes an API token which can be used in place of logging in to authorize requests to
+// the JSON and GraphQL APIs. Only a hash of the token itself is kept.
+type Token struct {
+	ID          string    `json:"id"`
+	Description string    `json:"description"`
+	Scope       string    `json:"scope"`
+	Created     time.Time `json:"created"`
+	Hash        string    `json:"hash"`
+}
+
+// Tokens holds the API tokens which have been created, persisting them as JSON to a file.
+// Access to tokens must be guarded by lock.
+type Tokens struct {
+	filename string
+	lock     sync.RWMutex
+	tokens   map[string]*Token
+}
+
+// OpenTokens returns Tokens persisted to filename, which is created once the first token is.
+func OpenTokens(filename string) (*Tokens, error) {
+	t := &Tokens{filename: filename, tokens: make(map[string]*Token)}
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tokens []*Token
+	if err := json.Unmarshal(b, &tokens); err != nil {
+		return nil, fmt.Errorf("reading tokens from %s: %w", filename, err)
+	}
+	for _, tok := range tokens {
+		t.tokens[tok.Hash] = tok
+	}
+	return t, nil
+}
+
+// Create creates a new token with the given description and scope, returning the token itself,
+// which can't be recovered later.
+func (t *Tokens) Create(description, scope string) (string, *Token, error) {
+	if scope != ScopeRead && scope != ScopeWrite {
+		return "", nil, fmt.Errorf("invalid scope %q", scope)
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	secret := tokenPrefix + hex.EncodeToString(b)
+	hash := hashToken(secret)
+	tok := &Token{ID: hash[:8], Description: description, Scope: scope, Created: time.Now(), Hash: hash}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.tokens[tok.Hash] = tok
+	if err := t.save(); err != nil {
+		delete(t.tokens, tok.Hash)
+		return "", nil, err
+	}
+	return secret, tok, nil
+}
+
+// Revoke deletes the token with id so that it can no longer be used.
+func (t *Tokens) Revoke(id string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for hash, tok := range t.tokens {
+		if tok.ID == id {
+			delete(t.tokens, hash)
+			if err := t.save(); err != nil {
+				t.tokens[hash] = tok
+				return err
+			}
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// List returns every token, most recently created first.
+func (t *Tokens) List() []Token {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	tokens := make([]Token, 0, len(t.tokens))
+	for _, tok := range t.tokens {
+		tokens = append(tokens, *tok)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Created.After(tokens[j].Created)
+	})
+	return tokens
+}
+
+// Check returns the token for secret, if it exists.
+func (t *Tokens) Check(secret string) (*Token, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	tok, ok := t.tokens[hashToken(secret)]
+	return tok, ok
+}
+
+// save writes the tokens to the file, replacing it atomically.
+func (t *Tokens) save() error {
+	tokens := make([]*Token, 0, len(t.tokens))
+	for _, tok := range t.tokens {
+		tokens = append(tokens, tok)
+	}
+	b, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := t.filename + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.filename)
+}
+
+func hashToken(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+// apiAuth returns whether r is authorized to use the API, either by being logged in or with an
+// API token in its Authorization header, and whether it's allowed to make changes.
+func apiAuth(auth *Auth, tokens *Tokens, r *http.Request) (ok, write bool) {
+	if auth.IsAuth(r) {
+		return true, true
+	}
+	h := r.Header.Get("Authorization")
+	if tokens == nil || !strings.HasPrefix(h, "Bearer ") {
+		return false, false
+	}
+	tok, ok := tokens.Check(strings.TrimPrefix(h, "Bearer "))
+	if !ok {
+		return false, false
+	}
+	return true, tok.Scope == ScopeWrite
+}
+
+// getSettings renders the settings page, which lists the API tokens and pattern links and allows
+// them to be created and revoked (or added and removed). If a token has just been created it's
+// displayed, as it can't be displayed again.
+func getSettings(auth *Auth, tokens *Tokens, patterns *Patterns, created string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !auth.IsAuth(r) {
+			http.Redirect(w, r, "/login", 302)
+			return
+		}
+
+		var data []Token
+		if tokens != nil {
+			data = tokens.List()
+		}
+		var pats []Pattern
+		if patterns != nil {
+			pats = patterns.List()
+		}
+		var user string
+		if u := userOf(r.Context()); u != nil {
+			user = u.Name
+		}
+		render(w, "settings.html", struct {
+			Title    string
+			Token    string
+			User     string
+			Admin    bool
+			Enabled  bool
+			Created  string
+			Data     []Token
+			Patterns bool
+			Pats     []Pattern
+		}{
+			fmt.Sprintf("settings - %s", r.Host), auth.XSRF(r), user, isAdmin(r), tokens != nil, created, data, patterns != nil, pats,
+		})
+	})
+}
+
+// postSettings handles the forms on the settings page, which either create a token with a
+// description and scope, revoke the token with an id, add a pattern with a link or remove a
+// pattern.
+func postSettings(auth *Auth, tokens *Tokens, patterns *Patterns) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		action := r.PostFormValue("action")
+		switch action {
+		case "create", "revoke":
+			if tokens == nil {
+				httpError(w, 404, errors.New("API tokens are disabled"))
+				return
+			}
+		case "add-pattern", "remove-pattern":
+			if patterns == nil {
+				httpError(w, 404, errors.New("pattern links are disabled"))
+				return
+			}
+		}
+
+		switch action {
+		case "create":
+			scope := r.PostFormValue("scope")
+			if scope != ScopeRead && scope != ScopeWrite {
+				httpError(w, 400)
+				return
+			}
+			secret, _, err := tokens.Create(r.PostFormValue("description"), scope)
+			if err != nil {
+				httpError(w, 500, err)
+				return
+			}
+			getSettings(auth, tokens, patterns, secret).ServeHTTP(w, r)
+		case "revoke":
+			err := tokens.Revoke(r.PostFormValue("id"))
+			if err == ErrNotFound {
+				httpError(w, 404, err)
+				return
+			}
+			if err != nil {
+				httpError(w, 500, err)
+				return
+			}
+			http.Redirect(w, r, settingsPath, 302)
+		case "add-pattern":
+			pattern, link := r.PostFormValue("pattern"), r.PostFormValue("link")
+			if _, err := regexp.Compile(pattern); err != nil || pattern == "" || !isValidLink(link) {
+				httpError(w, 400)
+				return
+			}
+			if err := checkPublic(r.Context(), r.Host, link, nil); err != nil {
+				httpError(w, 400, err)
+				return
+			}
+			if err := patterns.Add(pattern, link); err != nil {
+				httpError(w, 500, err)
+				return
+			}
+			http.Redirect(w, r, settingsPath, 302)
+		case "remove-pattern":
+			err := patterns.Remove(r.PostFormValue("pattern"))
+			if err == ErrNotFound {
+				httpError(w, 404, err)
+				return
+			}
+			if err != nil {
+				httpError(w, 500, err)
+				return
+			}
+			http.Redirect(w, r, settingsPath, 302)
+		default:
+			httpError(w, 400)
+		}
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Upstream looks up names with a parent golinks server. With an API token for it, names are
+// resolved through its API (see apiResolve) so that names it doesn't know either are handled here
+// as usual. Without one, requests are simply redirected to it and it handles them however it
+// handles names which don't exist.
+type Upstream struct {
+	remote *remoteStore
+}
+
+// NewUpstream returns an Upstream for the server at the URL server, authenticating with token if
+// it isn't empty.
+func NewUpstream(server, token string) *Upstream {
+	return &Upstream{remote: &remoteStore{
+		server: strings.TrimSuffix(server, "/"),
+		token:  token,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}}
+}
+
+// Resolve returns the link the parent server redirects name to for the request r, or ErrNotFound
+// if it doesn't know it. The query of r (and the headers links can be chosen by, see
+// visitorContext) are passed along, so that it's resolved as if r had been made to the parent.
+func (u *Upstream) Resolve(r *http.Request, name string) (string, error) {
+	if u.remote.token == "" {
+		link := u.remote.server + "/" + (&url.URL{Path: name}).EscapedPath()
+		if r.URL.RawQuery != "" {
+			link += "?" + r.URL.RawQuery
+		}
+		return link, nil
+	}
+
+	h := http.Header{}
+	for _, k := range []string{"User-Agent", "Accept-Language", configOf(r.Context()).regionHeader} {
+		if v := r.Header.Get(k); k != "" && v != "" {
+			h.Set(k, v)
+		}
+	}
+	path := resolvePath
+	if r.URL.RawQuery != "" {
+		path += "?" + r.URL.RawQuery
+	}
+	var out struct {
+		Links map[string]string `json:"links"`
+	}
+	in := struct {
+		Names []string `json:"names"`
+	}{[]string{name}}
+	if _, err := u.remote.do(r.Context(), "POST", path, h, in, &out); err != nil {
+		return "", err
+	}
+	link, ok := out.Links[name]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return link, nil
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// usersPath is the path of the page for managing users, which only admins can use.
+const usersPath = "/users"
+
+// validUsername matches the names users can have, which includes email addresses.
+var validUsername = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._@+-]{0,63}$`)
+
+var (
+	// errInvalidUsername is returned when adding a user whose name doesn't match validUsername.
+	errInvalidUsername = errors.New("invalid username")
+	// errMissingPassword is returned when adding a user (or changing their password) without one.
+	errMissingPassword = errors.New("missing password")
+	// errUserExists is returned when adding a user with the name of an existing user.
+	errUserExists = errors.New("user already exists")
+	// errOwnAccount is returned when admins try to remove their own account or admin rights, which
+	// could leave nobody able to manage users.
+	errOwnAccount = errors.New("you can't remove your own account or admin rights")
+)
+
+// User is someone who can log in with their own password, which only a hash of is kept (see
+// hashPassword). Admins can change any link if edits are restricted, and can manage users.
+type User struct {
+	Name    string    `json:"name"`
+	Hash    string    `json:"hash"`
+	Admin   bool      `json:"admin,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// usersCheckInterval is how often the users file is checked for changes when looking users up.
+const usersCheckInterval = time.Second
+
+// Users holds the users who can log in, persisting them as JSON to a file. As the file can also be
+// changed with the 'users' subcommand while the server is running, it's read again whenever it
+// has been modified, which is checked at most every usersCheckInterval when looking users up (so
+// that it isn't for every request) and always before changing them. Access to users must be
+// guarded by lock.
+type Users struct {
+	filename string
+	lock     sync.Mutex
+	users    map[string]*User
+	modified time.Time
+	checked  time.Time
+}
+
+// OpenUsers returns Users persisted to filename, which is created once the first user is added.
+func OpenUsers(filename string) (*Users, error) {
+	u := &Users{filename: filename, users: make(map[string]*User)}
+	if err := u.refresh(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// refresh reads the users from the file again if it has been modified since it was last read. It
+// must be called with lock held.
+func (u *Users) refresh() error {
+	u.checked = time.Now()
+	fi, err := os.Stat(u.filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(u.modified) {
+		return nil
+	}
+	b, err := ioutil.ReadFile(u.filename)
+	if err != nil {
+		return err
+	}
+	var users []*User
+	if err := json.Unmarshal(b, &users); err != nil {
+		return fmt.Errorf("reading users from %s: %w", u.filename, err)
+	}
+	u.users = make(map[string]*User, len(users))
+	for _, user := range users {
+		u.users[user.Name] = user
+	}
+	u.modified = fi.ModTime()
+	return nil
+}
+
+// Add adds a user called name with password, who is an admin if admin is true.
+func (u *Users) Add(name, password string, admin bool) error {
+	if !validUsername.MatchString(name) {
+		return fmt.Errorf("%w %q", errInvalidUsername, name)
+	}
+	if password == "" {
+		return errMissingPassword
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if err := u.refresh(); err != nil {
+		return err
+	}
+	if _, ok := u.users[name]; ok {
+		return errUserExists
+	}
+	u.users[name] = &User{Name: name, Hash: hash, Admin: admin, Created: time.Now()}
+	if err := u.save(); err != nil {
+		delete(u.users, name)
+		return err
+	}
+	return nil
+}
+
+// SetPassword changes the password of the user called name, which ends their sessions.
+func (u *Users) SetPassword(name, password string) error {
+	if password == "" {
+		return errMissingPassword
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	return u.update(name, func(user *User) { user.Hash = hash })
+}
+
+// SetAdmin changes whether the user called name is an admin.
+func (u *Users) SetAdmin(name string, admin bool) error {
+	return u.update(name, func(user *User) { user.Admin = admin })
+}
+
+// update changes the user called name with fn.
+func (u *Users) update(name string, fn func(*User)) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if err := u.refresh(); err != nil {
+		return err
+	}
+	user, ok := u.users[name]
+	if !ok {
+		return ErrNotFound
+	}
+	updated := *user
+	fn(&updated)
+	u.users[name] = &updated
+	if err := u.save(); err != nil {
+		u.users[name] = user
+		return err
+	}
+	return nil
+}
+
+// Remove removes the user called name, which ends their sessions. The links they created or own
+// are left as they are.
+func (u *Users) Remove(name string) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if err := u.refresh(); err != nil {
+		return err
+	}
+	user, ok := u.users[name]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(u.users, name)
+	if err := u.save(); err != nil {
+		u.users[name] = user
+		return err
+	}
+	return nil
+}
+
+// Get returns the user called name, if they exist.
+func (u *Users) Get(name string) (*User, bool) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	// If the file can't be read the users as of when it last could be are still used.
+	if time.Since(u.checked) >= usersCheckInterval {
+		_ = u.refresh()
+	}
+	user, ok := u.users[name]
+	if !ok {
+		return nil, false
+	}
+	c := *user
+	return &c, true
+}
+
+// Check returns the user called name if password is theirs, or errBadLogin otherwise.
+func (u *Users) Check(name, password string) (*User, error) {
+	user, ok := u.Get(name)
+	if !ok {
+		// Check a password anyway so that which users exist can't be found out from timing.
+		_ = checkPassword(dummyHash, password)
+		return nil, errBadLogin
+	}
+	if err := checkPassword(user.Hash, password); err != nil {
+		return nil, errBadLogin
+	}
+	return user, nil
+}
+
+// dummyHash is a hash to check passwords against for users who don't exist (see Users.Check).
+const dummyHash = "$2a$10$M7c6BWqVhhlKPWBLOkOezu4DwuGp/OeHE/xjeeIaeVyo0Whnuq89e"
+
+// List returns every user, in order of their names.
+func (u *Users) List() []User {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if time.Since(u.checked) >= usersCheckInterval {
+		_ = u.refresh()
+	}
+	users := make([]User, 0, len(u.users))
+	for _, user := range u.users {
+		users = append(users, *user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Name < users[j].Name
+	})
+	return users
+}
+
+// save writes the users to the file, replacing it atomically.
+func (u *Users) save() error {
+	users := make([]*User, 0, len(u.users))
+	for _, user := range u.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Name < users[j].Name
+	})
+	b, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := u.filename + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, u.filename); err != nil {
+		return err
+	}
+	// Our own changes don't need reading again.
+	if fi, err := os.Stat(u.filename); err == nil {
+		u.modified = fi.ModTime()
+	}
+	return nil
+}
+
+// usersCommand implements the 'users' subcommand, which lists, adds or removes the users in a
+// -users file, or changes their password or whether they're an admin. Passwords are read from the
+// first line of in, so that they don't end up in the shell's history.
+func usersCommand(args []string, in io.Reader, out io.Writer) error {
+	fs := flag.NewFlagSet("users", flag.ExitOnError)
+	file := fs.String("file", "", "file the users are kept in (see -users)")
+	admin := fs.Bool("admin", false, "whether the user added is an admin")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: golinks users -file FILE [-admin] list|add|passwd|admin|unadmin|remove [NAME]\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	cmd, name := fs.Arg(0), fs.Arg(1)
+	if *file == "" || cmd == "" || (cmd != "list" && (name == "" || fs.NArg() != 2)) {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	users, err := OpenUsers(*file)
+	if err != nil {
+		return err
+	}
+	switch cmd {
+	case "list":
+		tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		for _, u := range users.List() {
+			role := "user"
+			if u.Admin {
+				role = "admin"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", u.Name, role, u.Created.Format("2006-01-02"))
+		}
+		return tw.Flush()
+	case "add", "passwd":
+		fmt.Fprintf(os.Stderr, "password for %s: ", name)
+		password, err := bufio.NewReader(in).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		password = strings.TrimRight(password, "\r\n")
+		if cmd == "add" {
+			return users.Add(name, password, *admin)
+		}
+		return users.SetPassword(name, password)
+	case "admin", "unadmin":
+		return users.SetAdmin(name, cmd == "admin")
+	case "remove":
+		return users.Remove(name)
+	default:
+		return fmt.Errorf("unknown users command %q", cmd)
+	}
+}
+
+// getUsers renders the page for managing users, which only admins can see.
+func getUsers(auth *Auth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !auth.IsAuth(r) {
+			http.Redirect(w, r, "/login", 302)
+			return
+		}
+		if !auth.Accounts() {
+			httpError(w, 404, errors.New("user accounts are disabled, restart with -users to enable them"))
+			return
+		}
+		if !isAdmin(r) {
+			httpError(w, 403, errors.New("only admins can manage users"))
+			return
+		}
+
+		render(w, "users.html", struct {
+			Title string
+			Token string
+			User  string
+			Data  []User
+		}{
+			fmt.Sprintf("users - %s", r.Host), auth.XSRF(r), userOf(r.Context()).Name, auth.users.List(),
+		})
+	})
+}
+
+// postUsers handles the forms on the users page, which either add a user with a name, password
+// and whether they're an admin, change the password of the user with a name, make them an admin
+// (or not) or remove them.
+func postUsers(auth *Auth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !auth.Accounts() {
+			httpError(w, 404, errors.New("user accounts are disabled"))
+			return
+		}
+		if !isAdmin(r) {
+			httpError(w, 403, errors.New("only admins can manage users"))
+			return
+		}
+
+		users, name := auth.users, strings.TrimSpace(r.PostFormValue("name"))
+		self := userOf(r.Context()) != nil && userOf(r.Context()).Name == name
+		var err error
+		switch r.PostFormValue("action") {
+		case "add":
+			err = users.Add(name, r.PostFormValue("password"), r.PostFormValue("admin") != "")
+		case "passwd":
+			err = users.SetPassword(name, r.PostFormValue("password"))
+		case "admin":
+			if self && r.PostFormValue("admin") == "" {
+				err = errOwnAccount
+			} else {
+				err = users.SetAdmin(name, r.PostFormValue("admin") != "")
+			}
+		case "remove":
+			if self {
+				err = errOwnAccount
+			} else {
+				err = users.Remove(name)
+			}
+		default:
+			httpError(w, 400)
+			return
+		}
+		switch {
+		case err == ErrNotFound:
+			httpError(w, 404, err)
+		case err == errUserExists:
+			httpError(w, 409, err)
+		case err == errOwnAccount:
+			httpError(w, 403, err)
+		case errors.Is(err, errInvalidUsername) || err == errMissingPassword:
+			httpError(w, 400, err)
+		case err != nil:
+			httpError(w, 500, err)
+		default:
+			http.Redirect(w, r, usersPath, 302)
+		}
+	})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// varsPath is the path of the API endpoint exposing the expvar variables published by publishVars.
+// The rest (the Go runtime's memory statistics and command line, which includes any secrets given
+// as flags) are only served on the debug port (see debugHandler).
+const varsPath = "/api/v1/vars"
+
+// publishedVars are the names of the variables published by publishVars, in the order they were.
+var publishedVars []string
+
+// storeVars are the statistics about the store published by publishVars.
+type storeVars struct {
+	Links    int    `json:"links"`
+	Revision string `json:"revision,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// publishVars publishes expvar variables describing the runtime (the number of goroutines and how
+// long the server has been up, along with whether it's healthy) and store (how many links it
+// holds, as of when the variables are requested), along with how many names have been followed.
+// It must only be called once.
+func publishVars(store Store, hits *Hits) {
+	started := time.Now()
+	publishVar("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+	publishVar("uptime", expvar.Func(func() interface{} {
+		return time.Since(started).Round(time.Second).String()
+	}))
+	publishVar("healthy", expvar.Func(func() interface{} {
+		return atomic.LoadInt32(&healthy) == 1
+	}))
+	publishVar("store", expvar.Func(func() interface{} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		var v storeVars
+		err := store.Iterate(ctx, func(name string, e *Entry) error {
+			v.Links++
+			return nil
+		})
+		if err == nil {
+			v.Revision, err = revision(ctx, store)
+		}
+		if err != nil {
+			v.Error = err.Error()
+		}
+		return v
+	}))
+	if hits != nil {
+		publishVar("followed", expvar.Func(func() interface{} {
+			return len(hits.Ranked())
+		}))
+	}
+}
+
+// publishVar publishes the expvar variable name, recording it in publishedVars.
+func publishVar(name string, v expvar.Var) {
+	expvar.Publish(name, v)
+	publishedVars = append(publishedVars, name)
+}
+
+// serveVars serves the variables published by publishVars as a JSON object, in the same format as
+// expvar.Handler.
+func serveVars() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprintf(w, "{\n")
+		for i, name := range publishedVars {
+			if i > 0 {
+				fmt.Fprintf(w, ",\n")
+			}
+			fmt.Fprintf(w, "%q: %s", name, expvar.Get(name))
+		}
+		fmt.Fprintf(w, "\n}\n")
+	})
+}
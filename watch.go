@@ -0,0 +1,103 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watch reloads the store whenever its file is modified by something other
+// than the store until closed is closed. The directory containing the file is
+// watched rather than the file itself so that the file being replaced (as
+// most editors and sync tools do) is also noticed.
+func (s *FileStore) watch(closed chan struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	filename := filepath.Clean(s.file.Name())
+	if err := watcher.Add(filepath.Dir(filename)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-closed:
+				return
+			case ev := <-watcher.Events:
+				if filepath.Clean(ev.Name) != filename || ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				if err := s.reload(); err != nil {
+					log.Printf("reload of %s failed: %v\n", filename, err)
+				}
+			case err := <-watcher.Errors:
+				log.Printf("watching %s failed: %v\n", filename, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// reload replaces the in-memory mappings with the contents of the file if it
+// has been modified by something other than the store. If the reloaded file
+// needs to be rewritten (eg. because it was edited by hand to include lines in
+// the legacy "name link" format) it is also compacted.
+func (s *FileStore) reload() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	filename := s.file.Name()
+	fi, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		// The file is in the process of being replaced.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	cur, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	if os.SameFile(fi, cur) && fi.Size() == s.size {
+		return nil
+	}
+
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fresh := &FileStore{fuzzy: s.fuzzy, cache: newShards(), history: make(map[string][]*Entry), live: make(map[string]struct{})}
+	rewrite, err := read(f, filename, s.cipher, s.recovery, func(name string, e *Entry) {
+		fresh.order = append(fresh.order, name)
+		fresh.set(name, e)
+	})
+	if err == nil {
+		fi, err = f.Stat()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := s.sync(); err != nil {
+		log.Printf("sync of %s failed: %v\n", filename, err)
+	}
+	s.file.Close()
+	s.file, s.size, s.dirty = f, fi.Size(), false
+	s.order, s.history, s.live = fresh.order, fresh.history, fresh.live
+	s.cache.replace(fresh.cache)
+	s.revision++
+	log.Printf("reloaded %s after it was modified externally\n", filename)
+
+	if rewrite {
+		return s.compact()
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// waitFor fails t unless cond becomes true within a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReload(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "links")
+	s, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("a", &Entry{Link: "https://a.example"}); err != nil {
+		t.Fatal(err)
+	}
+	// The store's own writes don't count as modifications.
+	if err := s.reload(); err != nil {
+		t.Fatal(err)
+	}
+	checkLink(t, s, "a", "https://a.example")
+
+	// Lines appended by something else are picked up.
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(format("b", &Entry{Link: "https://b.example"})); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the appended line", func() bool {
+		_, ok := s.Get("b")
+		return ok
+	})
+	checkLink(t, s, "b", "https://b.example")
+
+	// So is the file being replaced, as editors and sync tools do.
+	tmp := filename + ".new"
+	if err := os.WriteFile(tmp, []byte(format("c", &Entry{Link: "https://c.example"})), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the replaced file", func() bool {
+		_, ok := s.Get("c")
+		return ok
+	})
+	if _, ok := s.Get("a"); ok {
+		t.Fatal("Get(a) found a name which was removed from the file")
+	}
+
+	// Later writes go to the replacement.
+	if err := s.Set("d", &Entry{Link: "https://d.example"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	checkLink(t, s, "c", "https://c.example")
+	checkLink(t, s, "d", "https://d.example")
+}
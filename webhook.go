@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// webhookQueue is the number of events queued for each webhook before
+	// further events are dropped, so that a webhook which is down can't block
+	// changes to the store.
+	webhookQueue = 1000
+	// webhookAttempts is the number of times delivering an event is attempted
+	// before it's dropped.
+	webhookAttempts = 8
+	// webhookBackoff is how long to wait before retrying a failed delivery,
+	// which doubles after each attempt.
+	webhookBackoff = time.Second
+)
+
+// Webhooks wraps a StoreCloser to send an event to each of a list of URLs
+// whenever a link is created, updated or deleted through it. Events are POSTed
+// as JSON in the order they happened, signed with an HMAC-SHA256 of the body
+// using a shared secret in the X-Golinks-Signature header ("sha256=" followed
+// by the hex digest). Failed deliveries are retried with exponential backoff
+// before being dropped. The lock is held during Set so that the previous entry
+// each event reports is consistent with the change.
+type Webhooks struct {
+	StoreCloser
+	secret string
+	client *http.Client
+	queues []chan []byte
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	lock sync.Mutex
+}
+
+// NewWebhooks returns Webhooks for store which sends events to urls, signed
+// with secret.
+func NewWebhooks(store StoreCloser, urls []string, secret string) *Webhooks {
+	w := &Webhooks{StoreCloser: store, secret: secret, client: &http.Client{Timeout: 10 * time.Second}, done: make(chan struct{})}
+	for _, u := range urls {
+		q := make(chan []byte, webhookQueue)
+		w.queues = append(w.queues, q)
+		w.wg.Add(1)
+		go w.deliver(u, q)
+	}
+	return w
+}
+
+func (w *Webhooks) Set(ctx context.Context, name string, e *Entry) error {
+	return w.SetAll(ctx, map[string]*Entry{name: e})
+}
+
+func (w *Webhooks) SetAll(ctx context.Context, entries map[string]*Entry) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	evs, err := setEvents(ctx, w.StoreCloser, entries)
+	if err != nil {
+		return err
+	}
+	for _, ev := range evs {
+		w.send(ev)
+	}
+	return nil
+}
+
+// send queues ev for delivery to each webhook.
+func (w *Webhooks) send(ev *event) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("encoding %s event for %s failed: %v\n", ev.Event, ev.Name, err)
+		return
+	}
+	for _, q := range w.queues {
+		select {
+		case q <- body:
+		default:
+			log.Printf("dropping %s event for %s: webhook queue is full\n", ev.Event, ev.Name)
+		}
+	}
+}
+
+// deliver POSTs each event from q to url in turn until q is closed.
+func (w *Webhooks) deliver(url string, q <-chan []byte) {
+	defer w.wg.Done()
+	for body := range q {
+		w.retry(url, body)
+	}
+}
+
+// retry POSTs body to url until it succeeds, webhookAttempts have failed or
+// the Webhooks are closed.
+func (w *Webhooks) retry(url string, body []byte) {
+	backoff := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		err := w.post(url, body)
+		if err == nil {
+			return
+		}
+		if attempt == webhookAttempts {
+			log.Printf("dropping event for webhook %s after %d attempts: %v\n", url, attempt, err)
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-w.done:
+			log.Printf("dropping event for webhook %s on shutdown: %v\n", url, err)
+			return
+		}
+		backoff *= 2
+	}
+}
+
+// post makes a single attempt to deliver body to url.
+func (w *Webhooks) post(url string, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, []byte(w.secret))
+	mac.Write(body)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Golinks-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// Unwrap returns the wrapped store.
+func (w *Webhooks) Unwrap() Store {
+	return w.StoreCloser
+}
+
+// Close delivers any queued events before closing the wrapped store, making a
+// single attempt at each of them rather than retrying.
+func (w *Webhooks) Close() error {
+	close(w.done)
+	for _, q := range w.queues {
+		close(q)
+	}
+	w.wg.Wait()
+	return w.StoreCloser.Close()
+}